@@ -0,0 +1,167 @@
+// Package broker is an embedded MQTT 3.1.1/5 broker, so small installations don't need separate Mosquitto.
+// ESPHome nodes connect to it directly and the bridge consumes messages in-process.
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.uber.org/zap"
+	"log/slog"
+	"os"
+	"sync/atomic"
+)
+
+type Config struct {
+	// Address is listen address, e.g. :1883. Broker is not started if empty
+	Address string `yaml:"address"`
+	// Users allowed to connect, anonymous access is allowed if empty
+	Users []User `yaml:"users"`
+	// TLS serves MQTT over TLS if Cert and Key are set
+	TLS TLSConfig `yaml:"tls"`
+	// StoreDir keeps retained messages (ESPHome discovery) across restarts, they are only kept in memory if empty
+	StoreDir string             `yaml:"store_dir"`
+	Logger   *zap.SugaredLogger `yaml:"-"`
+}
+
+type User struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type TLSConfig struct {
+	// Cert and Key are paths to PEM server certificate and its key
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ClientCA requires clients to present certificate signed by it
+	ClientCA string `yaml:"client_ca"`
+}
+
+type Broker struct {
+	srv      *mochi.Server
+	listener *listeners.TCP
+	store    *retainedStore
+	l        *zap.SugaredLogger
+	subID    atomic.Int64
+}
+
+func New(cfg Config) (*Broker, error) {
+	if len(cfg.Address) == 0 {
+		return nil, fmt.Errorf("broker listen address is empty")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	b := &Broker{l: cfg.Logger}
+	// mochi logs through slog, only its warnings are interesting
+	stdLog, err := zap.NewStdLogAt(cfg.Logger.Desugar(), zap.WarnLevel)
+	if err != nil {
+		return nil, err
+	}
+	b.srv = mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger: slog.New(slog.NewTextHandler(stdLog.Writer(), &slog.HandlerOptions{
+			Level: slog.LevelWarn,
+			ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey || a.Key == slog.LevelKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		})),
+	})
+	err = b.srv.AddHook(&authHook{users: cfg.Users, l: cfg.Logger}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.StoreDir) > 0 {
+		b.store, err = newRetainedStore(cfg.StoreDir, cfg.Logger)
+		if err != nil {
+			return nil, err
+		}
+		err = b.srv.AddHook(b.store, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	lcfg := listeners.Config{ID: "mqtt", Address: cfg.Address}
+	if len(cfg.TLS.Cert) > 0 || len(cfg.TLS.Key) > 0 {
+		lcfg.TLSConfig, err = cfg.TLS.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.listener = listeners.NewTCP(lcfg)
+	err = b.srv.AddListener(b.listener)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on %s: %w", cfg.Address, err)
+	}
+	err = b.srv.Serve()
+	if err != nil {
+		return nil, err
+	}
+	b.l.Infof("MQTT broker listening on %s", b.Addr())
+	return b, nil
+}
+
+func (c *TLSConfig) tlsConfig() (*tls.Config, error) {
+	if len(c.Cert) == 0 || len(c.Key) == 0 {
+		return nil, fmt.Errorf("both broker TLS cert and key have to be set")
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, fmt.Errorf("error loading broker certificate: %w", err)
+	}
+	cfg := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if len(c.ClientCA) > 0 {
+		pem, err := os.ReadFile(c.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", c.ClientCA)
+		}
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// Addr returns address broker listens on, with actual port if it was started on port 0
+func (b *Broker) Addr() string {
+	return b.listener.Address()
+}
+
+// Subscribe calls handler for every message matching filter, starting with retained ones.
+// Handler runs in goroutine of the publishing client so it should not block for long
+func (b *Broker) Subscribe(filter string, handler func(topic string, payload []byte, retained bool)) (unsubscribe func(), err error) {
+	id := int(b.subID.Add(1))
+	err = b.srv.Subscribe(filter, id, func(cl *mochi.Client, sub packets.Subscription, pk packets.Packet) {
+		handler(pk.TopicName, pk.Payload, pk.FixedHeader.Retain)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		b.srv.Unsubscribe(filter, id)
+	}, nil
+}
+
+func (b *Broker) Publish(topic string, payload []byte, retain bool, qos byte) error {
+	return b.srv.Publish(topic, payload, retain, qos)
+}
+
+// Close disconnects clients and saves retained messages
+func (b *Broker) Close() error {
+	err := b.srv.Close()
+	if b.store != nil {
+		b.store.Close()
+	}
+	return err
+}
@@ -0,0 +1,78 @@
+package broker
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"testing"
+	"time"
+)
+
+func testClient(t *testing.T, addr, username, password string) (mqtt.Client, error) {
+	c := mqtt.NewClient(mqtt.NewClientOptions().
+		AddBroker("tcp://" + addr).
+		SetClientID(t.Name() + username).
+		SetUsername(username).
+		SetPassword(password))
+	token := c.Connect()
+	if !token.WaitTimeout(time.Second * 5) {
+		return nil, assert.AnError
+	}
+	if token.Error() != nil {
+		return nil, token.Error()
+	}
+	t.Cleanup(func() { c.Disconnect(100) })
+	return c, nil
+}
+
+func TestBrokerAuth(t *testing.T) {
+	b, err := New(Config{
+		Address: "127.0.0.1:0",
+		Users:   []User{{Username: "esphome", Password: "secret"}},
+		Logger:  zaptest.NewLogger(t).Sugar(),
+	})
+	require.NoError(t, err)
+	defer b.Close()
+	_, err = testClient(t, b.Addr(), "esphome", "wrong")
+	assert.Error(t, err)
+	_, err = testClient(t, b.Addr(), "", "")
+	assert.Error(t, err)
+	_, err = testClient(t, b.Addr(), "esphome", "secret")
+	assert.NoError(t, err)
+}
+
+func TestBrokerRetainedPersistence(t *testing.T) {
+	dir := t.TempDir()
+	b, err := New(Config{
+		Address:  "127.0.0.1:0",
+		StoreDir: dir,
+		Logger:   zaptest.NewLogger(t).Sugar(),
+	})
+	require.NoError(t, err)
+	c, err := testClient(t, b.Addr(), "", "")
+	require.NoError(t, err)
+	require.True(t, c.Publish("homeassistant/sensor/kitchen/t1/config", 1, true, `{"name":"t1"}`).WaitTimeout(time.Second*5))
+	require.True(t, c.Publish("homeassistant/sensor/kitchen/t2/config", 1, true, `{"name":"t2"}`).WaitTimeout(time.Second*5))
+	// clearing retained message has to remove it from the store too
+	require.True(t, c.Publish("homeassistant/sensor/kitchen/t2/config", 1, true, "").WaitTimeout(time.Second*5))
+	c.Disconnect(100)
+	require.NoError(t, b.Close())
+	assert.FileExists(t, dir+"/"+retainedFile)
+
+	b, err = New(Config{
+		Address:  "127.0.0.1:0",
+		StoreDir: dir,
+		Logger:   zaptest.NewLogger(t).Sugar(),
+	})
+	require.NoError(t, err)
+	defer b.Close()
+	got := map[string]string{}
+	unsubscribe, err := b.Subscribe("homeassistant/#", func(topic string, payload []byte, retained bool) {
+		assert.True(t, retained)
+		got[topic] = string(payload)
+	})
+	require.NoError(t, err)
+	unsubscribe()
+	assert.Equal(t, map[string]string{"homeassistant/sensor/kitchen/t1/config": `{"name":"t1"}`}, got)
+}
@@ -0,0 +1,199 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/storage"
+	"github.com/mochi-mqtt/server/v2/packets"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// authHook checks username/password against configured users, everyone can publish and subscribe to everything
+type authHook struct {
+	mochi.HookBase
+	users []User
+	l     *zap.SugaredLogger
+}
+
+func (h *authHook) ID() string {
+	return "esphome2prom-auth"
+}
+
+func (h *authHook) Provides(b byte) bool {
+	return bytes.Contains([]byte{mochi.OnConnectAuthenticate, mochi.OnACLCheck}, []byte{b})
+}
+
+func (h *authHook) OnConnectAuthenticate(cl *mochi.Client, pk packets.Packet) bool {
+	if len(h.users) == 0 {
+		return true
+	}
+	for _, u := range h.users {
+		if subtle.ConstantTimeCompare([]byte(u.Username), pk.Connect.Username) == 1 &&
+			subtle.ConstantTimeCompare([]byte(u.Password), pk.Connect.Password) == 1 {
+			return true
+		}
+	}
+	h.l.Warnf("rejected client %s from %s: bad username or password", cl.ID, cl.Net.Remote)
+	return false
+}
+
+func (h *authHook) OnACLCheck(cl *mochi.Client, topic string, write bool) bool {
+	return true
+}
+
+const retainedFile = "retained.json"
+
+// retainedStore keeps retained messages in a JSON file, rewritten at most every few seconds
+type retainedStore struct {
+	mochi.HookBase
+	path     string
+	l        *zap.SugaredLogger
+	messages map[string]storage.Message
+	dirty    bool
+	done     chan struct{}
+	stopped  chan struct{}
+	sync.Mutex
+}
+
+func newRetainedStore(dir string, l *zap.SugaredLogger) (*retainedStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating broker store dir: %w", err)
+	}
+	s := &retainedStore{
+		path:     filepath.Join(dir, retainedFile),
+		l:        l,
+		messages: map[string]storage.Message{},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading retained messages: %w", err)
+	}
+	if len(b) > 0 {
+		var msgs []storage.Message
+		err := json.Unmarshal(b, &msgs)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", s.path, err)
+		}
+		for _, m := range msgs {
+			s.messages[m.TopicName] = m
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *retainedStore) ID() string {
+	return "esphome2prom-retained"
+}
+
+func (s *retainedStore) Provides(b byte) bool {
+	return bytes.Contains([]byte{mochi.OnRetainMessage, mochi.StoredRetainedMessages}, []byte{b})
+}
+
+func (s *retainedStore) OnRetainMessage(cl *mochi.Client, pk packets.Packet, r int64) {
+	s.Lock()
+	defer s.Unlock()
+	switch r {
+	case 1:
+		s.messages[pk.TopicName] = storage.Message{
+			T:           storage.RetainedKey,
+			FixedHeader: pk.FixedHeader,
+			TopicName:   pk.TopicName,
+			Payload:     pk.Payload,
+			Created:     pk.Created,
+			Origin:      pk.Origin,
+		}
+	case -1:
+		delete(s.messages, pk.TopicName)
+	default:
+		return
+	}
+	s.dirty = true
+}
+
+func (s *retainedStore) StoredRetainedMessages() ([]storage.Message, error) {
+	s.Lock()
+	defer s.Unlock()
+	msgs := make([]storage.Message, 0, len(s.messages))
+	for _, m := range s.messages {
+		msgs = append(msgs, m)
+	}
+	return msgs, nil
+}
+
+func (s *retainedStore) run() {
+	defer close(s.stopped)
+	t := time.NewTicker(time.Second * 5)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-s.done:
+			return
+		}
+		err := s.save()
+		if err != nil {
+			s.l.Errorf("error saving retained messages: %s", err)
+		}
+	}
+}
+
+// save rewrites the file atomically if anything changed since last save
+func (s *retainedStore) save() (err error) {
+	defer func() {
+		if err != nil {
+			// retry on next tick
+			s.Lock()
+			s.dirty = true
+			s.Unlock()
+		}
+	}()
+	s.Lock()
+	if !s.dirty {
+		s.Unlock()
+		return nil
+	}
+	msgs := make([]storage.Message, 0, len(s.messages))
+	for _, m := range s.messages {
+		msgs = append(msgs, m)
+	}
+	s.dirty = false
+	s.Unlock()
+	b, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), "."+retainedFile+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func (s *retainedStore) Close() {
+	close(s.done)
+	<-s.stopped
+	err := s.save()
+	if err != nil {
+		s.l.Errorf("error saving retained messages: %s", err)
+	}
+}
@@ -1,8 +1,23 @@
 package config
 
 import (
+	"github.com/XANi/esphome2prom/broker"
+	"github.com/XANi/esphome2prom/db"
+	"github.com/XANi/esphome2prom/esphomeapi"
+	"github.com/XANi/esphome2prom/homeassistant"
+	"github.com/XANi/esphome2prom/inventory"
+	"github.com/XANi/esphome2prom/mdns"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/XANi/esphome2prom/rtl433"
+	"github.com/XANi/esphome2prom/shelly"
+	"github.com/XANi/esphome2prom/spool"
+	"github.com/XANi/esphome2prom/tasmota"
+	"github.com/XANi/esphome2prom/tsdb"
+	"github.com/XANi/esphome2prom/web"
+	"github.com/XANi/esphome2prom/webserver"
 	"github.com/goccy/go-yaml"
 	"os"
+	"time"
 )
 
 type ConfigWithDefault interface {
@@ -17,6 +32,65 @@ type Config struct {
 	Debug              bool   `yaml:"debug"`
 	PProfAddress       string `yaml:"pprof_address"`
 	ExtraLabels        map[string]string
+	// MQTTTLS configures CA, client certificate and TLS version for ssl://, tls://, mqtts:// and wss:// brokers
+	MQTTTLS queue.MQTTTLSConfig `yaml:"mqtt_tls"`
+	// MQTTSession enables persistent session with stable client ID
+	MQTTSession queue.MQTTSessionConfig `yaml:"mqtt_session"`
+	// MQTTVersion is 3 (3.1.1, default) or 5
+	MQTTVersion int `yaml:"mqtt_version"`
+	// MQTTSharedGroup splits state messages between replicas subscribed with the same group, requires mqtt_version 5
+	MQTTSharedGroup string `yaml:"mqtt_shared_group"`
+	// Broker runs embedded MQTT broker, bridge consumes from it instead of MQTTAddress
+	Broker broker.Config `yaml:"broker"`
+	// NativeAPI connects directly to ESPHome nodes' native API, without MQTT
+	NativeAPI esphomeapi.Config `yaml:"native_api"`
+	// MDNS browses for ESPHome nodes, for native API and esphome_mdns_device_info
+	MDNS mdns.Config `yaml:"mdns"`
+	// WebServer reads nodes' web_server /events stream
+	WebServer webserver.Config `yaml:"web_server"`
+	// HomeAssistant reads sensor and binary_sensor entities from Home Assistant's WebSocket API
+	HomeAssistant homeassistant.Config `yaml:"home_assistant"`
+	// Ingest configures tokens for HTTP push endpoint on ListenAddress
+	Ingest web.IngestConfig `yaml:"ingest"`
+	// Tasmota reads Tasmota's tele/<topic>/SENSOR and STATE from MQTT
+	Tasmota tasmota.Config `yaml:"tasmota"`
+	// Shelly reads component status of Shelly Gen2+ devices from MQTT
+	Shelly shelly.Config `yaml:"shelly"`
+	// RTL433 reads 433 MHz sensors from rtl_433 and OpenMQTTGateway events in MQTT
+	RTL433 rtl433.Config `yaml:"rtl_433"`
+	// StaticSensors declares sensors of nodes running with discovery disabled, they take precedence over discovered ones
+	StaticSensors []queue.StaticSensor `yaml:"static_sensors"`
+	// DB persists discovered sensors, so they survive broker losing retained discovery
+	DB db.Config `yaml:"db"`
+	// Inventory tracks devices in DB, enabled with it
+	Inventory inventory.Config `yaml:"inventory"`
+	// TSDB stores samples in DB for HTTP query API, for sites without Prometheus
+	TSDB tsdb.Config `yaml:"tsdb"`
+	// RemoteWrite and Spool configure remote write sink created from PrometheusWriteURL
+	RemoteWrite queue.RemoteWriteConfig `yaml:"remote_write"`
+	Spool       spool.Config            `yaml:"spool"`
+	// Sinks are additional outputs
+	Sinks []queue.SinkConfig `yaml:"sinks"`
+	// SelfMetricsInterval enables sending bridge's own metrics through sinks
+	SelfMetricsInterval time.Duration `yaml:"self_metrics_interval"`
+}
+
+// GetSinks returns all configured sinks, including the one set up via PrometheusWriteURL
+func (c *Config) GetSinks() []queue.SinkConfig {
+	sinks := make([]queue.SinkConfig, 0, len(c.Sinks)+1)
+	if len(c.PrometheusWriteURL) > 0 {
+		rw := c.RemoteWrite
+		rw.URL = c.PrometheusWriteURL
+		if len(rw.Spool.Dir) == 0 {
+			rw.Spool = c.Spool
+		}
+		sinks = append(sinks, queue.SinkConfig{
+			Type:        queue.SinkRemoteWrite,
+			Name:        "prometheus",
+			RemoteWrite: rw,
+		})
+	}
+	return append(sinks, c.Sinks...)
 }
 
 func (c *Config) GetDefaultConfig() string {
@@ -31,6 +105,18 @@ func (c *Config) GetDefaultConfig() string {
 		ExtraLabels: map[string]string{
 			"host": h,
 		},
+		RemoteWrite: queue.RemoteWriteConfig{
+			MinShards:  1,
+			MaxShards:  4,
+			MaxRetries: 5,
+			MinBackoff: time.Millisecond * 100,
+			MaxBackoff: time.Second * 30,
+		},
+		// spool is disabled until dir is set, service user often can't write to /var/lib
+		Spool: spool.Config{
+			MaxSize: 256 * 1024 * 1024,
+			MaxAge:  time.Hour * 24 * 7,
+		},
 	}
 	b, _ := yaml.Marshal(&cfg)
 	return string(b)
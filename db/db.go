@@ -10,9 +10,10 @@ import (
 )
 
 type Config struct {
-	DSN    string
-	DbType string
-	Logger *zap.SugaredLogger
+	DSN string `yaml:"dsn"`
+	// DbType is sqlite or pgsql
+	DbType string             `yaml:"type"`
+	Logger *zap.SugaredLogger `yaml:"-"`
 }
 
 type DB struct {
@@ -30,7 +31,7 @@ func New(cfg Config) (*DB, error) {
 	case "pgsql":
 		dbConn, err = gorm.Open(postgres.Open(cfg.DSN))
 	default:
-		return nil, fmt.Errorf("db type [%s] not supported", err)
+		return nil, fmt.Errorf("db type [%s] not supported", cfg.DbType)
 	}
 	if err != nil {
 		return &DB{}, err
@@ -46,6 +47,13 @@ func New(cfg Config) (*DB, error) {
 	migrations := append(make([]interface{}, 0),
 		// types to migrate,
 		Record{},
+		Device{},
+		Sensor{},
+		InventoryDevice{},
+		DeviceEvent{},
+		TSDBSeries{},
+		TSDBSample{},
+		TSDBTier{},
 	)
 
 	for _, table := range migrations {
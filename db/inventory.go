@@ -0,0 +1,89 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/inventory"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Devices returns all devices in inventory
+func (d *DB) Devices() ([]inventory.Device, error) {
+	var rows []InventoryDevice
+	err := d.d.Order("name").Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading inventory: %w", err)
+	}
+	out := make([]inventory.Device, 0, len(rows))
+	for _, r := range rows {
+		dev := inventory.Device{
+			Name:         r.Name,
+			ID:           r.DeviceID,
+			Address:      r.Address,
+			MAC:          r.MAC,
+			Version:      r.Version,
+			Model:        r.Model,
+			Manufacturer: r.Manufacturer,
+			FirstSeen:    r.FirstSeen,
+			LastSeen:     r.LastSeen,
+		}
+		json.Unmarshal([]byte(r.Sensors), &dev.Sensors)
+		out = append(out, dev)
+	}
+	return out, nil
+}
+
+// SaveDevice stores or updates device in inventory
+func (d *DB) SaveDevice(dev inventory.Device) error {
+	sensors, err := json.Marshal(dev.Sensors)
+	if err != nil {
+		return err
+	}
+	row := InventoryDevice{
+		Name:         dev.Name,
+		DeviceID:     dev.ID,
+		Address:      dev.Address,
+		MAC:          dev.MAC,
+		Version:      dev.Version,
+		Model:        dev.Model,
+		Manufacturer: dev.Manufacturer,
+		FirstSeen:    dev.FirstSeen,
+		LastSeen:     dev.LastSeen,
+		Sensors:      string(sensors),
+	}
+	return d.d.Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+}
+
+// RenameDevice moves history of old device to new one and removes old one
+func (d *DB) RenameDevice(old, new string) error {
+	return d.d.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&DeviceEvent{}).Where("device = ?", old).Update("device", new).Error
+		if err != nil {
+			return fmt.Errorf("error moving history of %s: %w", old, err)
+		}
+		return tx.Delete(&InventoryDevice{Name: old}).Error
+	})
+}
+
+// AddEvent appends event to device's history
+func (d *DB) AddEvent(e inventory.Event) error {
+	return d.d.Create(&DeviceEvent{Device: e.Device, Time: e.Time, Kind: e.Kind, Old: e.Old, New: e.New}).Error
+}
+
+// History returns newest events of device first, all of them if limit is 0
+func (d *DB) History(device string, limit int) ([]inventory.Event, error) {
+	if limit <= 0 {
+		limit = -1
+	}
+	var rows []DeviceEvent
+	err := d.d.Where("device = ?", device).Order("time desc, id desc").Limit(limit).Find(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading history of %s: %w", device, err)
+	}
+	out := make([]inventory.Event, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, inventory.Event{Device: r.Device, Time: r.Time, Kind: r.Kind, Old: r.Old, New: r.New})
+	}
+	return out, nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"github.com/XANi/esphome2prom/inventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestInventory(t *testing.T) {
+	db := DBTestInit(t)
+	ts := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	dev := inventory.Device{Name: "garage", ID: "aabbcc", MAC: "aa:bb:cc:dd:ee:ff", Version: "2025.10.0", FirstSeen: ts, Sensors: []string{"t1"}}
+	require.NoError(t, db.SaveDevice(dev))
+	dev.LastSeen = ts.Add(time.Minute)
+	require.NoError(t, db.SaveDevice(dev))
+	require.NoError(t, db.AddEvent(inventory.Event{Device: "garage", Time: ts, Kind: inventory.EventFirstSeen}))
+	require.NoError(t, db.AddEvent(inventory.Event{Device: "garage", Time: ts.Add(time.Hour), Kind: inventory.EventFirmware, Old: "2025.10.0", New: "2025.11.0"}))
+
+	devices, err := db.Devices()
+	require.NoError(t, err)
+	var found *inventory.Device
+	for _, d := range devices {
+		if d.Name == "garage" {
+			found = &d
+		}
+	}
+	require.NotNil(t, found)
+	assert.Equal(t, []string{"t1"}, found.Sensors)
+	assert.True(t, dev.LastSeen.Equal(found.LastSeen))
+
+	dev.Name = "shed"
+	require.NoError(t, db.SaveDevice(dev))
+	require.NoError(t, db.RenameDevice("garage", "shed"))
+	history, err := db.History("shed", 0)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	assert.Equal(t, inventory.EventFirmware, history[0].Kind)
+	history, err = db.History("shed", 1)
+	require.NoError(t, err)
+	assert.Len(t, history, 1)
+	history, err = db.History("garage", 0)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	devices, err = db.Devices()
+	require.NoError(t, err)
+	for _, d := range devices {
+		assert.NotEqual(t, "garage", d.Name)
+	}
+}
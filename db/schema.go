@@ -1,5 +1,89 @@
 package db
 
+import "time"
+
 type Record struct {
 	ID uint
 }
+
+// Device is device sensors were discovered for, by device name the same as in metrics
+type Device struct {
+	Name            string `gorm:"primaryKey"`
+	DeviceID        string
+	SoftwareVersion string
+	Model           string
+	Manufacturer    string
+	// Connections is discovery's cns as JSON
+	Connections string
+	UpdatedAt   time.Time
+}
+
+// Sensor is sensor learned from MQTT discovery, by its config topic
+type Sensor struct {
+	ConfigTopic       string `gorm:"primaryKey"`
+	DeviceName        string `gorm:"index"`
+	Name              string
+	DeviceClass       string
+	Unit              string
+	StateClass        string
+	StateTopic        string
+	CommandTopic      string
+	AvailabilityTopic string
+	UniqID            string
+	UpdatedAt         time.Time
+}
+
+// InventoryDevice is device in inventory, kept after its sensors are gone
+type InventoryDevice struct {
+	Name         string `gorm:"primaryKey"`
+	DeviceID     string `gorm:"index"`
+	Address      string
+	MAC          string
+	Version      string
+	Model        string
+	Manufacturer string
+	FirstSeen    time.Time
+	LastSeen     time.Time
+	// Sensors is JSON list of sensor names
+	Sensors string
+}
+
+// DeviceEvent is change in device's history
+type DeviceEvent struct {
+	ID     uint      `gorm:"primaryKey"`
+	Device string    `gorm:"index"`
+	Time   time.Time `gorm:"index"`
+	Kind   string
+	Old    string
+	New    string
+}
+
+// TSDBSeries is series of local time-series storage
+type TSDBSeries struct {
+	ID   uint64 `gorm:"primaryKey"`
+	Name string `gorm:"index"`
+	// Labels as JSON
+	Labels string
+}
+
+func (TSDBSeries) TableName() string { return "tsdb_series" }
+
+// TSDBSample is raw sample (tier 0) or average of Count raw samples in bucket starting at TS
+type TSDBSample struct {
+	SeriesID uint64 `gorm:"primaryKey;autoIncrement:false"`
+	Tier     int    `gorm:"primaryKey;autoIncrement:false;index:idx_tsdb_samples_tier_ts,priority:1"`
+	// TS is unix time in ms, so buckets can be computed in SQL
+	TS    int64 `gorm:"primaryKey;autoIncrement:false;index:idx_tsdb_samples_tier_ts,priority:2"`
+	Value float64
+	Count int64
+}
+
+func (TSDBSample) TableName() string { return "tsdb_samples" }
+
+// TSDBTier records time tier is downsampled until
+type TSDBTier struct {
+	Tier  int `gorm:"primaryKey;autoIncrement:false"`
+	Until int64
+}
+
+func (TSDBTier) TableName() string { return "tsdb_tiers" }
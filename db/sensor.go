@@ -0,0 +1,118 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// SaveSensor stores or updates discovered sensor and its device
+func (d *DB) SaveSensor(configTopic string, disc queue.ESPHomeDiscovery) error {
+	if disc.Dev == nil {
+		return fmt.Errorf("sensor %s has no device", configTopic)
+	}
+	cns, err := json.Marshal(disc.Dev.Cns)
+	if err != nil {
+		return err
+	}
+	dev := Device{
+		Name:            disc.Dev.Name,
+		DeviceID:        disc.Dev.ID,
+		SoftwareVersion: disc.Dev.SoftwareVersion,
+		Model:           disc.Dev.Model,
+		Manufacturer:    disc.Dev.Manufacturer,
+		Connections:     string(cns),
+	}
+	sensor := Sensor{
+		ConfigTopic:       configTopic,
+		DeviceName:        disc.Dev.Name,
+		Name:              disc.Name,
+		DeviceClass:       string(disc.DeviceClass),
+		Unit:              disc.Unit,
+		StateClass:        disc.StateClass,
+		StateTopic:        disc.StateTopic,
+		CommandTopic:      disc.CommandTopic,
+		AvailabilityTopic: disc.AvailabilityTopic,
+		UniqID:            disc.UniqID,
+	}
+	return d.d.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&dev).Error
+		if err != nil {
+			return fmt.Errorf("error saving device %s: %w", dev.Name, err)
+		}
+		err = tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&sensor).Error
+		if err != nil {
+			return fmt.Errorf("error saving sensor %s: %w", configTopic, err)
+		}
+		return nil
+	})
+}
+
+// DeleteSensor removes sensor, and its device if it was the last one
+func (d *DB) DeleteSensor(configTopic string) error {
+	return d.d.Transaction(func(tx *gorm.DB) error {
+		var sensor Sensor
+		err := tx.Where("config_topic = ?", configTopic).Limit(1).Find(&sensor).Error
+		if err != nil || len(sensor.ConfigTopic) == 0 {
+			return err
+		}
+		err = tx.Delete(&sensor).Error
+		if err != nil {
+			return fmt.Errorf("error deleting sensor %s: %w", configTopic, err)
+		}
+		var left int64
+		err = tx.Model(&Sensor{}).Where("device_name = ?", sensor.DeviceName).Count(&left).Error
+		if err != nil || left > 0 {
+			return err
+		}
+		return tx.Delete(&Device{Name: sensor.DeviceName}).Error
+	})
+}
+
+// Sensors returns all stored sensors by config topic
+func (d *DB) Sensors() (map[string]queue.ESPHomeDiscovery, error) {
+	var devices []Device
+	err := d.d.Find(&devices).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading devices: %w", err)
+	}
+	devs := make(map[string]Device, len(devices))
+	for _, dev := range devices {
+		devs[dev.Name] = dev
+	}
+	var sensors []Sensor
+	err = d.d.Find(&sensors).Error
+	if err != nil {
+		return nil, fmt.Errorf("error loading sensors: %w", err)
+	}
+	out := make(map[string]queue.ESPHomeDiscovery, len(sensors))
+	for _, s := range sensors {
+		dev, ok := devs[s.DeviceName]
+		if !ok {
+			d.l.Warnf("sensor %s has no device %s, skipping", s.ConfigTopic, s.DeviceName)
+			continue
+		}
+		disc := queue.ESPHomeDiscovery{
+			DeviceClass:       queue.DeviceClass(s.DeviceClass),
+			Unit:              s.Unit,
+			StateClass:        s.StateClass,
+			Name:              s.Name,
+			StateTopic:        s.StateTopic,
+			CommandTopic:      s.CommandTopic,
+			AvailabilityTopic: s.AvailabilityTopic,
+			UniqID:            s.UniqID,
+			Dev: &queue.ESPHomeDev{
+				ID:              dev.DeviceID,
+				Name:            dev.Name,
+				SoftwareVersion: dev.SoftwareVersion,
+				Model:           dev.Model,
+				Manufacturer:    dev.Manufacturer,
+			},
+		}
+		json.Unmarshal([]byte(dev.Connections), &disc.Dev.Cns)
+		out[s.ConfigTopic] = disc
+	}
+	return out, nil
+}
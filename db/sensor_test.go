@@ -0,0 +1,37 @@
+package db
+
+import (
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSensors(t *testing.T) {
+	db := DBTestInit(t)
+	dev := &queue.ESPHomeDev{ID: "aabbcc", Name: "kitchen", SoftwareVersion: "2025.10.0", Cns: [][]string{{"mac", "aa:bb:cc"}}}
+	t1 := queue.ESPHomeDiscovery{DeviceClass: queue.DeviceClassTemperature, Unit: "°C", Name: "t1", StateTopic: "kitchen/sensor/t1/state", Dev: dev}
+	h1 := queue.ESPHomeDiscovery{DeviceClass: queue.DeviceClassHumidity, Unit: "%", Name: "h1", StateTopic: "kitchen/sensor/h1/state", Dev: dev}
+	require.NoError(t, db.SaveSensor("homeassistant/sensor/kitchen/t1/config", t1))
+	require.NoError(t, db.SaveSensor("homeassistant/sensor/kitchen/h1/config", h1))
+	t1.Unit = "°F"
+	require.NoError(t, db.SaveSensor("homeassistant/sensor/kitchen/t1/config", t1))
+	assert.Error(t, db.SaveSensor("homeassistant/sensor/x/config", queue.ESPHomeDiscovery{Name: "x"}))
+
+	sensors, err := db.Sensors()
+	require.NoError(t, err)
+	require.Len(t, sensors, 2)
+	assert.Equal(t, t1, sensors["homeassistant/sensor/kitchen/t1/config"])
+
+	require.NoError(t, db.DeleteSensor("homeassistant/sensor/kitchen/t1/config"))
+	require.NoError(t, db.DeleteSensor("homeassistant/sensor/kitchen/t1/config"))
+	var devices int64
+	db.d.Model(&Device{}).Count(&devices)
+	assert.Equal(t, int64(1), devices)
+	require.NoError(t, db.DeleteSensor("homeassistant/sensor/kitchen/h1/config"))
+	db.d.Model(&Device{}).Count(&devices)
+	assert.Equal(t, int64(0), devices)
+	sensors, err = db.Sensors()
+	require.NoError(t, err)
+	assert.Empty(t, sensors)
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/tsdb"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"time"
+)
+
+// Series returns all series of local time-series storage
+func (d *DB) Series() ([]tsdb.Series, error) {
+	var rows []TSDBSeries
+	err := d.d.Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	out := make([]tsdb.Series, 0, len(rows))
+	for _, r := range rows {
+		s := tsdb.Series{ID: r.ID, Name: r.Name}
+		err := json.Unmarshal([]byte(r.Labels), &s.Labels)
+		if err != nil {
+			return nil, fmt.Errorf("labels of series %d: %w", r.ID, err)
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// AddSeries stores new series and sets its ID
+func (d *DB) AddSeries(s *tsdb.Series) error {
+	labels, err := json.Marshal(s.Labels)
+	if err != nil {
+		return err
+	}
+	row := TSDBSeries{Name: s.Name, Labels: string(labels)}
+	err = d.d.Create(&row).Error
+	if err != nil {
+		return err
+	}
+	s.ID = row.ID
+	return nil
+}
+
+// AddSamples stores raw samples, sample with the same series and time replaces the old one
+func (d *DB) AddSamples(samples []tsdb.Sample) error {
+	rows := make([]TSDBSample, 0, len(samples))
+	for _, s := range samples {
+		rows = append(rows, TSDBSample{SeriesID: s.SeriesID, TS: s.TS.UnixMilli(), Value: s.Value, Count: 1})
+	}
+	return d.d.Clauses(clause.OnConflict{UpdateAll: true}).CreateInBatches(rows, 500).Error
+}
+
+// Downsample averages samples of tier-1 in [from, to) into buckets of resolution in tier and records tier is done until to
+func (d *DB) Downsample(tier int, resolution time.Duration, from, to time.Time) error {
+	res := resolution.Milliseconds()
+	return d.d.Transaction(func(tx *gorm.DB) error {
+		// averages are weighted by number of raw samples, so tier built from tier is the same as built from raw
+		err := tx.Exec(`INSERT INTO tsdb_samples (series_id, tier, ts, value, count)
+			SELECT series_id, ?, bucket, SUM(value * count) / SUM(count), SUM(count)
+			FROM (SELECT series_id, (ts / ?) * ? AS bucket, value, count FROM tsdb_samples WHERE tier = ? AND ts >= ? AND ts < ?) AS s
+			GROUP BY series_id, bucket
+			ON CONFLICT DO NOTHING`,
+			tier, res, res, tier-1, from.UnixMilli(), to.UnixMilli()).Error
+		if err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{UpdateAll: true}).Create(&TSDBTier{Tier: tier, Until: to.UnixMilli()}).Error
+	})
+}
+
+// Downsampled returns time each tier is downsampled until
+func (d *DB) Downsampled() (map[int]time.Time, error) {
+	var rows []TSDBTier
+	err := d.d.Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int]time.Time, len(rows))
+	for _, r := range rows {
+		out[r.Tier] = time.UnixMilli(r.Until)
+	}
+	return out, nil
+}
+
+// DeleteSamples removes samples of tier older than before
+func (d *DB) DeleteSamples(tier int, before time.Time) error {
+	return d.d.Where("tier = ? AND ts < ?", tier, before.UnixMilli()).Delete(&TSDBSample{}).Error
+}
+
+// Samples returns samples of series in tier in [from, to], oldest first
+func (d *DB) Samples(tier int, series []uint64, from, to time.Time) ([]tsdb.Sample, error) {
+	var rows []TSDBSample
+	err := d.d.Where("tier = ? AND series_id IN ? AND ts >= ? AND ts <= ?", tier, series, from.UnixMilli(), to.UnixMilli()).
+		Order("ts").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	out := make([]tsdb.Sample, 0, len(rows))
+	for _, r := range rows {
+		out = append(out, tsdb.Sample{SeriesID: r.SeriesID, TS: time.UnixMilli(r.TS), Value: r.Value})
+	}
+	return out, nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"github.com/XANi/esphome2prom/tsdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestTSDB(t *testing.T) {
+	db := DBTestInit(t)
+	s := &tsdb.Series{Name: "esphome_temperature", Labels: map[string]string{"device": "garage", "sensor": "t1"}}
+	require.NoError(t, db.AddSeries(s))
+	require.NotZero(t, s.ID)
+	series, err := db.Series()
+	require.NoError(t, err)
+	assert.Contains(t, series, *s)
+
+	start := time.UnixMilli(1_700_000_000_000).Truncate(time.Hour)
+	var samples []tsdb.Sample
+	// 10 minutes of samples every 30s, 0..19
+	for i := range 20 {
+		samples = append(samples, tsdb.Sample{SeriesID: s.ID, TS: start.Add(time.Duration(i) * time.Second * 30), Value: float64(i)})
+	}
+	require.NoError(t, db.AddSamples(samples))
+	// repeated write replaces
+	require.NoError(t, db.AddSamples(samples[:1]))
+
+	require.NoError(t, db.Downsample(1, time.Minute*5, time.Time{}, start.Add(time.Minute*10)))
+	require.NoError(t, db.Downsample(2, time.Minute*10, time.Time{}, start.Add(time.Minute*10)))
+	// already downsampled buckets are kept
+	require.NoError(t, db.Downsample(1, time.Minute*5, time.Time{}, start.Add(time.Minute*10)))
+	done, err := db.Downsampled()
+	require.NoError(t, err)
+	assert.True(t, done[2].Equal(start.Add(time.Minute*10)))
+
+	five, err := db.Samples(1, []uint64{s.ID}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, five, 2)
+	assert.Equal(t, 4.5, five[0].Value)
+	assert.Equal(t, 14.5, five[1].Value)
+	ten, err := db.Samples(2, []uint64{s.ID}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	require.Len(t, ten, 1)
+	assert.Equal(t, 9.5, ten[0].Value)
+	assert.True(t, ten[0].TS.Equal(start))
+
+	require.NoError(t, db.DeleteSamples(0, start.Add(time.Minute*5)))
+	raw, err := db.Samples(0, []uint64{s.ID}, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Len(t, raw, 10)
+	assert.Equal(t, 10.0, raw[0].Value)
+}
@@ -3,9 +3,21 @@ package main
 import (
 	"context"
 	"embed"
+	"github.com/XANi/esphome2prom/broker"
 	"github.com/XANi/esphome2prom/config"
+	"github.com/XANi/esphome2prom/db"
+	"github.com/XANi/esphome2prom/esphomeapi"
+	"github.com/XANi/esphome2prom/homeassistant"
+	"github.com/XANi/esphome2prom/inventory"
+	"github.com/XANi/esphome2prom/mdns"
 	"github.com/XANi/esphome2prom/queue"
+	"github.com/XANi/esphome2prom/rtl433"
+	"github.com/XANi/esphome2prom/shelly"
+	"github.com/XANi/esphome2prom/spool"
+	"github.com/XANi/esphome2prom/tasmota"
+	"github.com/XANi/esphome2prom/tsdb"
 	"github.com/XANi/esphome2prom/web"
+	"github.com/XANi/esphome2prom/webserver"
 	"github.com/XANi/go-yamlcfg"
 	"github.com/XANi/goneric"
 	"github.com/efigence/go-mon"
@@ -16,6 +28,8 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var version string
@@ -97,13 +111,19 @@ func main() {
 			),
 		},
 		&cli.StringFlag{
-			Name:     "mqtt-addr",
-			Usage:    "mqtt broker address",
-			Required: true,
+			Name:  "mqtt-addr",
+			Usage: "mqtt broker address, required unless embedded broker is enabled",
 			Sources: cli.NewValueSourceChain(
 				cli.EnvVar("MQTT_ADDR"),
 			),
 		},
+		&cli.StringFlag{
+			Name:  "broker-addr",
+			Usage: "listen address of embedded MQTT broker, disabled by default",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("BROKER_ADDR"),
+			),
+		},
 		&cli.StringFlag{
 			Name:  "prometheus-write-url",
 			Usage: "prometheus write protocol url",
@@ -111,6 +131,13 @@ func main() {
 				cli.EnvVar("PROMETHEUS_WRITE_URL"),
 			),
 		},
+		&cli.StringFlag{
+			Name:  "spool-dir",
+			Usage: "directory to buffer metrics in when remote write endpoint is down, disabled by default",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("SPOOL_DIR"),
+			),
+		},
 		&cli.StringFlag{
 			Name:  "pprof-addr",
 			Value: "",
@@ -134,9 +161,6 @@ func main() {
 			cli.ShowAppHelp(c)
 			os.Exit(1)
 		}
-		if c.String("prometheus-write-url") == "" && c.String("listen-addr") == "" {
-			log.Panic("must specify --prometheus-write-url or --listen-addr")
-		}
 
 		cfgFiles := []string{
 			c.String("config"),
@@ -149,6 +173,12 @@ func main() {
 			PProfAddress:       c.String("pprof-addr"),
 			ExtraLabels:        c.StringMap("extra-labels"),
 			PrometheusPrefix:   c.String("prometheus-prefix"),
+			Spool: spool.Config{
+				Dir: c.String("spool-dir"),
+			},
+			Broker: broker.Config{
+				Address: c.String("broker-addr"),
+			},
 		}
 		if c.String("config") != "" {
 			err := yamlcfg.LoadConfig(cfgFiles, &cfg)
@@ -158,6 +188,14 @@ func main() {
 		}
 		debug = cfg.Debug
 		log.Debug("debug enabled")
+		sinks := cfg.GetSinks()
+		if len(sinks) == 0 && cfg.ListenAddress == "" {
+			log.Panic("must specify --prometheus-write-url, sinks in config, or --listen-addr")
+		}
+		nativeAPI := len(cfg.NativeAPI.Nodes) > 0 || (cfg.NativeAPI.MDNS && cfg.MDNS.Enabled)
+		if cfg.MQTTAddress == "" && cfg.Broker.Address == "" && !nativeAPI && len(cfg.WebServer.Nodes) == 0 && cfg.HomeAssistant.URL == "" {
+			log.Panic("must specify --mqtt-addr, --broker-addr, or native_api, web_server or home_assistant in config")
+		}
 
 		var webDir fs.FS
 		webDir = embeddedWebContent
@@ -169,32 +207,213 @@ func main() {
 		}
 
 		os.DirFS(".")
-		if len(cfg.ListenAddress) > 0 {
-			w, err := web.New(web.Config{
-				Logger:     log,
-				ListenAddr: cfg.ListenAddress,
-			}, webDir)
-			_ = w
-			if err != nil {
-				log.Panicf("error starting web listener: %s", err)
-			}
-		}
 		if len(cfg.PProfAddress) > 0 {
 			log.Infof("listening pprof on %s", cfg.PProfAddress)
 			go func() {
 				log.Errorf("failed to start debug listener: %s (ignoring)", http.ListenAndServe(cfg.PProfAddress, nil))
 			}()
 		}
-		_, err := queue.New(&queue.Config{
-			MQTTAddr:    cfg.MQTTAddress,
-			Logger:      log.Named("mq"),
-			ExtraLabels: cfg.ExtraLabels,
-			Prefix:      cfg.PrometheusPrefix,
-			Debug:       debug,
+		var b *broker.Broker
+		var inProcess queue.InProcessBroker
+		if len(cfg.Broker.Address) > 0 {
+			bcfg := cfg.Broker
+			bcfg.Logger = log.Named("broker")
+			var err error
+			b, err = broker.New(bcfg)
+			if err != nil {
+				log.Panicf("error starting embedded broker: %s", err)
+			}
+			inProcess = b
+		}
+		var store queue.SensorStore
+		var inv *inventory.Inventory
+		// assigned only when set, nil pointer in interface would not be nil
+		var tracker queue.DeviceTracker
+		var series *tsdb.TSDB
+		if len(cfg.DB.DSN) > 0 {
+			dcfg := cfg.DB
+			dcfg.Logger = log.Named("db")
+			d, err := db.New(dcfg)
+			if err != nil {
+				log.Panicf("error opening db: %s", err)
+			}
+			store = d
+			icfg := cfg.Inventory
+			icfg.Logger = log.Named("inventory")
+			inv, err = inventory.New(icfg, d)
+			if err != nil {
+				log.Panicf("error loading device inventory: %s", err)
+			}
+			tracker = inv
+			if cfg.TSDB.Enabled {
+				tcfg := cfg.TSDB
+				tcfg.Logger = log.Named("tsdb")
+				series, err = tsdb.New(tcfg, d)
+				if err != nil {
+					log.Panicf("error starting tsdb: %s", err)
+				}
+				// closed by queue with other sinks
+				sinks = append(sinks, queue.SinkConfig{Name: "tsdb", Custom: series, Filter: cfg.TSDB.Filter})
+			}
+		} else if cfg.TSDB.Enabled {
+			log.Panic("tsdb needs db")
+		}
+		q, err := queue.New(&queue.Config{
+			MQTTAddr:            cfg.MQTTAddress,
+			MQTTTLS:             cfg.MQTTTLS,
+			MQTTSession:         cfg.MQTTSession,
+			MQTTVersion:         cfg.MQTTVersion,
+			MQTTSharedGroup:     cfg.MQTTSharedGroup,
+			Broker:              inProcess,
+			Logger:              log.Named("mq"),
+			ExtraLabels:         cfg.ExtraLabels,
+			Prefix:              cfg.PrometheusPrefix,
+			Debug:               debug,
+			Sinks:               sinks,
+			SelfMetricsInterval: cfg.SelfMetricsInterval,
+			StaticSensors:       cfg.StaticSensors,
+			Store:               store,
+			Tracker:             tracker,
 		})
 		if err != nil {
 			log.Panicf("error starting queue listener: %s", err)
 		}
+		if inv != nil {
+			inv.Start(q)
+		}
+		if len(cfg.ListenAddress) > 0 {
+			wcfg := web.Config{
+				Logger:     log,
+				ListenAddr: cfg.ListenAddress,
+				Ingest:     cfg.Ingest,
+				Ingester:   q,
+			}
+			if inv != nil {
+				wcfg.Inventory = inv
+			}
+			if series != nil {
+				wcfg.TSDB = series
+			}
+			w, err := web.New(wcfg, webDir)
+			if err != nil {
+				log.Panicf("error starting web listener: %s", err)
+			}
+			go func() {
+				log.Panicf("error running web listener: %s", w.Run())
+			}()
+		}
+		var api *esphomeapi.Source
+		var listeners []mdns.Listener
+		if nativeAPI {
+			acfg := cfg.NativeAPI
+			acfg.Logger = log.Named("api")
+			api, err = esphomeapi.New(acfg, q)
+			if err != nil {
+				log.Panicf("error starting native API ingestion: %s", err)
+			}
+			listeners = append(listeners, api)
+		}
+		if inv != nil {
+			listeners = append(listeners, inv)
+		}
+		var events *webserver.Source
+		if len(cfg.WebServer.Nodes) > 0 {
+			wcfg := cfg.WebServer
+			wcfg.Logger = log.Named("web_server")
+			events, err = webserver.New(wcfg, q)
+			if err != nil {
+				log.Panicf("error starting web_server ingestion: %s", err)
+			}
+		}
+		var ha *homeassistant.Source
+		if len(cfg.HomeAssistant.URL) > 0 {
+			hcfg := cfg.HomeAssistant
+			hcfg.Logger = log.Named("hass")
+			ha, err = homeassistant.New(hcfg, q)
+			if err != nil {
+				log.Panicf("error starting home assistant ingestion: %s", err)
+			}
+		}
+		var tele *tasmota.Source
+		if cfg.Tasmota.Enabled {
+			if cfg.MQTTAddress == "" && cfg.Broker.Address == "" {
+				log.Panic("tasmota needs --mqtt-addr or --broker-addr")
+			}
+			tcfg := cfg.Tasmota
+			tcfg.Logger = log.Named("tasmota")
+			tele, err = tasmota.New(tcfg, q)
+			if err != nil {
+				log.Panicf("error starting tasmota ingestion: %s", err)
+			}
+		}
+		var shellies *shelly.Source
+		if cfg.Shelly.Enabled {
+			if cfg.MQTTAddress == "" && cfg.Broker.Address == "" {
+				log.Panic("shelly needs --mqtt-addr or --broker-addr")
+			}
+			scfg := cfg.Shelly
+			scfg.Logger = log.Named("shelly")
+			shellies, err = shelly.New(scfg, q)
+			if err != nil {
+				log.Panicf("error starting shelly ingestion: %s", err)
+			}
+		}
+		var radio *rtl433.Source
+		if cfg.RTL433.Enabled {
+			if cfg.MQTTAddress == "" && cfg.Broker.Address == "" {
+				log.Panic("rtl_433 needs --mqtt-addr or --broker-addr")
+			}
+			rcfg := cfg.RTL433
+			rcfg.Logger = log.Named("rtl_433")
+			radio, err = rtl433.New(rcfg, q)
+			if err != nil {
+				log.Panicf("error starting rtl_433 ingestion: %s", err)
+			}
+		}
+		var browser *mdns.Browser
+		if cfg.MDNS.Enabled {
+			mcfg := cfg.MDNS
+			mcfg.Logger = log.Named("mdns")
+			browser, err = mdns.New(mcfg, q, listeners...)
+			if err != nil {
+				log.Panicf("error starting mDNS discovery: %s", err)
+			}
+		}
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			s := <-sig
+			log.Infof("got %s, shutting down", s)
+			if browser != nil {
+				browser.Close()
+			}
+			if api != nil {
+				api.Close()
+			}
+			if events != nil {
+				events.Close()
+			}
+			if ha != nil {
+				ha.Close()
+			}
+			if tele != nil {
+				tele.Close()
+			}
+			if shellies != nil {
+				shellies.Close()
+			}
+			if radio != nil {
+				radio.Close()
+			}
+			if inv != nil {
+				inv.Close()
+			}
+			q.Close()
+			if b != nil {
+				b.Close()
+			}
+			exit <- nil
+		}()
 		return <-exit
 	}
 	// to sort do that
@@ -0,0 +1,226 @@
+package esphomeapi
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+)
+
+// conn is single API connection to a node, after hello and login
+type conn struct {
+	c       net.Conn
+	fc      frameConn
+	timeout time.Duration
+	// Name is node name from hello response
+	Name string
+}
+
+func dial(ctx context.Context, cfg NodeConfig, timeout time.Duration) (*conn, error) {
+	var psk []byte
+	if len(cfg.EncryptionKey) > 0 {
+		var err error
+		psk, err = base64.StdEncoding.DecodeString(cfg.EncryptionKey)
+		if err != nil || len(psk) != 32 {
+			return nil, fmt.Errorf("encryption key has to be base64 encoded 32 bytes")
+		}
+	}
+	d := net.Dialer{Timeout: timeout}
+	nc, err := d.DialContext(ctx, "tcp", cfg.address())
+	if err != nil {
+		return nil, err
+	}
+	c := &conn{c: nc, timeout: timeout}
+	// whole setup has to fit in timeout
+	nc.SetDeadline(time.Now().Add(timeout))
+	err = c.setup(cfg.Password, psk)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func (c *conn) setup(password string, psk []byte) error {
+	if psk != nil {
+		nc, _, err := noiseClientHandshake(c.c, psk)
+		if err != nil {
+			return err
+		}
+		c.fc = nc
+	} else {
+		c.fc = newPlainConn(c.c)
+	}
+	err := c.fc.WriteMessage(msgHelloRequest, (&helloRequest{
+		ClientInfo: clientInfo,
+		Major:      apiVersionMajor,
+		Minor:      apiVersionMinor,
+	}).marshal())
+	if err != nil {
+		return err
+	}
+	f, err := c.expect(msgHelloResponse)
+	if err != nil {
+		return fmt.Errorf("hello: %w", err)
+	}
+	var hello helloResponse
+	hello.unmarshal(f)
+	if hello.Major != apiVersionMajor {
+		return fmt.Errorf("unsupported API version %d.%d", hello.Major, hello.Minor)
+	}
+	c.Name = hello.Name
+	err = c.fc.WriteMessage(msgConnectRequest, (&connectRequest{Password: password}).marshal())
+	if err != nil {
+		return err
+	}
+	f, err = c.expect(msgConnectResponse)
+	if err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	var login connectResponse
+	login.unmarshal(f)
+	if login.InvalidPassword {
+		return fmt.Errorf("invalid API password")
+	}
+	return nil
+}
+
+// handle answers requests node can send at any time, returns true if message was one of them
+func (c *conn) handle(msgType uint16) (bool, error) {
+	switch msgType {
+	case msgPingRequest:
+		return true, c.fc.WriteMessage(msgPingResponse, nil)
+	case msgGetTimeRequest:
+		return true, c.fc.WriteMessage(msgGetTimeResponse, (&getTimeResponse{EpochSeconds: uint32(time.Now().Unix())}).marshal())
+	case msgDisconnectRequest:
+		c.fc.WriteMessage(msgDisconnectResponse, nil)
+		return true, fmt.Errorf("node requested disconnect")
+	case msgPingResponse:
+		return true, nil
+	}
+	return false, nil
+}
+
+// read returns next message that is not handled internally
+func (c *conn) read() (uint16, fields, error) {
+	for {
+		msgType, data, err := c.fc.ReadMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		handled, err := c.handle(msgType)
+		if err != nil {
+			return 0, nil, err
+		}
+		if handled {
+			continue
+		}
+		f, err := parseFields(data)
+		if err != nil {
+			return 0, nil, fmt.Errorf("error decoding message type %d: %w", msgType, err)
+		}
+		return msgType, f, nil
+	}
+}
+
+// expect reads until message of given type, skipping unrelated ones
+func (c *conn) expect(msgType uint16) (fields, error) {
+	for {
+		t, f, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if t == msgType {
+			return f, nil
+		}
+	}
+}
+
+func (c *conn) deviceInfo() (deviceInfo, error) {
+	var info deviceInfo
+	c.c.SetDeadline(time.Now().Add(c.timeout))
+	defer c.c.SetDeadline(time.Time{})
+	err := c.fc.WriteMessage(msgDeviceInfoRequest, nil)
+	if err != nil {
+		return info, err
+	}
+	f, err := c.expect(msgDeviceInfoResponse)
+	if err != nil {
+		return info, fmt.Errorf("device info: %w", err)
+	}
+	info.unmarshal(f)
+	return info, nil
+}
+
+// listEntities returns sensor entities, other entity types are skipped
+func (c *conn) listEntities() ([]sensorEntity, error) {
+	c.c.SetDeadline(time.Now().Add(c.timeout))
+	defer c.c.SetDeadline(time.Time{})
+	err := c.fc.WriteMessage(msgListEntitiesRequest, nil)
+	if err != nil {
+		return nil, err
+	}
+	var sensors []sensorEntity
+	for {
+		t, f, err := c.read()
+		if err != nil {
+			return nil, fmt.Errorf("list entities: %w", err)
+		}
+		switch t {
+		case msgListEntitiesSensor:
+			var e sensorEntity
+			e.unmarshal(f)
+			sensors = append(sensors, e)
+		case msgListEntitiesDone:
+			return sensors, nil
+		}
+	}
+}
+
+// subscribeStates calls f for every sensor state until connection fails or ctx is done.
+// Node is pinged every keepAlive and connection is considered dead if nothing comes back for 3 of them
+func (c *conn) subscribeStates(ctx context.Context, keepAlive time.Duration, f func(sensorState)) error {
+	err := c.fc.WriteMessage(msgSubscribeStatesRequest, nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		t := time.NewTicker(keepAlive)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				// unblocks read
+				c.Close()
+				return
+			case <-t.C:
+				c.fc.WriteMessage(msgPingRequest, nil)
+			}
+		}
+	}()
+	for {
+		c.c.SetReadDeadline(time.Now().Add(keepAlive * 3))
+		t, fs, err := c.read()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if t == msgSensorStateResponse {
+			var s sensorState
+			s.unmarshal(fs)
+			f(s)
+		}
+	}
+}
+
+func (c *conn) Close() error {
+	c.c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.fc.WriteMessage(msgDisconnectRequest, nil)
+	return c.c.Close()
+}
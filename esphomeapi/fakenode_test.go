@@ -0,0 +1,187 @@
+package esphomeapi
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/flynn/noise"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeNode is minimal ESPHome API server: answers handshake, login, device info and entity list,
+// then sends whatever is put in states
+type fakeNode struct {
+	ln       net.Listener
+	psk      []byte
+	password string
+	info     deviceInfo
+	sensors  []sensorEntity
+	states   chan sensorState
+	// accepted connections, current one can be dropped with drop()
+	conns   atomic.Int32
+	current net.Conn
+	sync.Mutex
+}
+
+func newFakeNode(t *testing.T, psk []byte) *fakeNode {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNode{
+		ln:  ln,
+		psk: psk,
+		info: deviceInfo{
+			Name:           "kitchen",
+			MACAddress:     "AA:BB:CC:DD:EE:FF",
+			ESPHomeVersion: "2025.10.0",
+			Model:          "esp32dev",
+		},
+		sensors: []sensorEntity{{
+			ObjectID:    "temperature",
+			Key:         1,
+			Name:        "Temperature",
+			UniqueID:    "kitchentemperature",
+			Unit:        "°C",
+			DeviceClass: "temperature",
+			StateClass:  stateClassMeasurement,
+		}},
+		states: make(chan sensorState, 16),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.conns.Add(1)
+			f.Lock()
+			f.current = c
+			f.Unlock()
+			go f.serve(c)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNode) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// drop closes current connection, like node rebooting
+func (f *fakeNode) drop() {
+	f.Lock()
+	defer f.Unlock()
+	if f.current != nil {
+		f.current.Close()
+	}
+}
+
+func (f *fakeNode) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	var fc frameConn
+	if f.psk != nil {
+		indicator, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+		if indicator[0] != indicatorNoise {
+			writeNoiseFrame(c, []byte("\x01Bad indicator byte"))
+			return
+		}
+		nc, err := noiseServerHandshake(r, c, f.psk, f.info.Name)
+		if err != nil {
+			return
+		}
+		fc = nc
+	} else {
+		fc = &plainConn{r: r, w: c}
+	}
+	for {
+		msgType, data, err := fc.ReadMessage()
+		if err != nil {
+			return
+		}
+		fs, err := parseFields(data)
+		if err != nil {
+			return
+		}
+		switch msgType {
+		case msgHelloRequest:
+			var req helloRequest
+			req.unmarshal(fs)
+			err = fc.WriteMessage(msgHelloResponse, (&helloResponse{Major: 1, Minor: 10, ServerInfo: "fake", Name: f.info.Name}).marshal())
+		case msgConnectRequest:
+			var req connectRequest
+			req.unmarshal(fs)
+			err = fc.WriteMessage(msgConnectResponse, (&connectResponse{InvalidPassword: req.Password != f.password}).marshal())
+		case msgDeviceInfoRequest:
+			err = fc.WriteMessage(msgDeviceInfoResponse, f.info.marshal())
+		case msgListEntitiesRequest:
+			for _, s := range f.sensors {
+				fc.WriteMessage(msgListEntitiesSensor, s.marshal())
+			}
+			err = fc.WriteMessage(msgListEntitiesDone, nil)
+		case msgSubscribeStatesRequest:
+			go func() {
+				for s := range f.states {
+					if fc.WriteMessage(msgSensorStateResponse, s.marshal()) != nil {
+						// connection is gone, give state to next one
+						f.states <- s
+						return
+					}
+				}
+			}()
+		case msgPingRequest:
+			err = fc.WriteMessage(msgPingResponse, nil)
+		case msgDisconnectRequest:
+			fc.WriteMessage(msgDisconnectResponse, nil)
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func noiseServerHandshake(r *bufio.Reader, c net.Conn, psk []byte, name string) (*noiseConn, error) {
+	hello, err := readNoiseFrame(r)
+	if err != nil || len(hello) != 0 {
+		return nil, err
+	}
+	serverHello := bytes.Buffer{}
+	serverHello.WriteByte(indicatorNoise)
+	serverHello.WriteString(name)
+	serverHello.WriteByte(0)
+	writeNoiseFrame(c, serverHello.Bytes())
+	msg, err := readNoiseFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:           noiseCipherSuite,
+		Pattern:               noise.HandshakeNN,
+		Initiator:             false,
+		Prologue:              noisePrologue,
+		PresharedKey:          psk,
+		PresharedKeyPlacement: 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, err = hs.ReadMessage(nil, msg[1:])
+	if err != nil {
+		writeNoiseFrame(c, []byte("\x01Handshake MAC failure"))
+		return nil, err
+	}
+	resp, recv, send, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	writeNoiseFrame(c, append([]byte{0x00}, resp...))
+	return &noiseConn{r: r, w: c, send: send, recv: recv}, nil
+}
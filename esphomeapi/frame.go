@@ -0,0 +1,205 @@
+package esphomeapi
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/flynn/noise"
+	"io"
+	"sync"
+)
+
+const (
+	indicatorPlaintext = 0x00
+	indicatorNoise     = 0x01
+	// largest message we accept, ESPHome's own limit is lower
+	maxMessageSize = 1 << 20
+)
+
+var noisePrologue = []byte("NoiseAPIInit\x00\x00")
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+var ErrEncryptionRequired = errors.New("node requires encryption key")
+var ErrEncryptionNotSupported = errors.New("node does not have encryption enabled")
+
+// frameConn reads and writes API messages in one of the two framings
+type frameConn interface {
+	ReadMessage() (msgType uint16, data []byte, err error)
+	WriteMessage(msgType uint16, data []byte) error
+}
+
+// plainConn is unencrypted framing: indicator, varint size, varint type, protobuf message
+type plainConn struct {
+	r *bufio.Reader
+	w io.Writer
+	sync.Mutex
+}
+
+func newPlainConn(rw io.ReadWriter) *plainConn {
+	return &plainConn{r: bufio.NewReader(rw), w: rw}
+}
+
+func (c *plainConn) ReadMessage() (uint16, []byte, error) {
+	indicator, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	if indicator == indicatorNoise {
+		return 0, nil, ErrEncryptionRequired
+	}
+	if indicator != indicatorPlaintext {
+		return 0, nil, fmt.Errorf("bad frame indicator 0x%02x", indicator)
+	}
+	size, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	msgType, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if size > maxMessageSize || msgType > 0xffff {
+		return 0, nil, fmt.Errorf("bad frame: size %d, type %d", size, msgType)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(c.r, data)
+	return uint16(msgType), data, err
+}
+
+func (c *plainConn) WriteMessage(msgType uint16, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	b := make([]byte, 0, len(data)+1+2*binary.MaxVarintLen32)
+	b = append(b, indicatorPlaintext)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	b = binary.AppendUvarint(b, uint64(msgType))
+	b = append(b, data...)
+	_, err := c.w.Write(b)
+	return err
+}
+
+func readNoiseFrame(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 3)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	if header[0] == indicatorPlaintext {
+		return nil, ErrEncryptionNotSupported
+	}
+	if header[0] != indicatorNoise {
+		return nil, fmt.Errorf("bad frame indicator 0x%02x", header[0])
+	}
+	frame := make([]byte, binary.BigEndian.Uint16(header[1:]))
+	_, err = io.ReadFull(r, frame)
+	return frame, err
+}
+
+func writeNoiseFrame(w io.Writer, frame []byte) error {
+	if len(frame) > 0xffff {
+		return fmt.Errorf("frame too large: %d", len(frame))
+	}
+	b := make([]byte, 3, 3+len(frame))
+	b[0] = indicatorNoise
+	binary.BigEndian.PutUint16(b[1:], uint16(len(frame)))
+	_, err := w.Write(append(b, frame...))
+	return err
+}
+
+// noiseConn is Noise_NNpsk0_25519_ChaChaPoly_SHA256 encrypted framing.
+// Each frame carries encrypted 2 byte type, 2 byte length and protobuf message
+type noiseConn struct {
+	r    *bufio.Reader
+	w    io.Writer
+	send *noise.CipherState
+	recv *noise.CipherState
+	sync.Mutex
+}
+
+// noiseClientHandshake sends client hello and handshake and returns encrypted connection and server's name
+func noiseClientHandshake(rw io.ReadWriter, psk []byte) (*noiseConn, string, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:           noiseCipherSuite,
+		Pattern:               noise.HandshakeNN,
+		Initiator:             true,
+		Prologue:              noisePrologue,
+		PresharedKey:          psk,
+		PresharedKeyPlacement: 0,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	msg, _, _, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	buf := bytes.Buffer{}
+	writeNoiseFrame(&buf, nil)
+	writeNoiseFrame(&buf, append([]byte{0x00}, msg...))
+	_, err = rw.Write(buf.Bytes())
+	if err != nil {
+		return nil, "", err
+	}
+	r := bufio.NewReader(rw)
+	hello, err := readNoiseFrame(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading server hello: %w", err)
+	}
+	if len(hello) == 0 || hello[0] != indicatorNoise {
+		return nil, "", fmt.Errorf("unsupported noise protocol in server hello")
+	}
+	name, _, _ := bytes.Cut(hello[1:], []byte{0})
+	resp, err := readNoiseFrame(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("error reading handshake: %w", err)
+	}
+	if len(resp) == 0 {
+		return nil, "", fmt.Errorf("empty handshake response")
+	}
+	if resp[0] != 0x00 {
+		return nil, "", fmt.Errorf("handshake rejected: %s", string(resp[1:]))
+	}
+	_, send, recv, err := hs.ReadMessage(nil, resp[1:])
+	if err != nil {
+		return nil, "", fmt.Errorf("handshake failed, wrong encryption key? %w", err)
+	}
+	return &noiseConn{r: r, w: rw, send: send, recv: recv}, string(name), nil
+}
+
+func (c *noiseConn) ReadMessage() (uint16, []byte, error) {
+	frame, err := readNoiseFrame(c.r)
+	if err != nil {
+		return 0, nil, err
+	}
+	msg, err := c.recv.Decrypt(nil, nil, frame)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error decrypting frame: %w", err)
+	}
+	if len(msg) < 4 {
+		return 0, nil, fmt.Errorf("encrypted frame too short")
+	}
+	size := int(binary.BigEndian.Uint16(msg[2:4]))
+	if size != len(msg)-4 {
+		return 0, nil, fmt.Errorf("bad encrypted frame length %d, have %d", size, len(msg)-4)
+	}
+	return binary.BigEndian.Uint16(msg[0:2]), msg[4:], nil
+}
+
+func (c *noiseConn) WriteMessage(msgType uint16, data []byte) error {
+	if len(data) > 0xffff-4-16 {
+		return fmt.Errorf("message too large: %d", len(data))
+	}
+	c.Lock()
+	defer c.Unlock()
+	msg := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(msg[0:2], msgType)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(data)))
+	frame, err := c.send.Encrypt(nil, nil, append(msg, data...))
+	if err != nil {
+		return err
+	}
+	return writeNoiseFrame(c.w, frame)
+}
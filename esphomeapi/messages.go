@@ -0,0 +1,290 @@
+package esphomeapi
+
+import (
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+)
+
+// message type IDs from ESPHome's api.proto; only messages bridge needs are handled
+const (
+	msgHelloRequest           uint16 = 1
+	msgHelloResponse          uint16 = 2
+	msgConnectRequest         uint16 = 3
+	msgConnectResponse        uint16 = 4
+	msgDisconnectRequest      uint16 = 5
+	msgDisconnectResponse     uint16 = 6
+	msgPingRequest            uint16 = 7
+	msgPingResponse           uint16 = 8
+	msgDeviceInfoRequest      uint16 = 9
+	msgDeviceInfoResponse     uint16 = 10
+	msgListEntitiesRequest    uint16 = 11
+	msgListEntitiesSensor     uint16 = 16
+	msgListEntitiesDone       uint16 = 19
+	msgSubscribeStatesRequest uint16 = 20
+	msgSensorStateResponse    uint16 = 25
+	msgGetTimeRequest         uint16 = 36
+	msgGetTimeResponse        uint16 = 37
+)
+
+const (
+	apiVersionMajor = 1
+	apiVersionMinor = 10
+	clientInfo      = "esphome2prom"
+)
+
+// SensorStateClass enum
+const (
+	stateClassNone            = 0
+	stateClassMeasurement     = 1
+	stateClassTotalIncreasing = 2
+	stateClassTotal           = 3
+)
+
+// fields is decoded protobuf message, last value of each field number wins
+type fields map[protowire.Number]field
+
+type field struct {
+	v uint64
+	b []byte
+}
+
+func parseFields(data []byte) (fields, error) {
+	f := fields{}
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		data = data[n:]
+		switch typ {
+		case protowire.VarintType:
+			var v uint64
+			v, n = protowire.ConsumeVarint(data)
+			f[num] = field{v: v}
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(data)
+			f[num] = field{v: uint64(v)}
+		case protowire.Fixed64Type:
+			var v uint64
+			v, n = protowire.ConsumeFixed64(data)
+			f[num] = field{v: v}
+		case protowire.BytesType:
+			var b []byte
+			b, n = protowire.ConsumeBytes(data)
+			f[num] = field{b: b}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("field %d: %w", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+	}
+	return f, nil
+}
+
+func (f fields) str(n protowire.Number) string      { return string(f[n].b) }
+func (f fields) uint32(n protowire.Number) uint32   { return uint32(f[n].v) }
+func (f fields) bool(n protowire.Number) bool       { return f[n].v != 0 }
+func (f fields) float32(n protowire.Number) float32 { return math.Float32frombits(uint32(f[n].v)) }
+
+func appendString(b []byte, n protowire.Number, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, n, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+func appendVarint(b []byte, n protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, n, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+func appendFixed32(b []byte, n protowire.Number, v uint32) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, n, protowire.Fixed32Type)
+	return protowire.AppendFixed32(b, v)
+}
+
+func appendBool(b []byte, n protowire.Number, v bool) []byte {
+	if v {
+		return appendVarint(b, n, 1)
+	}
+	return b
+}
+
+type helloRequest struct {
+	ClientInfo string
+	Major      uint32
+	Minor      uint32
+}
+
+func (m *helloRequest) marshal() []byte {
+	b := appendString(nil, 1, m.ClientInfo)
+	b = appendVarint(b, 2, uint64(m.Major))
+	return appendVarint(b, 3, uint64(m.Minor))
+}
+
+func (m *helloRequest) unmarshal(f fields) {
+	m.ClientInfo = f.str(1)
+	m.Major = f.uint32(2)
+	m.Minor = f.uint32(3)
+}
+
+type helloResponse struct {
+	Major      uint32
+	Minor      uint32
+	ServerInfo string
+	Name       string
+}
+
+func (m *helloResponse) marshal() []byte {
+	b := appendVarint(nil, 1, uint64(m.Major))
+	b = appendVarint(b, 2, uint64(m.Minor))
+	b = appendString(b, 3, m.ServerInfo)
+	return appendString(b, 4, m.Name)
+}
+
+func (m *helloResponse) unmarshal(f fields) {
+	m.Major = f.uint32(1)
+	m.Minor = f.uint32(2)
+	m.ServerInfo = f.str(3)
+	m.Name = f.str(4)
+}
+
+type connectRequest struct {
+	Password string
+}
+
+func (m *connectRequest) marshal() []byte { return appendString(nil, 1, m.Password) }
+
+func (m *connectRequest) unmarshal(f fields) { m.Password = f.str(1) }
+
+type connectResponse struct {
+	InvalidPassword bool
+}
+
+func (m *connectResponse) marshal() []byte { return appendBool(nil, 1, m.InvalidPassword) }
+
+func (m *connectResponse) unmarshal(f fields) { m.InvalidPassword = f.bool(1) }
+
+type deviceInfo struct {
+	UsesPassword    bool
+	Name            string
+	MACAddress      string
+	ESPHomeVersion  string
+	CompilationTime string
+	Model           string
+	ProjectName     string
+	ProjectVersion  string
+	Manufacturer    string
+	FriendlyName    string
+}
+
+func (m *deviceInfo) marshal() []byte {
+	b := appendBool(nil, 1, m.UsesPassword)
+	b = appendString(b, 2, m.Name)
+	b = appendString(b, 3, m.MACAddress)
+	b = appendString(b, 4, m.ESPHomeVersion)
+	b = appendString(b, 5, m.CompilationTime)
+	b = appendString(b, 6, m.Model)
+	b = appendString(b, 8, m.ProjectName)
+	b = appendString(b, 9, m.ProjectVersion)
+	b = appendString(b, 12, m.Manufacturer)
+	return appendString(b, 13, m.FriendlyName)
+}
+
+func (m *deviceInfo) unmarshal(f fields) {
+	m.UsesPassword = f.bool(1)
+	m.Name = f.str(2)
+	m.MACAddress = f.str(3)
+	m.ESPHomeVersion = f.str(4)
+	m.CompilationTime = f.str(5)
+	m.Model = f.str(6)
+	m.ProjectName = f.str(8)
+	m.ProjectVersion = f.str(9)
+	m.Manufacturer = f.str(12)
+	m.FriendlyName = f.str(13)
+}
+
+type sensorEntity struct {
+	ObjectID          string
+	Key               uint32
+	Name              string
+	UniqueID          string
+	Unit              string
+	AccuracyDecimals  int32
+	DeviceClass       string
+	StateClass        uint32
+	DisabledByDefault bool
+}
+
+func (m *sensorEntity) marshal() []byte {
+	b := appendString(nil, 1, m.ObjectID)
+	b = appendFixed32(b, 2, m.Key)
+	b = appendString(b, 3, m.Name)
+	b = appendString(b, 4, m.UniqueID)
+	b = appendString(b, 6, m.Unit)
+	b = appendVarint(b, 7, uint64(m.AccuracyDecimals))
+	b = appendString(b, 9, m.DeviceClass)
+	b = appendVarint(b, 10, uint64(m.StateClass))
+	return appendBool(b, 12, m.DisabledByDefault)
+}
+
+func (m *sensorEntity) unmarshal(f fields) {
+	m.ObjectID = f.str(1)
+	m.Key = f.uint32(2)
+	m.Name = f.str(3)
+	m.UniqueID = f.str(4)
+	m.Unit = f.str(6)
+	m.AccuracyDecimals = int32(f.uint32(7))
+	m.DeviceClass = f.str(9)
+	m.StateClass = f.uint32(10)
+	m.DisabledByDefault = f.bool(12)
+}
+
+// stateClass returns state class the way MQTT discovery names it
+func (m *sensorEntity) stateClass() string {
+	switch m.StateClass {
+	case stateClassMeasurement:
+		return "measurement"
+	case stateClassTotalIncreasing:
+		return "total_increasing"
+	case stateClassTotal:
+		return "total"
+	default:
+		return ""
+	}
+}
+
+type sensorState struct {
+	Key          uint32
+	State        float32
+	MissingState bool
+}
+
+func (m *sensorState) marshal() []byte {
+	b := appendFixed32(nil, 1, m.Key)
+	b = appendFixed32(b, 2, math.Float32bits(m.State))
+	return appendBool(b, 3, m.MissingState)
+}
+
+func (m *sensorState) unmarshal(f fields) {
+	m.Key = f.uint32(1)
+	m.State = f.float32(2)
+	m.MissingState = f.bool(3)
+}
+
+type getTimeResponse struct {
+	EpochSeconds uint32
+}
+
+func (m *getTimeResponse) marshal() []byte { return appendFixed32(nil, 1, m.EpochSeconds) }
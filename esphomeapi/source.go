@@ -0,0 +1,318 @@
+// Package esphomeapi ingests sensors from ESPHome nodes over native API (port 6053), without MQTT.
+// Plaintext and Noise encrypted connections are supported.
+package esphomeapi
+
+import (
+	"context"
+	"fmt"
+	"github.com/XANi/esphome2prom/mdns"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type NodeConfig struct {
+	// Address is host or host:port, port defaults to 6053
+	Address string `yaml:"address"`
+	// EncryptionKey is base64 api encryption key from node's config, plaintext protocol is used if empty
+	EncryptionKey string `yaml:"encryption_key"`
+	// Password is legacy API password
+	Password string `yaml:"password"`
+}
+
+func (c *NodeConfig) address() string {
+	if _, _, err := net.SplitHostPort(c.Address); err == nil {
+		return c.Address
+	}
+	return net.JoinHostPort(c.Address, "6053")
+}
+
+type Config struct {
+	Nodes []NodeConfig `yaml:"nodes"`
+	// reconnect delay of each node
+	queue.BackoffConfig `yaml:",inline"`
+	// Timeout for connecting and handshake
+	Timeout time.Duration `yaml:"timeout"`
+	// KeepAlive is ping interval, connection is dropped after 3 of them without response
+	KeepAlive time.Duration `yaml:"keep_alive"`
+	// MDNS connects to nodes found by mDNS discovery, in addition to ones in Nodes
+	MDNS bool `yaml:"mdns"`
+	// EncryptionKeys are keys of nodes found by mDNS by node name, "*" is used for nodes not listed
+	EncryptionKeys map[string]string  `yaml:"encryption_keys"`
+	Logger         *zap.SugaredLogger `yaml:"-"`
+}
+
+// Source keeps API connection to every node
+type Source struct {
+	cfg   Config
+	reg   queue.SensorRegistry
+	l     *zap.SugaredLogger
+	nodes map[string]*node
+	// address of nodes added by mDNS discovery, by node name
+	discovered map[string]string
+	wg         sync.WaitGroup
+	sync.Mutex
+}
+
+func New(cfg Config, reg queue.SensorRegistry) (*Source, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = time.Second * 20
+	}
+	s := &Source{
+		cfg:        cfg,
+		reg:        reg,
+		l:          cfg.Logger,
+		nodes:      map[string]*node{},
+		discovered: map[string]string{},
+	}
+	for _, n := range cfg.Nodes {
+		err := s.AddNode(n)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// AddNode starts connecting to the node, node already present under the same address is left as is
+func (s *Source) AddNode(cfg NodeConfig) error {
+	if len(cfg.Address) == 0 {
+		return fmt.Errorf("node address is empty")
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.nodes[cfg.Address]; ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &node{
+		cfg:     cfg,
+		s:       s,
+		l:       s.l.Named(cfg.Address),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		sensors: map[string]string{},
+	}
+	s.nodes[cfg.Address] = n
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(n.done)
+		n.run(ctx)
+	}()
+	return nil
+}
+
+// RemoveNode disconnects from the node and removes its sensors, returning once they are removed
+func (s *Source) RemoveNode(address string) {
+	s.Lock()
+	n, ok := s.nodes[address]
+	delete(s.nodes, address)
+	s.Unlock()
+	if ok {
+		n.remove.Store(true)
+		n.cancel()
+		<-n.done
+	}
+}
+
+// DeviceUp connects to node found by mDNS discovery, replacing previous address of the same node.
+// Nodes that are also configured statically are skipped
+func (s *Source) DeviceUp(d mdns.Device) {
+	if !s.cfg.MDNS || s.static(d) {
+		return
+	}
+	addr := d.APIAddress()
+	s.Lock()
+	old, ok := s.discovered[d.Name]
+	s.discovered[d.Name] = addr
+	s.Unlock()
+	if ok && old != addr {
+		// sensor IDs are the same under new address, old ones have to be gone before new node registers them
+		s.RemoveNode(old)
+	}
+	key, ok := s.cfg.EncryptionKeys[d.Name]
+	if !ok {
+		key = s.cfg.EncryptionKeys["*"]
+	}
+	if len(d.APIEncryption) > 0 && len(key) == 0 {
+		s.l.Warnf("%s announces API encryption but there is no key for it in encryption_keys", d.Name)
+	}
+	err := s.AddNode(NodeConfig{Address: addr, EncryptionKey: key})
+	if err != nil {
+		s.l.Errorf("error adding %s: %s", d.Name, err)
+	}
+}
+
+// DeviceDown disconnects from node that stopped announcing itself
+func (s *Source) DeviceDown(d mdns.Device) {
+	s.Lock()
+	addr, ok := s.discovered[d.Name]
+	delete(s.discovered, d.Name)
+	s.Unlock()
+	if ok {
+		s.RemoveNode(addr)
+	}
+}
+
+// static returns true if device is one of configured nodes
+func (s *Source) static(d mdns.Device) bool {
+	for _, n := range s.cfg.Nodes {
+		host, _, err := net.SplitHostPort(n.Address)
+		if err != nil {
+			host = n.Address
+		}
+		host = strings.TrimSuffix(strings.ToLower(host), ".")
+		if host == d.Name || host == d.Host || host == d.Address {
+			return true
+		}
+	}
+	return false
+}
+
+// Close disconnects from all nodes, their sensors stay registered as nodes are not gone
+func (s *Source) Close() {
+	s.Lock()
+	for addr, n := range s.nodes {
+		n.cancel()
+		delete(s.nodes, addr)
+	}
+	s.Unlock()
+	s.wg.Wait()
+}
+
+type node struct {
+	cfg    NodeConfig
+	s      *Source
+	l      *zap.SugaredLogger
+	cancel context.CancelFunc
+	// remove makes node remove its sensors once it stops
+	remove atomic.Bool
+	// done is closed when node stops
+	done chan struct{}
+	// state topic by sensor ID of sensors registered from this node
+	sensors map[string]string
+}
+
+func (n *node) run(ctx context.Context) {
+	defer func() {
+		if n.remove.Load() {
+			n.removeSensors(nil)
+		}
+	}()
+	connected := n.metric("esphome2prom_native_api_connected", mon.NewGauge())
+	connects := n.metric("esphome2prom_native_api_connects", mon.NewCounter())
+	failures := n.metric("esphome2prom_native_api_errors", mon.NewCounter())
+	backoff := queue.NewBackoff(n.s.cfg.BackoffConfig)
+	for {
+		wasUp := false
+		err := n.session(ctx, func() {
+			wasUp = true
+			connected.Update(1)
+			connects.Update(1)
+		})
+		connected.Update(0)
+		if ctx.Err() != nil {
+			return
+		}
+		failures.Update(1)
+		// node that was working is likely just rebooting, start with short delay again
+		if wasUp {
+			backoff.Reset()
+		}
+		n.l.Warnf("API connection failed: %s, reconnecting in %s", err, backoff.Delay())
+		if !backoff.Wait(ctx) {
+			return
+		}
+	}
+}
+
+func (n *node) metric(name string, m mon.Metric) mon.Metric {
+	m, err := mon.GlobalRegistry.RegisterOrGet(name, m, map[string]string{"node": n.cfg.Address})
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// session does single connection: registers node's sensors and streams their states until connection breaks
+func (n *node) session(ctx context.Context, up func()) error {
+	c, err := dial(ctx, n.cfg, n.s.cfg.Timeout)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	info, err := c.deviceInfo()
+	if err != nil {
+		return err
+	}
+	entities, err := c.listEntities()
+	if err != nil {
+		return err
+	}
+	up()
+	n.l.Infof("connected to %s (ESPHome %s), %d sensors", info.Name, info.ESPHomeVersion, len(entities))
+	stateTopics := make(map[uint32]string, len(entities))
+	current := map[string]bool{}
+	for _, e := range entities {
+		id, d := n.discovery(info, e)
+		stateTopics[e.Key] = d.StateTopic
+		current[id] = true
+		n.sensors[id] = d.StateTopic
+		n.s.reg.AddSensor(id, d)
+	}
+	// entities removed from node's config since last connection
+	n.removeSensors(current)
+	return c.subscribeStates(ctx, n.s.cfg.KeepAlive, func(s sensorState) {
+		topic, ok := stateTopics[s.Key]
+		if !ok || s.MissingState || math.IsNaN(float64(s.State)) {
+			return
+		}
+		n.s.reg.State(topic, []byte(strconv.FormatFloat(float64(s.State), 'f', -1, 32)))
+	})
+}
+
+// discovery converts entity to discovery data MQTT discovery would give for it
+func (n *node) discovery(info deviceInfo, e sensorEntity) (id string, d queue.ESPHomeDiscovery) {
+	prefix := "esphome-api/" + info.Name + "/sensor/" + e.ObjectID
+	return prefix + "/config", queue.ESPHomeDiscovery{
+		DeviceClass: queue.DeviceClass(e.DeviceClass),
+		Unit:        e.Unit,
+		StateClass:  e.stateClass(),
+		Name:        e.Name,
+		StateTopic:  prefix + "/state",
+		UniqID:      e.UniqueID,
+		Dev: &queue.ESPHomeDev{
+			ID:              info.MACAddress,
+			Name:            info.Name,
+			SoftwareVersion: info.ESPHomeVersion,
+			Model:           info.Model,
+			Manufacturer:    info.Manufacturer,
+		},
+	}
+}
+
+// removeSensors removes registered sensors not in keep
+func (n *node) removeSensors(keep map[string]bool) {
+	for id := range n.sensors {
+		if keep[id] {
+			continue
+		}
+		n.s.reg.RemoveSensor(id)
+		delete(n.sensors, id)
+	}
+}
@@ -0,0 +1,202 @@
+package esphomeapi
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/XANi/esphome2prom/internal/sourcetest"
+	"github.com/XANi/esphome2prom/mdns"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var testPSK = []byte("0123456789abcdef0123456789abcdef")
+
+func testSource(t *testing.T, reg queue.SensorRegistry, nodes ...NodeConfig) *Source {
+	s, err := New(Config{
+		Nodes:         nodes,
+		BackoffConfig: queue.BackoffConfig{MinBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 100},
+		Timeout:       time.Second,
+		Logger:        zaptest.NewLogger(t).Sugar(),
+	}, reg)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestSourcePlaintext(t *testing.T) {
+	f := newFakeNode(t, nil)
+	reg := sourcetest.NewRegistry()
+	testSource(t, reg, NodeConfig{Address: f.Addr()})
+	f.states <- sensorState{Key: 1, State: 21.5}
+	require.Eventually(t, func() bool {
+		return reg.LastState("esphome-api/kitchen/sensor/temperature/state") == "21.5"
+	}, time.Second*5, time.Millisecond*10)
+	d, ok := reg.Sensor("esphome-api/kitchen/sensor/temperature/config")
+	require.True(t, ok)
+	assert.Equal(t, queue.DeviceClass("temperature"), d.DeviceClass)
+	assert.Equal(t, "measurement", d.StateClass)
+	assert.Equal(t, "°C", d.Unit)
+	require.NotNil(t, d.Dev)
+	assert.Equal(t, "kitchen", d.Dev.Name)
+	assert.Equal(t, "AA:BB:CC:DD:EE:FF", d.Dev.ID)
+}
+
+func TestSourceNoise(t *testing.T) {
+	f := newFakeNode(t, testPSK)
+	reg := sourcetest.NewRegistry()
+	testSource(t, reg, NodeConfig{Address: f.Addr(), EncryptionKey: base64.StdEncoding.EncodeToString(testPSK)})
+	f.states <- sensorState{Key: 1, State: 3.25}
+	require.Eventually(t, func() bool {
+		return reg.LastState("esphome-api/kitchen/sensor/temperature/state") == "3.25"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSourceMissingState(t *testing.T) {
+	f := newFakeNode(t, nil)
+	reg := sourcetest.NewRegistry()
+	testSource(t, reg, NodeConfig{Address: f.Addr()})
+	f.states <- sensorState{Key: 1, State: 1, MissingState: true}
+	f.states <- sensorState{Key: 2, State: 2}
+	f.states <- sensorState{Key: 1, State: 3}
+	require.Eventually(t, func() bool {
+		return reg.LastState("esphome-api/kitchen/sensor/temperature/state") == "3"
+	}, time.Second*5, time.Millisecond*10)
+	assert.Len(t, reg.StateTopics(), 1)
+}
+
+func TestDialErrors(t *testing.T) {
+	plain := newFakeNode(t, nil)
+	plain.password = "secret"
+	encrypted := newFakeNode(t, testPSK)
+	otherKey := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	ctx := context.Background()
+
+	_, err := dial(ctx, NodeConfig{Address: plain.Addr(), Password: "wrong"}, time.Second)
+	assert.ErrorContains(t, err, "invalid API password")
+	c, err := dial(ctx, NodeConfig{Address: plain.Addr(), Password: "secret"}, time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "kitchen", c.Name)
+	c.Close()
+
+	_, err = dial(ctx, NodeConfig{Address: encrypted.Addr()}, time.Second)
+	assert.ErrorIs(t, err, ErrEncryptionRequired)
+	_, err = dial(ctx, NodeConfig{Address: encrypted.Addr(), EncryptionKey: otherKey}, time.Second)
+	assert.ErrorContains(t, err, "handshake rejected")
+	_, err = dial(ctx, NodeConfig{Address: encrypted.Addr(), EncryptionKey: "c2hvcnQ="}, time.Second)
+	assert.ErrorContains(t, err, "32 bytes")
+}
+
+func TestSourceReconnect(t *testing.T) {
+	f := newFakeNode(t, nil)
+	reg := sourcetest.NewRegistry()
+	testSource(t, reg, NodeConfig{Address: f.Addr()})
+	f.states <- sensorState{Key: 1, State: 1}
+	require.Eventually(t, func() bool {
+		return reg.LastState("esphome-api/kitchen/sensor/temperature/state") == "1"
+	}, time.Second*5, time.Millisecond*10)
+	f.drop()
+	require.Eventually(t, func() bool { return f.conns.Load() == 2 }, time.Second*5, time.Millisecond*10)
+	f.states <- sensorState{Key: 1, State: 2}
+	require.Eventually(t, func() bool {
+		return reg.LastState("esphome-api/kitchen/sensor/temperature/state") == "2"
+	}, time.Second*5, time.Millisecond*10)
+}
+
+func TestSourceRemoveNode(t *testing.T) {
+	f := newFakeNode(t, nil)
+	reg := sourcetest.NewRegistry()
+	s := testSource(t, reg, NodeConfig{Address: f.Addr()})
+	require.Eventually(t, func() bool { return len(reg.Sensors()) == 1 }, time.Second*5, time.Millisecond*10)
+	s.RemoveNode(f.Addr())
+	require.Eventually(t, func() bool { return len(reg.Sensors()) == 0 }, time.Second*5, time.Millisecond*10)
+}
+
+func TestSourceCloseKeepsSensors(t *testing.T) {
+	f := newFakeNode(t, nil)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{Nodes: []NodeConfig{{Address: f.Addr()}}, Logger: zaptest.NewLogger(t).Sugar()}, reg)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return len(reg.Sensors()) == 1 }, time.Second*5, time.Millisecond*10)
+	s.Close()
+	assert.Len(t, reg.Sensors(), 1)
+}
+
+func TestSourceQueue(t *testing.T) {
+	f := newFakeNode(t, testPSK)
+	q, sink := sourcetest.NewQueue(t, nil)
+	testSource(t, q, NodeConfig{Address: f.Addr(), EncryptionKey: base64.StdEncoding.EncodeToString(testPSK)})
+	require.Eventually(t, func() bool {
+		_, ok := q.SensorDiscovery("kitchen", "Temperature")
+		return ok
+	}, time.Second*5, time.Millisecond*10)
+	f.states <- sensorState{Key: 1, State: 21.5}
+	metrics := sink.WaitFor(t, 1)
+	assert.Equal(t, 21.5, metrics[0].Value)
+	assert.Equal(t, "kitchen", metrics[0].Labels["device"])
+}
+
+func TestSourceMDNS(t *testing.T) {
+	f := newFakeNode(t, testPSK)
+	host, port, _ := net.SplitHostPort(f.Addr())
+	p, _ := strconv.Atoi(port)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{
+		MDNS:           true,
+		EncryptionKeys: map[string]string{"*": base64.StdEncoding.EncodeToString(testPSK)},
+		BackoffConfig:  queue.BackoffConfig{MinBackoff: time.Millisecond * 10},
+		Logger:         zaptest.NewLogger(t).Sugar(),
+	}, reg)
+	require.NoError(t, err)
+	defer s.Close()
+	d := mdns.Device{Name: "kitchen", Host: "kitchen.local", Address: host, Port: p}
+	s.DeviceUp(d)
+	require.Eventually(t, func() bool { return len(reg.Sensors()) == 1 }, time.Second*5, time.Millisecond*10)
+	s.DeviceDown(d)
+	require.Eventually(t, func() bool { return len(reg.Sensors()) == 0 }, time.Second*5, time.Millisecond*10)
+}
+
+func TestSourceMDNSAddressChange(t *testing.T) {
+	old, current := newFakeNode(t, testPSK), newFakeNode(t, testPSK)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{
+		MDNS:           true,
+		EncryptionKeys: map[string]string{"*": base64.StdEncoding.EncodeToString(testPSK)},
+		Logger:         zaptest.NewLogger(t).Sugar(),
+	}, reg)
+	require.NoError(t, err)
+	defer s.Close()
+	device := func(f *fakeNode) mdns.Device {
+		host, port, _ := net.SplitHostPort(f.Addr())
+		p, _ := strconv.Atoi(port)
+		return mdns.Device{Name: "kitchen", Host: "kitchen.local", Address: host, Port: p}
+	}
+	s.DeviceUp(device(old))
+	require.Eventually(t, func() bool { return len(reg.Sensors()) == 1 }, time.Second*5, time.Millisecond*10)
+	s.DeviceUp(device(current))
+	require.Eventually(t, func() bool { return current.conns.Load() == 1 }, time.Second*5, time.Millisecond*10)
+	current.states <- sensorState{Key: 1, State: 3}
+	require.Eventually(t, func() bool {
+		return reg.LastState("esphome-api/kitchen/sensor/temperature/state") == "3"
+	}, time.Second*5, time.Millisecond*10)
+	assert.Len(t, reg.Sensors(), 1)
+}
+
+func TestSourceMDNSSkipsStatic(t *testing.T) {
+	s, err := New(Config{
+		MDNS:  true,
+		Nodes: []NodeConfig{{Address: "kitchen.local:6053"}},
+	}, sourcetest.NewRegistry())
+	require.NoError(t, err)
+	defer s.Close()
+	s.DeviceUp(mdns.Device{Name: "kitchen", Host: "kitchen.local", Address: "10.0.0.5", Port: 6053})
+	s.Lock()
+	defer s.Unlock()
+	assert.Len(t, s.nodes, 1)
+	assert.Empty(t, s.discovered)
+}
@@ -0,0 +1,101 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// message is any message in WebSocket API, both directions
+type message struct {
+	ID        int             `json:"id,omitempty"`
+	Type      string          `json:"type"`
+	Success   bool            `json:"success,omitempty"`
+	Result    json.RawMessage `json:"result,omitempty"`
+	Error     *apiError       `json:"error,omitempty"`
+	Event     *event          `json:"event,omitempty"`
+	EventType string          `json:"event_type,omitempty"`
+	// AccessToken is sent in auth
+	AccessToken string `json:"access_token,omitempty"`
+	// Message is reason of auth_invalid
+	Message   string `json:"message,omitempty"`
+	HAVersion string `json:"ha_version,omitempty"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type event struct {
+	EventType string `json:"event_type"`
+	Data      struct {
+		EntityID string `json:"entity_id"`
+		// NewState is null when entity is removed
+		NewState *entityState `json:"new_state"`
+	} `json:"data"`
+}
+
+type entityState struct {
+	EntityID    string    `json:"entity_id"`
+	State       string    `json:"state"`
+	LastUpdated time.Time `json:"last_updated"`
+	Attributes  struct {
+		DeviceClass  string `json:"device_class"`
+		Unit         string `json:"unit_of_measurement"`
+		StateClass   string `json:"state_class"`
+		FriendlyName string `json:"friendly_name"`
+	} `json:"attributes"`
+}
+
+// domain returns sensor for sensor.kitchen_temperature
+func (s *entityState) domain() string {
+	d, _, _ := strings.Cut(s.EntityID, ".")
+	return d
+}
+
+// objectID returns kitchen_temperature for sensor.kitchen_temperature
+func (s *entityState) objectID() string {
+	_, id, _ := strings.Cut(s.EntityID, ".")
+	return id
+}
+
+// value returns state as number sensors can parse, false for states without value
+func (s *entityState) value() (string, bool) {
+	switch s.State {
+	case "", "unknown", "unavailable":
+		return "", false
+	}
+	if s.domain() == domainBinarySensor {
+		switch s.State {
+		case "on":
+			return "1", true
+		case "off":
+			return "0", true
+		default:
+			return "", false
+		}
+	}
+	return s.State, true
+}
+
+type registryDevice struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	NameByUser   string `json:"name_by_user"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	SWVersion    string `json:"sw_version"`
+}
+
+func (d *registryDevice) name() string {
+	if len(d.NameByUser) > 0 {
+		return d.NameByUser
+	}
+	return d.Name
+}
+
+type registryEntity struct {
+	EntityID string `json:"entity_id"`
+	DeviceID string `json:"device_id"`
+}
@@ -0,0 +1,421 @@
+// Package homeassistant ingests sensor and binary_sensor entities from Home Assistant's WebSocket API,
+// for sensors that only exist in HA (cloud integrations, ZHA and such)
+package homeassistant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	domainSensor       = "sensor"
+	domainBinarySensor = "binary_sensor"
+	// topicPrefix can't be homeassistant/, queue ignores states under it
+	topicPrefix = "hass/"
+)
+
+// BinarySensorMetric is state of binary_sensor entity, 1 is on and 0 is off, sent without prefix.
+// Their device classes (battery, power, moisture...) mean low battery or power detected, not a numeric value,
+// so they don't go through sensor types
+const BinarySensorMetric = "homeassistant_binary_sensor"
+
+// Registry gets sensors, their states and binary sensor metrics, implemented by queue.Queue
+type Registry interface {
+	queue.SensorRegistry
+	Dispatch(metrics []queue.Metric)
+}
+
+var (
+	haConnected = mon.GlobalRegistry.MustRegister("esphome2prom_homeassistant_connected", mon.NewGauge())
+	haConnects  = mon.GlobalRegistry.MustRegister("esphome2prom_homeassistant_connects", mon.NewCounter())
+	haErrors    = mon.GlobalRegistry.MustRegister("esphome2prom_homeassistant_errors", mon.NewCounter())
+)
+
+type Config struct {
+	// URL of Home Assistant, http(s):// or ws(s)://, /api/websocket is appended if missing
+	URL string `yaml:"url"`
+	// Token is long-lived access token from HA user's profile
+	Token string `yaml:"token"`
+	// DeviceName is device of entities that don't belong to any HA device, or all of them if token
+	// can't read device registry. Defaults to homeassistant
+	DeviceName          string `yaml:"device_name"`
+	queue.BackoffConfig `yaml:",inline"`
+	// Timeout for connecting, authentication and registry requests
+	Timeout time.Duration `yaml:"timeout"`
+	// KeepAlive is ping interval, connection is dropped after 3 of them without anything coming back
+	KeepAlive time.Duration      `yaml:"keep_alive"`
+	Logger    *zap.SugaredLogger `yaml:"-"`
+}
+
+// Source keeps WebSocket connection to Home Assistant
+type Source struct {
+	cfg Config
+	reg Registry
+	l   *zap.SugaredLogger
+	url string
+	// discovery of registered entities by entity ID
+	entities map[string]queue.ESPHomeDiscovery
+	// HA device of entity by entity ID
+	devices map[string]registryDevice
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func New(cfg Config, reg Registry) (*Source, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if len(cfg.DeviceName) == 0 {
+		cfg.DeviceName = "homeassistant"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = time.Second * 30
+	}
+	if len(cfg.Token) == 0 {
+		return nil, fmt.Errorf("home assistant token is empty")
+	}
+	u, err := wsURL(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Source{
+		cfg:      cfg,
+		reg:      reg,
+		l:        cfg.Logger,
+		url:      u,
+		entities: map[string]queue.ESPHomeDiscovery{},
+		devices:  map[string]registryDevice{},
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go s.run(ctx)
+	return s, nil
+}
+
+func wsURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || len(u.Host) == 0 {
+		return "", fmt.Errorf("bad home assistant url [%s]", raw)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	case "ws", "wss":
+	default:
+		return "", fmt.Errorf("unsupported home assistant url scheme [%s]", u.Scheme)
+	}
+	if !strings.HasSuffix(u.Path, "/api/websocket") {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/api/websocket"
+	}
+	return u.String(), nil
+}
+
+// Close disconnects, entities' sensors stay registered as entities are not gone
+func (s *Source) Close() {
+	s.cancel()
+	<-s.done
+}
+
+func (s *Source) run(ctx context.Context) {
+	defer close(s.done)
+	backoff := queue.NewBackoff(s.cfg.BackoffConfig)
+	for {
+		wasUp := false
+		err := s.session(ctx, func() {
+			wasUp = true
+			haConnected.Update(1)
+			haConnects.Update(1)
+		})
+		haConnected.Update(0)
+		if ctx.Err() != nil {
+			return
+		}
+		haErrors.Update(1)
+		if wasUp {
+			backoff.Reset()
+		}
+		s.l.Warnf("home assistant connection failed: %s, reconnecting in %s", err, backoff.Delay())
+		if !backoff.Wait(ctx) {
+			return
+		}
+	}
+}
+
+// conn is WebSocket connection with request IDs, writes can come from ping goroutine
+type conn struct {
+	ws     *websocket.Conn
+	nextID int
+	sync.Mutex
+}
+
+func (c *conn) send(m message) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.nextID++
+	m.ID = c.nextID
+	return m.ID, c.ws.WriteJSON(m)
+}
+
+// request sends m and decodes its result; only usable before subscribing as other messages are dropped
+func (c *conn) request(m message, result any) error {
+	id, err := c.send(m)
+	if err != nil {
+		return err
+	}
+	for {
+		var resp message
+		err := c.ws.ReadJSON(&resp)
+		if err != nil {
+			return err
+		}
+		if resp.ID != id || resp.Type != "result" {
+			continue
+		}
+		if !resp.Success {
+			return resultError(&resp)
+		}
+		return json.Unmarshal(resp.Result, result)
+	}
+}
+
+func resultError(m *message) error {
+	if m.Error != nil {
+		return fmt.Errorf("%s: %s", m.Error.Code, m.Error.Message)
+	}
+	return fmt.Errorf("request %d failed", m.ID)
+}
+
+func (s *Source) session(ctx context.Context, up func()) error {
+	// stops ping goroutine when session ends
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: s.cfg.Timeout,
+	}
+	ws, _, err := d.DialContext(ctx, s.url, nil)
+	if err != nil {
+		return err
+	}
+	defer ws.Close()
+	// unblocks read
+	stop := context.AfterFunc(ctx, func() { ws.Close() })
+	defer stop()
+	c := &conn{ws: ws}
+	ws.SetReadDeadline(time.Now().Add(s.cfg.Timeout))
+	version, err := s.auth(c)
+	if err != nil {
+		return err
+	}
+	s.updateDevices(c)
+	ws.SetReadDeadline(time.Time{})
+	up()
+	s.l.Infof("connected to home assistant %s", version)
+	subscribeID, err := c.send(message{Type: "subscribe_events", EventType: "state_changed"})
+	if err != nil {
+		return err
+	}
+	statesID, err := c.send(message{Type: "get_states"})
+	if err != nil {
+		return err
+	}
+	// last update of entities that had event in this session, zero for removed ones.
+	// Events can come before get_states result, its older states must not overwrite them
+	changed := map[string]time.Time{}
+	go func() {
+		t := time.NewTicker(s.cfg.KeepAlive)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				c.send(message{Type: "ping"})
+			}
+		}
+	}()
+	for {
+		ws.SetReadDeadline(time.Now().Add(s.cfg.KeepAlive * 3))
+		var m message
+		err := ws.ReadJSON(&m)
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case "result":
+			if !m.Success {
+				return fmt.Errorf("request %d failed: %w", m.ID, resultError(&m))
+			}
+			if m.ID != statesID {
+				continue
+			}
+			var states []entityState
+			err := json.Unmarshal(m.Result, &states)
+			if err != nil {
+				return fmt.Errorf("error decoding states: %w", err)
+			}
+			for i := range states {
+				if t, ok := changed[states[i].EntityID]; ok && (t.IsZero() || !states[i].LastUpdated.After(t)) {
+					continue
+				}
+				s.update(&states[i])
+			}
+		case "event":
+			if m.ID != subscribeID || m.Event == nil || m.Event.EventType != "state_changed" {
+				continue
+			}
+			if m.Event.Data.NewState == nil {
+				changed[m.Event.Data.EntityID] = time.Time{}
+				s.remove(m.Event.Data.EntityID)
+				continue
+			}
+			changed[m.Event.Data.EntityID] = m.Event.Data.NewState.LastUpdated
+			s.update(m.Event.Data.NewState)
+		}
+	}
+}
+
+// auth does the handshake and returns HA version
+func (s *Source) auth(c *conn) (string, error) {
+	var m message
+	err := c.ws.ReadJSON(&m)
+	if err != nil {
+		return "", err
+	}
+	if m.Type != "auth_required" {
+		return "", fmt.Errorf("expected auth_required, got %s", m.Type)
+	}
+	err = c.ws.WriteJSON(message{Type: "auth", AccessToken: s.cfg.Token})
+	if err != nil {
+		return "", err
+	}
+	m = message{}
+	err = c.ws.ReadJSON(&m)
+	if err != nil {
+		return "", err
+	}
+	switch m.Type {
+	case "auth_ok":
+		return m.HAVersion, nil
+	case "auth_invalid":
+		return "", fmt.Errorf("authentication failed: %s", m.Message)
+	default:
+		return "", fmt.Errorf("expected auth_ok, got %s", m.Type)
+	}
+}
+
+// updateDevices maps entities to their HA devices. Registry needs admin token, without it all entities
+// end up under DeviceName
+func (s *Source) updateDevices(c *conn) {
+	var devices []registryDevice
+	var entities []registryEntity
+	err := c.request(message{Type: "config/device_registry/list"}, &devices)
+	if err == nil {
+		err = c.request(message{Type: "config/entity_registry/list"}, &entities)
+	}
+	if err != nil {
+		s.l.Infof("could not read device registry, entities will be under %s device: %s", s.cfg.DeviceName, err)
+		return
+	}
+	byID := make(map[string]registryDevice, len(devices))
+	for _, d := range devices {
+		byID[d.ID] = d
+	}
+	s.devices = make(map[string]registryDevice, len(entities))
+	for _, e := range entities {
+		if d, ok := byID[e.DeviceID]; ok {
+			s.devices[e.EntityID] = d
+		}
+	}
+}
+
+// update registers entity or re-registers it if its attributes changed, then passes its state
+func (s *Source) update(st *entityState) {
+	domain := st.domain()
+	if domain != domainSensor && domain != domainBinarySensor {
+		return
+	}
+	// same as discovery without device class, there is no sensor type for it
+	if len(st.Attributes.DeviceClass) == 0 {
+		return
+	}
+	d := s.discovery(st)
+	if domain == domainBinarySensor {
+		if v, ok := st.value(); ok {
+			m := queue.Metric{
+				Name:   BinarySensorMetric,
+				Labels: map[string]string{"device": d.Dev.Name, "sensor": d.Name, "device_class": st.Attributes.DeviceClass},
+				TS:     time.Now(),
+			}
+			if v == "1" {
+				m.Value = 1
+			}
+			s.reg.Dispatch([]queue.Metric{m})
+		}
+		return
+	}
+	old, ok := s.entities[st.EntityID]
+	if !ok || !sameSensor(old, d) {
+		if ok {
+			s.reg.RemoveSensor(configID(st.EntityID))
+		}
+		s.entities[st.EntityID] = d
+		s.reg.AddSensor(configID(st.EntityID), d)
+	}
+	if v, ok := st.value(); ok {
+		s.reg.State(d.StateTopic, []byte(v))
+	}
+}
+
+func (s *Source) discovery(st *entityState) queue.ESPHomeDiscovery {
+	dev := &queue.ESPHomeDev{ID: s.cfg.DeviceName, Name: s.cfg.DeviceName}
+	if rd, ok := s.devices[st.EntityID]; ok {
+		dev = &queue.ESPHomeDev{
+			ID:              rd.ID,
+			Name:            rd.name(),
+			SoftwareVersion: rd.SWVersion,
+			Model:           rd.Model,
+			Manufacturer:    rd.Manufacturer,
+		}
+	}
+	return queue.ESPHomeDiscovery{
+		DeviceClass: queue.DeviceClass(st.Attributes.DeviceClass),
+		Unit:        st.Attributes.Unit,
+		StateClass:  st.Attributes.StateClass,
+		Name:        st.objectID(),
+		StateTopic:  topicPrefix + st.EntityID + "/state",
+		UniqID:      st.EntityID,
+		Dev:         dev,
+	}
+}
+
+func sameSensor(a, b queue.ESPHomeDiscovery) bool {
+	return a.DeviceClass == b.DeviceClass && a.Unit == b.Unit && a.StateClass == b.StateClass && a.Dev.Name == b.Dev.Name
+}
+
+func configID(entityID string) string {
+	return topicPrefix + entityID + "/config"
+}
+
+func (s *Source) remove(entityID string) {
+	if _, ok := s.entities[entityID]; ok {
+		s.reg.RemoveSensor(configID(entityID))
+		delete(s.entities, entityID)
+	}
+}
@@ -0,0 +1,250 @@
+package homeassistant
+
+import (
+	"encoding/json"
+	"github.com/XANi/esphome2prom/internal/sourcetest"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testToken = "long-lived-token"
+
+func state(entityID, value string, attrs map[string]string) map[string]any {
+	return map[string]any{"entity_id": entityID, "state": value, "attributes": attrs}
+}
+
+// fakeHA answers auth, registry lists and get_states, then sends events put in events
+type fakeHA struct {
+	admin  bool
+	states []map[string]any
+	events chan map[string]any
+}
+
+func (f *fakeHA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/websocket" {
+		http.NotFound(w, r)
+		return
+	}
+	ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer ws.Close()
+	ws.WriteJSON(map[string]any{"type": "auth_required", "ha_version": "2025.10.1"})
+	var auth map[string]any
+	if ws.ReadJSON(&auth) != nil {
+		return
+	}
+	if auth["access_token"] != testToken {
+		ws.WriteJSON(map[string]any{"type": "auth_invalid", "message": "Invalid access token or password"})
+		return
+	}
+	ws.WriteJSON(map[string]any{"type": "auth_ok", "ha_version": "2025.10.1"})
+	var writeLock sync.Mutex
+	write := func(m any) {
+		writeLock.Lock()
+		defer writeLock.Unlock()
+		ws.WriteJSON(m)
+	}
+	for {
+		var req struct {
+			ID   int    `json:"id"`
+			Type string `json:"type"`
+		}
+		if ws.ReadJSON(&req) != nil {
+			return
+		}
+		result := func(v any) { write(map[string]any{"id": req.ID, "type": "result", "success": true, "result": v}) }
+		switch req.Type {
+		case "config/device_registry/list", "config/entity_registry/list":
+			if !f.admin {
+				write(map[string]any{"id": req.ID, "type": "result", "success": false, "error": map[string]any{"code": "unauthorized", "message": "Unauthorized"}})
+				continue
+			}
+			if req.Type == "config/device_registry/list" {
+				result([]map[string]any{{"id": "dev1", "name": "Zigbee sensor", "name_by_user": "Bedroom", "manufacturer": "Aqara"}})
+			} else {
+				result([]map[string]any{{"entity_id": "sensor.bedroom_temperature", "device_id": "dev1"}})
+			}
+		case "subscribe_events":
+			result(nil)
+			id := req.ID
+			go func() {
+				for ev := range f.events {
+					write(map[string]any{"id": id, "type": "event", "event": ev})
+				}
+			}()
+		case "get_states":
+			result(f.states)
+		case "ping":
+			write(map[string]any{"id": req.ID, "type": "pong"})
+		}
+	}
+}
+
+func stateChanged(entityID string, newState any) map[string]any {
+	return map[string]any{"event_type": "state_changed", "data": map[string]any{"entity_id": entityID, "new_state": newState}}
+}
+
+func TestSource(t *testing.T) {
+	f := &fakeHA{
+		admin: true,
+		states: []map[string]any{
+			state("sensor.bedroom_temperature", "21.5", map[string]string{"device_class": "temperature", "unit_of_measurement": "°C", "state_class": "measurement"}),
+			state("sensor.outside_humidity", "unavailable", map[string]string{"device_class": "humidity", "unit_of_measurement": "%"}),
+			state("binary_sensor.door", "on", map[string]string{"device_class": "door"}),
+			state("binary_sensor.remote_battery", "on", map[string]string{"device_class": "battery"}),
+			state("sensor.no_class", "5", map[string]string{}),
+			state("light.kitchen", "on", map[string]string{}),
+		},
+		events: make(chan map[string]any, 16),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{URL: srv.URL, Token: testToken, Logger: zaptest.NewLogger(t).Sugar()}, reg)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(reg.States("hass/sensor.bedroom_temperature/state")) == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	d, ok := reg.Sensor("hass/sensor.bedroom_temperature/config")
+	require.True(t, ok)
+	assert.Equal(t, queue.DeviceClassTemperature, d.DeviceClass)
+	assert.Equal(t, "°C", d.Unit)
+	assert.Equal(t, "measurement", d.StateClass)
+	assert.Equal(t, "bedroom_temperature", d.Name)
+	assert.Equal(t, "Bedroom", d.Dev.Name)
+	assert.Equal(t, "Aqara", d.Dev.Manufacturer)
+	// not in device registry
+	d, ok = reg.Sensor("hass/sensor.outside_humidity/config")
+	require.True(t, ok)
+	assert.Equal(t, "homeassistant", d.Dev.Name)
+	assert.Empty(t, reg.States("hass/sensor.outside_humidity/state"))
+	assert.Equal(t, []float64{1}, binaryStates(reg, "door"))
+	// low battery, not battery level
+	_, ok = reg.Sensor("hass/binary_sensor.remote_battery/config")
+	assert.False(t, ok)
+	assert.Equal(t, []float64{1}, binaryStates(reg, "remote_battery"))
+	for _, m := range reg.Metrics() {
+		if m.Labels["sensor"] == "remote_battery" {
+			assert.Equal(t, map[string]string{"device": "homeassistant", "sensor": "remote_battery", "device_class": "battery"}, m.Labels)
+		}
+	}
+	_, ok = reg.Sensor("hass/sensor.no_class/config")
+	assert.False(t, ok)
+	_, ok = reg.Sensor("hass/light.kitchen/config")
+	assert.False(t, ok)
+
+	f.events <- stateChanged("sensor.outside_humidity", state("sensor.outside_humidity", "55", map[string]string{"device_class": "humidity", "unit_of_measurement": "%"}))
+	f.events <- stateChanged("binary_sensor.door", state("binary_sensor.door", "off", map[string]string{"device_class": "door"}))
+	f.events <- stateChanged("sensor.bedroom_temperature", nil)
+	require.Eventually(t, func() bool {
+		_, ok := reg.Sensor("hass/sensor.bedroom_temperature/config")
+		return !ok
+	}, time.Second*5, time.Millisecond*10)
+	assert.Equal(t, []string{"55"}, reg.States("hass/sensor.outside_humidity/state"))
+	assert.Equal(t, []float64{1, 0}, binaryStates(reg, "door"))
+
+	s.Close()
+	assert.Len(t, reg.Sensors(), 1)
+}
+
+// binaryStates returns values of BinarySensorMetric of sensor
+func binaryStates(reg *sourcetest.Registry, sensor string) (values []float64) {
+	for _, m := range reg.Metrics() {
+		if m.Name == BinarySensorMetric && m.Labels["sensor"] == sensor {
+			values = append(values, m.Value)
+		}
+	}
+	return values
+}
+
+func TestSourceEventBeforeStates(t *testing.T) {
+	attrs := map[string]string{"device_class": "temperature", "unit_of_measurement": "°C"}
+	older := state("sensor.bedroom_temperature", "21.5", attrs)
+	older["last_updated"] = "2025-10-01T10:00:00+00:00"
+	newer := state("sensor.bedroom_temperature", "22", attrs)
+	newer["last_updated"] = "2025-10-01T10:00:05+00:00"
+	f := &fakeHA{
+		states: []map[string]any{older, state("binary_sensor.door", "on", map[string]string{"device_class": "door"})},
+		events: make(chan map[string]any, 1),
+	}
+	// sent right after subscribing, so it usually comes before get_states result
+	f.events <- stateChanged("sensor.bedroom_temperature", newer)
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{URL: srv.URL, Token: testToken, Logger: zaptest.NewLogger(t).Sugar()}, reg)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Eventually(t, func() bool {
+		return len(binaryStates(reg, "door")) == 1 && slices.Contains(reg.States("hass/sensor.bedroom_temperature/state"), "22")
+	}, time.Second*5, time.Millisecond*10)
+	states := reg.States("hass/sensor.bedroom_temperature/state")
+	assert.Equal(t, "22", states[len(states)-1])
+}
+
+func TestSourceWithoutRegistryAccess(t *testing.T) {
+	f := &fakeHA{
+		states: []map[string]any{
+			state("sensor.bedroom_temperature", "21.5", map[string]string{"device_class": "temperature", "unit_of_measurement": "°C"}),
+		},
+		events: make(chan map[string]any),
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{URL: srv.URL + "/", Token: testToken, DeviceName: "ha", Logger: zaptest.NewLogger(t).Sugar()}, reg)
+	require.NoError(t, err)
+	defer s.Close()
+	require.Eventually(t, func() bool {
+		return len(reg.States("hass/sensor.bedroom_temperature/state")) == 1
+	}, time.Second*5, time.Millisecond*10)
+	d, _ := reg.Sensor("hass/sensor.bedroom_temperature/config")
+	assert.Equal(t, "ha", d.Dev.Name)
+}
+
+func TestSourceAuthFailure(t *testing.T) {
+	srv := httptest.NewServer(&fakeHA{})
+	t.Cleanup(srv.Close)
+	u, err := wsURL(srv.URL)
+	require.NoError(t, err)
+	s := &Source{cfg: Config{Token: "wrong", Timeout: time.Second}, url: u, l: zaptest.NewLogger(t).Sugar()}
+	err = s.session(t.Context(), func() { t.Error("should not be up") })
+	assert.ErrorContains(t, err, "authentication failed: Invalid access token")
+}
+
+func TestWSURL(t *testing.T) {
+	for in, out := range map[string]string{
+		"http://ha:8123":                     "ws://ha:8123/api/websocket",
+		"https://ha.example.com/":            "wss://ha.example.com/api/websocket",
+		"wss://ha.example.com/api/websocket": "wss://ha.example.com/api/websocket",
+	} {
+		u, err := wsURL(in)
+		require.NoError(t, err)
+		assert.Equal(t, out, u)
+	}
+	_, err := wsURL("ftp://ha")
+	assert.Error(t, err)
+}
+
+func TestEntityValue(t *testing.T) {
+	var st entityState
+	require.NoError(t, json.Unmarshal([]byte(`{"entity_id":"binary_sensor.motion","state":"unknown"}`), &st))
+	_, ok := st.value()
+	assert.False(t, ok)
+	st.State = "off"
+	v, ok := st.value()
+	assert.True(t, ok)
+	assert.Equal(t, "0", v)
+}
@@ -0,0 +1,161 @@
+// Package sourcetest has fakes shared by tests of ingestion sources
+package sourcetest
+
+import (
+	"context"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"maps"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Registry stands in for queue.Queue, it records sensors, states and metrics source passes to it
+type Registry struct {
+	sensors  map[string]queue.ESPHomeDiscovery
+	states   map[string][]string
+	metrics  []queue.Metric
+	handlers map[string]queue.MessageHandler
+	sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		sensors:  map[string]queue.ESPHomeDiscovery{},
+		states:   map[string][]string{},
+		handlers: map[string]queue.MessageHandler{},
+	}
+}
+
+func (r *Registry) AddSensor(id string, d queue.ESPHomeDiscovery) {
+	r.Lock()
+	defer r.Unlock()
+	r.sensors[id] = d
+}
+
+func (r *Registry) RemoveSensor(id string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.sensors, id)
+}
+
+func (r *Registry) State(stateTopic string, payload []byte) {
+	r.Lock()
+	defer r.Unlock()
+	r.states[stateTopic] = append(r.states[stateTopic], string(payload))
+}
+
+func (r *Registry) Dispatch(metrics []queue.Metric) {
+	r.Lock()
+	defer r.Unlock()
+	r.metrics = append(r.metrics, metrics...)
+}
+
+func (r *Registry) Subscribe(filter string, handler queue.MessageHandler) error {
+	r.Lock()
+	defer r.Unlock()
+	r.handlers[filter] = handler
+	return nil
+}
+
+// Sensors returns copy of registered sensors by ID
+func (r *Registry) Sensors() map[string]queue.ESPHomeDiscovery {
+	r.Lock()
+	defer r.Unlock()
+	return maps.Clone(r.sensors)
+}
+
+func (r *Registry) Sensor(id string) (queue.ESPHomeDiscovery, bool) {
+	r.Lock()
+	defer r.Unlock()
+	d, ok := r.sensors[id]
+	return d, ok
+}
+
+// States returns every state passed for topic, oldest first
+func (r *Registry) States(topic string) []string {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Clone(r.states[topic])
+}
+
+// LastState returns latest state of topic, empty if there was none
+func (r *Registry) LastState(topic string) string {
+	r.Lock()
+	defer r.Unlock()
+	states := r.states[topic]
+	if len(states) == 0 {
+		return ""
+	}
+	return states[len(states)-1]
+}
+
+// StateTopics returns topics that got any state, sorted
+func (r *Registry) StateTopics() []string {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Sorted(maps.Keys(r.states))
+}
+
+func (r *Registry) Metrics() []queue.Metric {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Clone(r.metrics)
+}
+
+// Filters returns filters source subscribed to, sorted
+func (r *Registry) Filters() []string {
+	r.Lock()
+	defer r.Unlock()
+	return slices.Sorted(maps.Keys(r.handlers))
+}
+
+// Handler returns handler subscribed to filter, nil if there is none
+func (r *Registry) Handler(filter string) queue.MessageHandler {
+	r.Lock()
+	defer r.Unlock()
+	return r.handlers[filter]
+}
+
+// Sink is queue sink keeping every metric written to it
+type Sink struct {
+	metrics []queue.Metric
+	sync.Mutex
+}
+
+func (s *Sink) Write(ctx context.Context, metrics []queue.Metric) error {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+	return nil
+}
+
+func (s *Sink) Close() {}
+
+func (s *Sink) Metrics() []queue.Metric {
+	s.Lock()
+	defer s.Unlock()
+	return slices.Clone(s.metrics)
+}
+
+// WaitFor waits until sink has n metrics and returns them
+func (s *Sink) WaitFor(t *testing.T, n int) []queue.Metric {
+	require.Eventually(t, func() bool { return len(s.Metrics()) == n }, time.Second*5, time.Millisecond*10)
+	return s.Metrics()
+}
+
+// NewQueue starts queue writing to Sink, reading from embedded broker b if it isn't nil. It is closed when test ends
+func NewQueue(t *testing.T, b queue.InProcessBroker) (*queue.Queue, *Sink) {
+	sink := &Sink{}
+	q, err := queue.New(&queue.Config{
+		Broker: b,
+		Logger: zaptest.NewLogger(t).Sugar(),
+		Sinks:  []queue.SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(q.Close)
+	return q, sink
+}
@@ -0,0 +1,188 @@
+// Package telemetry turns readings of devices that publish their own telemetry over MQTT (Tasmota, Shelly) into sensors
+package telemetry
+
+import (
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type FieldType struct {
+	Class      queue.DeviceClass
+	Unit       string
+	StateClass string
+}
+
+// Reading is single value from telemetry message
+type Reading struct {
+	// Name is sensor name, "AM2301 Temperature"
+	Name string
+	// ID is name usable in topic, "AM2301-Temperature"
+	ID    string
+	Type  FieldType
+	Value float64
+}
+
+// Registry gets sensors, their states and metrics that aren't sensors, implemented by queue.Queue
+type Registry interface {
+	queue.SensorRegistry
+	Dispatch(metrics []queue.Metric)
+}
+
+// Devices keeps availability and sensors of every device of one source
+type Devices struct {
+	source       string
+	manufacturer string
+	reg          Registry
+	l            *zap.SugaredLogger
+	// onlineDevices is number of devices that are online
+	onlineDevices mon.Metric
+	// devices by name
+	devices map[string]*device
+	closed  bool
+	sync.Mutex
+}
+
+type device struct {
+	online bool
+	// onlineGauge is 1 while device is online
+	onlineGauge mon.Metric
+	// sensors by config ID
+	sensors map[string]queue.ESPHomeDiscovery
+}
+
+// NewDevices registers sensors of source under <source>/<device>/sensor/<reading ID>. Number of online devices
+// is in esphome2prom_<source>_devices and state of each in esphome2prom_<source>_online
+func NewDevices(source, manufacturer string, reg Registry, l *zap.SugaredLogger) *Devices {
+	return &Devices{
+		source:        source,
+		manufacturer:  manufacturer,
+		reg:           reg,
+		l:             l,
+		onlineDevices: metric("esphome2prom_"+source+"_devices", mon.NewGauge()),
+		devices:       map[string]*device{},
+	}
+}
+
+func metric(name string, m mon.Metric, tags ...map[string]string) mon.Metric {
+	m, err := mon.GlobalRegistry.RegisterOrGet(name, m, tags...)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// SetOnline follows availability, sensors of device going offline are removed until it sends telemetry again
+func (d *Devices) SetOnline(name string, online bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.closed {
+		return
+	}
+	dev := d.device(name)
+	if dev.online != online {
+		if online {
+			d.l.Infof("%s online", name)
+		} else {
+			d.l.Infof("%s offline", name)
+		}
+	}
+	dev.online = online
+	if !online {
+		for id := range dev.sensors {
+			d.reg.RemoveSensor(id)
+		}
+		clear(dev.sensors)
+	}
+	d.updateOnline()
+}
+
+// Update registers sensors of readings, again if their unit changed, and passes their states.
+// Metrics are dispatched as they are
+func (d *Devices) Update(name string, readings []Reading, metrics []queue.Metric) {
+	type state struct {
+		topic string
+		value string
+	}
+	states := make([]state, 0, len(readings))
+	d.Lock()
+	if d.closed {
+		d.Unlock()
+		return
+	}
+	dev := d.device(name)
+	// telemetry without availability message seen, e.g. retained one was cleared
+	if !dev.online {
+		dev.online = true
+		d.updateOnline()
+	}
+	for _, r := range readings {
+		prefix := d.source + "/" + name + "/sensor/" + r.ID
+		disc := queue.ESPHomeDiscovery{
+			DeviceClass: r.Type.Class,
+			Unit:        r.Type.Unit,
+			StateClass:  r.Type.StateClass,
+			Name:        r.Name,
+			StateTopic:  prefix + "/state",
+			UniqID:      name + "-" + r.ID,
+			Dev:         &queue.ESPHomeDev{ID: name, Name: name, Manufacturer: d.manufacturer},
+		}
+		id := prefix + "/config"
+		if old, ok := dev.sensors[id]; !ok || old.Unit != disc.Unit {
+			d.reg.AddSensor(id, disc)
+			dev.sensors[id] = disc
+		}
+		states = append(states, state{topic: disc.StateTopic, value: strconv.FormatFloat(r.Value, 'f', -1, 64)})
+	}
+	d.Unlock()
+	for _, st := range states {
+		d.reg.State(st.topic, []byte(st.value))
+	}
+	if len(metrics) > 0 {
+		d.reg.Dispatch(metrics)
+	}
+}
+
+func (d *Devices) device(name string) *device {
+	dev, ok := d.devices[name]
+	if !ok {
+		dev = &device{
+			onlineGauge: metric("esphome2prom_"+d.source+"_online", mon.NewGauge(), map[string]string{"device": name}),
+			sensors:     map[string]queue.ESPHomeDiscovery{},
+		}
+		d.devices[name] = dev
+	}
+	return dev
+}
+
+func (d *Devices) updateOnline() {
+	online := 0
+	for _, dev := range d.devices {
+		if dev.online {
+			online++
+			dev.onlineGauge.Update(1)
+		} else {
+			dev.onlineGauge.Update(0)
+		}
+	}
+	d.onlineDevices.Update(float64(online))
+}
+
+// Close ignores everything from now on, sensors are not removed as devices didn't go anywhere
+func (d *Devices) Close() {
+	d.Lock()
+	defer d.Unlock()
+	d.closed = true
+}
+
+func SortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
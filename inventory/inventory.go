@@ -0,0 +1,380 @@
+// Package inventory keeps track of every device bridge has seen, when it was seen and how it changed
+package inventory
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/mdns"
+	"github.com/XANi/esphome2prom/queue"
+	"go.uber.org/zap"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LastSeenMetric  = "esphome_device_last_seen_timestamp_seconds"
+	FirstSeenMetric = "esphome_device_first_seen_timestamp_seconds"
+)
+
+// event kinds
+const (
+	EventFirstSeen     = "first_seen"
+	EventRenamed       = "renamed"
+	EventFirmware      = "firmware"
+	EventModel         = "model"
+	EventManufacturer  = "manufacturer"
+	EventAddress       = "address"
+	EventMAC           = "mac"
+	EventSensorAdded   = "sensor_added"
+	EventSensorRemoved = "sensor_removed"
+)
+
+type Device struct {
+	Name string `json:"name"`
+	// ID is device identifier from discovery, used to detect renames
+	ID           string    `json:"id"`
+	Address      string    `json:"address"`
+	MAC          string    `json:"mac"`
+	Version      string    `json:"version"`
+	Model        string    `json:"model"`
+	Manufacturer string    `json:"manufacturer"`
+	FirstSeen    time.Time `json:"first_seen"`
+	// LastSeen is time of last state message or mDNS announcement, zero if there was none yet
+	LastSeen time.Time `json:"last_seen"`
+	Sensors  []string  `json:"sensors"`
+}
+
+// Event is single change in device's history
+type Event struct {
+	Device string    `json:"device"`
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Old    string    `json:"old,omitempty"`
+	New    string    `json:"new,omitempty"`
+}
+
+// Store persists inventory, implemented by db.DB
+type Store interface {
+	Devices() ([]Device, error)
+	SaveDevice(d Device) error
+	// RenameDevice moves history of old device to new one and removes old one
+	RenameDevice(old, new string) error
+	AddEvent(e Event) error
+	// History returns newest events of device first
+	History(device string, limit int) ([]Event, error)
+}
+
+// MetricSink gets last/first seen metrics, implemented by queue.Queue
+type MetricSink interface {
+	Dispatch(metrics []queue.Metric)
+}
+
+type Config struct {
+	// Interval of saving last seen time and sending metrics
+	Interval time.Duration      `yaml:"interval"`
+	Logger   *zap.SugaredLogger `yaml:"-"`
+}
+
+// Inventory follows devices through queue (sensors and state messages) and mDNS
+type Inventory struct {
+	cfg     Config
+	store   Store
+	l       *zap.SugaredLogger
+	devices map[string]*Device
+	// devices with last seen not saved yet
+	dirty map[string]bool
+	// sensors added since start by device, restored devices have none until their source adds them
+	live map[string]map[string]bool
+	stop chan struct{}
+	done chan struct{}
+	sync.Mutex
+}
+
+func New(cfg Config, store Store) (*Inventory, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	devices, err := store.Devices()
+	if err != nil {
+		return nil, fmt.Errorf("error loading inventory: %w", err)
+	}
+	inv := &Inventory{
+		cfg:     cfg,
+		store:   store,
+		l:       cfg.Logger,
+		devices: map[string]*Device{},
+		dirty:   map[string]bool{},
+		live:    map[string]map[string]bool{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, d := range devices {
+		inv.devices[d.Name] = &d
+	}
+	inv.l.Infof("loaded %d devices", len(devices))
+	return inv, nil
+}
+
+// Start begins saving last seen times and sending metrics through sink
+func (i *Inventory) Start(metrics MetricSink) {
+	go func() {
+		defer close(i.done)
+		t := time.NewTicker(i.cfg.Interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				i.flush()
+				metrics.Dispatch(i.metrics(time.Now()))
+			case <-i.stop:
+				i.flush()
+				return
+			}
+		}
+	}()
+}
+
+// SensorAdded registers device of sensor and records what changed in it
+func (i *Inventory) SensorAdded(d queue.ESPHomeDiscovery) {
+	i.Lock()
+	defer i.Unlock()
+	if d.Dev == nil {
+		return
+	}
+	now := time.Now()
+	dev := i.device(d.Dev, now)
+	if i.live[dev.Name] == nil {
+		i.live[dev.Name] = map[string]bool{}
+	}
+	i.live[dev.Name][d.Name] = true
+	var events []Event
+	change := func(kind string, field *string, value string) {
+		if len(value) == 0 || *field == value {
+			return
+		}
+		if len(*field) > 0 {
+			events = append(events, Event{Device: dev.Name, Time: now, Kind: kind, Old: *field, New: value})
+		}
+		*field = value
+	}
+	changed := false
+	if len(dev.ID) == 0 && len(d.Dev.ID) > 0 {
+		dev.ID = d.Dev.ID
+		changed = true
+	}
+	change(EventFirmware, &dev.Version, d.Dev.SoftwareVersion)
+	change(EventModel, &dev.Model, d.Dev.Model)
+	change(EventManufacturer, &dev.Manufacturer, d.Dev.Manufacturer)
+	for _, c := range d.Dev.Cns {
+		if len(c) != 2 {
+			continue
+		}
+		switch c[0] {
+		case "mac":
+			change(EventMAC, &dev.MAC, normalizeMAC(c[1]))
+		case "ip":
+			change(EventAddress, &dev.Address, c[1])
+		}
+	}
+	if !slices.Contains(dev.Sensors, d.Name) {
+		dev.Sensors = append(dev.Sensors, d.Name)
+		slices.Sort(dev.Sensors)
+		events = append(events, Event{Device: dev.Name, Time: now, Kind: EventSensorAdded, New: d.Name})
+	}
+	i.save(dev, changed || len(events) > 0, events)
+}
+
+// SensorRemoved records removal of sensor
+func (i *Inventory) SensorRemoved(d queue.ESPHomeDiscovery) {
+	i.Lock()
+	defer i.Unlock()
+	if d.Dev == nil {
+		return
+	}
+	dev, ok := i.devices[d.Dev.Name]
+	if !ok {
+		return
+	}
+	delete(i.live[dev.Name], d.Name)
+	idx := slices.Index(dev.Sensors, d.Name)
+	if idx < 0 {
+		return
+	}
+	dev.Sensors = slices.Delete(dev.Sensors, idx, idx+1)
+	i.save(dev, true, []Event{{Device: dev.Name, Time: time.Now(), Kind: EventSensorRemoved, Old: d.Name}})
+}
+
+// DeviceSeen updates last seen time, called on every state message so it is saved only every interval
+func (i *Inventory) DeviceSeen(device string) {
+	i.Lock()
+	defer i.Unlock()
+	if dev, ok := i.devices[device]; ok {
+		dev.LastSeen = time.Now()
+		i.dirty[device] = true
+	}
+}
+
+// DeviceUp takes address and MAC of device announced over mDNS
+func (i *Inventory) DeviceUp(md mdns.Device) {
+	i.Lock()
+	defer i.Unlock()
+	dev, ok := i.devices[md.Name]
+	if !ok {
+		return
+	}
+	now := time.Now()
+	var events []Event
+	if len(md.Address) > 0 && md.Address != dev.Address {
+		if len(dev.Address) > 0 {
+			events = append(events, Event{Device: dev.Name, Time: now, Kind: EventAddress, Old: dev.Address, New: md.Address})
+		}
+		dev.Address = md.Address
+	}
+	if mac := normalizeMAC(md.MAC); len(mac) > 0 && mac != dev.MAC {
+		if len(dev.MAC) > 0 {
+			events = append(events, Event{Device: dev.Name, Time: now, Kind: EventMAC, Old: dev.MAC, New: mac})
+		}
+		dev.MAC = mac
+	}
+	dev.LastSeen = now
+	i.save(dev, true, events)
+}
+
+func (i *Inventory) DeviceDown(md mdns.Device) {}
+
+// device returns inventory entry of discovered device, following renames and creating new one if needed.
+// Device with the same ID is renamed only if nothing added its sensors since start, otherwise old name is
+// still announced (e.g. stale retained discovery) and renaming would flip between the two on every start
+func (i *Inventory) device(d *queue.ESPHomeDev, now time.Time) *Device {
+	if dev, ok := i.devices[d.Name]; ok {
+		return dev
+	}
+	if len(d.ID) > 0 {
+		for name, dev := range i.devices {
+			if dev.ID != d.ID || len(i.live[name]) > 0 {
+				continue
+			}
+			i.l.Infof("device %s renamed to %s", name, d.Name)
+			delete(i.devices, name)
+			delete(i.dirty, name)
+			dev.Name = d.Name
+			i.devices[d.Name] = dev
+			i.saveDevice(dev)
+			err := i.store.RenameDevice(name, d.Name)
+			if err != nil {
+				i.l.Errorf("error renaming %s: %s", name, err)
+			}
+			i.addEvent(Event{Device: d.Name, Time: now, Kind: EventRenamed, Old: name, New: d.Name})
+			return dev
+		}
+	}
+	dev := &Device{Name: d.Name, ID: d.ID, FirstSeen: now}
+	i.devices[d.Name] = dev
+	i.addEvent(Event{Device: d.Name, Time: now, Kind: EventFirstSeen})
+	i.saveDevice(dev)
+	return dev
+}
+
+func (i *Inventory) save(dev *Device, changed bool, events []Event) {
+	for _, e := range events {
+		i.addEvent(e)
+	}
+	if changed {
+		i.saveDevice(dev)
+	}
+}
+
+func (i *Inventory) saveDevice(dev *Device) {
+	err := i.store.SaveDevice(*dev)
+	if err != nil {
+		i.l.Errorf("error saving device %s: %s", dev.Name, err)
+		return
+	}
+	delete(i.dirty, dev.Name)
+}
+
+func (i *Inventory) addEvent(e Event) {
+	if e.Kind != EventSensorAdded && e.Kind != EventSensorRemoved {
+		i.l.Infof("%s: %s %s -> %s", e.Device, e.Kind, e.Old, e.New)
+	}
+	err := i.store.AddEvent(e)
+	if err != nil {
+		i.l.Errorf("error saving %s event of %s: %s", e.Kind, e.Device, err)
+	}
+}
+
+// flush saves last seen times updated since last flush
+func (i *Inventory) flush() {
+	i.Lock()
+	defer i.Unlock()
+	for name := range i.dirty {
+		if dev, ok := i.devices[name]; ok {
+			i.saveDevice(dev)
+		}
+	}
+	clear(i.dirty)
+}
+
+func (i *Inventory) metrics(now time.Time) []queue.Metric {
+	i.Lock()
+	defer i.Unlock()
+	metrics := make([]queue.Metric, 0, len(i.devices)*2)
+	for name, dev := range i.devices {
+		labels := map[string]string{"device": name}
+		metrics = append(metrics, queue.Metric{Name: FirstSeenMetric, Labels: labels, Value: float64(dev.FirstSeen.Unix()), TS: now})
+		if !dev.LastSeen.IsZero() {
+			metrics = append(metrics, queue.Metric{Name: LastSeenMetric, Labels: labels, Value: float64(dev.LastSeen.Unix()), TS: now})
+		}
+	}
+	return metrics
+}
+
+// Devices returns copy of all devices, sorted by name
+func (i *Inventory) Devices() []Device {
+	i.Lock()
+	defer i.Unlock()
+	out := make([]Device, 0, len(i.devices))
+	for _, dev := range i.devices {
+		d := *dev
+		d.Sensors = slices.Clone(dev.Sensors)
+		out = append(out, d)
+	}
+	slices.SortFunc(out, func(a, b Device) int { return strings.Compare(a.Name, b.Name) })
+	return out
+}
+
+// History returns newest events of device first
+func (i *Inventory) History(device string, limit int) ([]Event, error) {
+	return i.store.History(device, limit)
+}
+
+// Close stops background loop and saves last seen times
+func (i *Inventory) Close() {
+	select {
+	case <-i.stop:
+		return
+	default:
+	}
+	close(i.stop)
+	select {
+	case <-i.done:
+	case <-time.After(time.Second * 5):
+	}
+}
+
+// normalizeMAC returns aa:bb:cc:dd:ee:ff for any common MAC notation
+func normalizeMAC(mac string) string {
+	hex := strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+	if len(hex) != 12 {
+		return strings.ToLower(mac)
+	}
+	parts := make([]string, 0, 6)
+	for j := 0; j < 12; j += 2 {
+		parts = append(parts, hex[j:j+2])
+	}
+	return strings.Join(parts, ":")
+}
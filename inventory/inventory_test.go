@@ -0,0 +1,172 @@
+package inventory
+
+import (
+	"github.com/XANi/esphome2prom/mdns"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStore struct {
+	devices map[string]Device
+	events  []Event
+	sync.Mutex
+}
+
+func newMemStore() *memStore {
+	return &memStore{devices: map[string]Device{}}
+}
+
+func (m *memStore) Devices() ([]Device, error) {
+	m.Lock()
+	defer m.Unlock()
+	out := []Device{}
+	for _, d := range m.devices {
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func (m *memStore) SaveDevice(d Device) error {
+	m.Lock()
+	defer m.Unlock()
+	m.devices[d.Name] = d
+	return nil
+}
+
+func (m *memStore) RenameDevice(old, new string) error {
+	m.Lock()
+	defer m.Unlock()
+	for i := range m.events {
+		if m.events[i].Device == old {
+			m.events[i].Device = new
+		}
+	}
+	delete(m.devices, old)
+	return nil
+}
+
+func (m *memStore) AddEvent(e Event) error {
+	m.Lock()
+	defer m.Unlock()
+	m.events = append(m.events, e)
+	return nil
+}
+
+func (m *memStore) History(device string, limit int) ([]Event, error) {
+	m.Lock()
+	defer m.Unlock()
+	var out []Event
+	for _, e := range slices.Backward(m.events) {
+		if e.Device == device && (limit <= 0 || len(out) < limit) {
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (m *memStore) kinds(device string) []string {
+	history, _ := m.History(device, 0)
+	var kinds []string
+	for _, e := range slices.Backward(history) {
+		kinds = append(kinds, e.Kind)
+	}
+	return kinds
+}
+
+type testSink struct {
+	metrics []queue.Metric
+	sync.Mutex
+}
+
+func (s *testSink) Dispatch(metrics []queue.Metric) {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+}
+
+func (s *testSink) byName() map[string]queue.Metric {
+	s.Lock()
+	defer s.Unlock()
+	m := map[string]queue.Metric{}
+	for _, metric := range s.metrics {
+		m[metric.Name+"/"+metric.Labels["device"]] = metric
+	}
+	return m
+}
+
+func sensor(dev queue.ESPHomeDev, name string) queue.ESPHomeDiscovery {
+	return queue.ESPHomeDiscovery{DeviceClass: queue.DeviceClassTemperature, Name: name, Dev: &dev}
+}
+
+func TestInventory(t *testing.T) {
+	store := newMemStore()
+	inv, err := New(Config{Logger: zaptest.NewLogger(t).Sugar(), Interval: time.Millisecond * 10}, store)
+	require.NoError(t, err)
+	sink := &testSink{}
+	inv.Start(sink)
+
+	dev := queue.ESPHomeDev{ID: "aabbccddeeff", Name: "garage", SoftwareVersion: "2025.10.0", Model: "esp32dev", Cns: [][]string{{"mac", "AA:BB:CC:DD:EE:FF"}}}
+	inv.SensorAdded(sensor(dev, "t1"))
+	inv.SensorAdded(sensor(dev, "t1"))
+	inv.SensorAdded(sensor(dev, "h1"))
+	dev.SoftwareVersion = "2025.11.0"
+	inv.SensorAdded(sensor(dev, "t1"))
+	inv.SensorRemoved(sensor(dev, "h1"))
+	inv.DeviceUp(mdns.Device{Name: "garage", Address: "10.0.0.5", MAC: "aabbccddeeff"})
+	inv.DeviceSeen("garage")
+	inv.DeviceSeen("unknown")
+	assert.Equal(t, []string{EventFirstSeen, EventSensorAdded, EventSensorAdded, EventFirmware, EventSensorRemoved}, store.kinds("garage"))
+
+	devices := inv.Devices()
+	require.Len(t, devices, 1)
+	assert.Equal(t, "2025.11.0", devices[0].Version)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", devices[0].MAC)
+	assert.Equal(t, "10.0.0.5", devices[0].Address)
+	assert.Equal(t, []string{"t1"}, devices[0].Sensors)
+	require.Eventually(t, func() bool {
+		_, ok := sink.byName()[LastSeenMetric+"/garage"]
+		return ok
+	}, time.Second*5, time.Millisecond*10)
+	assert.InDelta(t, float64(time.Now().Unix()), sink.byName()[LastSeenMetric+"/garage"].Value, 5)
+
+	inv.Close()
+	assert.False(t, store.devices["garage"].LastSeen.IsZero())
+
+	// restored on start, same ID under new name is rename and history follows
+	inv, err = New(Config{Logger: zaptest.NewLogger(t).Sugar()}, store)
+	require.NoError(t, err)
+	dev.Name = "shed"
+	inv.SensorAdded(sensor(dev, "t1"))
+	devices = inv.Devices()
+	require.Len(t, devices, 1)
+	assert.Equal(t, "shed", devices[0].Name)
+	assert.Equal(t, []string{EventFirstSeen, EventSensorAdded, EventSensorAdded, EventFirmware, EventSensorRemoved, EventRenamed}, store.kinds("shed"))
+
+	// old name that is still announced is another device, not a rename back
+	old := dev
+	old.Name = "garage"
+	inv.SensorAdded(sensor(old, "t1"))
+	devices = inv.Devices()
+	require.Len(t, devices, 2)
+	assert.Equal(t, []string{EventFirstSeen, EventSensorAdded}, store.kinds("garage"))
+	assert.Len(t, store.kinds("shed"), 6)
+}
+
+func TestNormalizeMAC(t *testing.T) {
+	for in, out := range map[string]string{
+		"aabbccddeeff":      "aa:bb:cc:dd:ee:ff",
+		"AA-BB-CC-DD-EE-FF": "aa:bb:cc:dd:ee:ff",
+		"aa:bb:cc:dd:ee:ff": "aa:bb:cc:dd:ee:ff",
+		"aabb.ccdd.eeff":    "aa:bb:cc:dd:ee:ff",
+		"AABBCC":            "aabbcc",
+		"":                  "",
+	} {
+		assert.Equal(t, out, normalizeMAC(in), in)
+	}
+}
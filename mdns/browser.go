@@ -0,0 +1,441 @@
+// Package mdns finds ESPHome nodes by browsing _esphomelib._tcp service over multicast DNS,
+// so native API ingestion and availability tracking don't need hand maintained address lists
+package mdns
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/ipv4"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	serviceName = "_esphomelib._tcp.local."
+	// resolveInterval limits follow-up queries for instances that announced without SRV or address
+	resolveInterval = time.Second
+	// InfoMetric has device's TXT metadata as labels
+	InfoMetric = "esphome_mdns_device_info"
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+var devicesGauge = mon.GlobalRegistry.MustRegister("esphome2prom_mdns_devices", mon.NewGauge())
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Interfaces to browse on, all multicast capable ones if empty
+	Interfaces []string `yaml:"interfaces"`
+	// Interval between queries, device info metrics are sent at the same rate
+	Interval time.Duration `yaml:"interval"`
+	// Timeout after which device that stopped answering is considered gone, defaults to 3 intervals
+	Timeout time.Duration      `yaml:"timeout"`
+	Logger  *zap.SugaredLogger `yaml:"-"`
+}
+
+// Listener is told about devices appearing, changing address or metadata, and going away
+type Listener interface {
+	DeviceUp(d Device)
+	DeviceDown(d Device)
+}
+
+// MetricSink gets device info metrics, implemented by queue.Queue
+type MetricSink interface {
+	Dispatch(metrics []queue.Metric)
+}
+
+type Browser struct {
+	cfg       Config
+	l         *zap.SugaredLogger
+	conn      *ipv4.PacketConn
+	ifaces    map[int]string
+	metrics   MetricSink
+	listeners []Listener
+	// service instances by lowercase instance name
+	entries map[string]*entry
+	// IPv4 address by host name
+	hosts       map[string]hostAddr
+	lastResolve time.Time
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	sync.Mutex
+}
+
+type hostAddr struct {
+	ip      string
+	expires time.Time
+}
+
+type event struct {
+	up  bool
+	dev Device
+}
+
+func New(cfg Config, metrics MetricSink, listeners ...Listener) (*Browser, error) {
+	b := newBrowser(cfg, metrics, listeners)
+	ifaces, err := interfaces(cfg.Interfaces)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.ListenMulticastUDP("udp4", &ifaces[0], mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("error listening on mDNS port: %w", err)
+	}
+	b.conn = ipv4.NewPacketConn(c)
+	b.ifaces[ifaces[0].Index] = ifaces[0].Name
+	for _, ifi := range ifaces[1:] {
+		err := b.conn.JoinGroup(&ifi, mdnsGroup)
+		if err != nil {
+			if len(cfg.Interfaces) > 0 {
+				c.Close()
+				return nil, fmt.Errorf("error joining mDNS group on %s: %w", ifi.Name, err)
+			}
+			b.l.Debugf("skipping %s: %s", ifi.Name, err)
+			continue
+		}
+		b.ifaces[ifi.Index] = ifi.Name
+	}
+	err = b.conn.SetControlMessage(ipv4.FlagInterface, true)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	b.l.Infof("browsing %s on %s", serviceName, strings.Join(b.interfaceNames(), ","))
+	b.wg.Add(2)
+	go func() {
+		defer b.wg.Done()
+		b.readLoop()
+	}()
+	go func() {
+		defer b.wg.Done()
+		b.queryLoop()
+	}()
+	return b, nil
+}
+
+func newBrowser(cfg Config, metrics MetricSink, listeners []Listener) *Browser {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = cfg.Interval * 3
+	}
+	return &Browser{
+		cfg:       cfg,
+		l:         cfg.Logger,
+		ifaces:    map[int]string{},
+		metrics:   metrics,
+		listeners: listeners,
+		entries:   map[string]*entry{},
+		hosts:     map[string]hostAddr{},
+		stop:      make(chan struct{}),
+	}
+}
+
+func interfaces(names []string) ([]net.Interface, error) {
+	var ifaces []net.Interface
+	if len(names) > 0 {
+		for _, n := range names {
+			ifi, err := net.InterfaceByName(n)
+			if err != nil {
+				return nil, fmt.Errorf("interface %s: %w", n, err)
+			}
+			ifaces = append(ifaces, *ifi)
+		}
+		return ifaces, nil
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagMulticast != 0 && ifi.Flags&net.FlagLoopback == 0 {
+			ifaces = append(ifaces, ifi)
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, fmt.Errorf("no multicast capable interfaces found")
+	}
+	return ifaces, nil
+}
+
+func (b *Browser) interfaceNames() []string {
+	names := make([]string, 0, len(b.ifaces))
+	for _, n := range b.ifaces {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Devices returns devices currently announced, sorted by name
+func (b *Browser) Devices() []Device {
+	b.Lock()
+	defer b.Unlock()
+	devices := make([]Device, 0, len(b.entries))
+	for _, e := range b.entries {
+		if e.up {
+			devices = append(devices, e.dev)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Name < devices[j].Name })
+	return devices
+}
+
+func (b *Browser) Close() {
+	close(b.stop)
+	b.conn.Close()
+	b.wg.Wait()
+}
+
+func (b *Browser) readLoop() {
+	buf := make([]byte, 9000)
+	for {
+		n, cm, _, err := b.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-b.stop:
+				return
+			default:
+			}
+			b.l.Errorf("error reading mDNS packet: %s", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if cm == nil {
+			continue
+		}
+		iface, ok := b.ifaces[cm.IfIndex]
+		if !ok {
+			continue
+		}
+		events, questions := b.handle(buf[:n], iface, time.Now())
+		b.notify(events)
+		if len(questions) > 0 {
+			b.query(questions)
+		}
+	}
+}
+
+func (b *Browser) queryLoop() {
+	b.query(browseQuestions())
+	t := time.NewTicker(b.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-t.C:
+			now := time.Now()
+			b.Lock()
+			events := b.update(now)
+			b.Unlock()
+			b.notify(events)
+			b.sendInfo(b.Devices(), now)
+			b.query(browseQuestions())
+		}
+	}
+}
+
+func browseQuestions() []dnsmessage.Question {
+	return []dnsmessage.Question{{
+		Name:  dnsmessage.MustNewName(serviceName),
+		Type:  dnsmessage.TypePTR,
+		Class: dnsmessage.ClassINET,
+	}}
+}
+
+func (b *Browser) query(questions []dnsmessage.Question) {
+	msg := dnsmessage.Message{Questions: questions}
+	p, err := msg.Pack()
+	if err != nil {
+		b.l.Errorf("error building mDNS query: %s", err)
+		return
+	}
+	for idx, name := range b.ifaces {
+		_, err := b.conn.WriteTo(p, &ipv4.ControlMessage{IfIndex: idx}, mdnsGroup)
+		if err != nil {
+			b.l.Warnf("error sending mDNS query on %s: %s", name, err)
+		}
+	}
+}
+
+// handle processes mDNS packet received on iface. It returns device changes and
+// questions to ask about instances that are still missing SRV or address
+func (b *Browser) handle(data []byte, iface string, now time.Time) ([]event, []dnsmessage.Question) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(data); err != nil || !msg.Header.Response {
+		return nil, nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	records := append(msg.Answers, msg.Additionals...)
+	// addresses first so SRV in the same packet can be resolved
+	for _, rr := range records {
+		a, ok := rr.Body.(*dnsmessage.AResource)
+		if !ok {
+			continue
+		}
+		host := hostName(rr.Header.Name)
+		if rr.Header.TTL == 0 {
+			delete(b.hosts, host)
+			continue
+		}
+		b.hosts[host] = hostAddr{
+			ip:      net.IP(a.A[:]).String(),
+			expires: now.Add(min(time.Duration(rr.Header.TTL)*time.Second, b.cfg.Timeout)),
+		}
+	}
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header.Name.String())
+		var e *entry
+		switch body := rr.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if name != serviceName {
+				continue
+			}
+			e = b.entry(strings.ToLower(body.PTR.String()), iface)
+		case *dnsmessage.SRVResource:
+			if !strings.HasSuffix(name, "."+serviceName) {
+				continue
+			}
+			e = b.entry(name, iface)
+			e.dev.Host = hostName(body.Target)
+			e.dev.Port = int(body.Port)
+		case *dnsmessage.TXTResource:
+			if !strings.HasSuffix(name, "."+serviceName) {
+				continue
+			}
+			e = b.entry(name, iface)
+			e.dev.setTXT(body.TXT)
+		default:
+			continue
+		}
+		if rr.Header.TTL == 0 {
+			// goodbye, node is shutting down
+			e.expires = now
+			continue
+		}
+		e.seen(now, rr.Header.TTL, b.cfg.Timeout)
+	}
+	events := b.update(now)
+	if now.Sub(b.lastResolve) < resolveInterval {
+		return events, nil
+	}
+	var questions []dnsmessage.Question
+	for instance, e := range b.entries {
+		if e.complete() {
+			continue
+		}
+		if e.dev.Port == 0 {
+			name, err := dnsmessage.NewName(instance)
+			if err != nil {
+				continue
+			}
+			questions = append(questions,
+				dnsmessage.Question{Name: name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET},
+				dnsmessage.Question{Name: name, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET},
+			)
+		} else if name, err := dnsmessage.NewName(e.dev.Host + "."); err == nil {
+			questions = append(questions, dnsmessage.Question{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+		}
+	}
+	if len(questions) > 0 {
+		b.lastResolve = now
+	}
+	return events, questions
+}
+
+func hostName(n dnsmessage.Name) string {
+	return strings.TrimSuffix(strings.ToLower(n.String()), ".")
+}
+
+func (b *Browser) entry(instance string, iface string) *entry {
+	e, ok := b.entries[instance]
+	if !ok {
+		e = &entry{dev: Device{Name: strings.TrimSuffix(instance, "."+serviceName)}}
+		b.entries[instance] = e
+	}
+	e.dev.Interface = iface
+	return e
+}
+
+// update resolves addresses, removes expired entries and returns changes listeners weren't told about yet
+func (b *Browser) update(now time.Time) []event {
+	for host, a := range b.hosts {
+		if !a.expires.After(now) {
+			delete(b.hosts, host)
+		}
+	}
+	var events []event
+	up := 0
+	for instance, e := range b.entries {
+		if !e.expires.After(now) {
+			delete(b.entries, instance)
+			if e.up {
+				events = append(events, event{up: false, dev: e.dev})
+			}
+			continue
+		}
+		if a, ok := b.hosts[e.dev.Host]; ok {
+			e.dev.Address = a.ip
+		}
+		if !e.complete() {
+			continue
+		}
+		up++
+		if !e.up || e.dev.changed(&e.announced) {
+			e.up = true
+			e.announced = e.dev
+			events = append(events, event{up: true, dev: e.dev})
+		}
+	}
+	devicesGauge.Update(float64(up))
+	return events
+}
+
+func (b *Browser) notify(events []event) {
+	var up []Device
+	for _, ev := range events {
+		if ev.up {
+			b.l.Infof("found %s at %s (ESPHome %s, %s)", ev.dev.Name, ev.dev.APIAddress(), ev.dev.Version, ev.dev.Platform)
+			up = append(up, ev.dev)
+		} else {
+			b.l.Infof("%s is gone", ev.dev.Name)
+		}
+		for _, l := range b.listeners {
+			if ev.up {
+				l.DeviceUp(ev.dev)
+			} else {
+				l.DeviceDown(ev.dev)
+			}
+		}
+	}
+	b.sendInfo(up, time.Now())
+}
+
+// sendInfo sends esphome_mdns_device_info of devices
+func (b *Browser) sendInfo(devices []Device, now time.Time) {
+	if b.metrics == nil || len(devices) == 0 {
+		return
+	}
+	metrics := make([]queue.Metric, 0, len(devices))
+	for _, d := range devices {
+		metrics = append(metrics, queue.Metric{
+			Name:   InfoMetric,
+			Labels: d.infoLabels(),
+			Value:  1,
+			TS:     now,
+		})
+	}
+	b.metrics.Dispatch(metrics)
+}
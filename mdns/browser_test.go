@@ -0,0 +1,182 @@
+package mdns
+
+import (
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testListener struct {
+	up   []Device
+	down []Device
+}
+
+func (l *testListener) DeviceUp(d Device)   { l.up = append(l.up, d) }
+func (l *testListener) DeviceDown(d Device) { l.down = append(l.down, d) }
+
+type testSink struct {
+	metrics []queue.Metric
+	sync.Mutex
+}
+
+func (s *testSink) Dispatch(metrics []queue.Metric) {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+}
+
+type announce struct {
+	name string
+	ip   [4]byte
+	ttl  uint32
+	// skip SRV, TXT and A, like minimal answer to PTR query
+	ptrOnly bool
+}
+
+func (a announce) pack(t *testing.T) []byte {
+	instance := dnsmessage.MustNewName(a.name + "." + serviceName)
+	host := dnsmessage.MustNewName(a.name + ".local.")
+	hdr := func(n dnsmessage.Name, typ dnsmessage.Type) dnsmessage.ResourceHeader {
+		return dnsmessage.ResourceHeader{Name: n, Type: typ, Class: dnsmessage.ClassINET, TTL: a.ttl}
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true, Authoritative: true},
+		Answers: []dnsmessage.Resource{{
+			Header: hdr(dnsmessage.MustNewName(serviceName), dnsmessage.TypePTR),
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		}},
+	}
+	if !a.ptrOnly {
+		msg.Additionals = []dnsmessage.Resource{
+			{
+				Header: hdr(instance, dnsmessage.TypeSRV),
+				Body:   &dnsmessage.SRVResource{Port: 6053, Target: host},
+			},
+			{
+				Header: hdr(instance, dnsmessage.TypeTXT),
+				Body: &dnsmessage.TXTResource{TXT: []string{
+					"friendly_name=Kitchen", "version=2025.10.0", "mac=aabbccddeeff",
+					"platform=ESP32", "board=esp32dev", "network=wifi", "api_encryption=Noise_NNpsk0_25519_ChaChaPoly_SHA256",
+				}},
+			},
+			{
+				Header: hdr(host, dnsmessage.TypeA),
+				Body:   &dnsmessage.AResource{A: a.ip},
+			},
+		}
+	}
+	b, err := msg.Pack()
+	require.NoError(t, err)
+	return b
+}
+
+func TestBrowserAnnounce(t *testing.T) {
+	l := &testListener{}
+	sink := &testSink{}
+	b := newBrowser(Config{Interval: time.Minute}, sink, []Listener{l})
+	now := time.Now()
+	events, questions := b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 5}, ttl: 120}.pack(t), "eth0", now)
+	assert.Empty(t, questions)
+	b.notify(events)
+	require.Len(t, l.up, 1)
+	d := l.up[0]
+	assert.Equal(t, "kitchen", d.Name)
+	assert.Equal(t, "kitchen.local", d.Host)
+	assert.Equal(t, "10.0.0.5:6053", d.APIAddress())
+	assert.Equal(t, "eth0", d.Interface)
+	assert.Equal(t, "Kitchen", d.FriendlyName)
+	assert.Equal(t, "2025.10.0", d.Version)
+	assert.Equal(t, "aabbccddeeff", d.MAC)
+	assert.Equal(t, "ESP32", d.Platform)
+	assert.Equal(t, "esp32dev", d.Board)
+	assert.Equal(t, []Device{d}, b.Devices())
+
+	require.Len(t, sink.metrics, 1)
+	assert.Equal(t, InfoMetric, sink.metrics[0].Name)
+	assert.Equal(t, 1.0, sink.metrics[0].Value)
+	assert.Equal(t, map[string]string{
+		"device":        "kitchen",
+		"friendly_name": "Kitchen",
+		"version":       "2025.10.0",
+		"platform":      "ESP32",
+		"board":         "esp32dev",
+		"mac":           "aabbccddeeff",
+		"address":       "10.0.0.5",
+		"interface":     "eth0",
+	}, sink.metrics[0].Labels)
+
+	// same announcement again changes nothing
+	events, _ = b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 5}, ttl: 120}.pack(t), "eth0", now.Add(time.Second))
+	assert.Empty(t, events)
+	// new address is announced again
+	events, _ = b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 6}, ttl: 120}.pack(t), "eth0", now.Add(time.Second*2))
+	b.notify(events)
+	require.Len(t, l.up, 2)
+	assert.Equal(t, "10.0.0.6:6053", l.up[1].APIAddress())
+	assert.Empty(t, l.down)
+}
+
+func TestBrowserGoodbye(t *testing.T) {
+	l := &testListener{}
+	b := newBrowser(Config{}, nil, []Listener{l})
+	now := time.Now()
+	events, _ := b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 5}, ttl: 120}.pack(t), "eth0", now)
+	b.notify(events)
+	events, _ = b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 5}, ttl: 0}.pack(t), "eth0", now.Add(time.Second))
+	b.notify(events)
+	require.Len(t, l.down, 1)
+	assert.Equal(t, "kitchen", l.down[0].Name)
+	assert.Empty(t, b.Devices())
+}
+
+func TestBrowserExpire(t *testing.T) {
+	l := &testListener{}
+	b := newBrowser(Config{Interval: time.Second * 10}, nil, []Listener{l})
+	now := time.Now()
+	// TTL is longer than timeout, device that stops answering queries is gone after timeout anyway
+	events, _ := b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 5}, ttl: 4500}.pack(t), "eth0", now)
+	b.notify(events)
+	require.Len(t, l.up, 1)
+	assert.Empty(t, b.update(now.Add(time.Second*29)))
+	events = b.update(now.Add(time.Second * 30))
+	require.Len(t, events, 1)
+	assert.False(t, events[0].up)
+}
+
+func TestBrowserResolve(t *testing.T) {
+	l := &testListener{}
+	b := newBrowser(Config{}, nil, []Listener{l})
+	now := time.Now()
+	events, questions := b.handle(announce{name: "kitchen", ttl: 120, ptrOnly: true}.pack(t), "eth0", now)
+	assert.Empty(t, events)
+	require.Len(t, questions, 2)
+	assert.Equal(t, "kitchen._esphomelib._tcp.local.", questions[0].Name.String())
+	assert.Equal(t, dnsmessage.TypeSRV, questions[0].Type)
+	assert.Equal(t, dnsmessage.TypeTXT, questions[1].Type)
+	// rate limited
+	_, questions = b.handle(announce{name: "kitchen", ttl: 120, ptrOnly: true}.pack(t), "eth0", now.Add(time.Millisecond))
+	assert.Empty(t, questions)
+	events, _ = b.handle(announce{name: "kitchen", ip: [4]byte{10, 0, 0, 5}, ttl: 120}.pack(t), "eth0", now.Add(time.Second))
+	assert.Len(t, events, 1)
+}
+
+func TestBrowserIgnoresOtherServices(t *testing.T) {
+	b := newBrowser(Config{}, nil, nil)
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{Response: true},
+		Answers: []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("_http._tcp.local."), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: 120},
+			Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName("printer._http._tcp.local.")},
+		}},
+	}
+	p, err := msg.Pack()
+	require.NoError(t, err)
+	events, questions := b.handle(p, "eth0", time.Now())
+	assert.Empty(t, events)
+	assert.Empty(t, questions)
+	assert.Empty(t, b.entries)
+}
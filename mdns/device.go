@@ -0,0 +1,101 @@
+package mdns
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Device is ESPHome node announced over mDNS
+type Device struct {
+	// Name is node name, same as in ESPHome config and MQTT discovery
+	Name string
+	// Host is mDNS host name, without trailing dot
+	Host    string
+	Address string
+	Port    int
+	// Interface device was seen on
+	Interface string
+	// TXT metadata
+	Version       string
+	Platform      string
+	Board         string
+	MAC           string
+	FriendlyName  string
+	Network       string
+	APIEncryption string
+	// TXT has all TXT record entries, including the ones above
+	TXT      map[string]string
+	LastSeen time.Time
+}
+
+// APIAddress is host:port of node's native API
+func (d Device) APIAddress() string {
+	return net.JoinHostPort(d.Address, strconv.Itoa(d.Port))
+}
+
+func (d *Device) setTXT(txt []string) {
+	d.TXT = make(map[string]string, len(txt))
+	for _, kv := range txt {
+		k, v, _ := strings.Cut(kv, "=")
+		d.TXT[strings.ToLower(k)] = v
+	}
+	d.Version = d.TXT["version"]
+	d.Platform = d.TXT["platform"]
+	d.Board = d.TXT["board"]
+	d.MAC = d.TXT["mac"]
+	d.FriendlyName = d.TXT["friendly_name"]
+	d.Network = d.TXT["network"]
+	d.APIEncryption = d.TXT["api_encryption"]
+}
+
+// changed returns true if anything listeners care about differs
+func (d *Device) changed(o *Device) bool {
+	if d.Address != o.Address || d.Port != o.Port || len(d.TXT) != len(o.TXT) {
+		return true
+	}
+	for k, v := range d.TXT {
+		if o.TXT[k] != v {
+			return true
+		}
+	}
+	return false
+}
+
+// infoLabels are labels of esphome_mdns_device_info
+func (d *Device) infoLabels() map[string]string {
+	return map[string]string{
+		"device":        d.Name,
+		"friendly_name": d.FriendlyName,
+		"version":       d.Version,
+		"platform":      d.Platform,
+		"board":         d.Board,
+		"mac":           d.MAC,
+		"address":       d.Address,
+		"interface":     d.Interface,
+	}
+}
+
+// entry is what is known about single service instance, device is usable once SRV and address are known
+type entry struct {
+	dev     Device
+	expires time.Time
+	// up is true once listeners were told about the device
+	up bool
+	// announced is device as listeners last saw it
+	announced Device
+}
+
+func (e *entry) complete() bool {
+	return len(e.dev.Host) > 0 && e.dev.Port > 0 && len(e.dev.Address) > 0
+}
+
+// seen extends entry lifetime by ttl, capped at timeout as we keep asking and nodes that are gone don't answer
+func (e *entry) seen(now time.Time, ttl uint32, timeout time.Duration) {
+	e.dev.LastSeen = now
+	expires := now.Add(min(time.Duration(ttl)*time.Second, timeout))
+	if expires.After(e.expires) {
+		e.expires = expires
+	}
+}
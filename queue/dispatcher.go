@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// dispatcher fans metrics out to sinks; each sink has its own buffer and batching so slow one does not block others
+type dispatcher struct {
+	prefix      string
+	extraLabels map[string]string
+	sinks       []*sinkRunner
+	l           *zap.SugaredLogger
+	wg          sync.WaitGroup
+	// closed drops metrics and sensor changes coming after Close, writer and sources can still be running
+	closed     bool
+	closedLock sync.RWMutex
+}
+
+type sinkRunner struct {
+	cfg  SinkConfig
+	sink Sink
+	in   chan Metric
+	l    *zap.SugaredLogger
+}
+
+func newDispatcher(prefix string, extraLabels map[string]string, l *zap.SugaredLogger) *dispatcher {
+	return &dispatcher{
+		prefix:      prefix,
+		extraLabels: extraLabels,
+		l:           l,
+	}
+}
+
+// AddSink starts sending metrics matching the filter in cfg to the sink
+func (d *dispatcher) AddSink(cfg SinkConfig, sink Sink) {
+	cfg.setDefaults()
+	r := &sinkRunner{
+		cfg:  cfg,
+		sink: sink,
+		in:   make(chan Metric, cfg.Buffer),
+		l:    d.l.Named(cfg.Name),
+	}
+	d.sinks = append(d.sinks, r)
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		r.run()
+	}()
+}
+
+// prepareMetric applies prefix and extra labels; it always returns copy so sensor's map is not shared
+func (d *dispatcher) prepareMetric(ev Metric, prefix string) Metric {
+	m := Metric{
+		Name:   prefix + ev.Name,
+		Labels: make(map[string]string, len(ev.Labels)+len(d.extraLabels)),
+		TS:     ev.TS.UTC(),
+		Value:  ev.Value,
+	}
+	for k, v := range ev.Labels {
+		m.Labels[k] = v
+	}
+	for k, v := range d.extraLabels {
+		m.Labels[k] = v
+	}
+	return m
+}
+
+func (d *dispatcher) Dispatch(ev Metric) {
+	d.send(ev, d.prepareMetric(ev, d.prefix))
+}
+
+// DispatchSelf sends bridge's own metrics; they already have esphome2prom_ prefix so only extra labels are added
+func (d *dispatcher) DispatchSelf(metrics []Metric) {
+	for _, ev := range metrics {
+		d.send(ev, d.prepareMetric(ev, ""))
+	}
+}
+
+func (d *dispatcher) send(ev Metric, m Metric) {
+	d.closedLock.RLock()
+	defer d.closedLock.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, s := range d.sinks {
+		// filter on name before prefix so config doesn't depend on it
+		if !s.cfg.Filter.Match(ev) {
+			continue
+		}
+		select {
+		case s.in <- m:
+		default:
+			sinkDropped.With(s.cfg.Name).Update(1)
+			s.l.Warnf("sink buffer full, dropping %s%v", m.Name, m.Labels)
+		}
+	}
+}
+
+func (d *dispatcher) SensorAdded(disc ESPHomeDiscovery) {
+	d.closedLock.RLock()
+	defer d.closedLock.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, s := range d.sinks {
+		if l, ok := s.sink.(SensorListener); ok {
+			l.SensorAdded(disc)
+		}
+	}
+}
+
+func (d *dispatcher) updateStats() {
+	for _, s := range d.sinks {
+		sinkBufferDepth.With(s.cfg.Name).Update(float64(len(s.in)))
+	}
+}
+
+func (d *dispatcher) SensorRemoved(disc ESPHomeDiscovery) {
+	d.closedLock.RLock()
+	defer d.closedLock.RUnlock()
+	if d.closed {
+		return
+	}
+	for _, s := range d.sinks {
+		if l, ok := s.sink.(SensorListener); ok {
+			l.SensorRemoved(disc)
+		}
+	}
+}
+
+// Close flushes whatever is buffered and closes all sinks
+func (d *dispatcher) Close() {
+	d.closedLock.Lock()
+	if d.closed {
+		d.closedLock.Unlock()
+		return
+	}
+	d.closed = true
+	for _, s := range d.sinks {
+		close(s.in)
+	}
+	d.closedLock.Unlock()
+	d.wg.Wait()
+	for _, s := range d.sinks {
+		s.sink.Close()
+	}
+}
+
+func (r *sinkRunner) run() {
+	batch := make([]Metric, 0, r.cfg.MaxBatchLength)
+	deadline := time.After(r.cfg.MaxBatchDuration)
+	for {
+		select {
+		case ev, ok := <-r.in:
+			if !ok {
+				if len(batch) > 0 {
+					r.write(batch)
+				}
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) < r.cfg.MaxBatchLength {
+				continue
+			}
+		case <-deadline:
+		}
+		deadline = time.After(r.cfg.MaxBatchDuration)
+		if len(batch) == 0 {
+			continue
+		}
+		r.write(batch)
+		batch = make([]Metric, 0, r.cfg.MaxBatchLength)
+	}
+}
+
+func (r *sinkRunner) write(batch []Metric) {
+	start := time.Now()
+	err := r.sink.Write(context.Background(), batch)
+	sinkWriteSeconds.With(r.cfg.Name).Update(time.Since(start).Seconds())
+	sinkWrites.With(r.cfg.Name).Update(1)
+	if err != nil {
+		sinkWriteErrors.With(r.cfg.Name).Update(1)
+		r.l.Warnf("error writing %d metrics: %s", len(batch), err)
+		return
+	}
+	sinkSamples.With(r.cfg.Name).Update(float64(len(batch)))
+}
+
+func (q *Queue) writer() {
+	for ev := range q.sendQueue {
+		q.dispatcher.Dispatch(ev)
+	}
+}
@@ -0,0 +1,65 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSink struct {
+	metrics []Metric
+	closed  bool
+	sync.Mutex
+}
+
+func (s *testSink) Write(ctx context.Context, metrics []Metric) error {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+	return nil
+}
+
+func (s *testSink) Close() {
+	s.closed = true
+}
+
+func TestDispatcher(t *testing.T) {
+	d := newDispatcher("esp_", map[string]string{"host": "h1"}, zaptest.NewLogger(t).Sugar())
+	all := &testSink{}
+	temp := &testSink{}
+	d.AddSink(SinkConfig{Name: "all"}, all)
+	d.AddSink(SinkConfig{
+		Name: "temp",
+		Filter: SinkFilter{
+			Metrics:        []string{"temp*"},
+			ExcludeDevices: []string{"garage"},
+		},
+	}, temp)
+	labels := map[string]string{"device": "kitchen", "sensor": "t1"}
+	d.Dispatch(Metric{Name: "temperature", Labels: labels, Value: 21, TS: time.Now()})
+	d.Dispatch(Metric{Name: "temperature", Labels: map[string]string{"device": "garage"}, Value: 5, TS: time.Now()})
+	d.Dispatch(Metric{Name: "humidity", Labels: map[string]string{"device": "kitchen"}, Value: 40, TS: time.Now()})
+	d.Close()
+
+	assert.Len(t, all.metrics, 3)
+	require.Len(t, temp.metrics, 1)
+	assert.Equal(t, "esp_temperature", temp.metrics[0].Name)
+	assert.Equal(t, "h1", temp.metrics[0].Labels["host"])
+	assert.NotContains(t, labels, "host", "sensor labels must not be modified")
+	assert.True(t, all.closed)
+	assert.True(t, temp.closed)
+
+	// metrics from still running writer are dropped, not sent to closed sink buffers
+	d.Dispatch(Metric{Name: "temperature", Labels: labels, Value: 22, TS: time.Now()})
+	d.Close()
+	assert.Len(t, all.metrics, 3)
+}
+
+func TestSinkFilterValidate(t *testing.T) {
+	f := SinkFilter{Metrics: []string{"[temp"}}
+	assert.Error(t, f.validate())
+}
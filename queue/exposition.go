@@ -0,0 +1,175 @@
+package queue
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshot keeps latest value of every series, for outputs that expose current state instead of a stream
+type snapshot struct {
+	series map[uint64]snapshotEntry
+	sync.Mutex
+}
+
+type snapshotEntry struct {
+	m       Metric
+	updated time.Time
+}
+
+func newSnapshot() *snapshot {
+	return &snapshot{series: map[uint64]snapshotEntry{}}
+}
+
+func (s *snapshot) Update(metrics []Metric) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	for _, m := range metrics {
+		s.series[seriesHash(m)] = snapshotEntry{m: m, updated: now}
+	}
+}
+
+// Remove forgets series matching f
+func (s *snapshot) Remove(f func(m Metric) bool) {
+	s.Lock()
+	defer s.Unlock()
+	for k, e := range s.series {
+		if f(e.m) {
+			delete(s.series, k)
+		}
+	}
+}
+
+// Current returns metrics updated within staleAfter and forgets older ones
+func (s *snapshot) Current(staleAfter time.Duration) []Metric {
+	cutoff := time.Now().Add(-staleAfter)
+	s.Lock()
+	defer s.Unlock()
+	metrics := make([]Metric, 0, len(s.series))
+	for k, e := range s.series {
+		if staleAfter > 0 && e.updated.Before(cutoff) {
+			delete(s.series, k)
+			continue
+		}
+		metrics = append(metrics, e.m)
+	}
+	return metrics
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeExposition writes metrics in Prometheus text format, grouped by name with HELP and TYPE lines.
+// Timestamps are not included as textfile collector and pushgateway reject them.
+// Metric and label names are sanitised; names with both counter and gauge series and series whose label names
+// collide after sanitising are left out, reasons are returned in skipped
+func writeExposition(w io.Writer, metrics []Metric, prefix string, meta func(device, sensor string) (ESPHomeDiscovery, bool)) (skipped []string, err error) {
+	byName := map[string][]Metric{}
+	for _, m := range metrics {
+		name := sanitizeName(m.Name, true)
+		labels := make(map[string]string, len(m.Labels))
+		for k, v := range m.Labels {
+			labels[sanitizeName(k, false)] = v
+		}
+		if len(labels) != len(m.Labels) {
+			skipped = append(skipped, fmt.Sprintf("%s%s: label names collide after sanitising", name, labelString(labels)))
+			continue
+		}
+		m.Name, m.Labels = name, labels
+		byName[name] = append(byName[name], m)
+	}
+	names := make([]string, 0, len(byName))
+	for n := range byName {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		series := byName[name]
+		sort.Slice(series, func(i, j int) bool { return labelString(series[i].Labels) < labelString(series[j].Labels) })
+		metricType := exposedType(series[0], meta)
+		mixed := false
+		for _, m := range series[1:] {
+			if exposedType(m, meta) != metricType {
+				mixed = true
+				break
+			}
+		}
+		if mixed {
+			skipped = append(skipped, fmt.Sprintf("%s: has both counter and gauge series", name))
+			continue
+		}
+		b.WriteString("# HELP " + name + " " + strings.TrimPrefix(name, prefix) + " reported by ESPHome sensors\n")
+		b.WriteString("# TYPE " + name + " " + metricType + "\n")
+		for _, m := range series {
+			b.WriteString(name)
+			b.WriteString(labelString(m.Labels))
+			b.WriteByte(' ')
+			b.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+			b.WriteByte('\n')
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return skipped, err
+}
+
+// exposedType is counter for series of total_increasing sensors, gauge for everything else
+func exposedType(m Metric, meta func(device, sensor string) (ESPHomeDiscovery, bool)) string {
+	if meta != nil {
+		if d, ok := meta(m.Labels["device"], m.Labels["sensor"]); ok && d.StateClass == "total_increasing" {
+			return "counter"
+		}
+	}
+	return "gauge"
+}
+
+// sanitizeName replaces characters not allowed in metric (colon allowed) or label name with _
+func sanitizeName(name string, metric bool) string {
+	valid := func(i int, r rune) bool {
+		return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(i > 0 && r >= '0' && r <= '9') || (metric && r == ':')
+	}
+	var b strings.Builder
+	for i, r := range name {
+		if valid(i, r) {
+			b.WriteRune(r)
+			continue
+		}
+		if i == 0 && r >= '0' && r <= '9' {
+			b.WriteByte('_')
+			b.WriteRune(r)
+			continue
+		}
+		b.WriteByte('_')
+	}
+	if b.Len() == 0 {
+		return "_"
+	}
+	return b.String()
+}
+
+// labelString formats labels as {k="v",...} with sorted keys
+func labelString(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(k + `="` + labelValueEscaper.Replace(labels[k]) + `"`)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"net/url"
+	"strings"
+)
+
+// mqttClient is the part of MQTT connection Queue uses, so the same code works over MQTT 3.1.1 and 5
+type mqttClient interface {
+	// Publish returns once message is sent (QoS 0) or acknowledged by broker, or ctx is done
+	Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error
+	// Subscribe adds subscription with its own handler, messages matching it don't reach discovery or state handling
+	Subscribe(filter string, qos byte, handler MessageHandler) error
+	IsConnected() bool
+	Disconnect()
+}
+
+const (
+	MQTTVersion3 = 3
+	MQTTVersion5 = 5
+)
+
+func (q *Queue) newMQTTClient() (mqttClient, error) {
+	if q.cfg.Broker != nil {
+		if len(q.cfg.MQTTSharedGroup) > 0 {
+			return nil, fmt.Errorf("MQTT shared subscription group can't be used with embedded broker")
+		}
+		return newMQTTInProcess(q)
+	}
+	if len(q.cfg.MQTTAddr) == 0 {
+		q.l.Infof("no MQTT address, only sensors added by other sources will be handled")
+		return mqttDisabled{}, nil
+	}
+	if len(q.cfg.MQTTSharedGroup) > 0 {
+		if q.cfg.MQTTVersion != MQTTVersion5 {
+			return nil, fmt.Errorf("MQTT shared subscription group requires MQTT version 5")
+		}
+		if strings.ContainsAny(q.cfg.MQTTSharedGroup, "/+#") {
+			return nil, fmt.Errorf("MQTT shared subscription group [%s] can't contain /, + or #", q.cfg.MQTTSharedGroup)
+		}
+	}
+	switch q.cfg.MQTTVersion {
+	case 0, MQTTVersion3:
+		return newMQTTv3(q)
+	case MQTTVersion5:
+		return newMQTTv5(q)
+	default:
+		return nil, fmt.Errorf("unsupported MQTT version [%d], use 3 or 5", q.cfg.MQTTVersion)
+	}
+}
+
+// mqttDisabled is used when sensors come only from non-MQTT sources
+type mqttDisabled struct{}
+
+var errMQTTDisabled = errors.New("MQTT is not configured")
+
+func (mqttDisabled) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	return errMQTTDisabled
+}
+func (mqttDisabled) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	return errMQTTDisabled
+}
+func (mqttDisabled) IsConnected() bool { return true }
+func (mqttDisabled) Disconnect()       {}
+
+// stateSubscription is the filter state topics are subscribed with.
+// Replicas in the same shared group split state messages between them, discovery is always delivered to all of them
+func (q *Queue) stateSubscription() string {
+	if len(q.cfg.MQTTSharedGroup) > 0 {
+		return "$share/" + q.cfg.MQTTSharedGroup + "/" + stateTopic
+	}
+	return stateTopic
+}
+
+// onMessage routes message from client without per-subscription callbacks
+func (q *Queue) onMessage(m mqtt.Message) {
+	if strings.HasPrefix(m.Topic(), "homeassistant/") {
+		q.onDiscovery(m)
+		return
+	}
+	q.onState(m)
+}
+
+// mqttServer returns broker URL with credentials stripped and default port filled in, and the credentials
+func (c *Config) mqttServer() (server *url.URL, username, password string, err error) {
+	u, err := url.Parse(c.MQTTAddr)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("cannot parse MQTT URL: %w", err)
+	}
+	broker, err := mqttBroker(u)
+	if err != nil {
+		return nil, "", "", err
+	}
+	server, err = url.Parse(broker)
+	if err != nil {
+		return nil, "", "", err
+	}
+	password, _ = u.User.Password()
+	return server, u.User.Username(), password, nil
+}
+
+// mqttTLS returns TLS config for the broker, nil if it is not needed
+func (c *Config) mqttTLS(server *url.URL) (*tls.Config, error) {
+	if !mqttTLSSchemes[server.Scheme] && !c.MQTTTLS.enabled() {
+		return nil, nil
+	}
+	tlsCfg, err := c.MQTTTLS.TLSConfig()
+	if err != nil {
+		return nil, fmt.Errorf("MQTT TLS config: %w", err)
+	}
+	return tlsCfg, nil
+}
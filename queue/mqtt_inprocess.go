@@ -0,0 +1,82 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// InProcessBroker is MQTT broker running in the same process, queue subscribes to it without network round trip
+type InProcessBroker interface {
+	// Subscribe calls handler for every message matching filter, retained ones first
+	Subscribe(filter string, handler func(topic string, payload []byte, retained bool)) (unsubscribe func(), err error)
+	Publish(topic string, payload []byte, retain bool, qos byte) error
+}
+
+// mqttInProcess consumes directly from embedded broker
+type mqttInProcess struct {
+	broker      InProcessBroker
+	unsubscribe []func()
+	sync.Mutex
+}
+
+func newMQTTInProcess(q *Queue) (*mqttInProcess, error) {
+	c := &mqttInProcess{broker: q.cfg.Broker}
+	for _, filter := range []string{discoveryTopic, stateTopic} {
+		unsubscribe, err := c.broker.Subscribe(filter, func(topic string, payload []byte, retained bool) {
+			q.onMessage(&inProcessMessage{topic: topic, payload: payload, retained: retained})
+		})
+		if err != nil {
+			c.Disconnect()
+			return nil, fmt.Errorf("error subscribing to %s: %w", filter, err)
+		}
+		c.unsubscribe = append(c.unsubscribe, unsubscribe)
+	}
+	mqttConnects.Update(1)
+	q.l.Infof("consuming from embedded broker")
+	return c, nil
+}
+
+func (c *mqttInProcess) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	return c.broker.Publish(topic, payload, retained, qos)
+}
+
+func (c *mqttInProcess) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	unsubscribe, err := c.broker.Subscribe(filter, func(topic string, payload []byte, retained bool) {
+		handler(topic, payload)
+	})
+	if err != nil {
+		return fmt.Errorf("error subscribing to %s: %w", filter, err)
+	}
+	c.Lock()
+	c.unsubscribe = append(c.unsubscribe, unsubscribe)
+	c.Unlock()
+	return nil
+}
+
+func (c *mqttInProcess) IsConnected() bool {
+	return true
+}
+
+func (c *mqttInProcess) Disconnect() {
+	c.Lock()
+	defer c.Unlock()
+	for _, unsubscribe := range c.unsubscribe {
+		unsubscribe()
+	}
+	c.unsubscribe = nil
+}
+
+type inProcessMessage struct {
+	topic    string
+	payload  []byte
+	retained bool
+}
+
+func (m *inProcessMessage) Duplicate() bool   { return false }
+func (m *inProcessMessage) Qos() byte         { return 0 }
+func (m *inProcessMessage) Retained() bool    { return m.retained }
+func (m *inProcessMessage) Topic() string     { return m.topic }
+func (m *inProcessMessage) MessageID() uint16 { return 0 }
+func (m *inProcessMessage) Payload() []byte   { return m.payload }
+func (m *inProcessMessage) Ack()              {}
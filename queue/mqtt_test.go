@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/broker"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"log/slog"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testBroker starts in-process broker on random port and returns its tcp:// address
+func testBroker(t *testing.T) (*mochi.Server, string) {
+	srv := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(io.Discard, nil)),
+	})
+	require.NoError(t, srv.AddHook(new(auth.AllowHook), nil))
+	l := listeners.NewTCP(listeners.Config{ID: "test", Address: "127.0.0.1:0"})
+	require.NoError(t, srv.AddListener(l))
+	require.NoError(t, srv.Serve())
+	t.Cleanup(func() { srv.Close() })
+	return srv, "tcp://" + l.Address()
+}
+
+func (s *testSink) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.metrics)
+}
+
+func testDiscovery(device, sensor string) []byte {
+	return []byte(fmt.Sprintf(`{"dev_cla":"temperature","unit_of_meas":"°C","name":"%s","stat_t":"%s/sensor/%s/state","dev":{"ids":"%s","name":"%s"}}`,
+		sensor, device, sensor, device, device))
+}
+
+func TestQueueMQTTv3(t *testing.T) {
+	srv, addr := testBroker(t)
+	require.NoError(t, srv.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	sink := &testSink{}
+	q, err := New(&Config{
+		MQTTAddr: addr,
+		Logger:   zaptest.NewLogger(t).Sugar(),
+		Sinks:    []SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, ok := q.SensorDiscovery("kitchen", "t1")
+		return ok
+	}, time.Second*5, time.Millisecond*10)
+	require.NoError(t, srv.Publish("kitchen/sensor/t1/state", []byte("21.5"), false, 0))
+	require.Eventually(t, func() bool { return sink.count() == 1 }, time.Second*5, time.Millisecond*10)
+	q.Close()
+	assert.Equal(t, 21.5, sink.metrics[0].Value)
+	assert.True(t, sink.closed)
+}
+
+func TestQueueMQTTv5SharedSubscription(t *testing.T) {
+	srv, addr := testBroker(t)
+	require.NoError(t, srv.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	require.NoError(t, srv.Publish("homeassistant/sensor/garage/t1/config", testDiscovery("garage", "t1"), true, 0))
+	var queues []*Queue
+	var sinks []*testSink
+	for i := 0; i < 2; i++ {
+		sink := &testSink{}
+		q, err := New(&Config{
+			MQTTAddr:        addr,
+			MQTTVersion:     MQTTVersion5,
+			MQTTSharedGroup: "esphome2prom",
+			Logger:          zaptest.NewLogger(t).Sugar().Named(strconv.Itoa(i)),
+			Sinks:           []SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+		})
+		require.NoError(t, err)
+		queues = append(queues, q)
+		sinks = append(sinks, sink)
+	}
+	// every replica needs full discovery to handle whatever state message it gets
+	for _, q := range queues {
+		require.Eventually(t, func() bool {
+			_, kitchen := q.SensorDiscovery("kitchen", "t1")
+			_, garage := q.SensorDiscovery("garage", "t1")
+			return kitchen && garage
+		}, time.Second*5, time.Millisecond*10)
+	}
+	// shared subscription is set up after discovery one, wait for broker to see both members
+	require.Eventually(t, func() bool {
+		members := 0
+		for _, group := range srv.Topics.Subscribers("kitchen/sensor/t1/state").Shared {
+			members += len(group)
+		}
+		return members == 2
+	}, time.Second*5, time.Millisecond*10)
+
+	messages := 20
+	for i := 0; i < messages; i++ {
+		device := "kitchen"
+		if i%2 == 1 {
+			device = "garage"
+		}
+		require.NoError(t, srv.Publish(device+"/sensor/t1/state", []byte(strconv.Itoa(i)), false, 0))
+	}
+	require.Eventually(t, func() bool {
+		return sinks[0].count()+sinks[1].count() >= messages
+	}, time.Second*5, time.Millisecond*10)
+	for _, q := range queues {
+		q.Close()
+	}
+	seen := map[float64]int{}
+	for _, s := range sinks {
+		for _, m := range s.metrics {
+			seen[m.Value]++
+		}
+	}
+	assert.Len(t, seen, messages)
+	for v, n := range seen {
+		assert.Equal(t, 1, n, "state %v should be processed by exactly one replica", v)
+	}
+}
+
+func TestQueueMQTTSharedGroupRequiresV5(t *testing.T) {
+	_, err := New(&Config{
+		MQTTAddr:        "tcp://127.0.0.1:1",
+		MQTTSharedGroup: "g",
+		Logger:          zaptest.NewLogger(t).Sugar(),
+	})
+	assert.Error(t, err)
+}
+
+func TestQueueInProcessBroker(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	sink := &testSink{}
+	q, err := New(&Config{
+		Broker: b,
+		Logger: zaptest.NewLogger(t).Sugar(),
+		Sinks:  []SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+	})
+	require.NoError(t, err)
+	// retained discovery is delivered while subscribing
+	_, ok := q.SensorDiscovery("kitchen", "t1")
+	require.True(t, ok)
+
+	// node connects to embedded broker over network as it would to any other
+	node := mqtt.NewClient(mqtt.NewClientOptions().AddBroker("tcp://" + b.Addr()).SetClientID("kitchen"))
+	require.True(t, node.Connect().WaitTimeout(time.Second*5))
+	defer node.Disconnect(100)
+	require.True(t, node.Publish("kitchen/sensor/t1/state", 0, false, "19.5").WaitTimeout(time.Second*5))
+	require.Eventually(t, func() bool { return sink.count() == 1 }, time.Second*5, time.Millisecond*10)
+	q.Close()
+	assert.Equal(t, 19.5, sink.metrics[0].Value)
+}
@@ -0,0 +1,105 @@
+package queue
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+)
+
+type MQTTTLSConfig struct {
+	// CA is path to PEM bundle used instead of system roots
+	CA string `yaml:"ca"`
+	// Cert and Key are paths to PEM client certificate and its key, for brokers requiring mutual TLS
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+	// ServerName overrides name certificate is verified against, if broker is connected to by IP or other alias
+	ServerName string `yaml:"server_name"`
+	// MinVersion is one of 1.0, 1.1, 1.2 (default), 1.3
+	MinVersion string `yaml:"min_version"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// default ports for schemes paho accepts
+var mqttSchemePorts = map[string]string{
+	"tcp":      "1883",
+	"mqtt":     "1883",
+	"ssl":      "8883",
+	"tls":      "8883",
+	"mqtts":    "8883",
+	"mqtt+ssl": "8883",
+	"tcps":     "8883",
+	"ws":       "80",
+	"wss":      "443",
+	"unix":     "",
+}
+
+var mqttTLSSchemes = map[string]bool{
+	"ssl":      true,
+	"tls":      true,
+	"mqtts":    true,
+	"mqtt+ssl": true,
+	"tcps":     true,
+	"wss":      true,
+}
+
+func (c *MQTTTLSConfig) enabled() bool {
+	return len(c.CA) > 0 || len(c.Cert) > 0 || len(c.ServerName) > 0 || len(c.MinVersion) > 0
+}
+
+func (c *MQTTTLSConfig) TLSConfig() (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: c.ServerName,
+	}
+	if len(c.MinVersion) > 0 {
+		v, ok := tlsVersions[c.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version [%s], use one of 1.0, 1.1, 1.2, 1.3", c.MinVersion)
+		}
+		cfg.MinVersion = v
+	}
+	if len(c.CA) > 0 {
+		pem, err := os.ReadFile(c.CA)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA bundle: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", c.CA)
+		}
+	}
+	if len(c.Cert) > 0 || len(c.Key) > 0 {
+		if len(c.Cert) == 0 || len(c.Key) == 0 {
+			return nil, fmt.Errorf("both client cert and key have to be set")
+		}
+		cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// mqttBroker returns broker URL without credentials and with default port filled in
+func mqttBroker(u *url.URL) (string, error) {
+	port, ok := mqttSchemePorts[u.Scheme]
+	if !ok {
+		return "", fmt.Errorf("unsupported MQTT scheme [%s]", u.Scheme)
+	}
+	b := *u
+	b.User = nil
+	if len(b.Port()) == 0 && len(port) > 0 {
+		b.Host = net.JoinHostPort(b.Hostname(), port)
+	}
+	return b.String(), nil
+}
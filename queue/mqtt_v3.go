@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"time"
+)
+
+// mqttV3 is MQTT 3.1.1 connection over paho.mqtt.golang
+type mqttV3 struct {
+	client mqtt.Client
+}
+
+// mqttV3Options are connection options shared by bridge's client and duplicate instance probe
+func mqttV3Options(cfg *Config) (*mqtt.ClientOptions, error) {
+	server, username, password, err := cfg.mqttServer()
+	if err != nil {
+		return nil, err
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(server.String()).
+		SetUsername(username).
+		SetPassword(password).
+		SetKeepAlive(20 * time.Second).
+		SetPingTimeout(10 * time.Second).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(30 * time.Second).
+		SetAutoReconnect(true)
+	tlsCfg, err := cfg.mqttTLS(server)
+	if err != nil {
+		return nil, err
+	}
+	if tlsCfg != nil {
+		opts.SetTLSConfig(tlsCfg)
+	}
+	return opts, nil
+}
+
+func newMQTTv3(q *Queue) (*mqttV3, error) {
+	cfg := q.cfg
+	opts, err := mqttV3Options(cfg)
+	if err != nil {
+		return nil, err
+	}
+	opts.SetReconnectingHandler(func(client mqtt.Client, options *mqtt.ClientOptions) {
+		cfg.Logger.Warnf("reconnecting to MQ")
+	}).SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		mqttDisconnects.Update(1)
+		cfg.Logger.Warnf("connection to MQTT lost: %v", err)
+	}).SetOnConnectHandler(func(client mqtt.Client) {
+		mqttConnects.Update(1)
+		cfg.Logger.Infof("connected to MQTT")
+		q.l.Debugf("adding subscriptions")
+		// callbacks are set up as routes below
+		client.Subscribe(discoveryTopic, q.subscriptionQoS(), nil)
+		client.Subscribe(q.stateSubscription(), q.subscriptionQoS(), nil)
+		for _, s := range q.extraSubscriptions() {
+			client.Subscribe(s.filter, q.subscriptionQoS(), nil)
+		}
+		if cfg.MQTTSession.persistent() {
+			client.Publish(cfg.MQTTSession.presenceTopic(), 1, true, sessionOnline)
+		}
+	})
+	if cfg.MQTTSession.persistent() && !cfg.MQTTSession.SkipInstanceCheck {
+		err := checkDuplicateInstance(opts, cfg.MQTTSession, time.Second*2)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = cfg.MQTTSession.apply(opts)
+	if err != nil {
+		return nil, err
+	}
+	client := mqtt.NewClient(opts)
+	// routes have to be there before connecting, persistent session delivers queued messages right away
+	client.AddRoute(discoveryTopic, func(c mqtt.Client, m mqtt.Message) { q.onDiscovery(m) })
+	client.AddRoute(stateTopic, func(c mqtt.Client, m mqtt.Message) { q.onState(m) })
+	if token := client.Connect(); token.Wait() && token.Error() != nil {
+		return nil, fmt.Errorf("err connecting: %w", token.Error())
+	}
+	cfg.Logger.Infof("connected to mqtt %s", opts.Servers[0])
+	return &mqttV3{client: client}, nil
+}
+
+func (c *mqttV3) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	t := c.client.Publish(topic, qos, retained, payload)
+	select {
+	case <-t.Done():
+		return t.Error()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (c *mqttV3) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	c.client.AddRoute(filter, func(_ mqtt.Client, m mqtt.Message) { handler(m.Topic(), m.Payload()) })
+	// otherwise it is subscribed on connect
+	if !c.client.IsConnectionOpen() {
+		return nil
+	}
+	t := c.client.Subscribe(filter, qos, nil)
+	t.Wait()
+	return t.Error()
+}
+
+func (c *mqttV3) IsConnected() bool {
+	return c.client.IsConnected()
+}
+
+func (c *mqttV3) Disconnect() {
+	c.client.Disconnect(1000)
+}
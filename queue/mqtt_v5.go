@@ -0,0 +1,237 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"github.com/eclipse/paho.golang/paho/session/state"
+	"github.com/eclipse/paho.golang/paho/store/file"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mqttV5 is MQTT 5 connection over paho.golang, needed for shared subscriptions
+type mqttV5 struct {
+	cm        *autopaho.ConnectionManager
+	cancel    context.CancelFunc
+	connected atomic.Bool
+	// routes are subscriptions added with Subscribe
+	routes     []subscription
+	routesLock sync.RWMutex
+}
+
+func newMQTTv5(q *Queue) (*mqttV5, error) {
+	cfg := q.cfg
+	server, username, password, err := cfg.mqttServer()
+	if err != nil {
+		return nil, err
+	}
+	if server.Scheme == "unix" {
+		return nil, fmt.Errorf("unix socket is not supported with MQTT version 5")
+	}
+	tlsCfg, err := cfg.mqttTLS(server)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttV5{}
+	session := cfg.MQTTSession
+	clientCfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		TlsCfg:                        tlsCfg,
+		KeepAlive:                     20,
+		CleanStartOnInitialConnection: !session.persistent(),
+		ReconnectBackoff:              autopaho.NewConstantBackoff(30 * time.Second),
+		ConnectTimeout:                10 * time.Second,
+		ConnectUsername:               username,
+		ConnectPassword:               []byte(password),
+		OnConnectionUp: func(cm *autopaho.ConnectionManager, connack *paho.Connack) {
+			c.connected.Store(true)
+			mqttConnects.Update(1)
+			cfg.Logger.Infof("connected to MQTT")
+			// callback must not block
+			go c.subscribe(q)
+		},
+		OnConnectionDown: func() bool {
+			c.connected.Store(false)
+			mqttDisconnects.Update(1)
+			cfg.Logger.Warnf("connection to MQTT lost")
+			return true
+		},
+		OnConnectError: func(err error) {
+			cfg.Logger.Warnf("error connecting to MQTT: %s", err)
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: "esphome2prom" + randomString(32),
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					if h := c.route(pr.Packet.Topic); h != nil {
+						h(pr.Packet.Topic, pr.Packet.Payload)
+						return true, nil
+					}
+					q.onMessage(&v5Message{p: pr.Packet})
+					return true, nil
+				},
+			},
+			OnClientError: func(err error) {
+				cfg.Logger.Warnf("MQTT client error: %s", err)
+			},
+		},
+	}
+	if session.persistent() {
+		if !session.SkipInstanceCheck {
+			// presence is plain retained message, MQTT 3.1.1 probe can check it on any broker
+			opts, err := mqttV3Options(cfg)
+			if err != nil {
+				return nil, err
+			}
+			err = checkDuplicateInstance(opts, session, time.Second*2)
+			if err != nil {
+				return nil, err
+			}
+		}
+		clientCfg.ClientID = session.ClientID
+		clientCfg.SessionExpiryInterval = uint32(session.sessionExpiry().Seconds())
+		clientCfg.SetWillMessage(session.presenceTopic(), []byte(sessionOffline), 1, true)
+		if len(session.StoreDir) > 0 {
+			sess, err := session.v5Store()
+			if err != nil {
+				return nil, err
+			}
+			clientCfg.Session = sess
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cm, err := autopaho.NewConnection(ctx, clientCfg)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("err connecting: %w", err)
+	}
+	c.cm = cm
+	c.cancel = cancel
+	err = cm.AwaitConnection(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("err connecting: %w", err)
+	}
+	cfg.Logger.Infof("connected to mqtt %s (MQTT 5)", server)
+	return c, nil
+}
+
+func (c *mqttV5) subscribe(q *Queue) {
+	q.l.Debugf("adding subscriptions")
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	subs := []paho.SubscribeOptions{
+		{Topic: discoveryTopic, QoS: q.subscriptionQoS()},
+		{Topic: q.stateSubscription(), QoS: q.subscriptionQoS()},
+	}
+	for _, s := range q.extraSubscriptions() {
+		subs = append(subs, paho.SubscribeOptions{Topic: s.filter, QoS: q.subscriptionQoS()})
+	}
+	_, err := c.cm.Subscribe(ctx, &paho.Subscribe{Subscriptions: subs})
+	if err != nil {
+		q.l.Errorf("error subscribing: %s", err)
+		return
+	}
+	if q.cfg.MQTTSession.persistent() {
+		err := c.Publish(ctx, q.cfg.MQTTSession.presenceTopic(), 1, true, []byte(sessionOnline))
+		if err != nil {
+			q.l.Warnf("error publishing session presence: %s", err)
+		}
+	}
+}
+
+func (c *mqttV5) Publish(ctx context.Context, topic string, qos byte, retained bool, payload []byte) error {
+	_, err := c.cm.Publish(ctx, &paho.Publish{
+		Topic:   topic,
+		QoS:     qos,
+		Retain:  retained,
+		Payload: payload,
+	})
+	return err
+}
+
+func (c *mqttV5) Subscribe(filter string, qos byte, handler MessageHandler) error {
+	c.routesLock.Lock()
+	c.routes = append(c.routes, subscription{filter: filter, handler: handler})
+	c.routesLock.Unlock()
+	// otherwise it is subscribed on connect
+	if !c.IsConnected() {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	_, err := c.cm.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: filter, QoS: qos}},
+	})
+	return err
+}
+
+// route returns handler of subscription added with Subscribe that topic matches
+func (c *mqttV5) route(topic string) MessageHandler {
+	c.routesLock.RLock()
+	defer c.routesLock.RUnlock()
+	for _, r := range c.routes {
+		if topicMatch(r.filter, topic) {
+			return r.handler
+		}
+	}
+	return nil
+}
+
+func (c *mqttV5) IsConnected() bool {
+	return c.connected.Load()
+}
+
+func (c *mqttV5) Disconnect() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	// cancelling stops reconnecting even if broker didn't get DISCONNECT in time
+	c.cm.Disconnect(ctx)
+	c.cancel()
+}
+
+// v5Message adapts MQTT 5 publish to message interface sensors process
+type v5Message struct {
+	p *paho.Publish
+}
+
+func (m *v5Message) Duplicate() bool   { return m.p.Duplicate() }
+func (m *v5Message) Qos() byte         { return m.p.QoS }
+func (m *v5Message) Retained() bool    { return m.p.Retain }
+func (m *v5Message) Topic() string     { return m.p.Topic }
+func (m *v5Message) MessageID() uint16 { return m.p.PacketID }
+func (m *v5Message) Payload() []byte   { return m.p.Payload }
+
+// Ack is no-op, paho.golang acknowledges after OnPublishReceived callbacks return
+func (m *v5Message) Ack() {}
+
+func (c *MQTTSessionConfig) sessionExpiry() time.Duration {
+	if c.SessionExpiry > 0 {
+		return c.SessionExpiry
+	}
+	return time.Hour * 24
+}
+
+// v5Store keeps client and server side of session state in StoreDir
+func (c *MQTTSessionConfig) v5Store() (*state.State, error) {
+	dir := filepath.Join(c.StoreDir, "v5")
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating MQTT store dir: %w", err)
+	}
+	client, err := file.New(dir, "client_", ".pkt")
+	if err != nil {
+		return nil, fmt.Errorf("error opening MQTT store: %w", err)
+	}
+	server, err := file.New(dir, "server_", ".pkt")
+	if err != nil {
+		return nil, fmt.Errorf("error opening MQTT store: %w", err)
+	}
+	return state.New(client, server), nil
+}
@@ -0,0 +1,257 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type InfluxConfig struct {
+	// URL is either http(s)://host:8086 or udp://host:8089
+	URL string `yaml:"url"`
+	// Version selects HTTP API, 1 for /write, 2 for /api/v2/write
+	Version int `yaml:"version"`
+	// v2 API
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+	// v1 API, user/password can also be passed in URL
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	// Measurement and Field are templates executed on Metric, by default `{{.Name}}` and `value`.
+	// Measurement per device with field per sensor would be `{{.Labels.device}}` and `{{.Name}}_{{.Labels.sensor}}`
+	Measurement string `yaml:"measurement"`
+	Field       string `yaml:"field"`
+	// DropTags are labels that should not be sent as tags, usually ones already used in measurement or field name
+	DropTags []string      `yaml:"drop_tags"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// max payload of single UDP packet, stays under typical MTU
+const influxUDPPacketSize = 1400
+
+// influxSkipped counts metrics that can't be written as line protocol, they are left out instead of failing whole batch
+var influxSkipped = newLabeledCounter("esphome2prom_influx_lines_skipped", "sink")
+
+type influxWriter struct {
+	cfg         InfluxConfig
+	name        string
+	l           *zap.SugaredLogger
+	url         *url.URL
+	writeURL    string
+	http        *http.Client
+	udp         net.Conn
+	measurement *template.Template
+	field       *template.Template
+	dropTags    map[string]bool
+}
+
+func newInfluxWriter(cfg InfluxConfig, name string, l *zap.SugaredLogger) (*influxWriter, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse influx URL: %w", err)
+	}
+	if len(cfg.Measurement) == 0 {
+		cfg.Measurement = "{{.Name}}"
+	}
+	if len(cfg.Field) == 0 {
+		cfg.Field = "value"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	w := &influxWriter{
+		cfg:      cfg,
+		name:     name,
+		l:        l,
+		url:      u,
+		dropTags: map[string]bool{},
+	}
+	for _, t := range cfg.DropTags {
+		w.dropTags[t] = true
+	}
+	// missing labels should produce empty string, not "<no value>"
+	w.measurement, err = template.New("measurement").Option("missingkey=zero").Parse(cfg.Measurement)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing measurement template: %w", err)
+	}
+	w.field, err = template.New("field").Option("missingkey=zero").Parse(cfg.Field)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing field template: %w", err)
+	}
+	switch u.Scheme {
+	case "udp":
+		w.udp, err = net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up influx UDP: %w", err)
+		}
+	case "http", "https":
+		w.http = &http.Client{Timeout: cfg.Timeout}
+		q := url.Values{}
+		q.Set("precision", "ns")
+		wu := *u
+		wu.User = nil
+		switch cfg.Version {
+		case 2:
+			wu.Path = strings.TrimSuffix(wu.Path, "/") + "/api/v2/write"
+			q.Set("org", cfg.Org)
+			q.Set("bucket", cfg.Bucket)
+		case 1, 0:
+			wu.Path = strings.TrimSuffix(wu.Path, "/") + "/write"
+			q.Set("db", cfg.Database)
+			if len(cfg.RetentionPolicy) > 0 {
+				q.Set("rp", cfg.RetentionPolicy)
+			}
+		default:
+			return nil, fmt.Errorf("unknown influx API version %d", cfg.Version)
+		}
+		wu.RawQuery = q.Encode()
+		w.writeURL = wu.String()
+	default:
+		return nil, fmt.Errorf("unsupported influx URL scheme [%s]", u.Scheme)
+	}
+	return w, nil
+}
+
+func (w *influxWriter) Write(ctx context.Context, metrics []Metric) error {
+	lines := make([][]byte, 0, len(metrics))
+	var lineErr error
+	for _, m := range metrics {
+		line, err := w.line(m)
+		if err != nil {
+			lineErr = err
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if skipped := len(metrics) - len(lines); skipped > 0 {
+		influxSkipped.With(w.name).Update(float64(skipped))
+		w.l.Warnf("skipped %d metrics that can't be written: %s", skipped, lineErr)
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if w.udp != nil {
+		return w.writeUDP(lines)
+	}
+	return w.writeHTTP(ctx, bytes.Join(lines, nil))
+}
+
+func (w *influxWriter) writeUDP(lines [][]byte) error {
+	buf := bytes.Buffer{}
+	for _, l := range lines {
+		if buf.Len() > 0 && buf.Len()+len(l) > influxUDPPacketSize {
+			if _, err := w.udp.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.Write(l)
+	}
+	if buf.Len() > 0 {
+		_, err := w.udp.Write(buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+func (w *influxWriter) writeHTTP(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", w.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if len(w.cfg.Token) > 0 {
+		req.Header.Set("Authorization", "Token "+w.cfg.Token)
+	} else if w.url.User != nil {
+		p, _ := w.url.User.Password()
+		req.SetBasicAuth(w.url.User.Username(), p)
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return RecoverableError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("influx returned [%d]: %s", resp.StatusCode, string(b))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return RecoverableError{Err: err, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
+
+func (w *influxWriter) Close() {
+	if w.udp != nil {
+		w.udp.Close()
+	}
+}
+
+func (w *influxWriter) line(m Metric) ([]byte, error) {
+	measurement := bytes.Buffer{}
+	err := w.measurement.Execute(&measurement, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error executing measurement template: %w", err)
+	}
+	field := bytes.Buffer{}
+	err = w.field.Execute(&field, &m)
+	if err != nil {
+		return nil, fmt.Errorf("error executing field template: %w", err)
+	}
+	if measurement.Len() == 0 || field.Len() == 0 {
+		return nil, fmt.Errorf("empty measurement or field name for %s%v", m.Name, m.Labels)
+	}
+	// line protocol has no NaN or Inf
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		return nil, fmt.Errorf("value %v of %s%v is not supported", m.Value, m.Name, m.Labels)
+	}
+	buf := bytes.Buffer{}
+	buf.WriteString(influxMeasurementEscaper.Replace(measurement.String()))
+	tags := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		if !w.dropTags[k] && len(m.Labels[k]) > 0 {
+			tags = append(tags, k)
+		}
+	}
+	sort.Strings(tags)
+	for _, k := range tags {
+		buf.WriteByte(',')
+		buf.WriteString(influxTagEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(influxTagEscaper.Replace(m.Labels[k]))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(influxTagEscaper.Replace(field.String()))
+	buf.WriteByte('=')
+	buf.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(m.TS.UnixNano(), 10))
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+var influxMeasurementEscaper = strings.NewReplacer(
+	",", `\,`,
+	" ", `\ `,
+	"\n", `\n`,
+)
+var influxTagEscaper = strings.NewReplacer(
+	",", `\,`,
+	"=", `\=`,
+	" ", `\ `,
+	"\n", `\n`,
+)
@@ -0,0 +1,81 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var influxTestMetric = Metric{
+	Name:   "temperature",
+	Labels: map[string]string{"device": "living room", "sensor": "bme280,temp", "host": "h1"},
+	Value:  21.5,
+	TS:     time.Unix(1700000000, 0),
+}
+
+func TestInfluxLine(t *testing.T) {
+	w, err := newInfluxWriter(InfluxConfig{URL: "http://127.0.0.1:8086"}, "influx", zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	l, err := w.line(influxTestMetric)
+	require.NoError(t, err)
+	assert.Equal(t, `temperature,device=living\ room,host=h1,sensor=bme280\,temp value=21.5 1700000000000000000`+"\n", string(l))
+
+	w, err = newInfluxWriter(InfluxConfig{
+		URL:         "http://127.0.0.1:8086",
+		Measurement: "{{.Labels.device}}",
+		Field:       "{{.Name}}_{{.Labels.sensor}}",
+		DropTags:    []string{"device", "sensor"},
+	}, "influx", zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	l, err = w.line(influxTestMetric)
+	require.NoError(t, err)
+	assert.Equal(t, `living\ room,host=h1 temperature_bme280\,temp=21.5 1700000000000000000`+"\n", string(l))
+}
+
+func TestInfluxWriteV2(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v2/write", r.URL.Path)
+		assert.Equal(t, "home", r.URL.Query().Get("org"))
+		assert.Equal(t, "esp", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		b, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(b), "temperature,")
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	w, err := newInfluxWriter(InfluxConfig{
+		URL:     srv.URL,
+		Version: 2,
+		Org:     "home",
+		Bucket:  "esp",
+		Token:   "secret",
+	}, "influx", zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	require.NoError(t, w.Write(context.Background(), []Metric{influxTestMetric}))
+}
+
+func TestInfluxWriteSkipsBadLines(t *testing.T) {
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	w, err := newInfluxWriter(InfluxConfig{URL: srv.URL, Measurement: "{{.Labels.device}}"}, "influx-skip", zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	noDevice := influxTestMetric
+	noDevice.Labels = map[string]string{"sensor": "t"}
+	nan := influxTestMetric
+	nan.Value = math.NaN()
+	require.NoError(t, w.Write(context.Background(), []Metric{noDevice, influxTestMetric, nan}))
+	assert.Equal(t, `living\ room,device=living\ room,host=h1,sensor=bme280\,temp value=21.5 1700000000000000000`+"\n", body)
+	assert.Equal(t, 2.0, influxSkipped.With("influx-skip").Value())
+}
@@ -0,0 +1,222 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type MQTTOutputConfig struct {
+	// Topic is a template executed on Metric, output is disabled if empty
+	// e.g. `esphome2prom/{{.Labels.device}}/{{.Name}}/{{.Labels.sensor}}`
+	Topic string `yaml:"topic"`
+	// InventoryTopic gets retained JSON document with all known devices and their sensors
+	InventoryTopic string `yaml:"inventory_topic"`
+	QoS            byte   `yaml:"qos"`
+	Retain         bool   `yaml:"retain"`
+}
+
+type mqttMetric struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Value     float64           `json:"value"`
+	Timestamp int64             `json:"timestamp"`
+}
+
+type mqttInventory struct {
+	Devices []mqttInventoryDevice `json:"devices"`
+	Updated time.Time             `json:"updated"`
+}
+
+type mqttInventoryDevice struct {
+	Name            string                `json:"name"`
+	ID              string                `json:"id,omitempty"`
+	Model           string                `json:"model,omitempty"`
+	Manufacturer    string                `json:"manufacturer,omitempty"`
+	SoftwareVersion string                `json:"sw_version,omitempty"`
+	Sensors         []mqttInventorySensor `json:"sensors"`
+}
+
+type mqttInventorySensor struct {
+	Name        string      `json:"name"`
+	DeviceClass DeviceClass `json:"device_class"`
+	Unit        string      `json:"unit,omitempty"`
+	StateClass  string      `json:"state_class,omitempty"`
+	StateTopic  string      `json:"state_topic"`
+}
+
+// MQTT wildcards and separator can't be in a topic level
+var mqttTopicLevelEscaper = strings.NewReplacer(
+	"/", "_",
+	"+", "_",
+	"#", "_",
+)
+
+type mqttPublisher struct {
+	q                *Queue
+	cfg              MQTTOutputConfig
+	topic            *template.Template
+	inventoryChanged chan struct{}
+	done             chan struct{}
+	stopped          chan struct{}
+}
+
+func newMQTTPublisher(q *Queue, cfg MQTTOutputConfig) (*mqttPublisher, error) {
+	t, err := template.New("topic").Option("missingkey=zero").Parse(cfg.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing MQTT output topic template: %w", err)
+	}
+	p := &mqttPublisher{
+		q:                q,
+		cfg:              cfg,
+		topic:            t,
+		inventoryChanged: make(chan struct{}, 1),
+		done:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+	}
+	if len(cfg.InventoryTopic) > 0 {
+		go p.inventoryPublisher()
+	} else {
+		close(p.stopped)
+	}
+	return p, nil
+}
+
+func (p *mqttPublisher) topicFor(m Metric) (string, error) {
+	// escape labels so they can't break topic structure
+	tm := Metric{
+		Name:   mqttTopicLevelEscaper.Replace(m.Name),
+		Labels: make(map[string]string, len(m.Labels)),
+	}
+	for k, v := range m.Labels {
+		tm.Labels[k] = mqttTopicLevelEscaper.Replace(v)
+	}
+	topic := bytes.Buffer{}
+	err := p.topic.Execute(&topic, &tm)
+	if err != nil {
+		return "", fmt.Errorf("error executing topic template: %w", err)
+	}
+	return topic.String(), nil
+}
+
+func (p *mqttPublisher) Write(ctx context.Context, metrics []Metric) error {
+	// sink only publishing inventory
+	if len(p.cfg.Topic) == 0 {
+		return nil
+	}
+	for _, m := range metrics {
+		topic, err := p.topicFor(m)
+		if err != nil {
+			return err
+		}
+		payload, err := json.Marshal(&mqttMetric{
+			Name:      m.Name,
+			Labels:    m.Labels,
+			Value:     m.Value,
+			Timestamp: m.TS.UnixMilli(),
+		})
+		if err != nil {
+			return err
+		}
+		err = p.q.client.Publish(ctx, topic, p.cfg.QoS, p.cfg.Retain, payload)
+		if err != nil {
+			return fmt.Errorf("error publishing to %s: %w", topic, err)
+		}
+	}
+	return nil
+}
+
+// Close stops inventory publisher, waiting for publish in progress
+func (p *mqttPublisher) Close() {
+	close(p.done)
+	<-p.stopped
+}
+
+// SensorAdded schedules republishing of device inventory
+func (p *mqttPublisher) SensorAdded(d ESPHomeDiscovery) {
+	p.inventoryUpdate()
+}
+
+func (p *mqttPublisher) SensorRemoved(d ESPHomeDiscovery) {
+	p.inventoryUpdate()
+}
+
+func (p *mqttPublisher) inventoryUpdate() {
+	if len(p.cfg.InventoryTopic) == 0 {
+		return
+	}
+	select {
+	case p.inventoryChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (p *mqttPublisher) inventoryPublisher() {
+	defer close(p.stopped)
+	for {
+		select {
+		case <-p.inventoryChanged:
+		case <-p.done:
+			return
+		}
+		// discovery comes in bursts on reconnect, wait for it to settle
+		select {
+		case <-time.After(time.Second * 5):
+		case <-p.done:
+			return
+		}
+		select {
+		case <-p.inventoryChanged:
+		default:
+		}
+		b, err := json.Marshal(p.inventory())
+		if err != nil {
+			p.q.l.Errorf("error encoding inventory: %s", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		err = p.q.client.Publish(ctx, p.cfg.InventoryTopic, 1, true, b)
+		cancel()
+		if err != nil {
+			p.q.l.Warnf("error publishing inventory: %s", err)
+		}
+	}
+}
+
+func (p *mqttPublisher) inventory() *mqttInventory {
+	inv := &mqttInventory{Updated: time.Now()}
+	devices := map[string]*mqttInventoryDevice{}
+	p.q.RLock()
+	for _, d := range p.q.discovery {
+		dev, ok := devices[d.Dev.Name]
+		if !ok {
+			dev = &mqttInventoryDevice{
+				Name:            d.Dev.Name,
+				ID:              d.Dev.ID,
+				Model:           d.Dev.Model,
+				Manufacturer:    d.Dev.Manufacturer,
+				SoftwareVersion: d.Dev.SoftwareVersion,
+			}
+			devices[d.Dev.Name] = dev
+		}
+		dev.Sensors = append(dev.Sensors, mqttInventorySensor{
+			Name:        d.Name,
+			DeviceClass: d.DeviceClass,
+			Unit:        d.Unit,
+			StateClass:  d.StateClass,
+			StateTopic:  d.StateTopic,
+		})
+	}
+	p.q.RUnlock()
+	for _, dev := range devices {
+		sort.Slice(dev.Sensors, func(i, j int) bool { return dev.Sensors[i].Name < dev.Sensors[j].Name })
+		inv.Devices = append(inv.Devices, *dev)
+	}
+	sort.Slice(inv.Devices, func(i, j int) bool { return inv.Devices[i].Name < inv.Devices[j].Name })
+	return inv
+}
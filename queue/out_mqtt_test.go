@@ -0,0 +1,63 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMQTTPublisherTopic(t *testing.T) {
+	p, err := newMQTTPublisher(&Queue{}, MQTTOutputConfig{
+		Topic: "esphome2prom/{{.Labels.device}}/{{.Name}}/{{.Labels.sensor}}",
+	})
+	require.NoError(t, err)
+	topic, err := p.topicFor(Metric{
+		Name:   "temperature",
+		Labels: map[string]string{"device": "garage", "sensor": "in/out #1"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "esphome2prom/garage/temperature/in_out _1", topic)
+}
+
+func TestMQTTPublisherInventory(t *testing.T) {
+	q := &Queue{discovery: map[string]ESPHomeDiscovery{}}
+	dev := &ESPHomeDev{Name: "garage", Model: "esp32", SoftwareVersion: "2025.10.0"}
+	q.discovery["garage/temp"] = ESPHomeDiscovery{Name: "temp", DeviceClass: DeviceClassTemperature, Unit: "°C", StateTopic: "garage/sensor/temp/state", Dev: dev}
+	q.discovery["garage/hum"] = ESPHomeDiscovery{Name: "hum", DeviceClass: DeviceClassHumidity, Unit: "%", StateTopic: "garage/sensor/hum/state", Dev: dev}
+	p, err := newMQTTPublisher(q, MQTTOutputConfig{Topic: "x"})
+	require.NoError(t, err)
+	inv := p.inventory()
+	require.Len(t, inv.Devices, 1)
+	assert.Equal(t, "esp32", inv.Devices[0].Model)
+	require.Len(t, inv.Devices[0].Sensors, 2)
+	assert.Equal(t, "hum", inv.Devices[0].Sensors[0].Name)
+}
+
+func TestMQTTPublisherInventoryOnly(t *testing.T) {
+	// client is nil, publishing metrics would panic
+	p, err := newMQTTPublisher(&Queue{}, MQTTOutputConfig{InventoryTopic: "esphome2prom/inventory"})
+	require.NoError(t, err)
+	assert.NoError(t, p.Write(context.Background(), []Metric{{Name: "temperature"}}))
+	p.SensorAdded(ESPHomeDiscovery{})
+	done := make(chan struct{})
+	go func() {
+		p.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("inventory publisher did not stop")
+	}
+}
+
+func TestMQTTSinkWithoutClient(t *testing.T) {
+	q := &Queue{cfg: &Config{}}
+	_, err := q.newSink(SinkConfig{Type: SinkMQTT, MQTT: MQTTOutputConfig{Topic: "x"}})
+	assert.Error(t, err)
+	q.cfg.MQTTAddr = "tcp://127.0.0.1:1883"
+	_, err = q.newSink(SinkConfig{Type: SinkMQTT})
+	assert.Error(t, err)
+}
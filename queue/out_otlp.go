@@ -0,0 +1,371 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OTLPProtocolHTTPProtobuf = "http/protobuf"
+	OTLPProtocolHTTPJSON     = "http/json"
+	OTLPProtocolGRPC         = "grpc"
+)
+
+type OTLPConfig struct {
+	// Endpoint is URL for HTTP (path defaults to /v1/metrics) or host:port for gRPC
+	Endpoint string `yaml:"endpoint"`
+	// Protocol is one of http/protobuf (default), http/json or grpc
+	Protocol string            `yaml:"protocol"`
+	Headers  map[string]string `yaml:"headers"`
+	// Insecure disables TLS for gRPC
+	Insecure bool          `yaml:"insecure"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// UCUM units of metrics after conversion done by sensors
+var ucumUnits = map[string]string{
+	"temperature":   "Cel",
+	"humidity":      "%",
+	"pressure":      "hPa",
+	"voltage":       "V",
+	"current":       "A",
+	"co2":           "[ppm]",
+	"power":         "W",
+	"energy":        "kW.h",
+	"battery":       "%",
+	"wind_speed":    "m/s",
+	"precipitation": "mm",
+}
+
+// UCUM for units passed in `unit` label
+var ucumLabelUnits = map[string]string{
+	"dBm":   "dB[mW]",
+	"dB":    "dB",
+	"µg/m³": "ug/m3",
+	"μg/m³": "ug/m3",
+	"%":     "%",
+	"ppm":   "[ppm]",
+}
+
+type otlpWriter struct {
+	cfg      OTLPConfig
+	prefix   string
+	meta     func(device, sensor string) (ESPHomeDiscovery, bool)
+	http     *http.Client
+	url      string
+	grpcConn *grpc.ClientConn
+	grpc     colmetricspb.MetricsServiceClient
+	started  time.Time
+	// start time and last value of cumulative series by seriesHash
+	sums      map[uint64]otlpSum
+	lastEvict time.Time
+	sync.Mutex
+}
+
+// otlpSumMaxAge is how long state of cumulative series that stopped coming is kept
+const otlpSumMaxAge = time.Hour * 24
+
+type otlpSum struct {
+	start time.Time
+	last  float64
+	seen  time.Time
+}
+
+func newOTLPWriter(cfg OTLPConfig, prefix string, meta func(device, sensor string) (ESPHomeDiscovery, bool)) (*otlpWriter, error) {
+	if len(cfg.Protocol) == 0 {
+		cfg.Protocol = OTLPProtocolHTTPProtobuf
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	w := &otlpWriter{
+		cfg:     cfg,
+		prefix:  prefix,
+		meta:    meta,
+		started: time.Now(),
+		sums:    map[uint64]otlpSum{},
+	}
+	switch cfg.Protocol {
+	case OTLPProtocolHTTPProtobuf, OTLPProtocolHTTPJSON:
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse OTLP endpoint: %w", err)
+		}
+		if len(strings.Trim(u.Path, "/")) == 0 {
+			u.Path = "/v1/metrics"
+		}
+		w.url = u.String()
+		w.http = &http.Client{Timeout: cfg.Timeout}
+	case OTLPProtocolGRPC:
+		creds := credentials.NewTLS(&tls.Config{})
+		if cfg.Insecure {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("error setting up OTLP gRPC client: %w", err)
+		}
+		w.grpcConn = conn
+		w.grpc = colmetricspb.NewMetricsServiceClient(conn)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol [%s]", cfg.Protocol)
+	}
+	return w, nil
+}
+
+func (w *otlpWriter) Write(ctx context.Context, metrics []Metric) error {
+	req := w.request(metrics)
+	if w.grpc != nil {
+		return w.writeGRPC(ctx, req)
+	}
+	return w.writeHTTP(ctx, req)
+}
+
+func (w *otlpWriter) writeGRPC(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, w.cfg.Timeout)
+	defer cancel()
+	if len(w.cfg.Headers) > 0 {
+		ctx = metadata.NewOutgoingContext(ctx, metadata.New(w.cfg.Headers))
+	}
+	_, err := w.grpc.Export(ctx, req)
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.ResourceExhausted, codes.DeadlineExceeded, codes.Aborted:
+		return RecoverableError{Err: err}
+	}
+	return err
+}
+
+func (w *otlpWriter) writeHTTP(ctx context.Context, req *colmetricspb.ExportMetricsServiceRequest) error {
+	var body []byte
+	var err error
+	contentType := "application/x-protobuf"
+	if w.cfg.Protocol == OTLPProtocolHTTPJSON {
+		contentType = "application/json"
+		body, err = protojson.Marshal(req)
+	} else {
+		body, err = proto.Marshal(req)
+	}
+	if err != nil {
+		return fmt.Errorf("error marshalling OTLP request: %w", err)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, "POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", contentType)
+	for k, v := range w.cfg.Headers {
+		hreq.Header.Set(k, v)
+	}
+	resp, err := w.http.Do(hreq)
+	if err != nil {
+		return RecoverableError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("OTLP endpoint returned [%d]: %s", resp.StatusCode, string(b))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return RecoverableError{Err: err, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
+
+func (w *otlpWriter) Close() {
+	if w.grpcConn != nil {
+		w.grpcConn.Close()
+	}
+}
+
+// request groups metrics by device; device metadata from discovery ends up in resource attributes.
+// Points of the same metric are sent as data points of single metric
+func (w *otlpWriter) request(metrics []Metric) *colmetricspb.ExportMetricsServiceRequest {
+	byDevice := map[string][]Metric{}
+	for _, m := range metrics {
+		byDevice[m.Labels["device"]] = append(byDevice[m.Labels["device"]], m)
+	}
+	devices := make([]string, 0, len(byDevice))
+	for d := range byDevice {
+		devices = append(devices, d)
+	}
+	sort.Strings(devices)
+	req := &colmetricspb.ExportMetricsServiceRequest{}
+	w.Lock()
+	defer w.Unlock()
+	w.evictSums(time.Now())
+	for _, device := range devices {
+		res := &resourcepb.Resource{
+			Attributes: []*commonpb.KeyValue{otlpString("service.name", "esphome2prom")},
+		}
+		if len(device) > 0 {
+			res.Attributes = append(res.Attributes, otlpString("esphome.device", device))
+		}
+		scope := &metricspb.ScopeMetrics{
+			Scope: &commonpb.InstrumentationScope{Name: "github.com/XANi/esphome2prom"},
+		}
+		// sensors sharing a name can still differ in unit or state class, those go to separate metrics
+		byKey := map[[3]string]*metricspb.Metric{}
+		devMetaAdded := false
+		for _, m := range byDevice[device] {
+			d, ok := w.meta(device, m.Labels["sensor"])
+			if ok && !devMetaAdded && d.Dev != nil {
+				res.Attributes = append(res.Attributes, otlpDeviceAttributes(d.Dev)...)
+				devMetaAdded = true
+			}
+			unit := ucumUnit(strings.TrimPrefix(m.Name, w.prefix), m.Labels["unit"])
+			key := [3]string{m.Name, unit, d.StateClass}
+			om, ok := byKey[key]
+			if !ok {
+				om = newOTLPMetric(m.Name, unit, d.StateClass)
+				byKey[key] = om
+				scope.Metrics = append(scope.Metrics, om)
+			}
+			dp := w.dataPoint(m)
+			if sum := om.GetSum(); sum != nil {
+				dp.StartTimeUnixNano = uint64(w.startTime(m, sum.IsMonotonic).UnixNano())
+				sum.DataPoints = append(sum.DataPoints, dp)
+			} else {
+				om.GetGauge().DataPoints = append(om.GetGauge().DataPoints, dp)
+			}
+		}
+		req.ResourceMetrics = append(req.ResourceMetrics, &metricspb.ResourceMetrics{
+			Resource:     res,
+			ScopeMetrics: []*metricspb.ScopeMetrics{scope},
+		})
+	}
+	return req
+}
+
+func newOTLPMetric(name, unit, stateClass string) *metricspb.Metric {
+	om := &metricspb.Metric{
+		Name: name,
+		Unit: unit,
+	}
+	switch stateClass {
+	case "total_increasing":
+		om.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			IsMonotonic:            true,
+		}}
+	case "total":
+		om.Data = &metricspb.Metric_Sum{Sum: &metricspb.Sum{
+			AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+		}}
+	default:
+		om.Data = &metricspb.Metric_Gauge{Gauge: &metricspb.Gauge{}}
+	}
+	return om
+}
+
+func (w *otlpWriter) dataPoint(m Metric) *metricspb.NumberDataPoint {
+	dp := &metricspb.NumberDataPoint{
+		TimeUnixNano: uint64(m.TS.UnixNano()),
+		Value:        &metricspb.NumberDataPoint_AsDouble{AsDouble: m.Value},
+	}
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		if k != "device" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		dp.Attributes = append(dp.Attributes, otlpString(k, m.Labels[k]))
+	}
+	return dp
+}
+
+// startTime of cumulative series is writer start (or first point if older) and
+// moves to the point's time when monotonic counter goes down, i.e. device reset it.
+// Must be called with lock held
+func (w *otlpWriter) startTime(m Metric, monotonic bool) time.Time {
+	h := seriesHash(m)
+	s, ok := w.sums[h]
+	switch {
+	case !ok:
+		s.start = w.started
+		if m.TS.Before(s.start) {
+			s.start = m.TS
+		}
+	case monotonic && m.Value < s.last:
+		s.start = m.TS.Add(-time.Millisecond)
+	}
+	s.last = m.Value
+	s.seen = time.Now()
+	w.sums[h] = s
+	return s.start
+}
+
+// evictSums forgets cumulative series not seen for otlpSumMaxAge, so removed sensors don't pile up.
+// Must be called with lock held
+func (w *otlpWriter) evictSums(now time.Time) {
+	if now.Sub(w.lastEvict) < otlpSumMaxAge/24 {
+		return
+	}
+	w.lastEvict = now
+	for h, s := range w.sums {
+		if now.Sub(s.seen) > otlpSumMaxAge {
+			delete(w.sums, h)
+		}
+	}
+}
+
+func ucumUnit(name string, labelUnit string) string {
+	if u, ok := ucumUnits[name]; ok {
+		return u
+	}
+	if u, ok := ucumLabelUnits[labelUnit]; ok {
+		return u
+	}
+	return labelUnit
+}
+
+func otlpDeviceAttributes(d *ESPHomeDev) (attrs []*commonpb.KeyValue) {
+	if len(d.ID) > 0 {
+		attrs = append(attrs, otlpString("device.id", d.ID))
+	}
+	if len(d.Manufacturer) > 0 {
+		attrs = append(attrs, otlpString("device.manufacturer", d.Manufacturer))
+	}
+	if len(d.Model) > 0 {
+		attrs = append(attrs, otlpString("device.model.identifier", d.Model))
+	}
+	if len(d.SoftwareVersion) > 0 {
+		attrs = append(attrs, otlpString("esphome.sw_version", d.SoftwareVersion))
+	}
+	return attrs
+}
+
+func otlpString(k, v string) *commonpb.KeyValue {
+	return &commonpb.KeyValue{
+		Key:   k,
+		Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: v}},
+	}
+}
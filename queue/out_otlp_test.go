@@ -0,0 +1,184 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testOTLPMeta(device, sensor string) (ESPHomeDiscovery, bool) {
+	if device != "plug" {
+		return ESPHomeDiscovery{}, false
+	}
+	d := ESPHomeDiscovery{
+		Name: sensor,
+		Dev: &ESPHomeDev{
+			ID:              "aabbcc",
+			Name:            "plug",
+			SoftwareVersion: "2025.10.0",
+			Model:           "esp32",
+			Manufacturer:    "espressif",
+		},
+	}
+	if sensor == "energy" {
+		d.StateClass = "total_increasing"
+	}
+	return d, true
+}
+
+func TestOTLPRequest(t *testing.T) {
+	w, err := newOTLPWriter(OTLPConfig{Endpoint: "http://127.0.0.1:4318"}, "esp_", testOTLPMeta)
+	require.NoError(t, err)
+	assert.Equal(t, "http://127.0.0.1:4318/v1/metrics", w.url)
+	req := w.request([]Metric{
+		{Name: "esp_voltage", Labels: map[string]string{"device": "plug", "sensor": "mains"}, Value: 230, TS: time.Now()},
+		{Name: "esp_energy", Labels: map[string]string{"device": "plug", "sensor": "energy"}, Value: 12.5, TS: time.Now()},
+		{Name: "esp_temperature", Labels: map[string]string{"device": "other", "sensor": "t"}, Value: 21, TS: time.Now()},
+	})
+	require.Len(t, req.ResourceMetrics, 2)
+	plug := req.ResourceMetrics[1]
+	attrs := map[string]string{}
+	for _, a := range plug.Resource.Attributes {
+		attrs[a.Key] = a.Value.GetStringValue()
+	}
+	assert.Equal(t, "plug", attrs["esphome.device"])
+	assert.Equal(t, "esp32", attrs["device.model.identifier"])
+	assert.Equal(t, "2025.10.0", attrs["esphome.sw_version"])
+	metrics := plug.ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "V", metrics[0].Unit)
+	assert.NotNil(t, metrics[0].GetGauge())
+	assert.Equal(t, "sensor", metrics[0].GetGauge().DataPoints[0].Attributes[0].Key)
+	require.NotNil(t, metrics[1].GetSum())
+	assert.True(t, metrics[1].GetSum().IsMonotonic)
+	assert.Equal(t, uint64(w.started.UnixNano()), metrics[1].GetSum().DataPoints[0].StartTimeUnixNano)
+	assert.Equal(t, "Cel", req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Unit)
+}
+
+func TestOTLPRequestGrouping(t *testing.T) {
+	w, err := newOTLPWriter(OTLPConfig{Endpoint: "http://127.0.0.1:4318"}, "", testOTLPMeta)
+	require.NoError(t, err)
+	ts := time.Now()
+	energy := func(sensor string, v float64, ts time.Time) Metric {
+		return Metric{Name: "energy", Labels: map[string]string{"device": "plug", "sensor": sensor}, Value: v, TS: ts}
+	}
+	req := w.request([]Metric{
+		{Name: "voltage", Labels: map[string]string{"device": "plug", "sensor": "l1"}, Value: 230, TS: ts},
+		energy("energy", 10, ts),
+		{Name: "voltage", Labels: map[string]string{"device": "plug", "sensor": "l2"}, Value: 231, TS: ts},
+		energy("energy", 11, ts.Add(time.Second)),
+	})
+	metrics := req.ResourceMetrics[0].ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "voltage", metrics[0].Name)
+	assert.Len(t, metrics[0].GetGauge().DataPoints, 2)
+	sum := metrics[1].GetSum()
+	require.NotNil(t, sum)
+	require.Len(t, sum.DataPoints, 2)
+	start := uint64(w.started.UnixNano())
+	assert.Equal(t, start, sum.DataPoints[0].StartTimeUnixNano)
+	assert.Equal(t, start, sum.DataPoints[1].StartTimeUnixNano)
+
+	// counter going down is a reset, start time moves to it
+	resetTS := ts.Add(time.Minute)
+	req = w.request([]Metric{energy("energy", 1, resetTS)})
+	dp := req.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].GetSum().DataPoints[0]
+	assert.Greater(t, dp.StartTimeUnixNano, start)
+	assert.Less(t, dp.StartTimeUnixNano, uint64(resetTS.UnixNano()))
+}
+
+func TestOTLPUnits(t *testing.T) {
+	sink := &testSink{}
+	q, err := New(&Config{
+		Logger: zaptest.NewLogger(t).Sugar(),
+		Sinks:  []SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+	})
+	require.NoError(t, err)
+	// every device class with a sensor type and UCUM unit of metric it produces
+	classes := []struct {
+		class DeviceClass
+		unit  string
+		ucum  string
+	}{
+		{DeviceClassTemperature, "°C", "Cel"},
+		{DeviceClassPressure, "hPa", "hPa"},
+		{DeviceClassHumidity, "%", "%"},
+		{DeviceClassSignalStrength, "dBm", "dB[mW]"},
+		{DeviceClassVoltage, "V", "V"},
+		{DeviceClassCurrent, "A", "A"},
+		{DeviceClassPower, "W", "W"},
+		{DeviceClassEnergy, "kWh", "kW.h"},
+		{DeviceClassBattery, "%", "%"},
+		{DeviceClassWindSpeed, "km/h", "m/s"},
+		{DeviceClassPrecipitation, "in", "mm"},
+		{DeviceClassCO2, "ppm", "[ppm]"},
+		{DeviceClassParticulate1, "µg/m³", "ug/m3"},
+		{DeviceClassParticulate25, "µg/m³", "ug/m3"},
+		{DeviceClassParticulate4, "µg/m³", "ug/m3"},
+		{DeviceClassParticulate10, "µg/m³", "ug/m3"},
+		// index, no unit
+		{DeviceClassParticulateSize, "", ""},
+	}
+	for _, c := range classes {
+		topic := "dev/sensor/" + string(c.class) + "/state"
+		q.AddSensor(topic+"/config", ESPHomeDiscovery{
+			DeviceClass: c.class,
+			Unit:        c.unit,
+			Name:        string(c.class),
+			StateTopic:  topic,
+			Dev:         &ESPHomeDev{Name: "dev"},
+		})
+		q.State(topic, []byte("1"))
+	}
+	require.Eventually(t, func() bool { return sink.count() == len(classes) }, time.Second*5, time.Millisecond*10)
+	q.Close()
+	units := map[DeviceClass]string{}
+	for _, m := range sink.metrics {
+		units[DeviceClass(m.Labels["sensor"])] = ucumUnit(m.Name, m.Labels["unit"])
+	}
+	for _, c := range classes {
+		assert.Equal(t, c.ucum, units[c.class], "device class %s", c.class)
+	}
+}
+
+func TestOTLPEvictSums(t *testing.T) {
+	w, err := newOTLPWriter(OTLPConfig{Endpoint: "http://127.0.0.1:4318"}, "", testOTLPMeta)
+	require.NoError(t, err)
+	w.request([]Metric{{Name: "energy", Labels: map[string]string{"device": "plug", "sensor": "energy"}, Value: 1, TS: time.Now()}})
+	require.Len(t, w.sums, 1)
+	w.evictSums(time.Now().Add(otlpSumMaxAge / 2))
+	assert.Len(t, w.sums, 1)
+	w.evictSums(time.Now().Add(otlpSumMaxAge * 2))
+	assert.Empty(t, w.sums)
+}
+
+func TestOTLPWriteJSON(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/metrics", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "k1", r.Header.Get("X-Api-Key"))
+		b, _ := io.ReadAll(r.Body)
+		req := &colmetricspb.ExportMetricsServiceRequest{}
+		assert.NoError(t, protojson.Unmarshal(b, req))
+		assert.Len(t, req.ResourceMetrics, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	w, err := newOTLPWriter(OTLPConfig{
+		Endpoint: srv.URL,
+		Protocol: OTLPProtocolHTTPJSON,
+		Headers:  map[string]string{"X-Api-Key": "k1"},
+	}, "", testOTLPMeta)
+	require.NoError(t, err)
+	require.NoError(t, w.Write(context.Background(), []Metric{
+		{Name: "voltage", Labels: map[string]string{"device": "plug", "sensor": "mains"}, Value: 230, TS: time.Now()},
+	}))
+}
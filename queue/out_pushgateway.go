@@ -0,0 +1,264 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PushgatewayConfig struct {
+	URL string `yaml:"url"`
+	// Job is the job label of grouping key, defaults to esphome2prom
+	Job string `yaml:"job"`
+	// Grouping are labels added to grouping key after job, e.g. [device]
+	Grouping []string `yaml:"grouping"`
+	// Method is PUT (replace whole group, default) or POST (replace only pushed metric names)
+	Method     string        `yaml:"method"`
+	Interval   time.Duration `yaml:"interval"`
+	StaleAfter time.Duration `yaml:"stale_after"`
+	Username   string        `yaml:"username"`
+	Password   string        `yaml:"password"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+// pushgatewayWriter periodically pushes latest value of every sensor, one push per grouping key
+type pushgatewayWriter struct {
+	cfg      PushgatewayConfig
+	prefix   string
+	meta     func(device, sensor string) (ESPHomeDiscovery, bool)
+	http     *http.Client
+	snapshot *snapshot
+	l        *zap.SugaredLogger
+	// grouping labels of groups pushed so far, by group URL
+	pushed map[string]map[string]string
+	pushMu sync.Mutex
+	// devices whose groups are deleted on next push
+	removed   map[string]bool
+	removedMu sync.Mutex
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+func newPushgatewayWriter(cfg PushgatewayConfig, prefix string, meta func(device, sensor string) (ESPHomeDiscovery, bool), l *zap.SugaredLogger) (*pushgatewayWriter, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || len(u.Host) == 0 {
+		return nil, fmt.Errorf("bad pushgateway URL [%s]: %v", cfg.URL, err)
+	}
+	if len(cfg.Job) == 0 {
+		cfg.Job = "esphome2prom"
+	}
+	cfg.Method = strings.ToUpper(cfg.Method)
+	if len(cfg.Method) == 0 {
+		cfg.Method = http.MethodPut
+	}
+	if cfg.Method != http.MethodPut && cfg.Method != http.MethodPost {
+		return nil, fmt.Errorf("pushgateway method must be PUT or POST, not [%s]", cfg.Method)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second * 15
+	}
+	if cfg.StaleAfter <= 0 {
+		cfg.StaleAfter = time.Minute * 5
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	w := &pushgatewayWriter{
+		cfg:      cfg,
+		prefix:   prefix,
+		meta:     meta,
+		http:     &http.Client{Timeout: cfg.Timeout},
+		snapshot: newSnapshot(),
+		l:        l,
+		pushed:   map[string]map[string]string{},
+		removed:  map[string]bool{},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *pushgatewayWriter) Write(ctx context.Context, metrics []Metric) error {
+	w.snapshot.Update(metrics)
+	return nil
+}
+
+func (w *pushgatewayWriter) run() {
+	defer close(w.stopped)
+	t := time.NewTicker(w.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.done:
+			return
+		}
+		err := w.push(context.Background())
+		if err != nil {
+			w.l.Warnf("error pushing to pushgateway: %s", err)
+		}
+	}
+}
+
+// Close pushes final snapshot, so one-shot runs (e.g. from cron) still deliver their data
+func (w *pushgatewayWriter) Close() {
+	close(w.done)
+	<-w.stopped
+	err := w.push(context.Background())
+	if err != nil {
+		w.l.Warnf("error pushing to pushgateway: %s", err)
+	}
+}
+
+func (w *pushgatewayWriter) SensorAdded(d ESPHomeDiscovery) {}
+
+// SensorRemoved forgets sensor's series, device's groups are deleted on next push once it has no sensors left
+func (w *pushgatewayWriter) SensorRemoved(d ESPHomeDiscovery) {
+	if d.Dev == nil {
+		return
+	}
+	device := d.Dev.Name
+	w.snapshot.Remove(func(m Metric) bool {
+		return m.Labels["device"] == device && m.Labels["sensor"] == d.Name
+	})
+	for _, m := range w.snapshot.Current(0) {
+		if m.Labels["device"] == device {
+			return
+		}
+	}
+	w.removedMu.Lock()
+	defer w.removedMu.Unlock()
+	w.removed[device] = true
+}
+
+func (w *pushgatewayWriter) push(ctx context.Context) error {
+	groups := map[string][]Metric{}
+	groupLabels := map[string]map[string]string{}
+	for _, m := range w.snapshot.Current(w.cfg.StaleAfter) {
+		labels := make(map[string]string, len(w.cfg.Grouping))
+		for _, l := range w.cfg.Grouping {
+			labels[l] = m.Labels[l]
+		}
+		u := w.groupURL(labels)
+		groups[u] = append(groups[u], m)
+		groupLabels[u] = labels
+	}
+	w.removedMu.Lock()
+	removed := w.removed
+	w.removed = map[string]bool{}
+	w.removedMu.Unlock()
+	w.pushMu.Lock()
+	defer w.pushMu.Unlock()
+	var errs []string
+	for u, labels := range w.pushed {
+		// device can come back before its groups are deleted
+		if _, ok := groups[u]; ok || !removed[labels["device"]] {
+			continue
+		}
+		err := w.request(ctx, http.MethodDelete, u, nil)
+		if err != nil {
+			errs = append(errs, err.Error())
+			w.removedMu.Lock()
+			w.removed[labels["device"]] = true
+			w.removedMu.Unlock()
+			continue
+		}
+		w.l.Infof("deleted group %s of removed device %s", u, labels["device"])
+		delete(w.pushed, u)
+	}
+	for u, metrics := range groups {
+		body := bytes.Buffer{}
+		skipped, err := writeExposition(&body, metrics, w.prefix, w.meta)
+		if err != nil {
+			return err
+		}
+		if len(skipped) > 0 {
+			w.l.Warnf("left out of %s: %s", u, strings.Join(skipped, "; "))
+		}
+		err = w.request(ctx, w.cfg.Method, u, body.Bytes())
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		w.pushed[u] = groupLabels[u]
+	}
+	// with PUT semantics group with no live series shouldn't keep its last values
+	if w.cfg.Method == http.MethodPut {
+		for u := range w.pushed {
+			if _, ok := groups[u]; ok {
+				continue
+			}
+			err := w.request(ctx, http.MethodDelete, u, nil)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			delete(w.pushed, u)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d requests failed: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// groupURL builds /metrics/job/<job>/<label>/<value>... path, values that can't be used as path segment are base64 encoded
+func (w *pushgatewayWriter) groupURL(labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString(w.cfg.URL + "/metrics/job")
+	b.WriteString(pushgatewayPathValue(w.cfg.Job))
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString("/" + k + pushgatewayPathValue(labels[k]))
+	}
+	return b.String()
+}
+
+func pushgatewayPathValue(v string) string {
+	if len(v) == 0 {
+		return "@base64/="
+	}
+	if strings.Contains(v, "/") {
+		return "@base64/" + base64.RawURLEncoding.EncodeToString([]byte(v))
+	}
+	return "/" + url.PathEscape(v)
+}
+
+func (w *pushgatewayWriter) request(ctx context.Context, method, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+	}
+	if len(w.cfg.Username) > 0 {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	}
+	resp, err := w.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("%s %s returned [%d]: %s", method, u, resp.StatusCode, string(b))
+}
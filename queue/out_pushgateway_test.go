@@ -0,0 +1,67 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPushgateway(t *testing.T) {
+	var lock sync.Mutex
+	var requests []string
+	bodies := map[string]string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		bodies[r.URL.Path] = string(b)
+		lock.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+	w, err := newPushgatewayWriter(PushgatewayConfig{
+		URL:      srv.URL + "/",
+		Job:      "laptop",
+		Grouping: []string{"device"},
+		Interval: time.Hour,
+	}, "", nil, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	require.NoError(t, w.Write(context.Background(), []Metric{
+		{Name: "temperature", Labels: map[string]string{"device": "garage", "sensor": "t"}, Value: 5},
+		{Name: "temperature", Labels: map[string]string{"device": "a/b", "sensor": "t"}, Value: 21},
+	}))
+	require.NoError(t, w.push(context.Background()))
+	sort.Strings(requests)
+	assert.Equal(t, []string{
+		"PUT /metrics/job/laptop/device/garage",
+		"PUT /metrics/job/laptop/device@base64/YS9i",
+	}, requests)
+	assert.Contains(t, bodies["/metrics/job/laptop/device/garage"], `temperature{device="garage",sensor="t"} 5`)
+
+	requests = nil
+	w.SensorRemoved(ESPHomeDiscovery{Name: "t", Dev: &ESPHomeDev{Name: "garage"}})
+	assert.Empty(t, requests)
+	require.NoError(t, w.push(context.Background()))
+	assert.Equal(t, []string{
+		"DELETE /metrics/job/laptop/device/garage",
+		"PUT /metrics/job/laptop/device@base64/YS9i",
+	}, requests)
+
+	requests = nil
+	w.Close()
+	assert.Equal(t, []string{"PUT /metrics/job/laptop/device@base64/YS9i"}, requests)
+}
+
+func TestPushgatewayGroupURL(t *testing.T) {
+	w := &pushgatewayWriter{cfg: PushgatewayConfig{URL: "http://pg:9091", Job: "esphome2prom"}}
+	assert.Equal(t, "http://pg:9091/metrics/job/esphome2prom/device/x%20y/host@base64/=",
+		w.groupURL(map[string]string{"device": "x y", "host": ""}))
+}
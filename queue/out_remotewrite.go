@@ -0,0 +1,196 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/XANi/esphome2prom/spool"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// each remote write sink can have its own spool
+var spoolDepth = newLabeledGauge("esphome2prom_spool_depth", "sink")
+var spoolSize = newLabeledGauge("esphome2prom_spool_size_bytes", "sink")
+var spoolOldestAge = newLabeledGauge("esphome2prom_spool_oldest_sample_age_seconds", "sink")
+
+// remoteWriteSink sends metrics via Prometheus remote write, sharded, with retries and optional on-disk spool
+type remoteWriteSink struct {
+	name   string
+	rw     *remoteWrite
+	shards *shardManager
+	spool  *spool.Spool
+	l      *zap.SugaredLogger
+	done   chan struct{}
+	// replay goroutine, spool can only be closed after it is gone
+	replay sync.WaitGroup
+}
+
+func newRemoteWriteSink(cfg RemoteWriteConfig, name string, l *zap.SugaredLogger) (*remoteWriteSink, error) {
+	if len(cfg.URL) == 0 {
+		return nil, fmt.Errorf("remote write URL is empty")
+	}
+	s := &remoteWriteSink{
+		name: name,
+		rw:   newRemoteWrite(cfg.URL, cfg.Timeout),
+		l:    l,
+		done: make(chan struct{}),
+	}
+	if len(cfg.Spool.Dir) > 0 {
+		if cfg.Spool.Logger == nil {
+			cfg.Spool.Logger = l.Named("spool")
+		}
+		var err error
+		s.spool, err = spool.New(cfg.Spool)
+		if err != nil {
+			return nil, fmt.Errorf("error opening spool: %w", err)
+		}
+	}
+	s.shards = newShardManager(s, cfg)
+	if s.spool != nil {
+		s.replay.Add(1)
+		go s.replaySpool()
+	}
+	return s, nil
+}
+
+// Write queues metrics on shards; sending, retries and spooling happen in background
+func (s *remoteWriteSink) Write(ctx context.Context, metrics []Metric) error {
+	for _, m := range metrics {
+		s.shards.Enqueue(m)
+	}
+	return nil
+}
+
+func (s *remoteWriteSink) Close() {
+	close(s.done)
+	s.replay.Wait()
+	s.shards.Close()
+	if s.spool != nil {
+		s.spool.Close()
+	}
+}
+
+func (s *remoteWriteSink) flush(batch []Metric) {
+	// keep order; if there is anything in spool, new data have to go after it
+	if s.spool != nil && s.spool.Depth() > 0 {
+		s.spoolMetrics(batch)
+		return
+	}
+	err := s.shards.sendWithRetry(batch)
+	if err == nil {
+		return
+	}
+	var rerr RecoverableError
+	if s.spool != nil && errors.As(err, &rerr) {
+		s.l.Warnf("error writing %d metrics, spooling: %s", len(batch), err)
+		s.spoolMetrics(batch)
+		return
+	}
+	rwSamplesFailed.Update(float64(len(batch)))
+	s.l.Warnf("error writing %d metrics, dropping: %s", len(batch), err)
+}
+
+func (s *remoteWriteSink) spoolMetrics(batch []Metric) {
+	entries := make([]spool.Entry, 0, len(batch))
+	for _, m := range batch {
+		b, err := json.Marshal(&m)
+		if err != nil {
+			rwSamplesFailed.Update(1)
+			s.l.Errorf("could not encode metric %+v: %s", m, err)
+			continue
+		}
+		entries = append(entries, spool.Entry{TS: m.TS, Data: b})
+	}
+	err := s.spool.Append(entries...)
+	if err != nil {
+		rwSamplesFailed.Update(float64(len(entries)))
+		s.l.Errorf("error spooling %d metrics, dropping: %s", len(batch), err)
+	}
+}
+
+// replaySpool sends spooled data in order once endpoint is back up
+func (s *remoteWriteSink) replaySpool() {
+	defer s.replay.Done()
+	backoff := time.Second
+	for {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		s.updateSpoolStats()
+		entries, err := s.spool.Peek(s.shards.cfg.MaxBatchLength)
+		if err != nil {
+			s.l.Errorf("error reading spool: %s", err)
+			if !s.sleep(time.Second * 10) {
+				return
+			}
+			continue
+		}
+		if len(entries) == 0 {
+			if !s.sleep(time.Second) {
+				return
+			}
+			continue
+		}
+		batch := make([]Metric, 0, len(entries))
+		for _, e := range entries {
+			var m Metric
+			err := json.Unmarshal(e.Data, &m)
+			if err != nil {
+				rwSamplesFailed.Update(1)
+				s.l.Warnf("skipping undecodable spool entry [%s]: %s", string(e.Data), err)
+				continue
+			}
+			batch = append(batch, m)
+		}
+		err = s.rw.Send(context.Background(), batch)
+		var rerr RecoverableError
+		if err != nil && errors.As(err, &rerr) {
+			s.l.Infof("endpoint still down, %d metrics in spool, retrying in %s: %s", s.spool.Depth(), backoff, err)
+			if !s.sleep(backoff) {
+				return
+			}
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		if err != nil {
+			rwSamplesFailed.Update(float64(len(batch)))
+			s.l.Warnf("dropping %d spooled metrics rejected by endpoint: %s", len(batch), err)
+		} else {
+			rwSamplesSent.Update(float64(len(batch)))
+		}
+		backoff = time.Second
+		err = s.spool.Commit(len(entries))
+		if err != nil {
+			s.l.Errorf("error committing spool: %s", err)
+		}
+	}
+}
+
+// sleep returns false if sink was closed before d passed
+func (s *remoteWriteSink) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+func (s *remoteWriteSink) updateSpoolStats() {
+	spoolDepth.With(s.name).Update(float64(s.spool.Depth()))
+	spoolSize.With(s.name).Update(float64(s.spool.Size()))
+	if ts := s.spool.Oldest(); !ts.IsZero() {
+		spoolOldestAge.With(s.name).Update(time.Since(ts).Seconds())
+	} else {
+		spoolOldestAge.With(s.name).Update(0)
+	}
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type TextfileConfig struct {
+	// Dir is node_exporter's --collector.textfile.directory
+	Dir string `yaml:"dir"`
+	// Filename defaults to esphome2prom.prom, it has to end with .prom to be picked up by node_exporter
+	Filename string        `yaml:"filename"`
+	Interval time.Duration `yaml:"interval"`
+	// StaleAfter drops sensors that were not updated for that long
+	StaleAfter time.Duration `yaml:"stale_after"`
+}
+
+// textfileWriter periodically rewrites .prom file with latest value of every sensor
+type textfileWriter struct {
+	cfg      TextfileConfig
+	path     string
+	prefix   string
+	meta     func(device, sensor string) (ESPHomeDiscovery, bool)
+	snapshot *snapshot
+	l        *zap.SugaredLogger
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func newTextfileWriter(cfg TextfileConfig, prefix string, meta func(device, sensor string) (ESPHomeDiscovery, bool), l *zap.SugaredLogger) (*textfileWriter, error) {
+	if len(cfg.Dir) == 0 {
+		return nil, fmt.Errorf("textfile dir is empty")
+	}
+	if len(cfg.Filename) == 0 {
+		cfg.Filename = "esphome2prom.prom"
+	}
+	if !strings.HasSuffix(cfg.Filename, ".prom") || strings.ContainsRune(cfg.Filename, os.PathSeparator) {
+		return nil, fmt.Errorf("textfile filename [%s] must be plain file name ending with .prom", cfg.Filename)
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Second * 15
+	}
+	if cfg.StaleAfter <= 0 {
+		cfg.StaleAfter = time.Minute * 5
+	}
+	st, err := os.Stat(cfg.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("textfile dir: %w", err)
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("textfile dir %s is not a directory", cfg.Dir)
+	}
+	w := &textfileWriter{
+		cfg:      cfg,
+		path:     filepath.Join(cfg.Dir, cfg.Filename),
+		prefix:   prefix,
+		meta:     meta,
+		snapshot: newSnapshot(),
+		l:        l,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *textfileWriter) Write(ctx context.Context, metrics []Metric) error {
+	w.snapshot.Update(metrics)
+	return nil
+}
+
+func (w *textfileWriter) run() {
+	defer close(w.stopped)
+	t := time.NewTicker(w.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-w.done:
+			return
+		}
+		err := w.writeFile()
+		if err != nil {
+			w.l.Errorf("error writing %s: %s", w.path, err)
+		}
+	}
+}
+
+// writeFile replaces the file atomically so node_exporter never reads partial one
+func (w *textfileWriter) writeFile() error {
+	// tmp file must not end with .prom or collector could pick it up
+	f, err := os.CreateTemp(w.cfg.Dir, "."+w.cfg.Filename+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	skipped, err := writeExposition(f, w.snapshot.Current(w.cfg.StaleAfter), w.prefix, w.meta)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if len(skipped) > 0 {
+		w.l.Warnf("left out of %s: %s", w.path, strings.Join(skipped, "; "))
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), w.path)
+}
+
+// Close writes final state and stops the writer
+func (w *textfileWriter) Close() {
+	close(w.done)
+	<-w.stopped
+	err := w.writeFile()
+	if err != nil {
+		w.l.Errorf("error writing %s: %s", w.path, err)
+	}
+}
+
+func (w *textfileWriter) SensorAdded(d ESPHomeDiscovery) {}
+
+// SensorRemoved drops removed sensor from the file without waiting for it to go stale
+func (w *textfileWriter) SensorRemoved(d ESPHomeDiscovery) {
+	if d.Dev == nil {
+		return
+	}
+	w.snapshot.Remove(func(m Metric) bool {
+		return m.Labels["device"] == d.Dev.Name && m.Labels["sensor"] == d.Name
+	})
+}
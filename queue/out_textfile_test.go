@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTextfileWriter(t *testing.T) {
+	dir := t.TempDir()
+	w, err := newTextfileWriter(TextfileConfig{Dir: dir, Interval: time.Hour, StaleAfter: time.Millisecond * 200}, "esp_", testOTLPMeta, zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	require.NoError(t, w.Write(context.Background(), []Metric{
+		{Name: "esp_voltage", Labels: map[string]string{"device": "plug", "sensor": "mains"}, Value: 230.5, TS: time.Now()},
+		{Name: "esp_energy", Labels: map[string]string{"device": "plug", "sensor": "energy"}, Value: 12, TS: time.Now()},
+		{Name: "esp_voltage", Labels: map[string]string{"device": "other", "sensor": `a"b`}, Value: 5, TS: time.Now()},
+	}))
+	require.NoError(t, w.writeFile())
+	b, err := os.ReadFile(filepath.Join(dir, "esphome2prom.prom"))
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP esp_energy energy reported by ESPHome sensors
+# TYPE esp_energy counter
+esp_energy{device="plug",sensor="energy"} 12
+# HELP esp_voltage voltage reported by ESPHome sensors
+# TYPE esp_voltage gauge
+esp_voltage{device="other",sensor="a\"b"} 5
+esp_voltage{device="plug",sensor="mains"} 230.5
+`, string(b))
+
+	time.Sleep(time.Millisecond * 300)
+	require.NoError(t, w.Write(context.Background(), []Metric{
+		{Name: "esp_voltage", Labels: map[string]string{"device": "plug", "sensor": "mains"}, Value: 231, TS: time.Now()},
+	}))
+	w.Close()
+	b, err = os.ReadFile(filepath.Join(dir, "esphome2prom.prom"))
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "energy")
+	assert.Contains(t, string(b), `esp_voltage{device="plug",sensor="mains"} 231`)
+	files, _ := os.ReadDir(dir)
+	assert.Len(t, files, 1, "temporary files should be cleaned up")
+}
+
+func TestWriteExpositionInvalid(t *testing.T) {
+	b := strings.Builder{}
+	skipped, err := writeExposition(&b, []Metric{
+		{Name: "esp_energy", Labels: map[string]string{"device": "plug", "sensor": "energy"}, Value: 12},
+		// same name, but not total_increasing
+		{Name: "esp_energy", Labels: map[string]string{"device": "other", "sensor": "energy"}, Value: 3},
+		{Name: "esp_voltage", Labels: map[string]string{"device": "plug", "sensor": "mains", "room.name": "hall", "1st": "x"}, Value: 230},
+		{Name: "esp_voltage", Labels: map[string]string{"device": "plug", "sensor": "l2", "a-b": "1", "a_b": "2"}, Value: 231},
+	}, "esp_", testOTLPMeta)
+	require.NoError(t, err)
+	assert.Equal(t, `# HELP esp_voltage voltage reported by ESPHome sensors
+# TYPE esp_voltage gauge
+esp_voltage{_1st="x",device="plug",room_name="hall",sensor="mains"} 230
+`, b.String())
+	require.Len(t, skipped, 2)
+	assert.Contains(t, skipped[0], "collide")
+	assert.Contains(t, skipped[1], "esp_energy")
+}
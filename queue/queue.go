@@ -1,26 +1,37 @@
 package queue
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/XANi/promwriter"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/k0kubun/pp/v3"
 	"go.uber.org/zap"
 	"log"
-	"net/url"
-	"os"
 	"strings"
 	"sync"
 	"time"
 )
 
 type Queue struct {
-	client    mqtt.Client
+	client    mqttClient
 	cfg       *Config
 	l         *zap.SugaredLogger
 	sensorMap map[string]Sensor
-	sendQueue chan Metric
+	// discovery data of registered sensors, by device and sensor name
+	discovery map[string]ESPHomeDiscovery
+	// discovery by config topic, to find what to remove when config is cleared
+	configTopics map[string]ESPHomeDiscovery
+	// device name by state topic, for per-device stats
+	stateDevices map[string]string
+	sendQueue    chan Metric
+	dispatcher   *dispatcher
+	// state messages that came before discovery of their sensor
+	pending *pendingState
+	// subscriptions added with Subscribe
+	subscriptions []subscription
+	stored        storedSensors
 	sync.RWMutex
 }
 
@@ -30,54 +41,84 @@ type Config struct {
 	ExtraLabels map[string]string
 	Prefix      string
 	Debug       bool
+	// MQTTTLS is used for ssl://, tls://, mqtts:// and wss:// brokers
+	MQTTTLS MQTTTLSConfig
+	// MQTTSession configures persistent session, clean session with random client ID is used by default
+	MQTTSession MQTTSessionConfig
+	// MQTTVersion is protocol version, 3 (3.1.1, default) or 5
+	MQTTVersion int
+	// MQTTSharedGroup subscribes state topics as $share/<group>/..., so replicas in the group split state messages.
+	// Requires MQTT 5, discovery is still received by every replica
+	MQTTSharedGroup string
+	// Broker is embedded broker consumed in-process, MQTTAddr and other MQTT client settings are ignored if set
+	Broker InProcessBroker
+	// Sinks are outputs metrics are fanned out to
+	Sinks []SinkConfig
+	// SelfMetricsInterval is how often bridge's own metrics are sent through sinks, 0 disables it
+	SelfMetricsInterval time.Duration
+	// StaticSensors are sensors of nodes without discovery, they take precedence over discovered ones
+	StaticSensors []StaticSensor
+	// Store persists sensors learned from discovery, they are restored on start
+	Store SensorStore
+	// StoreReconcileAfter is how long retained discovery has to be quiet before restored sensors it didn't
+	// confirm are removed, 30s by default
+	StoreReconcileAfter time.Duration
+	// Tracker gets devices' sensors and state messages
+	Tracker DeviceTracker
 }
 
 func New(cfg *Config) (*Queue, error) {
-	mqttURL, err := url.Parse(cfg.MQTTAddr)
+	q := &Queue{
+		sensorMap:    map[string]Sensor{},
+		discovery:    map[string]ESPHomeDiscovery{},
+		configTopics: map[string]ESPHomeDiscovery{},
+		stateDevices: map[string]string{},
+		pending:      newPendingState(),
+		cfg:          cfg,
+		sendQueue:    make(chan Metric, 128),
+		l:            cfg.Logger,
+	}
+	q.dispatcher = newDispatcher(cfg.Prefix, cfg.ExtraLabels, cfg.Logger.Named("sink"))
+	for _, sc := range cfg.Sinks {
+		sc.setDefaults()
+		if err := sc.Filter.validate(); err != nil {
+			return nil, fmt.Errorf("sink %s: %w", sc.Name, err)
+		}
+		sink, err := q.newSink(sc)
+		if err != nil {
+			return nil, fmt.Errorf("error setting up %s sink: %w", sc.Type, err)
+		}
+		q.dispatcher.AddSink(sc, sink)
+	}
+	// static sensors have to be there before discovery of the same ones comes in
+	err := q.addStaticSensors()
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse MQTT URL: %w", err)
+		q.dispatcher.Close()
+		return nil, err
+	}
+	err = q.restoreSensors()
+	if err != nil {
+		q.dispatcher.Close()
+		return nil, fmt.Errorf("error restoring sensors: %w", err)
+	}
+	// writer has to run before messages start coming in
+	go q.writer()
+	client, err := q.newMQTTClient()
+	if err != nil {
+		q.dispatcher.Close()
+		return nil, err
 	}
-	q := &Queue{
-		sensorMap: map[string]Sensor{},
-		cfg:       cfg,
-		sendQueue: make(chan Metric, 128),
-		l:         cfg.Logger,
-	}
-	p, _ := mqttURL.User.Password()
-
-	opts := mqtt.NewClientOptions().
-		AddBroker(cfg.MQTTAddr).
-		SetUsername(mqttURL.User.Username()).
-		SetPassword(p).
-		SetClientID("esphome2prom" + randomString(32)). // this need to be unique, else we get disconnect
-		SetKeepAlive(20 * time.Second).
-		SetPingTimeout(10 * time.Second).
-		SetConnectRetry(true).
-		SetConnectRetryInterval(30 * time.Second).
-		SetAutoReconnect(true).
-		SetReconnectingHandler(func(client mqtt.Client, options *mqtt.ClientOptions) {
-			cfg.Logger.Warnf("reconnecting to MQ")
-		}).SetConnectionLostHandler(func(client mqtt.Client, err error) {
-		cfg.Logger.Warnf("connection to MQTT lost: %v", err)
-	}).SetOnConnectHandler(func(client mqtt.Client) {
-		cfg.Logger.Infof("connected to MQTT")
-		q.addSubscriptions()
-	})
-	client := mqtt.NewClient(opts)
 	q.client = client
-
-	if token := client.Connect(); token.Wait() {
-		if token.Error() != nil {
-			cfg.Logger.Panicf("err connecting: %s", token.Error())
-		} else {
-			cfg.Logger.Infof("connected to mqtt %s:%s", mqttURL.Hostname(), mqttURL.Port())
-		}
+	err = q.subscribeStaticSensors()
+	if err != nil {
+		q.Close()
+		return nil, err
 	}
 	go func() {
 		failCount := 0
 		for {
 			time.Sleep(30 * time.Second)
-			if !client.IsConnected() {
+			if !q.client.IsConnected() {
 				failCount++
 				failCount++
 			} else if failCount > 0 {
@@ -90,119 +131,251 @@ func New(cfg *Config) (*Queue, error) {
 	}()
 	//token := client.Publish("esphome/discover", 0, false, "hello mqtt")
 	//token.Wait()
-	promcfg := promwriter.Config{
-		URL:              os.Getenv("PROMETHEUS_WRITE_URL"),
-		MaxBatchDuration: time.Second * 1,
-		MaxBatchLength:   10,
-		Logger:           cfg.Logger.Named("promwriter"),
+	go q.statsLoop()
+
+	return q, nil
+}
+
+// SensorDiscovery returns discovery data sensor was registered with
+func (q *Queue) SensorDiscovery(device, sensor string) (ESPHomeDiscovery, bool) {
+	q.RLock()
+	defer q.RUnlock()
+	d, ok := q.discovery[device+"/"+sensor]
+	return d, ok
+}
+
+func (q *Queue) statsLoop() {
+	interval := time.Second * 10
+	if q.cfg.SelfMetricsInterval > 0 {
+		interval = min(interval, q.cfg.SelfMetricsInterval)
 	}
-	pw, err := promwriter.New(promcfg)
-	if err != nil {
-		cfg.Logger.Panicw("promwriter", "err", err)
+	lastSent := time.Now()
+	for {
+		time.Sleep(interval)
+		sendQueueDepth.Update(float64(len(q.sendQueue)))
+		q.dispatcher.updateStats()
+		if q.cfg.SelfMetricsInterval > 0 && time.Since(lastSent) >= q.cfg.SelfMetricsInterval {
+			lastSent = time.Now()
+			q.dispatcher.DispatchSelf(selfMetrics())
+		}
 	}
-	go func() {
+}
 
-		for ev := range q.sendQueue {
-			metric := promwriter.Metric{
-				Name:   cfg.Prefix + ev.Name,
-				Labels: ev.Labels,
-				TS:     ev.TS.UTC(),
-				Value:  ev.Value,
-			}
-			for k, v := range cfg.ExtraLabels {
-				ev.Labels[k] = v
-			}
-			err := pw.WriteMetric(metric)
-			if err != nil {
-				cfg.Logger.Warnf("error writing metric %+v: %s", metric, err)
-			}
+func (q *Queue) removeSensor(configTopic string) {
+	q.Lock()
+	d, ok := q.configTopics[configTopic]
+	if ok {
+		delete(q.configTopics, configTopic)
+		delete(q.discovery, d.Dev.Name+"/"+d.Name)
+		delete(q.sensorMap, d.StateTopic)
+		delete(q.stateDevices, d.StateTopic)
+	}
+	q.Unlock()
+	if ok {
+		discoveryMessages.With(discoveryRemoved).Update(1)
+		q.l.Infof("removing %s sensor under %s", d.DeviceClass, d.StateTopic)
+		q.dispatcher.SensorRemoved(d)
+		if q.cfg.Tracker != nil {
+			q.cfg.Tracker.SensorRemoved(d)
 		}
-	}()
+	}
+}
 
-	return q, nil
+// Close marks session offline, disconnects from MQTT and flushes sinks
+func (q *Queue) Close() {
+	if q.cfg.MQTTSession.persistent() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+		q.client.Publish(ctx, q.cfg.MQTTSession.presenceTopic(), 1, true, []byte(sessionOffline))
+		cancel()
+	}
+	q.client.Disconnect()
+	q.closeStore()
+	q.dispatcher.Close()
 }
 
-func (q *Queue) addSubscriptions() {
-	q.l.Debugf("adding subscriptions")
-	q.client.Subscribe("homeassistant/#", 0, func(c mqtt.Client, m mqtt.Message) {
-		d := ESPHomeDiscovery{}
-		// wildcard must be last character in the topic so we can't just do `homeassistant/#/config` here
-		if !strings.HasSuffix(m.Topic(), "/config") {
-			return
-		}
-		err := json.Unmarshal(m.Payload(), &d)
-		if err != nil {
-			q.cfg.Logger.Warnf("could not decode discovery %s: %s\n", m.Topic(), string(m.Payload()))
-			return
-		}
-		if q.cfg.Debug {
-			q.cfg.Logger.Debugf("received %s: %+v\n", m.Topic(), pp.Sprint(&d))
+const (
+	discoveryTopic = "homeassistant/#"
+	// this path need to be pretty exact to not catch the discovery path from above
+	stateTopic = "+/sensor/+/state"
+)
+
+func (q *Queue) subscriptionQoS() byte {
+	if q.cfg.MQTTSession.persistent() {
+		return 1
+	}
+	return 0
+}
+
+func (q *Queue) onDiscovery(m mqtt.Message) {
+	d := ESPHomeDiscovery{}
+	// wildcard must be last character in the topic so we can't just do `homeassistant/#/config` here
+	if !strings.HasSuffix(m.Topic(), "/config") {
+		return
+	}
+	// empty retained config means entity was removed
+	if len(m.Payload()) == 0 {
+		q.confirmSensor(m.Topic(), m.Retained())
+		q.removeSensor(m.Topic())
+		q.forgetSensor(m.Topic())
+		return
+	}
+	err := json.Unmarshal(m.Payload(), &d)
+	if err != nil {
+		discoveryMessages.With(discoveryInvalid).Update(1)
+		q.cfg.Logger.Warnf("could not decode discovery %s: %s\n", m.Topic(), string(m.Payload()))
+		return
+	}
+	if q.cfg.Debug {
+		q.cfg.Logger.Debugf("received %s: %+v\n", m.Topic(), pp.Sprint(&d))
+	}
+	q.addSensor(m.Topic(), d)
+	q.confirmSensor(m.Topic(), m.Retained())
+	q.storeSensor(m.Topic())
+}
+
+// AddSensor registers sensor coming from source other than MQTT discovery.
+// id is used to remove it later, its states are passed to State with d.StateTopic
+func (q *Queue) AddSensor(id string, d ESPHomeDiscovery) {
+	q.addSensor(id, d)
+}
+
+// RemoveSensor removes sensor added with AddSensor
+func (q *Queue) RemoveSensor(id string) {
+	q.removeSensor(id)
+}
+
+// State processes state of sensor added with AddSensor, same as MQTT state message with that payload
+func (q *Queue) State(stateTopic string, payload []byte) {
+	q.onState(&inProcessMessage{topic: stateTopic, payload: payload})
+}
+
+// Dispatch sends metrics produced outside of sensors (e.g. device metadata) to sinks.
+// Names are used as is, without prefix; sink filters and extra labels apply
+func (q *Queue) Dispatch(metrics []Metric) {
+	q.dispatcher.DispatchSelf(metrics)
+}
+
+// addSensor creates sensor for discovery received under configTopic
+func (q *Queue) addSensor(configTopic string, d ESPHomeDiscovery) {
+	if d.Dev == nil {
+		discoveryMessages.With(discoveryUnrelated).Update(1)
+		return
+	}
+	if d.Dev.Name == "ignoreme" {
+		discoveryMessages.With(discoveryIgnored).Update(1)
+		q.l.Infof("ignoring %s", configTopic)
+		return
+	}
+	if q.overriddenByStatic(configTopic, d) {
+		discoveryMessages.With(discoveryIgnored).Update(1)
+		q.l.Debugf("ignoring %s, sensor is in static_sensors", configTopic)
+		return
+	}
+	// https://www.home-assistant.io/integrations/sensor/#device-class
+	if d.StateTopic != "" {
+		sensorNotFound := false
+		q.Lock()
+		switch d.DeviceClass {
+		case DeviceClassTemperature:
+			q.sensorMap[d.StateTopic] = NewTemperatureSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassPressure:
+			q.sensorMap[d.StateTopic] = NewPressureSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassHumidity:
+			q.sensorMap[d.StateTopic] = NewHumiditySensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassSignalStrength:
+			q.sensorMap[d.StateTopic] = NewSignalStrengthSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassVoltage:
+			q.sensorMap[d.StateTopic] = NewVoltageSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassCurrent:
+			q.sensorMap[d.StateTopic] = NewCurrentSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassPower:
+			q.sensorMap[d.StateTopic] = NewPowerSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassEnergy:
+			q.sensorMap[d.StateTopic] = NewEnergySensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassBattery:
+			q.sensorMap[d.StateTopic] = NewBatterySensor(d, q.sendQueue)
+		case DeviceClassWindSpeed:
+			q.sensorMap[d.StateTopic] = NewWindSpeedSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassPrecipitation:
+			q.sensorMap[d.StateTopic] = NewPrecipitationSensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassCO2:
+			q.sensorMap[d.StateTopic] = NewCO2Sensor(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassParticulate1:
+			q.sensorMap[d.StateTopic] = NewParticulateSensor1(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassParticulate25:
+			q.sensorMap[d.StateTopic] = NewParticulateSensor25(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassParticulate4:
+			q.sensorMap[d.StateTopic] = NewParticulateSensor4(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassParticulate10:
+			q.sensorMap[d.StateTopic] = NewParticulateSensor10(q.l.Named(configTopic), d, q.sendQueue)
+		case DeviceClassParticulateSize:
+			q.sensorMap[d.StateTopic] = NewParticulateSensorCount10(q.l.Named(configTopic), d, q.sendQueue)
+		case "": // ignore unrelated messages
+			sensorNotFound = true
+			discoveryMessages.With(discoveryUnrelated).Update(1)
+		default:
+			sensorNotFound = true
+			discoveryMessages.With(discoveryUnknownClass).Update(1)
+			q.l.Infof("[%s] unknown device class [%s]", configTopic, d.DeviceClass)
 		}
-		if d.Dev.Name == "ignoreme" {
-			q.l.Infof("ignoring %s", m.Topic())
-			return
+		var pending []mqtt.Message
+		if !sensorNotFound {
+			q.discovery[d.Dev.Name+"/"+d.Name] = d
+			q.configTopics[configTopic] = d
+			q.stateDevices[d.StateTopic] = d.Dev.Name
+			// taken under the same lock sensor is added with, so no state falls between the two
+			pending = q.pending.Take(d.StateTopic)
 		}
-		// https://www.home-assistant.io/integrations/sensor/#device-class
-		if d.StateTopic != "" {
-			sensorNotFound := false
-			q.Lock()
-			switch d.DeviceClass {
-			case DeviceClassTemperature:
-				q.sensorMap[d.StateTopic] = NewTemperatureSensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassPressure:
-				q.sensorMap[d.StateTopic] = NewPressureSensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassHumidity:
-				q.sensorMap[d.StateTopic] = NewHumiditySensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassSignalStrength:
-				q.sensorMap[d.StateTopic] = NewSignalStrengthSensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassVoltage:
-				q.sensorMap[d.StateTopic] = NewVoltageSensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassCurrent:
-				q.sensorMap[d.StateTopic] = NewCurrentSensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassCO2:
-				q.sensorMap[d.StateTopic] = NewCO2Sensor(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassParticulate1:
-				q.sensorMap[d.StateTopic] = NewParticulateSensor1(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassParticulate25:
-				q.sensorMap[d.StateTopic] = NewParticulateSensor25(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassParticulate4:
-				q.sensorMap[d.StateTopic] = NewParticulateSensor4(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassParticulate10:
-				q.sensorMap[d.StateTopic] = NewParticulateSensor10(q.l.Named(m.Topic()), d, q.sendQueue)
-			case DeviceClassParticulateSize:
-				q.sensorMap[d.StateTopic] = NewParticulateSensorCount10(q.l.Named(m.Topic()), d, q.sendQueue)
-			case "": // ignore unrelated messages
-				sensorNotFound = true
-			default:
-				sensorNotFound = true
-				q.l.Infof("[%s] unknown device class [%s]", m.Topic(), d.DeviceClass)
+		q.Unlock()
+		if !sensorNotFound {
+			discoveryMessages.With(discoveryAdded).Update(1)
+			q.l.Infof("adding %s sensor under %s", d.DeviceClass, d.StateTopic)
+			q.dispatcher.SensorAdded(d)
+			if q.cfg.Tracker != nil {
+				q.cfg.Tracker.SensorAdded(d)
 			}
-			q.Unlock()
-			if !sensorNotFound {
-				q.l.Infof("adding %s sensor under %s", d.DeviceClass, d.StateTopic)
+			for _, pm := range pending {
+				q.onState(pm)
 			}
 		}
-	})
-	// this path need to be pretty exact to not catch the discovery path from above
-	q.client.Subscribe("+/sensor/+/state", 0, func(c mqtt.Client, m mqtt.Message) {
-		if strings.HasPrefix(m.Topic(), "homeassistant/") {
-			return
+	} else {
+		discoveryMessages.With(discoveryUnrelated).Update(1)
+	}
+}
+
+func (q *Queue) onState(m mqtt.Message) {
+	if strings.HasPrefix(m.Topic(), "homeassistant/") {
+		return
+	}
+	if strings.Contains(m.Topic(), "ignoreme/") {
+		return
+	}
+	q.RLock() // optimize that lock out
+	if f, ok := q.sensorMap[m.Topic()]; ok {
+		if q.cfg.Debug {
+			q.l.Debugf("sensor %s: %s", m.Topic(), string(m.Payload()))
 		}
-		if strings.Contains(m.Topic(), "ignoreme/") {
-			return
+		device := q.stateDevices[m.Topic()]
+		stateMessages.With(device).Update(1)
+		if q.cfg.Tracker != nil {
+			q.cfg.Tracker.DeviceSeen(device)
 		}
-		q.RLock() // optimize that lock out
-		if f, ok := q.sensorMap[m.Topic()]; ok {
-			if q.cfg.Debug {
-				q.l.Debugf("sensor %s: %s", m.Topic(), string(m.Payload()))
-			}
-			err := f.ProcessMessage(m)
-			if err != nil {
-				q.l.Warnf("could not process message %s: %s\n", m.Topic(), string(m.Payload()))
-			}
-		} else if q.cfg.Debug {
+		err := f.ProcessMessage(m)
+		if errors.Is(err, ErrSendQueueTimeout) {
+			sendQueueTimeouts.Update(1)
+			q.l.Warnf("could not queue metric from %s: %s", m.Topic(), err)
+		} else if err != nil {
+			stateParseErrors.With(device).Update(1)
+			q.l.Warnf("could not process message %s: %s\n", m.Topic(), string(m.Payload()))
+		}
+	} else {
+		stateUnhandled.Update(1)
+		if q.cfg.MQTTSession.persistent() {
+			q.pending.Add(m)
+		}
+		if q.cfg.Debug {
 			q.l.Warnf("unhandled sensor: %s: %s", m.Topic(), string(m.Payload()))
 		}
-		q.RUnlock()
-	})
+	}
+	q.RUnlock()
 }
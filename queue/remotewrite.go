@@ -0,0 +1,108 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// RecoverableError is returned when request can be retried later (network errors, 5xx, 429)
+type RecoverableError struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e RecoverableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e RecoverableError) Unwrap() error {
+	return e.Err
+}
+
+// remoteWrite is a synchronous Prometheus remote write client.
+// Unlike promwriter it reports send errors back so caller can decide whether to spool or retry the batch
+type remoteWrite struct {
+	url  string
+	http *http.Client
+}
+
+// parseRetryAfter parses Retry-After header, either in seconds or as HTTP date
+func parseRetryAfter(h string) time.Duration {
+	if len(h) == 0 {
+		return 0
+	}
+	if sec, err := strconv.Atoi(h); err == nil && sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	if ts, err := http.ParseTime(h); err == nil {
+		return time.Until(ts)
+	}
+	return 0
+}
+
+func newRemoteWrite(url string, timeout time.Duration) *remoteWrite {
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	return &remoteWrite{
+		url:  url,
+		http: &http.Client{Timeout: timeout},
+	}
+}
+
+func (r *remoteWrite) Send(ctx context.Context, metrics []Metric) error {
+	wr := &prompb.WriteRequest{
+		Timeseries: make([]prompb.TimeSeries, 0, len(metrics)),
+	}
+	for _, m := range metrics {
+		ts := prompb.TimeSeries{
+			Labels: []prompb.Label{{Name: "__name__", Value: m.Name}},
+		}
+		for k, v := range m.Labels {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: k, Value: v})
+		}
+		// protocol requires labels to be sorted
+		sort.Slice(ts.Labels, func(i, j int) bool {
+			return ts.Labels[i].Name < ts.Labels[j].Name
+		})
+		ts.Samples = []prompb.Sample{{
+			Timestamp: m.TS.UnixMilli(),
+			Value:     m.Value,
+		}}
+		wr.Timeseries = append(wr.Timeseries, ts)
+	}
+	b, err := wr.Marshal()
+	if err != nil {
+		return fmt.Errorf("error marshalling write request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", r.url, bytes.NewReader(snappy.Encode(nil, b)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return RecoverableError{Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("remote write returned [%d]: %s", resp.StatusCode, string(body))
+	if resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests {
+		return RecoverableError{Err: err, RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+	return err
+}
@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"strconv"
+	"time"
+)
+
+var DeviceClassBattery DeviceClass = "battery"
+
+type BatterySensor struct {
+	device string
+	sensor string
+	queue  chan Metric
+}
+
+func (t *BatterySensor) ProcessMessage(msg mqtt.Message) error {
+	metric := Metric{
+		Name: "battery",
+		Labels: map[string]string{
+			"device": t.device,
+			"sensor": t.sensor,
+		},
+	}
+	v, err := strconv.ParseFloat(string(msg.Payload()), 64)
+	if err != nil {
+		return fmt.Errorf("error parsing[%s]:%s", string(msg.Payload()), err)
+	}
+	metric.Value = v
+	metric.TS = time.Now()
+	select {
+	case t.queue <- metric:
+		return nil
+	case <-time.After(time.Second):
+		return ErrSendQueueTimeout
+	}
+}
+func NewBatterySensor(discovery ESPHomeDiscovery, out chan Metric) *BatterySensor {
+	ts := &BatterySensor{device: discovery.Dev.Name, sensor: discovery.Name}
+	ts.queue = out
+	return ts
+}
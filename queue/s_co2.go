@@ -35,7 +35,7 @@ func (t *CO2Sensor) ProcessMessage(msg mqtt.Message) error {
 	case t.queue <- metric:
 		return nil
 	case <-time.After(time.Second):
-		return fmt.Errorf("timeout on send queue")
+		return ErrSendQueueTimeout
 	}
 }
 func NewCO2Sensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *CO2Sensor {
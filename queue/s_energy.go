@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+var DeviceClassEnergy DeviceClass = "energy"
+
+type EnergySensor struct {
+	device     string
+	sensor     string
+	conversion func(float64) float64
+	queue      chan Metric
+}
+
+func (t *EnergySensor) ProcessMessage(msg mqtt.Message) error {
+	metric := Metric{
+		Name: "energy",
+		Labels: map[string]string{
+			"device": t.device,
+			"sensor": t.sensor,
+		},
+	}
+	v, err := strconv.ParseFloat(string(msg.Payload()), 64)
+	if err != nil {
+		return fmt.Errorf("error parsing[%s]:%s", string(msg.Payload()), err)
+	}
+	metric.Value = t.conversion(v)
+	metric.TS = time.Now()
+	select {
+	case t.queue <- metric:
+		return nil
+	case <-time.After(time.Second):
+		return ErrSendQueueTimeout
+	}
+}
+func NewEnergySensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *EnergySensor {
+	s := &EnergySensor{device: discovery.Dev.Name, sensor: discovery.Name}
+	// kWh, as it is what energy meters count in
+	switch discovery.Unit {
+	case "Wh":
+		s.conversion = func(wh float64) float64 { return wh / 1000 }
+	case "MWh":
+		s.conversion = func(mwh float64) float64 { return mwh * 1000 }
+	default:
+		if discovery.Unit != "kWh" {
+			log.Warnf("sensor [%s] does not have kWh unit, add conversion", discovery)
+		}
+		s.conversion = func(kwh float64) float64 { return kwh }
+	}
+	s.queue = out
+	return s
+}
@@ -35,7 +35,7 @@ func (t *HumiditySensor) ProcessMessage(msg mqtt.Message) error {
 	case t.queue <- metric:
 		return nil
 	case <-time.After(time.Second):
-		return fmt.Errorf("timeout on send queue")
+		return ErrSendQueueTimeout
 	}
 }
 func NewHumiditySensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *HumiditySensor {
@@ -41,7 +41,7 @@ func (t *ParticulateSensor) ProcessMessage(msg mqtt.Message) error {
 	case t.queue <- metric:
 		return nil
 	case <-time.After(time.Second):
-		return fmt.Errorf("timeout on send queue")
+		return ErrSendQueueTimeout
 	}
 }
 func NewParticulateSensor1(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *ParticulateSensor {
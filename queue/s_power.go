@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+var DeviceClassPower DeviceClass = "power"
+
+type PowerSensor struct {
+	device     string
+	sensor     string
+	conversion func(float64) float64
+	queue      chan Metric
+}
+
+func (t *PowerSensor) ProcessMessage(msg mqtt.Message) error {
+	metric := Metric{
+		Name: "power",
+		Labels: map[string]string{
+			"device": t.device,
+			"sensor": t.sensor,
+		},
+	}
+	v, err := strconv.ParseFloat(string(msg.Payload()), 64)
+	if err != nil {
+		return fmt.Errorf("error parsing[%s]:%s", string(msg.Payload()), err)
+	}
+	metric.Value = t.conversion(v)
+	metric.TS = time.Now()
+	select {
+	case t.queue <- metric:
+		return nil
+	case <-time.After(time.Second):
+		return ErrSendQueueTimeout
+	}
+}
+func NewPowerSensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *PowerSensor {
+	s := &PowerSensor{device: discovery.Dev.Name, sensor: discovery.Name}
+	switch discovery.Unit {
+	case "mW":
+		s.conversion = func(w float64) float64 { return w / 1000 }
+	case "kW":
+		s.conversion = func(w float64) float64 { return w * 1000 }
+	default:
+		if discovery.Unit != "W" {
+			log.Warnf("sensor [%s] does not have W unit, add conversion", discovery)
+		}
+		s.conversion = func(w float64) float64 { return w }
+	}
+	s.queue = out
+	return s
+}
@@ -0,0 +1,56 @@
+package queue
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+var DeviceClassPrecipitation DeviceClass = "precipitation"
+
+type PrecipitationSensor struct {
+	device     string
+	sensor     string
+	conversion func(float64) float64
+	queue      chan Metric
+}
+
+func (t *PrecipitationSensor) ProcessMessage(msg mqtt.Message) error {
+	metric := Metric{
+		Name: "precipitation",
+		Labels: map[string]string{
+			"device": t.device,
+			"sensor": t.sensor,
+		},
+	}
+	v, err := strconv.ParseFloat(string(msg.Payload()), 64)
+	if err != nil {
+		return fmt.Errorf("error parsing[%s]:%s", string(msg.Payload()), err)
+	}
+	metric.Value = t.conversion(v)
+	metric.TS = time.Now()
+	select {
+	case t.queue <- metric:
+		return nil
+	case <-time.After(time.Second):
+		return ErrSendQueueTimeout
+	}
+}
+func NewPrecipitationSensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *PrecipitationSensor {
+	s := &PrecipitationSensor{device: discovery.Dev.Name, sensor: discovery.Name}
+	switch discovery.Unit {
+	case "in":
+		s.conversion = func(v float64) float64 { return v * 25.4 }
+	case "cm":
+		s.conversion = func(v float64) float64 { return v * 10 }
+	default:
+		if discovery.Unit != "mm" {
+			log.Warnf("sensor [%s] does not have mm unit, add conversion", discovery)
+		}
+		s.conversion = func(v float64) float64 { return v }
+	}
+	s.queue = out
+	return s
+}
@@ -37,7 +37,7 @@ func (t *TemperatureSensor) ProcessMessage(msg mqtt.Message) error {
 	case t.queue <- metric:
 		return nil
 	case <-time.After(time.Second):
-		return fmt.Errorf("timeout on send queue")
+		return ErrSendQueueTimeout
 	}
 }
 func NewTemperatureSensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *TemperatureSensor {
@@ -36,7 +36,7 @@ func (t *VoltageSensor) ProcessMessage(msg mqtt.Message) error {
 	case t.queue <- metric:
 		return nil
 	case <-time.After(time.Second):
-		return fmt.Errorf("timeout on send queue")
+		return ErrSendQueueTimeout
 	}
 }
 func NewVoltageSensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *VoltageSensor {
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"go.uber.org/zap"
+	"strconv"
+	"time"
+)
+
+var DeviceClassWindSpeed DeviceClass = "wind_speed"
+
+type WindSpeedSensor struct {
+	device     string
+	sensor     string
+	conversion func(float64) float64
+	queue      chan Metric
+}
+
+func (t *WindSpeedSensor) ProcessMessage(msg mqtt.Message) error {
+	metric := Metric{
+		Name: "wind_speed",
+		Labels: map[string]string{
+			"device": t.device,
+			"sensor": t.sensor,
+		},
+	}
+	v, err := strconv.ParseFloat(string(msg.Payload()), 64)
+	if err != nil {
+		return fmt.Errorf("error parsing[%s]:%s", string(msg.Payload()), err)
+	}
+	metric.Value = t.conversion(v)
+	metric.TS = time.Now()
+	select {
+	case t.queue <- metric:
+		return nil
+	case <-time.After(time.Second):
+		return ErrSendQueueTimeout
+	}
+}
+func NewWindSpeedSensor(log *zap.SugaredLogger, discovery ESPHomeDiscovery, out chan Metric) *WindSpeedSensor {
+	s := &WindSpeedSensor{device: discovery.Dev.Name, sensor: discovery.Name}
+	// m/s
+	switch discovery.Unit {
+	case "km/h":
+		s.conversion = func(v float64) float64 { return v / 3.6 }
+	case "mph":
+		s.conversion = func(v float64) float64 { return v * 0.44704 }
+	case "kn":
+		s.conversion = func(v float64) float64 { return v * 1852 / 3600 }
+	default:
+		if discovery.Unit != "m/s" {
+			log.Warnf("sensor [%s] does not have m/s unit, add conversion", discovery)
+		}
+		s.conversion = func(v float64) float64 { return v }
+	}
+	s.queue = out
+	return s
+}
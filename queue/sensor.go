@@ -1,10 +1,14 @@
 package queue
 
 import (
+	"errors"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"time"
 )
 
+// ErrSendQueueTimeout is returned by sensors when metric could not be queued in time
+var ErrSendQueueTimeout = errors.New("timeout on send queue")
+
 type Sensor interface {
 	ProcessMessage(msg mqtt.Message) error
 }
@@ -0,0 +1,170 @@
+package queue
+
+import (
+	"fmt"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+type MQTTSessionConfig struct {
+	// ClientID enables persistent session; broker queues QoS 1 messages for it while bridge is disconnected.
+	// It must be unique per bridge instance, by default random one is used with clean session
+	ClientID string `yaml:"client_id"`
+	// StoreDir keeps paho's in-flight messages on disk, in memory if empty
+	StoreDir string `yaml:"store_dir"`
+	// SkipInstanceCheck disables refusing to start if another instance with same ClientID is online
+	SkipInstanceCheck bool `yaml:"skip_instance_check"`
+	// SessionExpiry is how long MQTT 5 broker keeps session of disconnected bridge, 24h by default.
+	// MQTT 3.1.1 brokers decide that on their own
+	SessionExpiry time.Duration `yaml:"session_expiry"`
+}
+
+const (
+	sessionOnline  = "online"
+	sessionOffline = "offline"
+	// how long queued state message can wait for discovery of its sensor
+	pendingStateTTL = time.Minute * 5
+	// limits of messages waiting for discovery
+	pendingStateTopics   = 1024
+	pendingStatePerTopic = 16
+)
+
+func (c *MQTTSessionConfig) persistent() bool {
+	return len(c.ClientID) > 0
+}
+
+// presenceTopic gets retained "online" while instance is connected and "offline" (via will if needed) after
+func (c *MQTTSessionConfig) presenceTopic() string {
+	return "esphome2prom/session/" + c.ClientID
+}
+
+func (c *MQTTSessionConfig) apply(opts *mqtt.ClientOptions) error {
+	if !c.persistent() {
+		opts.SetClientID("esphome2prom" + randomString(32)) // this need to be unique, else we get disconnect
+		return nil
+	}
+	opts.SetClientID(c.ClientID).
+		SetCleanSession(false).
+		SetWill(c.presenceTopic(), sessionOffline, 1, true)
+	if len(c.StoreDir) > 0 {
+		err := os.MkdirAll(c.StoreDir, 0700)
+		if err != nil {
+			return fmt.Errorf("error creating MQTT store dir: %w", err)
+		}
+		opts.SetStore(mqtt.NewFileStore(c.StoreDir))
+	}
+	return nil
+}
+
+// checkDuplicateInstance connects with throwaway client ID and looks at presence topic of our client ID.
+// Connecting with ID already in use would make broker kick the other instance and both would keep taking over the session.
+// Instance that crashed stays online until broker notices it is gone and publishes its will, so that is waited for
+func checkDuplicateInstance(opts *mqtt.ClientOptions, cfg MQTTSessionConfig, timeout time.Duration) error {
+	probeOpts := *opts
+	probeOpts.SetClientID("esphome2prom-probe-" + randomString(16)).
+		SetCleanSession(true).
+		SetConnectRetry(false).
+		SetAutoReconnect(false).
+		SetStore(mqtt.NewMemoryStore()).
+		SetOnConnectHandler(nil).
+		SetConnectionLostHandler(nil)
+	probeOpts.UnsetWill()
+	probe := mqtt.NewClient(&probeOpts)
+	if t := probe.Connect(); !t.WaitTimeout(timeout) || t.Error() != nil {
+		return fmt.Errorf("error connecting to check for duplicate instance: %v", t.Error())
+	}
+	defer probe.Disconnect(250)
+	state := make(chan string, 16)
+	t := probe.Subscribe(cfg.presenceTopic(), 1, func(c mqtt.Client, m mqtt.Message) {
+		select {
+		case state <- string(m.Payload()):
+		default:
+		}
+	})
+	if !t.WaitTimeout(timeout) || t.Error() != nil {
+		return fmt.Errorf("error subscribing to %s: %v", cfg.presenceTopic(), t.Error())
+	}
+	select {
+	case s := <-state:
+		if s != sessionOnline {
+			return nil
+		}
+	case <-time.After(timeout):
+		// nothing retained, never ran or broker lost it
+		return nil
+	}
+	// broker gives up on client after 1.5 keep alive interval without packets
+	wait := time.Duration(opts.KeepAlive)*time.Second*3/2 + timeout
+	deadline := time.After(wait)
+	for {
+		select {
+		case s := <-state:
+			if s != sessionOnline {
+				return nil
+			}
+		case <-deadline:
+			return fmt.Errorf("another instance with client ID [%s] is online (%s) for over %s, refusing to start", cfg.ClientID, cfg.presenceTopic(), wait)
+		}
+	}
+}
+
+// pendingState keeps state messages for topics with no sensor yet.
+// With persistent session broker delivers queued messages right after connecting, before retained discovery comes in.
+// Topics that got nothing for pendingStateTTL are dropped, so ones that never get discovery don't take up the limit forever
+type pendingState struct {
+	topics map[string][]pendingMessage
+	sync.Mutex
+}
+
+type pendingMessage struct {
+	msg      mqtt.Message
+	received time.Time
+}
+
+func newPendingState() *pendingState {
+	return &pendingState{topics: map[string][]pendingMessage{}}
+}
+
+func (p *pendingState) Add(m mqtt.Message) {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+	msgs, ok := p.topics[m.Topic()]
+	if !ok && len(p.topics) >= pendingStateTopics {
+		p.expire(now)
+		if len(p.topics) >= pendingStateTopics {
+			return
+		}
+	}
+	msgs = slices.DeleteFunc(msgs, func(pm pendingMessage) bool { return now.Sub(pm.received) >= pendingStateTTL })
+	if len(msgs) >= pendingStatePerTopic {
+		msgs = msgs[1:]
+	}
+	p.topics[m.Topic()] = append(msgs, pendingMessage{msg: m, received: now})
+}
+
+// expire removes topics whose newest message is older than pendingStateTTL
+func (p *pendingState) expire(now time.Time) {
+	for topic, msgs := range p.topics {
+		if len(msgs) == 0 || now.Sub(msgs[len(msgs)-1].received) >= pendingStateTTL {
+			delete(p.topics, topic)
+		}
+	}
+}
+
+// Take removes and returns messages for topic that are not older than pendingStateTTL
+func (p *pendingState) Take(topic string) (msgs []mqtt.Message) {
+	p.Lock()
+	pending := p.topics[topic]
+	delete(p.topics, topic)
+	p.Unlock()
+	for _, m := range pending {
+		if time.Since(m.received) < pendingStateTTL {
+			msgs = append(msgs, m.msg)
+		}
+	}
+	return msgs
+}
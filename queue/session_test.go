@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/broker"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *testMessage) Topic() string   { return m.topic }
+func (m *testMessage) Payload() []byte { return m.payload }
+
+func TestPendingState(t *testing.T) {
+	p := newPendingState()
+	for i := 0; i < pendingStatePerTopic+2; i++ {
+		p.Add(&testMessage{topic: "dev/sensor/t/state", payload: []byte{byte(i)}})
+	}
+	p.Add(&testMessage{topic: "dev/sensor/h/state", payload: []byte("1")})
+	msgs := p.Take("dev/sensor/t/state")
+	require.Len(t, msgs, pendingStatePerTopic)
+	assert.Equal(t, []byte{2}, msgs[0].Payload(), "oldest messages should be dropped first")
+	assert.Empty(t, p.Take("dev/sensor/t/state"))
+
+	p.topics["old"] = []pendingMessage{{msg: &testMessage{topic: "old"}, received: time.Now().Add(-pendingStateTTL * 2)}}
+	assert.Empty(t, p.Take("old"))
+
+	// expired topics make room for new ones
+	p = newPendingState()
+	for i := range pendingStateTopics {
+		p.topics[fmt.Sprint(i)] = []pendingMessage{{msg: &testMessage{topic: fmt.Sprint(i)}, received: time.Now().Add(-pendingStateTTL * 2)}}
+	}
+	p.Add(&testMessage{topic: "new", payload: []byte("1")})
+	assert.Len(t, p.Take("new"), 1)
+	assert.Empty(t, p.topics)
+}
+
+func TestCheckDuplicateInstance(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	cfg := MQTTSessionConfig{ClientID: "bridge-1"}
+	opts := mqtt.NewClientOptions().AddBroker("tcp://" + b.Addr()).SetKeepAlive(time.Second)
+	timeout := time.Millisecond * 200
+	require.NoError(t, checkDuplicateInstance(opts, cfg, timeout))
+
+	require.NoError(t, b.Publish(cfg.presenceTopic(), []byte(sessionOnline), true, 1))
+	assert.ErrorContains(t, checkDuplicateInstance(opts, cfg, timeout), "is online")
+
+	// crashed instance goes offline once broker sends its will
+	go func() {
+		time.Sleep(timeout * 2)
+		b.Publish(cfg.presenceTopic(), []byte(sessionOffline), true, 1)
+	}()
+	assert.NoError(t, checkDuplicateInstance(opts, cfg, timeout))
+}
+
+func TestMQTTSessionApply(t *testing.T) {
+	opts := mqtt.NewClientOptions()
+	require.NoError(t, (&MQTTSessionConfig{}).apply(opts))
+	assert.True(t, opts.CleanSession)
+	assert.Contains(t, opts.ClientID, "esphome2prom")
+
+	opts = mqtt.NewClientOptions()
+	c := MQTTSessionConfig{ClientID: "bridge-1", StoreDir: filepath.Join(t.TempDir(), "store")}
+	require.NoError(t, c.apply(opts))
+	assert.False(t, opts.CleanSession)
+	assert.Equal(t, "bridge-1", opts.ClientID)
+	assert.True(t, opts.WillEnabled)
+	assert.Equal(t, "esphome2prom/session/bridge-1", opts.WillTopic)
+	assert.True(t, opts.WillRetained)
+	assert.DirExists(t, c.StoreDir)
+}
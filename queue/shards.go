@@ -0,0 +1,295 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"github.com/XANi/esphome2prom/spool"
+	"github.com/efigence/go-mon"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type RemoteWriteConfig struct {
+	URL string `yaml:"url"`
+	// Spool buffers metrics on disk when remote write is down, disabled if Dir is empty
+	Spool     spool.Config `yaml:"spool"`
+	MinShards int          `yaml:"min_shards"`
+	MaxShards int          `yaml:"max_shards"`
+	// ShardCapacity is number of samples each shard can buffer
+	ShardCapacity    int           `yaml:"shard_capacity"`
+	MaxBatchLength   int           `yaml:"max_batch_length"`
+	MaxBatchDuration time.Duration `yaml:"max_batch_duration"`
+	// MaxRetries is number of retries of recoverable errors before giving up (or spooling) the batch
+	MaxRetries int           `yaml:"max_retries"`
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Timeout    time.Duration `yaml:"timeout"`
+}
+
+var rwSamplesSent = mon.GlobalRegistry.MustRegister("esphome2prom_remote_write_samples_sent", mon.NewCounter())
+var rwSamplesFailed = mon.GlobalRegistry.MustRegister("esphome2prom_remote_write_samples_failed", mon.NewCounter())
+var rwSamplesRetried = mon.GlobalRegistry.MustRegister("esphome2prom_remote_write_samples_retried", mon.NewCounter())
+var rwSamplesPending = mon.GlobalRegistry.MustRegister("esphome2prom_remote_write_samples_pending", mon.NewGauge())
+var rwShards = mon.GlobalRegistry.MustRegister("esphome2prom_remote_write_shards", mon.NewGauge())
+
+func (c *RemoteWriteConfig) setDefaults() {
+	if c.MinShards <= 0 {
+		c.MinShards = 1
+	}
+	if c.MaxShards < c.MinShards {
+		c.MaxShards = c.MinShards * 4
+	}
+	if c.ShardCapacity <= 0 {
+		c.ShardCapacity = 500
+	}
+	if c.MaxBatchLength <= 0 {
+		c.MaxBatchLength = 100
+	}
+	if c.MaxBatchDuration <= 0 {
+		c.MaxBatchDuration = time.Second
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = 5
+	}
+	if c.MinBackoff <= 0 {
+		c.MinBackoff = time.Millisecond * 100
+	}
+	if c.MaxBackoff < c.MinBackoff {
+		c.MaxBackoff = time.Second * 30
+	}
+}
+
+// shardManager spreads metrics over shards by series hash so each series is still sent in order,
+// and adjusts number of shards based on backlog
+type shardManager struct {
+	cfg    RemoteWriteConfig
+	sink   *remoteWriteSink
+	shards []chan Metric
+	// drained is closed once current shards, and all before them, sent everything they got
+	drained chan struct{}
+	// failing is set while sends fail, more shards would only hit the endpoint harder
+	failing atomic.Bool
+	closed  bool
+	sync.RWMutex
+}
+
+func newShardManager(sink *remoteWriteSink, cfg RemoteWriteConfig) *shardManager {
+	cfg.setDefaults()
+	m := &shardManager{
+		cfg:  cfg,
+		sink: sink,
+	}
+	m.start(cfg.MinShards, nil)
+	go m.reshardLoop()
+	return m
+}
+
+// start replaces shards with n new ones, they only start sending once shards before them (prev) are drained
+// so samples of the same series don't go out of order
+func (m *shardManager) start(n int, prev <-chan struct{}) {
+	m.shards = make([]chan Metric, n)
+	m.drained = make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := range m.shards {
+		m.shards[i] = make(chan Metric, m.cfg.ShardCapacity)
+		wg.Add(1)
+		go m.runShard(m.shards[i], prev, wg)
+	}
+	go func(drained chan struct{}) {
+		wg.Wait()
+		close(drained)
+	}(m.drained)
+	rwShards.Update(float64(n))
+}
+
+// Enqueue puts metric on its shard. Lock (so resharding can't close channel under us) is only held for
+// non-blocking send, full shards of failing endpoint must not block reshard and Close. Metric that doesn't fit
+// goes to spool if there is one, otherwise Enqueue waits for space
+func (m *shardManager) Enqueue(metric Metric) {
+	h := seriesHash(metric)
+	for {
+		m.RLock()
+		if m.closed {
+			m.RUnlock()
+			return
+		}
+		select {
+		case m.shards[h%uint64(len(m.shards))] <- metric:
+			m.RUnlock()
+			return
+		default:
+		}
+		m.RUnlock()
+		if m.sink.spool != nil {
+			m.sink.spoolMetrics([]Metric{metric})
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func (m *shardManager) pending() (pending int) {
+	m.RLock()
+	defer m.RUnlock()
+	for _, s := range m.shards {
+		pending += len(s)
+	}
+	return pending
+}
+
+// reshard swaps in n new shards and lets old ones drain in background, new ones wait for them before sending
+func (m *shardManager) reshard(n int) {
+	m.Lock()
+	defer m.Unlock()
+	if m.closed {
+		return
+	}
+	m.sink.l.Infof("resharding remote write from %d to %d shards", len(m.shards), n)
+	old := m.shards
+	m.start(n, m.drained)
+	for _, s := range old {
+		close(s)
+	}
+}
+
+// Close flushes all shards; Enqueue must not be called after that
+func (m *shardManager) Close() {
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return
+	}
+	m.closed = true
+	for _, s := range m.shards {
+		close(s)
+	}
+	drained := m.drained
+	m.Unlock()
+	<-drained
+}
+
+// target returns number of shards needed for pending samples
+func (m *shardManager) target(pending, current int) int {
+	capacity := current * m.cfg.ShardCapacity
+	switch {
+	// backlog from failing endpoint doesn't go away with more shards
+	case pending > capacity/2 && current < m.cfg.MaxShards && !m.failing.Load():
+		return min(current*2, m.cfg.MaxShards)
+	case pending < capacity/10 && current > m.cfg.MinShards:
+		return max(current/2, m.cfg.MinShards)
+	}
+	return current
+}
+
+func (m *shardManager) reshardLoop() {
+	for {
+		time.Sleep(time.Second * 10)
+		m.RLock()
+		closed := m.closed
+		current := len(m.shards)
+		m.RUnlock()
+		if closed {
+			return
+		}
+		pending := m.pending()
+		rwSamplesPending.Update(float64(pending))
+		if n := m.target(pending, current); n != current {
+			m.reshard(n)
+		}
+	}
+}
+
+func (m *shardManager) runShard(in chan Metric, prev <-chan struct{}, wg *sync.WaitGroup) {
+	defer wg.Done()
+	flush := func(batch []Metric) {
+		if prev != nil {
+			<-prev
+			prev = nil
+		}
+		m.sink.flush(batch)
+	}
+	// shards after this one count on it to be done only once previous ones are
+	defer func() {
+		if prev != nil {
+			<-prev
+		}
+	}()
+	batch := make([]Metric, 0, m.cfg.MaxBatchLength)
+	deadline := time.After(m.cfg.MaxBatchDuration)
+	for {
+		select {
+		case ev, ok := <-in:
+			if !ok {
+				if len(batch) > 0 {
+					flush(batch)
+				}
+				return
+			}
+			batch = append(batch, ev)
+			if len(batch) < m.cfg.MaxBatchLength {
+				continue
+			}
+		case <-deadline:
+		}
+		deadline = time.After(m.cfg.MaxBatchDuration)
+		if len(batch) == 0 {
+			continue
+		}
+		flush(batch)
+		batch = make([]Metric, 0, m.cfg.MaxBatchLength)
+	}
+}
+
+// sendWithRetry retries recoverable errors with exponential backoff and jitter, honouring Retry-After
+func (m *shardManager) sendWithRetry(batch []Metric) error {
+	backoff := m.cfg.MinBackoff
+	var err error
+	for try := 0; try <= m.cfg.MaxRetries; try++ {
+		if try > 0 {
+			rwSamplesRetried.Update(float64(len(batch)))
+		}
+		err = m.sink.rw.Send(context.Background(), batch)
+		if err == nil {
+			m.failing.Store(false)
+			rwSamplesSent.Update(float64(len(batch)))
+			return nil
+		}
+		var rerr RecoverableError
+		if !errors.As(err, &rerr) {
+			break
+		}
+		sleep := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		if rerr.RetryAfter > 0 {
+			sleep = rerr.RetryAfter
+		}
+		if try < m.cfg.MaxRetries {
+			m.sink.l.Debugf("retrying %d samples in %s: %s", len(batch), sleep, err)
+			time.Sleep(sleep)
+		}
+		backoff = min(backoff*2, m.cfg.MaxBackoff)
+	}
+	// not counted as failed here, caller may still spool the batch
+	m.failing.Store(true)
+	return err
+}
+
+func seriesHash(m Metric) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(m.Name))
+	keys := make([]string, 0, len(m.Labels))
+	for k := range m.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.Write([]byte{0xff})
+		h.Write([]byte(k))
+		h.Write([]byte{0xfe})
+		h.Write([]byte(m.Labels[k]))
+	}
+	return h.Sum64()
+}
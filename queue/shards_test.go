@@ -0,0 +1,239 @@
+package queue
+
+import (
+	"context"
+	"github.com/XANi/esphome2prom/spool"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testShardManager(t *testing.T, url string) *shardManager {
+	s := &remoteWriteSink{
+		l:  zaptest.NewLogger(t).Sugar(),
+		rw: newRemoteWrite(url, time.Second),
+	}
+	cfg := RemoteWriteConfig{
+		MaxRetries: 3,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: time.Millisecond * 10,
+	}
+	cfg.setDefaults()
+	return &shardManager{cfg: cfg, sink: s}
+}
+
+var testBatch = []Metric{{
+	Name:   "temperature",
+	Labels: map[string]string{"device": "d1", "sensor": "s1"},
+	Value:  21.5,
+	TS:     time.Now(),
+}}
+
+func TestSendWithRetry(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	m := testShardManager(t, srv.URL)
+	require.NoError(t, m.sendWithRetry(testBatch))
+	assert.Equal(t, int32(3), calls.Load())
+}
+
+func TestSendWithRetryClientError(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	m := testShardManager(t, srv.URL)
+	err := m.sendWithRetry(testBatch)
+	require.Error(t, err)
+	assert.NotErrorAs(t, err, &RecoverableError{})
+	assert.Equal(t, int32(1), calls.Load())
+}
+
+func TestSendWithRetryGiveUp(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+	m := testShardManager(t, srv.URL)
+	err := m.sendWithRetry(testBatch)
+	require.Error(t, err)
+	assert.ErrorAs(t, err, &RecoverableError{})
+	assert.Equal(t, int32(4), calls.Load())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, time.Second*5, parseRetryAfter("5"))
+	assert.Equal(t, time.Duration(0), parseRetryAfter(""))
+	assert.InDelta(t, time.Minute, parseRetryAfter(time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)), float64(time.Second*2))
+}
+
+func TestSeriesHash(t *testing.T) {
+	a := Metric{Name: "x", Labels: map[string]string{"a": "1", "b": "2"}}
+	b := Metric{Name: "x", Labels: map[string]string{"b": "2", "a": "1"}, Value: 3}
+	c := Metric{Name: "x", Labels: map[string]string{"a": "2", "b": "1"}}
+	assert.Equal(t, seriesHash(a), seriesHash(b))
+	assert.NotEqual(t, seriesHash(a), seriesHash(c))
+}
+
+func TestShardTarget(t *testing.T) {
+	m := testShardManager(t, "http://127.0.0.1:1")
+	m.cfg.MinShards, m.cfg.MaxShards, m.cfg.ShardCapacity = 1, 8, 100
+	assert.Equal(t, 4, m.target(150, 2))
+	assert.Equal(t, 8, m.target(700, 8))
+	assert.Equal(t, 2, m.target(10, 4))
+	assert.Equal(t, 2, m.target(50, 2))
+	m.failing.Store(true)
+	assert.Equal(t, 2, m.target(150, 2))
+	assert.Equal(t, 2, m.target(10, 4))
+}
+
+func TestReshard(t *testing.T) {
+	unblock := make(chan struct{})
+	var order []float64
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		req, err := decodeWriteRequest(r)
+		require.NoError(t, err)
+		mu.Lock()
+		for _, ts := range req.Timeseries {
+			for _, s := range ts.Samples {
+				order = append(order, s.Value)
+			}
+		}
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	m := testShardManager(t, srv.URL)
+	m.cfg.MaxBatchLength = 1
+	m.sink.shards = m
+	m.start(1, nil)
+	metric := testBatch[0]
+	metric.Value = 1
+	m.Enqueue(metric)
+	// first send hangs, reshard and enqueue must not wait for it
+	time.Sleep(time.Millisecond * 50)
+	done := make(chan struct{})
+	go func() {
+		m.reshard(2)
+		metric.Value = 2
+		m.Enqueue(metric)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("reshard blocked on draining shards")
+	}
+	close(unblock)
+	m.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []float64{1, 2}, order)
+}
+
+func TestEnqueueFullShard(t *testing.T) {
+	unblock := make(chan struct{})
+	var received atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		req, err := decodeWriteRequest(r)
+		require.NoError(t, err)
+		received.Add(int32(len(req.Timeseries)))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	m := testShardManager(t, srv.URL)
+	m.cfg.MaxBatchLength = 1
+	m.cfg.ShardCapacity = 1
+	m.sink.shards = m
+	m.start(1, nil)
+	// first one is being sent, second waits in shard, third doesn't fit
+	enqueued := make(chan struct{})
+	go func() {
+		for i := range 3 {
+			metric := testBatch[0]
+			metric.Value = float64(i)
+			m.Enqueue(metric)
+		}
+		close(enqueued)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	done := make(chan struct{})
+	go func() {
+		m.reshard(2)
+		m.pending()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("reshard blocked on full shard")
+	}
+	close(unblock)
+	<-enqueued
+	m.Close()
+	assert.Equal(t, int32(3), received.Load())
+}
+
+func decodeWriteRequest(r *http.Request) (*prompb.WriteRequest, error) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	b, err = snappy.Decode(nil, b)
+	if err != nil {
+		return nil, err
+	}
+	req := &prompb.WriteRequest{}
+	return req, req.Unmarshal(b)
+}
+
+func TestRemoteWriteSinkCloseDuringReplay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	s, err := newRemoteWriteSink(RemoteWriteConfig{
+		URL:              srv.URL,
+		Spool:            spool.Config{Dir: t.TempDir()},
+		MaxRetries:       1,
+		MinBackoff:       time.Millisecond,
+		MaxBackoff:       time.Millisecond,
+		MaxBatchDuration: time.Millisecond * 10,
+	}, "test", zaptest.NewLogger(t).Sugar())
+	require.NoError(t, err)
+	failed := rwSamplesFailed.Value()
+	require.NoError(t, s.Write(context.Background(), testBatch))
+	require.Eventually(t, func() bool { return s.spool.Depth() > 0 }, time.Second*5, time.Millisecond*10)
+	// spooled, not failed
+	assert.Equal(t, failed, rwSamplesFailed.Value())
+	// replay is backing off after failed send
+	time.Sleep(time.Millisecond * 1200)
+	start := time.Now()
+	s.Close()
+	assert.Less(t, time.Since(start), time.Millisecond*500)
+}
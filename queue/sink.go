@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+)
+
+// Sink is an output metrics are fanned out to. Metrics passed to Write are shared between sinks and must not be modified.
+type Sink interface {
+	Write(ctx context.Context, metrics []Metric) error
+	Close()
+}
+
+// SensorListener can be implemented by sink that wants to know about discovered and removed sensors
+type SensorListener interface {
+	SensorAdded(d ESPHomeDiscovery)
+	SensorRemoved(d ESPHomeDiscovery)
+}
+
+// DeviceTracker follows devices through their sensors and state messages, implemented by inventory.Inventory
+type DeviceTracker interface {
+	SensorListener
+	// DeviceSeen is called on every handled state message
+	DeviceSeen(device string)
+}
+
+const (
+	SinkRemoteWrite = "remote_write"
+	SinkInflux      = "influx"
+	SinkOTLP        = "otlp"
+	SinkMQTT        = "mqtt"
+	SinkTextfile    = "textfile"
+	SinkPushgateway = "pushgateway"
+)
+
+type SinkConfig struct {
+	// Type is one of remote_write, influx, otlp, mqtt, textfile, pushgateway
+	Type string `yaml:"type"`
+	// Name is used in logs, defaults to type
+	Name   string     `yaml:"name"`
+	Filter SinkFilter `yaml:"filter"`
+	// Buffer is number of metrics queued for the sink before new ones get dropped
+	Buffer           int           `yaml:"buffer"`
+	MaxBatchLength   int           `yaml:"max_batch_length"`
+	MaxBatchDuration time.Duration `yaml:"max_batch_duration"`
+
+	RemoteWrite RemoteWriteConfig `yaml:"remote_write"`
+	Influx      InfluxConfig      `yaml:"influx"`
+	OTLP        OTLPConfig        `yaml:"otlp"`
+	MQTT        MQTTOutputConfig  `yaml:"mqtt"`
+	Textfile    TextfileConfig    `yaml:"textfile"`
+	Pushgateway PushgatewayConfig `yaml:"pushgateway"`
+	// Custom is used as is instead of building sink from Type, for embedding the bridge as a library
+	Custom Sink `yaml:"-"`
+}
+
+// SinkFilter selects metrics sent to the sink. Patterns are globs matched against metric name before prefix is applied
+// and against device name. Empty include list matches everything, exclude is checked after include.
+type SinkFilter struct {
+	Metrics        []string `yaml:"metrics"`
+	ExcludeMetrics []string `yaml:"exclude_metrics"`
+	Devices        []string `yaml:"devices"`
+	ExcludeDevices []string `yaml:"exclude_devices"`
+}
+
+func (f *SinkFilter) Match(m Metric) bool {
+	return globMatch(f.Metrics, m.Name, true) &&
+		!globMatch(f.ExcludeMetrics, m.Name, false) &&
+		globMatch(f.Devices, m.Labels["device"], true) &&
+		!globMatch(f.ExcludeDevices, m.Labels["device"], false)
+}
+
+func (f *SinkFilter) validate() error {
+	for _, list := range [][]string{f.Metrics, f.ExcludeMetrics, f.Devices, f.ExcludeDevices} {
+		for _, p := range list {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("bad filter pattern [%s]: %w", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+func globMatch(patterns []string, s string, empty bool) bool {
+	if len(patterns) == 0 {
+		return empty
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *SinkConfig) setDefaults() {
+	if len(c.Name) == 0 {
+		c.Name = c.Type
+	}
+	if c.Buffer <= 0 {
+		c.Buffer = 1024
+	}
+	if c.MaxBatchLength <= 0 {
+		c.MaxBatchLength = 100
+	}
+	if c.MaxBatchDuration <= 0 {
+		c.MaxBatchDuration = time.Second
+	}
+}
+
+// newSink creates sink of configured type
+func (q *Queue) newSink(cfg SinkConfig) (Sink, error) {
+	if cfg.Custom != nil {
+		return cfg.Custom, nil
+	}
+	switch cfg.Type {
+	case SinkRemoteWrite:
+		return newRemoteWriteSink(cfg.RemoteWrite, cfg.Name, q.l.Named(cfg.Name))
+	case SinkInflux:
+		return newInfluxWriter(cfg.Influx, cfg.Name, q.l.Named(cfg.Name))
+	case SinkOTLP:
+		return newOTLPWriter(cfg.OTLP, q.cfg.Prefix, q.SensorDiscovery)
+	case SinkMQTT:
+		if q.cfg.Broker == nil && len(q.cfg.MQTTAddr) == 0 {
+			return nil, fmt.Errorf("mqtt sink needs MQTT address or embedded broker")
+		}
+		if len(cfg.MQTT.Topic) == 0 && len(cfg.MQTT.InventoryTopic) == 0 {
+			return nil, fmt.Errorf("mqtt sink needs topic or inventory_topic")
+		}
+		return newMQTTPublisher(q, cfg.MQTT)
+	case SinkTextfile:
+		return newTextfileWriter(cfg.Textfile, q.cfg.Prefix, q.SensorDiscovery, q.l.Named(cfg.Name))
+	case SinkPushgateway:
+		return newPushgatewayWriter(cfg.Pushgateway, q.cfg.Prefix, q.SensorDiscovery, q.l.Named(cfg.Name))
+	default:
+		return nil, fmt.Errorf("unknown sink type [%s]", cfg.Type)
+	}
+}
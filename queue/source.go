@@ -0,0 +1,60 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// SensorRegistry gets sensors and their states from ingestion sources that don't come through MQTT discovery,
+// implemented by Queue
+type SensorRegistry interface {
+	AddSensor(id string, d ESPHomeDiscovery)
+	RemoveSensor(id string)
+	State(stateTopic string, payload []byte)
+}
+
+// BackoffConfig bounds reconnect delay of sources, it is doubled after each failed attempt.
+// Defaults are 1s and 5m
+type BackoffConfig struct {
+	MinBackoff time.Duration `yaml:"min_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+}
+
+// Backoff is delay before next reconnect
+type Backoff struct {
+	cfg   BackoffConfig
+	delay time.Duration
+}
+
+func NewBackoff(cfg BackoffConfig) *Backoff {
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute * 5
+	}
+	return &Backoff{cfg: cfg, delay: cfg.MinBackoff}
+}
+
+// Delay returns how long next Wait takes
+func (b *Backoff) Delay() time.Duration {
+	return b.delay
+}
+
+// Reset starts from minimal delay again, for connection that was working for a while
+func (b *Backoff) Reset() {
+	b.delay = b.cfg.MinBackoff
+}
+
+// Wait sleeps for the delay and doubles it. Returns false if ctx was cancelled first
+func (b *Backoff) Wait(ctx context.Context) bool {
+	t := time.NewTimer(b.delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+		return false
+	}
+	b.delay = min(b.delay*2, b.cfg.MaxBackoff)
+	return true
+}
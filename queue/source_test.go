@@ -0,0 +1,24 @@
+package queue
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(BackoffConfig{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond * 3})
+	assert.Equal(t, time.Millisecond, b.Delay())
+	assert.True(t, b.Wait(context.Background()))
+	assert.Equal(t, time.Millisecond*2, b.Delay())
+	assert.True(t, b.Wait(context.Background()))
+	assert.Equal(t, time.Millisecond*3, b.Delay())
+	b.Reset()
+	assert.Equal(t, time.Millisecond, b.Delay())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.False(t, NewBackoff(BackoffConfig{}).Wait(ctx))
+	assert.Equal(t, time.Minute*5, NewBackoff(BackoffConfig{}).cfg.MaxBackoff)
+}
@@ -0,0 +1,84 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+)
+
+// StaticSensor declares sensor of node running without MQTT discovery
+type StaticSensor struct {
+	StateTopic  string      `yaml:"state_topic"`
+	Device      string      `yaml:"device"`
+	Name        string      `yaml:"name"`
+	DeviceClass DeviceClass `yaml:"device_class"`
+	Unit        string      `yaml:"unit"`
+	StateClass  string      `yaml:"state_class"`
+}
+
+// staticConfigPrefix is prefix of config IDs static sensors are registered under
+const staticConfigPrefix = "static/"
+
+func (s *StaticSensor) validate() error {
+	if len(s.StateTopic) == 0 || len(s.Device) == 0 || len(s.Name) == 0 || len(s.DeviceClass) == 0 {
+		return fmt.Errorf("state_topic, device, name and device_class are required")
+	}
+	if strings.ContainsAny(s.StateTopic, "+#") {
+		return fmt.Errorf("state_topic [%s] can't contain wildcards", s.StateTopic)
+	}
+	return nil
+}
+
+func (s *StaticSensor) discovery() ESPHomeDiscovery {
+	return ESPHomeDiscovery{
+		DeviceClass: s.DeviceClass,
+		Unit:        s.Unit,
+		StateClass:  s.StateClass,
+		Name:        s.Name,
+		StateTopic:  s.StateTopic,
+		UniqID:      s.Device + "-" + s.Name,
+		Dev:         &ESPHomeDev{ID: s.Device, Name: s.Device},
+	}
+}
+
+// addStaticSensors registers sensors from config, before discovery can come in
+func (q *Queue) addStaticSensors() error {
+	for _, s := range q.cfg.StaticSensors {
+		if err := s.validate(); err != nil {
+			return fmt.Errorf("static sensor %s/%s: %w", s.Device, s.Name, err)
+		}
+		q.addSensor(staticConfigPrefix+s.StateTopic, s.discovery())
+		if _, ok := q.SensorDiscovery(s.Device, s.Name); !ok {
+			return fmt.Errorf("static sensor %s/%s: device class %s is not supported", s.Device, s.Name, s.DeviceClass)
+		}
+	}
+	return nil
+}
+
+// subscribeStaticSensors subscribes state topics of static sensors that state subscription doesn't cover
+func (q *Queue) subscribeStaticSensors() error {
+	for _, s := range q.cfg.StaticSensors {
+		if topicMatch(stateTopic, s.StateTopic) {
+			continue
+		}
+		err := q.Subscribe(s.StateTopic, func(topic string, payload []byte) {
+			q.onState(&inProcessMessage{topic: topic, payload: payload})
+		})
+		if err != nil {
+			return fmt.Errorf("static sensor %s/%s: error subscribing to %s: %w", s.Device, s.Name, s.StateTopic, err)
+		}
+	}
+	return nil
+}
+
+// overriddenByStatic checks whether discovered sensor is declared in config, which takes precedence
+func (q *Queue) overriddenByStatic(configTopic string, d ESPHomeDiscovery) bool {
+	if strings.HasPrefix(configTopic, staticConfigPrefix) {
+		return false
+	}
+	for _, s := range q.cfg.StaticSensors {
+		if s.StateTopic == d.StateTopic || (s.Device == d.Dev.Name && s.Name == d.Name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package queue
+
+import (
+	"github.com/XANi/esphome2prom/broker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"testing"
+	"time"
+)
+
+func TestQueueStaticSensors(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	// node's discovery says °C, config overrides it
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	require.NoError(t, b.Publish("homeassistant/sensor/garage/t1/config", testDiscovery("garage", "t1"), true, 0))
+	sink := &testSink{}
+	q, err := New(&Config{
+		Broker: b,
+		Logger: zaptest.NewLogger(t).Sugar(),
+		Sinks:  []SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+		StaticSensors: []StaticSensor{
+			{StateTopic: "kitchen/sensor/t1/state", Device: "kitchen", Name: "t1", DeviceClass: DeviceClassTemperature, Unit: "°F"},
+			{StateTopic: "custom/shed/humidity", Device: "shed", Name: "humidity", DeviceClass: DeviceClassHumidity, Unit: "%"},
+		},
+	})
+	require.NoError(t, err)
+	d, ok := q.SensorDiscovery("kitchen", "t1")
+	require.True(t, ok)
+	assert.Equal(t, "°F", d.Unit)
+	_, ok = q.SensorDiscovery("garage", "t1")
+	assert.True(t, ok)
+
+	// removal of discovery doesn't touch static sensor
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", nil, true, 0))
+	require.NoError(t, b.Publish("kitchen/sensor/t1/state", []byte("212"), false, 0))
+	require.NoError(t, b.Publish("custom/shed/humidity", []byte("55"), false, 0))
+	require.Eventually(t, func() bool { return sink.count() == 2 }, time.Second*5, time.Millisecond*10)
+	q.Close()
+	byDevice := map[string]float64{}
+	for _, m := range sink.metrics {
+		byDevice[m.Labels["device"]] = m.Value
+	}
+	assert.InDelta(t, 100.0, byDevice["kitchen"], 0.001)
+	assert.Equal(t, 55.0, byDevice["shed"])
+}
+
+func TestQueueStaticSensorsInvalid(t *testing.T) {
+	for _, s := range []StaticSensor{
+		{StateTopic: "node/sensor/t/state", Device: "node", Name: "t"},
+		{StateTopic: "node/+/t/state", Device: "node", Name: "t", DeviceClass: DeviceClassTemperature},
+		{StateTopic: "node/sensor/t/state", Device: "node", Name: "t", DeviceClass: "door"},
+	} {
+		_, err := New(&Config{Logger: zaptest.NewLogger(t).Sugar(), StaticSensors: []StaticSensor{s}})
+		assert.Error(t, err)
+	}
+}
@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/efigence/go-mon"
+	"strings"
+	"sync"
+	"time"
+)
+
+// self-instrumentation; all metrics live in go-mon's global registry so they show up on /_status/metrics and /metrics
+var mqttConnects = mon.GlobalRegistry.MustRegister("esphome2prom_mqtt_connects", mon.NewCounter())
+var mqttDisconnects = mon.GlobalRegistry.MustRegister("esphome2prom_mqtt_disconnects", mon.NewCounter())
+var sendQueueDepth = mon.GlobalRegistry.MustRegister("esphome2prom_send_queue_depth", mon.NewGauge())
+var sendQueueTimeouts = mon.GlobalRegistry.MustRegister("esphome2prom_send_queue_timeouts", mon.NewCounter())
+var stateUnhandled = mon.GlobalRegistry.MustRegister("esphome2prom_state_messages_unhandled", mon.NewCounter())
+
+const (
+	discoveryAdded        = "added"
+	discoveryRemoved      = "removed"
+	discoveryIgnored      = "ignored"
+	discoveryInvalid      = "invalid"
+	discoveryUnknownClass = "unknown_class"
+	discoveryUnrelated    = "unrelated"
+)
+
+var discoveryMessages = newLabeledCounter("esphome2prom_discovery_messages", "outcome")
+var stateMessages = newLabeledCounter("esphome2prom_state_messages", "device")
+var stateParseErrors = newLabeledCounter("esphome2prom_state_parse_errors", "device")
+var sinkWrites = newLabeledCounter("esphome2prom_sink_writes", "sink")
+var sinkWriteErrors = newLabeledCounter("esphome2prom_sink_write_errors", "sink")
+var sinkWriteSeconds = newLabeledCounter("esphome2prom_sink_write_seconds", "sink")
+var sinkSamples = newLabeledCounter("esphome2prom_sink_samples", "sink")
+var sinkDropped = newLabeledCounter("esphome2prom_sink_samples_dropped", "sink")
+var sinkBufferDepth = newLabeledGauge("esphome2prom_sink_buffer_depth", "sink")
+
+// labeledMetric is a family of metrics with single label, registered on first use
+type labeledMetric struct {
+	name    string
+	label   string
+	new     func(unit ...string) mon.Metric
+	metrics sync.Map
+}
+
+func newLabeledCounter(name, label string) *labeledMetric {
+	return &labeledMetric{name: name, label: label, new: mon.NewCounter}
+}
+
+func newLabeledGauge(name, label string) *labeledMetric {
+	return &labeledMetric{name: name, label: label, new: mon.NewGauge}
+}
+
+func (c *labeledMetric) With(value string) mon.Metric {
+	if m, ok := c.metrics.Load(value); ok {
+		return m.(mon.Metric)
+	}
+	m, err := mon.GlobalRegistry.RegisterOrGet(c.name, c.new(), map[string]string{c.label: value})
+	if err != nil {
+		panic(err)
+	}
+	c.metrics.Store(value, m)
+	return m
+}
+
+// selfMetrics returns current values of bridge's own metrics, to be sent through sinks
+func selfMetrics() []Metric {
+	ts := time.Now()
+	var metrics []Metric
+	for name, series := range mon.GlobalRegistry.GetRegistry().Metrics {
+		if !strings.HasPrefix(name, "esphome2prom_") {
+			continue
+		}
+		for tags, m := range series {
+			var t mon.GobTag
+			err := gob.NewDecoder(bytes.NewReader([]byte(tags))).Decode(&t)
+			if err != nil {
+				continue
+			}
+			labels := make(map[string]string, len(t.T))
+			for k, v := range t.T {
+				labels[k] = v
+			}
+			metrics = append(metrics, Metric{
+				Name:   name,
+				Labels: labels,
+				Value:  m.Value(),
+				TS:     ts,
+			})
+		}
+	}
+	return metrics
+}
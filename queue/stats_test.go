@@ -0,0 +1,20 @@
+package queue
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	stateParseErrors.With("test-device").Update(2)
+	mqttConnects.Update(1)
+	found := map[string]Metric{}
+	for _, m := range selfMetrics() {
+		found[m.Name+labelString(m.Labels)] = m
+	}
+	assert.Equal(t, float64(2), found[`esphome2prom_state_parse_errors{device="test-device"}`].Value)
+	assert.GreaterOrEqual(t, found["esphome2prom_mqtt_connects"].Value, float64(1))
+	for k := range found {
+		assert.NotContains(t, k, "gc.")
+	}
+}
@@ -0,0 +1,215 @@
+package queue
+
+import (
+	"github.com/efigence/go-mon"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SensorStore keeps sensors learned from MQTT discovery across restarts, implemented by db.DB
+type SensorStore interface {
+	SaveSensor(configTopic string, d ESPHomeDiscovery) error
+	DeleteSensor(configTopic string) error
+	// Sensors returns all stored sensors by config topic
+	Sensors() (map[string]ESPHomeDiscovery, error)
+}
+
+// defaultStoreReconcileAfter is how long retained discovery has to be quiet before restored sensors it didn't confirm are removed
+const defaultStoreReconcileAfter = time.Second * 30
+
+var storeErrors = mon.GlobalRegistry.MustRegister("esphome2prom_sensor_store_errors", mon.NewCounter())
+var storeRestored = mon.GlobalRegistry.MustRegister("esphome2prom_sensor_store_restored", mon.NewGauge())
+
+// storedSensors tracks what is in the store so repeated retained discovery doesn't rewrite it
+type storedSensors struct {
+	sensors map[string]ESPHomeDiscovery
+	// restored are sensors loaded from store that live discovery didn't confirm yet, nil once reconciled
+	restored map[string]bool
+	// retainedSeen is set once broker delivered any retained discovery
+	retainedSeen bool
+	reconcile    *time.Timer
+	// writes waiting for storeWriter by config topic, nil deletes sensor. Store is not written from MQTT callback
+	writes map[string]*ESPHomeDiscovery
+	wake   chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+	sync.Mutex
+}
+
+// restoreSensors registers stored sensors, so they work even if broker lost retained discovery.
+// Live discovery updates or removes them as it comes in, ones it didn't confirm are removed by reconcileSensors
+func (q *Queue) restoreSensors() error {
+	q.stored.sensors = map[string]ESPHomeDiscovery{}
+	if q.cfg.Store == nil {
+		return nil
+	}
+	sensors, err := q.cfg.Store.Sensors()
+	if err != nil {
+		return err
+	}
+	q.stored.Lock()
+	q.stored.restored = map[string]bool{}
+	for configTopic, d := range sensors {
+		q.stored.sensors[configTopic] = d
+		q.stored.restored[configTopic] = true
+	}
+	q.stored.writes = map[string]*ESPHomeDiscovery{}
+	q.stored.wake = make(chan struct{}, 1)
+	q.stored.stop = make(chan struct{})
+	q.stored.done = make(chan struct{})
+	if q.cfg.StoreReconcileAfter == 0 {
+		q.cfg.StoreReconcileAfter = defaultStoreReconcileAfter
+	}
+	q.stored.reconcile = time.AfterFunc(q.cfg.StoreReconcileAfter, q.reconcileSensors)
+	q.stored.Unlock()
+	for configTopic, d := range sensors {
+		q.addSensor(configTopic, d)
+	}
+	go q.storeWriter()
+	storeRestored.Update(float64(len(sensors)))
+	q.l.Infof("restored %d sensors from store", len(sensors))
+	return nil
+}
+
+// confirmSensor marks restored sensor as still existing. Retained discovery pushes reconciliation back,
+// so it happens once broker is done sending it after connecting
+func (q *Queue) confirmSensor(configTopic string, retained bool) {
+	if q.cfg.Store == nil {
+		return
+	}
+	q.stored.Lock()
+	defer q.stored.Unlock()
+	if q.stored.restored == nil {
+		return
+	}
+	delete(q.stored.restored, configTopic)
+	if retained {
+		q.stored.retainedSeen = true
+		q.stored.reconcile.Reset(q.cfg.StoreReconcileAfter)
+	}
+}
+
+// reconcileSensors removes restored sensors that initial retained discovery didn't confirm, they were removed while bridge was down.
+// If broker sent no retained discovery at all it most likely lost it, so they are kept
+func (q *Queue) reconcileSensors() {
+	q.stored.Lock()
+	if q.stored.restored == nil {
+		q.stored.Unlock()
+		return
+	}
+	if !q.stored.retainedSeen {
+		q.l.Infof("no retained discovery from broker, keeping %d restored sensors", len(q.stored.restored))
+		q.stored.restored = nil
+		q.stored.Unlock()
+		return
+	}
+	gone := make([]string, 0, len(q.stored.restored))
+	for configTopic := range q.stored.restored {
+		gone = append(gone, configTopic)
+	}
+	q.stored.restored = nil
+	q.stored.Unlock()
+	if len(gone) > 0 {
+		q.l.Infof("removing %d restored sensors missing from retained discovery", len(gone))
+	}
+	for _, configTopic := range gone {
+		q.removeSensor(configTopic)
+		q.forgetSensor(configTopic)
+	}
+}
+
+// storeSensor saves discovered sensor if it was registered and is different from stored one
+func (q *Queue) storeSensor(configTopic string) {
+	if q.cfg.Store == nil {
+		return
+	}
+	q.RLock()
+	d, ok := q.configTopics[configTopic]
+	q.RUnlock()
+	// unsupported, ignored or overridden by static sensor
+	if !ok {
+		return
+	}
+	q.stored.Lock()
+	defer q.stored.Unlock()
+	if old, ok := q.stored.sensors[configTopic]; ok && reflect.DeepEqual(old, d) {
+		return
+	}
+	q.stored.sensors[configTopic] = d
+	q.queueWrite(configTopic, &d)
+}
+
+// forgetSensor removes sensor whose discovery was cleared from store
+func (q *Queue) forgetSensor(configTopic string) {
+	if q.cfg.Store == nil {
+		return
+	}
+	q.stored.Lock()
+	defer q.stored.Unlock()
+	if _, ok := q.stored.sensors[configTopic]; !ok {
+		return
+	}
+	delete(q.stored.sensors, configTopic)
+	q.queueWrite(configTopic, nil)
+}
+
+// queueWrite has to be called with stored locked, only the latest write of topic is kept
+func (q *Queue) queueWrite(configTopic string, d *ESPHomeDiscovery) {
+	q.stored.writes[configTopic] = d
+	select {
+	case q.stored.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) storeWriter() {
+	defer close(q.stored.done)
+	for {
+		select {
+		case <-q.stored.wake:
+			q.flushStore()
+		case <-q.stored.stop:
+			q.flushStore()
+			return
+		}
+	}
+}
+
+func (q *Queue) flushStore() {
+	q.stored.Lock()
+	writes := q.stored.writes
+	q.stored.writes = map[string]*ESPHomeDiscovery{}
+	q.stored.Unlock()
+	for configTopic, d := range writes {
+		var err error
+		if d == nil {
+			err = q.cfg.Store.DeleteSensor(configTopic)
+		} else {
+			err = q.cfg.Store.SaveSensor(configTopic, *d)
+		}
+		if err == nil {
+			continue
+		}
+		storeErrors.Update(1)
+		q.l.Errorf("error updating sensor %s in store: %s", configTopic, err)
+		// next discovery of it tries again
+		if d != nil {
+			q.stored.Lock()
+			if _, queued := q.stored.writes[configTopic]; !queued {
+				delete(q.stored.sensors, configTopic)
+			}
+			q.stored.Unlock()
+		}
+	}
+}
+
+// closeStore stops reconciliation and writes what is left to store
+func (q *Queue) closeStore() {
+	if q.cfg.Store == nil {
+		return
+	}
+	q.stored.reconcile.Stop()
+	close(q.stored.stop)
+	<-q.stored.done
+}
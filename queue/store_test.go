@@ -0,0 +1,176 @@
+package queue
+
+import (
+	"github.com/XANi/esphome2prom/broker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memStore struct {
+	sensors map[string]ESPHomeDiscovery
+	saves   int
+	sync.Mutex
+}
+
+func (s *memStore) SaveSensor(configTopic string, d ESPHomeDiscovery) error {
+	s.Lock()
+	defer s.Unlock()
+	s.saves++
+	s.sensors[configTopic] = d
+	return nil
+}
+
+func (s *memStore) DeleteSensor(configTopic string) error {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.sensors, configTopic)
+	return nil
+}
+
+func (s *memStore) Sensors() (map[string]ESPHomeDiscovery, error) {
+	s.Lock()
+	defer s.Unlock()
+	out := map[string]ESPHomeDiscovery{}
+	for k, v := range s.sensors {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *memStore) stored() (sensors, saves int) {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sensors), s.saves
+}
+
+func garageStore() *memStore {
+	return &memStore{sensors: map[string]ESPHomeDiscovery{
+		"homeassistant/sensor/garage/t1/config": {DeviceClass: DeviceClassTemperature, Unit: "°C", Name: "t1", StateTopic: "garage/sensor/t1/state", Dev: &ESPHomeDev{ID: "garage", Name: "garage"}},
+	}}
+}
+
+func TestQueueSensorStore(t *testing.T) {
+	store := garageStore()
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	sink := &testSink{}
+	// broker lost its retained discovery
+	q, err := New(&Config{
+		Broker:              b,
+		Logger:              zaptest.NewLogger(t).Sugar(),
+		Sinks:               []SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+		Store:               store,
+		StoreReconcileAfter: time.Millisecond * 50,
+	})
+	require.NoError(t, err)
+	_, ok := q.SensorDiscovery("garage", "t1")
+	require.True(t, ok)
+	require.NoError(t, b.Publish("garage/sensor/t1/state", []byte("5"), false, 0))
+	require.Eventually(t, func() bool { return sink.count() == 1 }, time.Second*5, time.Millisecond*10)
+	// nothing to reconcile with
+	time.Sleep(time.Millisecond * 200)
+	_, ok = q.SensorDiscovery("garage", "t1")
+	assert.True(t, ok)
+
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	require.Eventually(t, func() bool {
+		sensors, saves := store.stored()
+		return sensors == 2 && saves == 1
+	}, time.Second*5, time.Millisecond*10)
+	// the same discovery again, e.g. after reconnect
+	q.onDiscovery(&inProcessMessage{topic: "homeassistant/sensor/kitchen/t1/config", payload: testDiscovery("kitchen", "t1")})
+	// only retained discovery sent right after connecting is reconciled with
+	time.Sleep(time.Millisecond * 200)
+	_, ok = q.SensorDiscovery("garage", "t1")
+	assert.True(t, ok)
+	// pending writes are flushed on close
+	q.Close()
+	sensors, saves := store.stored()
+	assert.Equal(t, 2, sensors)
+	assert.Equal(t, 1, saves)
+}
+
+func TestQueueSensorStoreReconcile(t *testing.T) {
+	store := garageStore()
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	// garage was removed while bridge was down
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	q, err := New(&Config{
+		Broker:              b,
+		Logger:              zaptest.NewLogger(t).Sugar(),
+		Store:               store,
+		StoreReconcileAfter: time.Millisecond * 50,
+	})
+	require.NoError(t, err)
+	defer q.Close()
+	require.Eventually(t, func() bool {
+		_, ok := q.SensorDiscovery("garage", "t1")
+		return !ok
+	}, time.Second*5, time.Millisecond*10)
+	_, ok := q.SensorDiscovery("kitchen", "t1")
+	assert.True(t, ok)
+	require.Eventually(t, func() bool {
+		sensors, _ := store.stored()
+		return sensors == 1
+	}, time.Second*5, time.Millisecond*10)
+
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", nil, true, 0))
+	require.Eventually(t, func() bool {
+		sensors, _ := store.stored()
+		return sensors == 0
+	}, time.Second*5, time.Millisecond*10)
+}
+
+type testTracker struct {
+	added, removed []string
+	seen           map[string]int
+	sync.Mutex
+}
+
+func (t *testTracker) SensorAdded(d ESPHomeDiscovery) {
+	t.Lock()
+	defer t.Unlock()
+	t.added = append(t.added, d.Dev.Name+"/"+d.Name)
+}
+
+func (t *testTracker) SensorRemoved(d ESPHomeDiscovery) {
+	t.Lock()
+	defer t.Unlock()
+	t.removed = append(t.removed, d.Dev.Name+"/"+d.Name)
+}
+
+func (t *testTracker) DeviceSeen(device string) {
+	t.Lock()
+	defer t.Unlock()
+	t.seen[device]++
+}
+
+func TestQueueTracker(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", testDiscovery("kitchen", "t1"), true, 0))
+	tracker := &testTracker{seen: map[string]int{}}
+	q, err := New(&Config{
+		Broker:  b,
+		Logger:  zaptest.NewLogger(t).Sugar(),
+		Tracker: tracker,
+	})
+	require.NoError(t, err)
+	defer q.Close()
+	require.NoError(t, b.Publish("kitchen/sensor/t1/state", []byte("5"), false, 0))
+	require.NoError(t, b.Publish("kitchen/sensor/t2/state", []byte("5"), false, 0))
+	require.NoError(t, b.Publish("homeassistant/sensor/kitchen/t1/config", nil, true, 0))
+	tracker.Lock()
+	defer tracker.Unlock()
+	assert.Equal(t, []string{"kitchen/t1"}, tracker.added)
+	assert.Equal(t, []string{"kitchen/t1"}, tracker.removed)
+	assert.Equal(t, map[string]int{"kitchen": 1}, tracker.seen)
+}
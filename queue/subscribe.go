@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"strings"
+)
+
+// MessageHandler gets messages of topics subscribed with Queue.Subscribe
+type MessageHandler func(topic string, payload []byte)
+
+type subscription struct {
+	filter  string
+	handler MessageHandler
+}
+
+// Subscribe subscribes to topics outside of discovery and sensor state, for sources using other MQTT conventions.
+// Subscription is kept across reconnects
+func (q *Queue) Subscribe(filter string, handler MessageHandler) error {
+	q.Lock()
+	q.subscriptions = append(q.subscriptions, subscription{filter: filter, handler: handler})
+	q.Unlock()
+	return q.client.Subscribe(filter, q.subscriptionQoS(), handler)
+}
+
+// extraSubscriptions returns subscriptions added with Subscribe, to be renewed on reconnect
+func (q *Queue) extraSubscriptions() []subscription {
+	q.RLock()
+	defer q.RUnlock()
+	return append([]subscription(nil), q.subscriptions...)
+}
+
+// topicMatch checks whether topic matches MQTT filter with + and # wildcards
+func topicMatch(filter, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) {
+			return false
+		}
+		if part != "+" && part != t[i] {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,50 @@
+package queue
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTopicMatch(t *testing.T) {
+	assert.True(t, topicMatch("tele/+/+", "tele/plug1/SENSOR"))
+	assert.True(t, topicMatch("tele/#", "tele/plug1/SENSOR"))
+	assert.True(t, topicMatch("tele/#", "tele"))
+	assert.False(t, topicMatch("tele/+/+", "tele/plug1"))
+	assert.False(t, topicMatch("tele/+/+", "tele/plug1/SENSOR/x"))
+	assert.False(t, topicMatch("tele/+/+", "stat/plug1/POWER"))
+}
+
+func TestQueueSubscribe(t *testing.T) {
+	for _, version := range []int{MQTTVersion3, MQTTVersion5} {
+		srv, addr := testBroker(t)
+		q, err := New(&Config{
+			MQTTAddr:    addr,
+			MQTTVersion: version,
+			Logger:      zaptest.NewLogger(t).Sugar(),
+		})
+		require.NoError(t, err)
+		var lock sync.Mutex
+		var got []string
+		require.NoError(t, q.Subscribe("tele/+/SENSOR", func(topic string, payload []byte) {
+			lock.Lock()
+			defer lock.Unlock()
+			got = append(got, topic+" "+string(payload))
+		}))
+		require.Eventually(t, func() bool {
+			return len(srv.Topics.Subscribers("tele/plug1/SENSOR").Subscriptions) > 0
+		}, time.Second*5, time.Millisecond*10)
+		require.NoError(t, srv.Publish("tele/plug1/STATE", []byte("{}"), false, 0))
+		require.NoError(t, srv.Publish("tele/plug1/SENSOR", []byte("{}"), false, 0))
+		require.Eventually(t, func() bool {
+			lock.Lock()
+			defer lock.Unlock()
+			return len(got) == 1
+		}, time.Second*5, time.Millisecond*10, "MQTT %d", version)
+		assert.Equal(t, "tele/plug1/SENSOR {}", got[0])
+		q.Close()
+	}
+}
@@ -0,0 +1,112 @@
+package rtl433
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type fieldType struct {
+	class      queue.DeviceClass
+	unit       string
+	stateClass string
+}
+
+// fields maps rtl_433 event field to sensor type, see https://triq.org/rtl_433/DATA_FORMAT.html
+var fields = map[string]fieldType{
+	"temperature_C": {class: queue.DeviceClassTemperature, unit: "°C", stateClass: "measurement"},
+	"temperature_F": {class: queue.DeviceClassTemperature, unit: "°F", stateClass: "measurement"},
+	"humidity":      {class: queue.DeviceClassHumidity, unit: "%", stateClass: "measurement"},
+	"pressure_hPa":  {class: queue.DeviceClassPressure, unit: "hPa", stateClass: "measurement"},
+	"wind_avg_km_h": {class: queue.DeviceClassWindSpeed, unit: "km/h", stateClass: "measurement"},
+	"wind_avg_m_s":  {class: queue.DeviceClassWindSpeed, unit: "m/s", stateClass: "measurement"},
+	"wind_max_km_h": {class: queue.DeviceClassWindSpeed, unit: "km/h", stateClass: "measurement"},
+	"wind_max_m_s":  {class: queue.DeviceClassWindSpeed, unit: "m/s", stateClass: "measurement"},
+	"rain_mm":       {class: queue.DeviceClassPrecipitation, unit: "mm", stateClass: "total_increasing"},
+	"rain_in":       {class: queue.DeviceClassPrecipitation, unit: "in", stateClass: "total_increasing"},
+}
+
+// identity of transmitter, channel is empty for models without one
+type identity struct {
+	Model   string
+	ID      string
+	Channel string
+}
+
+func (i identity) String() string {
+	s := i.Model + "-" + i.ID
+	if len(i.Channel) > 0 {
+		s += "-" + i.Channel
+	}
+	return s
+}
+
+type reading struct {
+	field string
+	typ   fieldType
+	value float64
+}
+
+// batteryOKField is sent as BatteryOKMetric, it is status flag and not battery level
+const batteryOKField = "battery_ok"
+
+// parseEvent returns transmitter, known values and battery_ok (nil if event has none) of decoded event
+func parseEvent(payload []byte) (identity, []reading, *float64, error) {
+	var ev map[string]json.RawMessage
+	err := json.Unmarshal(payload, &ev)
+	if err != nil {
+		return identity{}, nil, nil, fmt.Errorf("error decoding event: %w", err)
+	}
+	id := identity{
+		Model:   scalar(ev["model"]),
+		ID:      scalar(ev["id"]),
+		Channel: scalar(ev["channel"]),
+	}
+	if len(id.Model) == 0 {
+		return id, nil, nil, fmt.Errorf("event without model")
+	}
+	keys := make([]string, 0, len(ev))
+	for k := range ev {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var readings []reading
+	var batteryOK *float64
+	for _, k := range keys {
+		var v float64
+		if k == batteryOKField {
+			if json.Unmarshal(ev[k], &v) == nil {
+				batteryOK = &v
+			}
+			continue
+		}
+		typ, ok := fields[k]
+		if !ok {
+			continue
+		}
+		if json.Unmarshal(ev[k], &v) != nil {
+			continue
+		}
+		readings = append(readings, reading{field: k, typ: typ, value: v})
+	}
+	return id, readings, batteryOK, nil
+}
+
+// scalar returns number or string field as string
+func scalar(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	var f float64
+	if json.Unmarshal(raw, &f) == nil {
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strings.Trim(string(raw), `"`)
+}
@@ -0,0 +1,181 @@
+// Package rtl433 ingests 433 MHz sensors decoded by rtl_433 or OpenMQTTGateway and published as JSON events
+package rtl433
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DeviceConfig struct {
+	Model string `yaml:"model"`
+	ID    string `yaml:"id"`
+	// Channel has to match if set
+	Channel string `yaml:"channel"`
+	// Name is device name in metrics, defaults to <model>-<id>[-<channel>]
+	Name string `yaml:"name"`
+}
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Topics with JSON events, rtl_433 MQTT output and OpenMQTTGateway by default
+	Topics []string `yaml:"topics"`
+	// Devices is allow-list of transmitters, neighbours' ones are picked up too
+	Devices []DeviceConfig `yaml:"devices"`
+	// TrackAll ingests every transmitter heard, for finding IDs of own ones
+	TrackAll bool               `yaml:"track_all"`
+	Logger   *zap.SugaredLogger `yaml:"-"`
+}
+
+// BatteryOKMetric is battery_ok of transmitter, 0 is low and 1 is ok (some decoders report fraction in between), sent without prefix
+const BatteryOKMetric = "rtl433_battery_ok"
+
+// Registry gets sensors, their states and battery status, and delivers event topics, implemented by queue.Queue
+type Registry interface {
+	queue.SensorRegistry
+	Subscribe(filter string, handler queue.MessageHandler) error
+	Dispatch(metrics []queue.Metric)
+}
+
+var events = mon.GlobalRegistry.MustRegister("esphome2prom_rtl433_events", mon.NewCounter())
+var eventsIgnored = mon.GlobalRegistry.MustRegister("esphome2prom_rtl433_ignored", mon.NewCounter())
+var eventErrors = mon.GlobalRegistry.MustRegister("esphome2prom_rtl433_errors", mon.NewCounter())
+
+// Source turns events of allowed transmitters into sensors
+type Source struct {
+	cfg Config
+	reg Registry
+	l   *zap.SugaredLogger
+	// sensors by config ID
+	sensors map[string]queue.ESPHomeDiscovery
+	// ignored transmitters already logged
+	ignored map[identity]bool
+	closed  bool
+	sync.Mutex
+}
+
+func New(cfg Config, reg Registry) (*Source, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if len(cfg.Topics) == 0 {
+		cfg.Topics = []string{"rtl_433/+/events", "home/+/RTL_433toMQTT/#"}
+	}
+	if len(cfg.Devices) == 0 && !cfg.TrackAll {
+		return nil, fmt.Errorf("no devices in allow-list, set devices or track_all")
+	}
+	for _, d := range cfg.Devices {
+		if len(d.Model) == 0 || len(d.ID) == 0 {
+			return nil, fmt.Errorf("device %+v needs model and id", d)
+		}
+		if strings.ContainsAny(d.Name, "/+#") {
+			return nil, fmt.Errorf("device name [%s] can't contain /, + or #", d.Name)
+		}
+	}
+	s := &Source{
+		cfg:     cfg,
+		reg:     reg,
+		l:       cfg.Logger,
+		sensors: map[string]queue.ESPHomeDiscovery{},
+		ignored: map[identity]bool{},
+	}
+	for _, topic := range cfg.Topics {
+		err := reg.Subscribe(topic, s.onMessage)
+		if err != nil {
+			return nil, fmt.Errorf("error subscribing to %s: %w", topic, err)
+		}
+	}
+	s.l.Infof("reading rtl_433 events from %s, %d devices allowed", strings.Join(cfg.Topics, ", "), len(cfg.Devices))
+	return s, nil
+}
+
+const maxIgnoredLogged = 1000
+
+// topicSafe replaces characters that can't be in topic, some model names have / in them
+var topicSafe = strings.NewReplacer("/", "-", "+", "-", "#", "-")
+
+// name returns device name of allowed transmitter
+func (s *Source) name(id identity) (string, bool) {
+	for _, d := range s.cfg.Devices {
+		if d.Model != id.Model || d.ID != id.ID || (len(d.Channel) > 0 && d.Channel != id.Channel) {
+			continue
+		}
+		if len(d.Name) > 0 {
+			return d.Name, true
+		}
+		return topicSafe.Replace(id.String()), true
+	}
+	return topicSafe.Replace(id.String()), s.cfg.TrackAll
+}
+
+func (s *Source) onMessage(topic string, payload []byte) {
+	// OpenMQTTGateway also publishes per-field topics under the same prefix
+	if len(payload) == 0 || payload[0] != '{' {
+		return
+	}
+	events.Update(1)
+	id, readings, batteryOK, err := parseEvent(payload)
+	if err != nil {
+		eventErrors.Update(1)
+		s.l.Debugf("[%s] %s", topic, err)
+		return
+	}
+	name, ok := s.name(id)
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
+	}
+	if !ok {
+		eventsIgnored.Update(1)
+		// bounded, IDs of some transmitters change on every battery swap
+		if !s.ignored[id] && len(s.ignored) < maxIgnoredLogged {
+			s.ignored[id] = true
+			s.l.Infof("ignoring transmitter not in allow-list: model %s, id %s, channel %s", id.Model, id.ID, id.Channel)
+		}
+		s.Unlock()
+		return
+	}
+	type state struct {
+		topic string
+		value string
+	}
+	states := make([]state, 0, len(readings))
+	for _, r := range readings {
+		prefix := "rtl_433/" + name + "/sensor/" + r.field
+		d := queue.ESPHomeDiscovery{
+			DeviceClass: r.typ.class,
+			Unit:        r.typ.unit,
+			StateClass:  r.typ.stateClass,
+			Name:        r.field,
+			StateTopic:  prefix + "/state",
+			UniqID:      name + "-" + r.field,
+			Dev:         &queue.ESPHomeDev{ID: id.String(), Name: name, Model: id.Model},
+		}
+		cid := prefix + "/config"
+		if _, ok := s.sensors[cid]; !ok {
+			s.reg.AddSensor(cid, d)
+			s.sensors[cid] = d
+		}
+		states = append(states, state{topic: d.StateTopic, value: strconv.FormatFloat(r.value, 'f', -1, 64)})
+	}
+	s.Unlock()
+	for _, st := range states {
+		s.reg.State(st.topic, []byte(st.value))
+	}
+	if batteryOK != nil {
+		s.reg.Dispatch([]queue.Metric{{Name: BatteryOKMetric, Labels: map[string]string{"device": name}, Value: *batteryOK, TS: time.Now()}})
+	}
+}
+
+// Close makes source ignore later events, radio sensors have no availability so they are never removed
+func (s *Source) Close() {
+	s.Lock()
+	defer s.Unlock()
+	s.closed = true
+}
@@ -0,0 +1,91 @@
+package rtl433
+
+import (
+	"github.com/XANi/esphome2prom/broker"
+	"github.com/XANi/esphome2prom/internal/sourcetest"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"testing"
+)
+
+const towerEvent = `{"time":"2025-10-19 10:00:00","model":"Acurite-Tower","id":1234,"channel":"A","battery_ok":1,"temperature_C":21.3,"humidity":45,"mic":"CHECKSUM"}`
+
+func TestSource(t *testing.T) {
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{
+		Devices: []DeviceConfig{
+			{Model: "Acurite-Tower", ID: "1234", Channel: "A", Name: "balcony"},
+			{Model: "Fineoffset-WH24", ID: "77"},
+		},
+		Logger: zaptest.NewLogger(t).Sugar(),
+	}, reg)
+	require.NoError(t, err)
+	require.Len(t, reg.Filters(), 2)
+	h := reg.Handler("rtl_433/+/events")
+	h("rtl_433/pi/events", []byte(towerEvent))
+	// neighbour's
+	h("rtl_433/pi/events", []byte(`{"model":"Acurite-Tower","id":1234,"channel":"B","temperature_C":5}`))
+	h("rtl_433/pi/events", []byte(`{"model":"Nexus-TH","id":99,"channel":1,"temperature_C":5}`))
+	h("home/gw/RTL_433toMQTT", []byte(`{"model":"Fineoffset-WH24","id":77,"battery_ok":0.5,"wind_avg_m_s":3.2,"wind_max_m_s":5.1,"rain_mm":120.3,"uv":1}`))
+	h("home/gw/RTL_433toMQTT/Fineoffset-WH24/77/rain_mm", []byte(`120.3`))
+	h("rtl_433/pi/events", []byte(`{"id":1}`))
+
+	sensors := reg.Sensors()
+	assert.Len(t, sensors, 5)
+	d := sensors["rtl_433/balcony/sensor/temperature_C/config"]
+	assert.Equal(t, queue.DeviceClassTemperature, d.DeviceClass)
+	assert.Equal(t, "balcony", d.Dev.Name)
+	assert.Equal(t, "Acurite-Tower", d.Dev.Model)
+	assert.Equal(t, []string{"21.3"}, reg.States("rtl_433/balcony/sensor/temperature_C/state"))
+	// battery_ok is status flag, not level
+	assert.NotContains(t, sensors, "rtl_433/balcony/sensor/battery_ok/config")
+	metrics := reg.Metrics()
+	require.Len(t, metrics, 2)
+	assert.Equal(t, BatteryOKMetric, metrics[0].Name)
+	assert.Equal(t, 1.0, metrics[0].Value)
+	assert.Equal(t, "balcony", metrics[0].Labels["device"])
+	assert.Equal(t, 0.5, metrics[1].Value)
+	assert.Equal(t, "Fineoffset-WH24-77", metrics[1].Labels["device"])
+	d = sensors["rtl_433/Fineoffset-WH24-77/sensor/rain_mm/config"]
+	assert.Equal(t, queue.DeviceClassPrecipitation, d.DeviceClass)
+	assert.Equal(t, "total_increasing", d.StateClass)
+
+	s.Close()
+	assert.Len(t, reg.Sensors(), 5)
+}
+
+func TestSourceAllowList(t *testing.T) {
+	_, err := New(Config{}, sourcetest.NewRegistry())
+	assert.Error(t, err)
+	_, err = New(Config{Devices: []DeviceConfig{{Model: "Acurite-Tower"}}}, sourcetest.NewRegistry())
+	assert.Error(t, err)
+
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{TrackAll: true}, reg)
+	require.NoError(t, err)
+	defer s.Close()
+	reg.Handler("rtl_433/+/events")("rtl_433/pi/events", []byte(`{"model":"LaCrosse/TX141","id":5,"temperature_F":70}`))
+	d, ok := reg.Sensor("rtl_433/LaCrosse-TX141-5/sensor/temperature_F/config")
+	require.True(t, ok)
+	assert.Equal(t, "°F", d.Unit)
+}
+
+func TestSourceQueue(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	q, sink := sourcetest.NewQueue(t, b)
+	s, err := New(Config{Devices: []DeviceConfig{{Model: "Fineoffset-WH24", ID: "77"}}, Logger: zaptest.NewLogger(t).Sugar()}, q)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, b.Publish("rtl_433/pi/events", []byte(`{"model":"Fineoffset-WH24","id":77,"wind_avg_km_h":36,"rain_in":1}`), false, 0))
+	byName := map[string]queue.Metric{}
+	for _, m := range sink.WaitFor(t, 2) {
+		byName[m.Name] = m
+	}
+	assert.InDelta(t, 10.0, byName["wind_speed"].Value, 0.001)
+	assert.InDelta(t, 25.4, byName["precipitation"].Value, 0.001)
+	assert.Equal(t, "Fineoffset-WH24-77", byName["wind_speed"].Labels["device"])
+}
@@ -0,0 +1,151 @@
+// Package shelly ingests component status of Shelly Gen2+ (Plus/Pro) devices published over MQTT
+package shelly
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/internal/telemetry"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// OutputMetric is on/off state of switch and light components, sent without prefix
+const OutputMetric = "shelly_output"
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Prefixes are MQTT topic prefixes of devices, "+" (any single level one, device ID by default) if empty
+	Prefixes []string           `yaml:"prefixes"`
+	Logger   *zap.SugaredLogger `yaml:"-"`
+}
+
+// Registry gets sensors, their states and output metrics, and delivers Shelly topics, implemented by queue.Queue
+type Registry interface {
+	telemetry.Registry
+	Subscribe(filter string, handler queue.MessageHandler) error
+}
+
+var statusMessages = mon.GlobalRegistry.MustRegister("esphome2prom_shelly_messages", mon.NewCounter())
+var statusErrors = mon.GlobalRegistry.MustRegister("esphome2prom_shelly_errors", mon.NewCounter())
+
+// Source turns component status of Shelly devices into sensors
+type Source struct {
+	cfg Config
+	l   *zap.SugaredLogger
+	// devices by topic prefix
+	devices *telemetry.Devices
+}
+
+// rpcNotification is message on <prefix>/events/rpc
+type rpcNotification struct {
+	Src    string                     `json:"src"`
+	Method string                     `json:"method"`
+	Params map[string]json.RawMessage `json:"params"`
+}
+
+func New(cfg Config, reg Registry) (*Source, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if len(cfg.Prefixes) == 0 {
+		cfg.Prefixes = []string{"+"}
+	}
+	s := &Source{
+		cfg:     cfg,
+		l:       cfg.Logger,
+		devices: telemetry.NewDevices("shelly", "Shelly", reg, cfg.Logger),
+	}
+	for _, prefix := range cfg.Prefixes {
+		if strings.Contains(prefix, "#") {
+			return nil, fmt.Errorf("prefix [%s] can't contain #", prefix)
+		}
+		for _, filter := range []string{prefix + "/online", prefix + "/events/rpc", prefix + "/status/+"} {
+			err := reg.Subscribe(filter, s.onMessage)
+			if err != nil {
+				return nil, fmt.Errorf("error subscribing to %s: %w", filter, err)
+			}
+		}
+	}
+	s.l.Infof("reading Shelly status under %s", strings.Join(cfg.Prefixes, ", "))
+	return s, nil
+}
+
+func (s *Source) onMessage(topic string, payload []byte) {
+	if name, ok := strings.CutSuffix(topic, "/online"); ok {
+		// sensors of device going offline are removed until it sends status again
+		switch string(payload) {
+		case "true":
+			s.devices.SetOnline(name, true)
+		case "false":
+			s.devices.SetOnline(name, false)
+		}
+		return
+	}
+	statusMessages.Update(1)
+	if name, ok := strings.CutSuffix(topic, "/events/rpc"); ok {
+		var n rpcNotification
+		err := json.Unmarshal(payload, &n)
+		if err != nil {
+			statusErrors.Update(1)
+			s.l.Warnf("[%s] error decoding notification: %s", topic, err)
+			return
+		}
+		// NotifyEvent carries button presses and such
+		if n.Method != "NotifyStatus" && n.Method != "NotifyFullStatus" {
+			return
+		}
+		var readings []telemetry.Reading
+		var outputs []output
+		for _, component := range telemetry.SortedKeys(n.Params) {
+			r, o := componentStatus(component, n.Params[component])
+			readings = append(readings, r...)
+			if o != nil {
+				outputs = append(outputs, *o)
+			}
+		}
+		s.update(name, readings, outputs)
+		return
+	}
+	i := strings.LastIndex(topic, "/status/")
+	if i < 0 {
+		return
+	}
+	name, component := topic[:i], topic[i+len("/status/"):]
+	if !json.Valid(payload) {
+		statusErrors.Update(1)
+		s.l.Warnf("[%s] invalid status JSON", topic)
+		return
+	}
+	readings, o := componentStatus(component, payload)
+	var outputs []output
+	if o != nil {
+		outputs = append(outputs, *o)
+	}
+	s.update(name, readings, outputs)
+}
+
+// update passes readings of device and its outputs as OutputMetric
+func (s *Source) update(name string, readings []telemetry.Reading, outputs []output) {
+	var metrics []queue.Metric
+	now := time.Now()
+	for _, o := range outputs {
+		m := queue.Metric{
+			Name:   OutputMetric,
+			Labels: map[string]string{"device": name, "sensor": o.component},
+			TS:     now,
+		}
+		if o.on {
+			m.Value = 1
+		}
+		metrics = append(metrics, m)
+	}
+	s.devices.Update(name, readings, metrics)
+}
+
+// Close ignores messages from now on, devices' sensors stay registered
+func (s *Source) Close() {
+	s.devices.Close()
+}
@@ -0,0 +1,83 @@
+package shelly
+
+import (
+	"github.com/XANi/esphome2prom/broker"
+	"github.com/XANi/esphome2prom/internal/sourcetest"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"testing"
+)
+
+const switchStatus = `{"id":0,"source":"init","output":true,"apower":12.5,"voltage":231.2,"freq":50.0,"current":0.061,"aenergy":{"total":1234.5,"by_minute":[0,0,0],"minute_ts":1760000000},"temperature":{"tC":41.3,"tF":106.4}}`
+
+func TestSource(t *testing.T) {
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{Logger: zaptest.NewLogger(t).Sugar()}, reg)
+	require.NoError(t, err)
+	assert.Len(t, reg.Filters(), 3)
+	h := reg.Handler("+/status/+")
+	h("shellyplus1pm-a8032ab12345/online", []byte("true"))
+	h("shellyplus1pm-a8032ab12345/status/switch:0", []byte(switchStatus))
+	h("shellyplus1pm-a8032ab12345/status/wifi", []byte(`{"sta_ip":"10.0.0.5","status":"got ip","ssid":"home","rssi":-61}`))
+	h("shellyplus1pm-a8032ab12345/status/sys", []byte(`{"uptime":100}`))
+
+	sensors := reg.Sensors()
+	assert.Len(t, sensors, 6)
+	d := sensors["shelly/shellyplus1pm-a8032ab12345/sensor/switch:0-apower/config"]
+	assert.Equal(t, queue.DeviceClassPower, d.DeviceClass)
+	assert.Equal(t, "switch:0 apower", d.Name)
+	assert.Equal(t, "shellyplus1pm-a8032ab12345", d.Dev.Name)
+	d = sensors["shelly/shellyplus1pm-a8032ab12345/sensor/switch:0-aenergy.total/config"]
+	assert.Equal(t, queue.DeviceClassEnergy, d.DeviceClass)
+	assert.Equal(t, "Wh", d.Unit)
+	assert.Equal(t, []string{"41.3"}, reg.States("shelly/shellyplus1pm-a8032ab12345/sensor/switch:0-temperature.tC/state"))
+	assert.Equal(t, []string{"-61"}, reg.States("shelly/shellyplus1pm-a8032ab12345/sensor/wifi-rssi/state"))
+	metrics := reg.Metrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, OutputMetric, metrics[0].Name)
+	assert.Equal(t, 1.0, metrics[0].Value)
+	assert.Equal(t, "switch:0", metrics[0].Labels["sensor"])
+
+	// notifications carry only what changed
+	h("shellyplus1pm-a8032ab12345/events/rpc", []byte(`{"src":"shellyplus1pm-a8032ab12345","dst":"shellyplus1pm-a8032ab12345/events","method":"NotifyStatus","params":{"ts":1760000001.5,"switch:0":{"id":0,"output":false,"apower":0}}}`))
+	h("shellyplus1pm-a8032ab12345/events/rpc", []byte(`{"src":"shellyplus1pm-a8032ab12345","method":"NotifyEvent","params":{"ts":1760000002,"events":[{"component":"input:0","event":"single_push"}]}}`))
+	assert.Equal(t, []string{"12.5", "0"}, reg.States("shelly/shellyplus1pm-a8032ab12345/sensor/switch:0-apower/state"))
+	assert.Equal(t, []string{"231.2"}, reg.States("shelly/shellyplus1pm-a8032ab12345/sensor/switch:0-voltage/state"))
+	metrics = reg.Metrics()
+	require.Len(t, metrics, 2)
+	assert.Equal(t, 0.0, metrics[1].Value)
+
+	h("shellyplus1pm-a8032ab12345/online", []byte("false"))
+	assert.Empty(t, reg.Sensors())
+	h("shellypro3em-c8f09e000000/status/em:0", []byte(`{"id":0,"a_current":1.2,"a_voltage":230.1,"a_act_power":250,"b_current":0,"total_act_power":250,"user_calibrated_phase":[]}`))
+	assert.Len(t, reg.Sensors(), 5)
+	assert.Equal(t, []string{"250"}, reg.States("shelly/shellypro3em-c8f09e000000/sensor/em:0-total_act_power/state"))
+
+	h("shellypro3em-c8f09e000000/events/rpc", []byte(`{"src":`))
+	s.Close()
+	assert.Len(t, reg.Sensors(), 5)
+	h("shellyplus1pm-a8032ab12345/online", []byte("false"))
+	assert.Len(t, reg.Sensors(), 5)
+}
+
+func TestSourceQueue(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	q, sink := sourcetest.NewQueue(t, b)
+	s, err := New(Config{Prefixes: []string{"shellies/garage"}, Logger: zaptest.NewLogger(t).Sugar()}, q)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, b.Publish("shellies/garage/status/switch:0", []byte(switchStatus), false, 0))
+	byName := map[string]queue.Metric{}
+	for _, m := range sink.WaitFor(t, 6) {
+		byName[m.Labels["sensor"]+" "+m.Name] = m
+	}
+	assert.Equal(t, 12.5, byName["switch:0 apower power"].Value)
+	// Wh converted to kWh like ESPHome energy sensors
+	assert.InDelta(t, 1.2345, byName["switch:0 aenergy.total energy"].Value, 0.0001)
+	assert.Equal(t, 1.0, byName["switch:0 "+OutputMetric].Value)
+	assert.Equal(t, "shellies/garage", byName["switch:0 apower power"].Labels["device"])
+}
@@ -0,0 +1,116 @@
+package shelly
+
+import (
+	"encoding/json"
+	"github.com/XANi/esphome2prom/internal/telemetry"
+	"github.com/XANi/esphome2prom/queue"
+	"strings"
+)
+
+var (
+	power       = telemetry.FieldType{Class: queue.DeviceClassPower, Unit: "W", StateClass: "measurement"}
+	voltage     = telemetry.FieldType{Class: queue.DeviceClassVoltage, Unit: "V", StateClass: "measurement"}
+	current     = telemetry.FieldType{Class: queue.DeviceClassCurrent, Unit: "A", StateClass: "measurement"}
+	energy      = telemetry.FieldType{Class: queue.DeviceClassEnergy, Unit: "Wh", StateClass: "total_increasing"}
+	temperature = telemetry.FieldType{Class: queue.DeviceClassTemperature, Unit: "°C", StateClass: "measurement"}
+)
+
+// metering are fields of switch, cover, light and pm1 components
+var metering = map[string]telemetry.FieldType{
+	"apower":         power,
+	"voltage":        voltage,
+	"current":        current,
+	"aenergy.total":  energy,
+	"temperature.tC": temperature,
+}
+
+// components maps status field (nested ones joined with ".") of component type to sensor type
+var components = map[string]map[string]telemetry.FieldType{
+	"switch": metering,
+	"cover":  metering,
+	"light":  metering,
+	"pm1":    metering,
+	"em1": {
+		"voltage":   voltage,
+		"current":   current,
+		"act_power": power,
+	},
+	"em": {
+		"a_voltage":       voltage,
+		"b_voltage":       voltage,
+		"c_voltage":       voltage,
+		"a_current":       current,
+		"b_current":       current,
+		"c_current":       current,
+		"n_current":       current,
+		"total_current":   current,
+		"a_act_power":     power,
+		"b_act_power":     power,
+		"c_act_power":     power,
+		"total_act_power": power,
+	},
+	"em1data": {
+		"total_act_energy": energy,
+	},
+	"emdata": {
+		"a_total_act_energy": energy,
+		"b_total_act_energy": energy,
+		"c_total_act_energy": energy,
+		"total_act":          energy,
+	},
+	"temperature": {"tC": temperature},
+	"humidity":    {"rh": {Class: queue.DeviceClassHumidity, Unit: "%", StateClass: "measurement"}},
+	"voltmeter":   {"voltage": voltage},
+	"devicepower": {"battery.V": voltage},
+	"wifi":        {"rssi": {Class: queue.DeviceClassSignalStrength, Unit: "dBm", StateClass: "measurement"}},
+}
+
+// output is on/off state of switch or light
+type output struct {
+	component string
+	on        bool
+}
+
+// componentStatus returns known values from status of component ("switch:0", "wifi", ...).
+// Notifications carry only changed fields so any of them can be missing
+func componentStatus(component string, status json.RawMessage) ([]telemetry.Reading, *output) {
+	typ, _, _ := strings.Cut(component, ":")
+	known, ok := components[typ]
+	if !ok {
+		return nil, nil
+	}
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(status, &obj) != nil {
+		return nil, nil
+	}
+	var readings []telemetry.Reading
+	for _, field := range telemetry.SortedKeys(obj) {
+		var v float64
+		if json.Unmarshal(obj[field], &v) == nil {
+			if ft, ok := known[field]; ok {
+				readings = append(readings, telemetry.Reading{Name: component + " " + field, ID: component + "-" + field, Type: ft, Value: v})
+			}
+			continue
+		}
+		var nested map[string]json.RawMessage
+		if json.Unmarshal(obj[field], &nested) != nil {
+			continue
+		}
+		for _, sub := range telemetry.SortedKeys(nested) {
+			ft, ok := known[field+"."+sub]
+			if ok && json.Unmarshal(nested[sub], &v) == nil {
+				readings = append(readings, telemetry.Reading{Name: component + " " + field + "." + sub, ID: component + "-" + field + "." + sub, Type: ft, Value: v})
+			}
+		}
+	}
+	var out *output
+	if typ == "switch" || typ == "light" {
+		var o struct {
+			Output *bool `json:"output"`
+		}
+		if json.Unmarshal(status, &o) == nil && o.Output != nil {
+			out = &output{component: component, on: *o.Output}
+		}
+	}
+	return readings, out
+}
@@ -0,0 +1,428 @@
+// Package spool is a segmented, append-only on-disk buffer.
+// Entries are written as `<unix nano ts> <data>\n` lines into numbered segment files,
+// read back in order and removed once whole segment is committed.
+// Read position is persisted so restart resumes where it stopped.
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const segmentSuffix = ".spool"
+const positionFile = "position"
+
+type Config struct {
+	Dir string `yaml:"dir"`
+	// MaxSize is total size cap in bytes; oldest segments are dropped when exceeded
+	MaxSize int64 `yaml:"max_size"`
+	// MaxAge drops entries older than that on read
+	MaxAge time.Duration `yaml:"max_age"`
+	// SegmentSize is size after which new segment file is started
+	SegmentSize int64              `yaml:"segment_size"`
+	Logger      *zap.SugaredLogger `yaml:"-"`
+}
+
+type Entry struct {
+	TS   time.Time
+	Data []byte
+}
+
+type Spool struct {
+	cfg      Config
+	l        *zap.SugaredLogger
+	segments []uint64
+	// write side
+	wSeg  uint64
+	wFile *os.File
+	// read side
+	rSeg    uint64
+	rOffset int64
+	size    int64
+	depth   int
+	sync.Mutex
+}
+
+func New(cfg Config) (*Spool, error) {
+	if len(cfg.Dir) == 0 {
+		return nil, fmt.Errorf("spool dir not set")
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = 4 * 1024 * 1024
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = 256 * 1024 * 1024
+	}
+	if cfg.MaxAge <= 0 {
+		cfg.MaxAge = time.Hour * 24 * 7
+	}
+	err := os.MkdirAll(cfg.Dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("error creating spool dir: %w", err)
+	}
+	s := &Spool{
+		cfg: cfg,
+		l:   cfg.Logger,
+	}
+	files, err := filepath.Glob(filepath.Join(cfg.Dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), segmentSuffix), 10, 64)
+		if err != nil {
+			s.l.Warnf("ignoring unknown file in spool dir: %s", f)
+			continue
+		}
+		s.segments = append(s.segments, id)
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i] < s.segments[j] })
+	s.loadPosition()
+	for _, seg := range s.segments {
+		st, err := os.Stat(s.segmentPath(seg))
+		if err != nil {
+			return nil, err
+		}
+		s.size += st.Size()
+		s.depth += s.countEntries(seg)
+	}
+	if len(s.segments) > 0 {
+		s.wSeg = s.segments[len(s.segments)-1]
+	}
+	// always start writing into fresh segment, previous one might have been cut mid-line
+	err = s.rotate()
+	if err != nil {
+		return nil, err
+	}
+	if s.depth > 0 {
+		s.l.Infof("spool %s has %d unsent entries", cfg.Dir, s.depth)
+	}
+	return s, nil
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+func (s *Spool) loadPosition() {
+	if len(s.segments) > 0 {
+		s.rSeg = s.segments[0]
+	}
+	b, err := os.ReadFile(filepath.Join(s.cfg.Dir, positionFile))
+	if err != nil {
+		return
+	}
+	var seg uint64
+	var offset int64
+	_, err = fmt.Sscanf(string(b), "%d %d", &seg, &offset)
+	if err != nil {
+		s.l.Warnf("ignoring broken spool position file: %s", err)
+		return
+	}
+	if len(s.segments) > 0 && seg == s.segments[0] {
+		s.rOffset = offset
+	}
+}
+
+func (s *Spool) savePosition() error {
+	tmp := filepath.Join(s.cfg.Dir, positionFile+".tmp")
+	err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d\n", s.rSeg, s.rOffset)), 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.cfg.Dir, positionFile))
+}
+
+func (s *Spool) countEntries(seg uint64) int {
+	f, err := os.Open(s.segmentPath(seg))
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	if seg == s.rSeg && s.rOffset > 0 {
+		f.Seek(s.rOffset, io.SeekStart)
+	}
+	count := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		if len(line) > 1 {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Spool) rotate() error {
+	if s.wFile != nil {
+		s.wFile.Close()
+	}
+	s.wSeg++
+	f, err := os.OpenFile(s.segmentPath(s.wSeg), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating spool segment: %w", err)
+	}
+	s.wFile = f
+	s.segments = append(s.segments, s.wSeg)
+	if len(s.segments) == 1 {
+		s.rSeg = s.wSeg
+		s.rOffset = 0
+	}
+	return nil
+}
+
+// Append writes entries at the end of spool. Data must not contain newlines.
+func (s *Spool) Append(entries ...Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	buf := bytes.Buffer{}
+	for _, e := range entries {
+		if bytes.IndexByte(e.Data, '\n') >= 0 {
+			return fmt.Errorf("spool entry can't contain newline")
+		}
+		buf.WriteString(strconv.FormatInt(e.TS.UnixNano(), 10))
+		buf.WriteByte(' ')
+		buf.Write(e.Data)
+		buf.WriteByte('\n')
+	}
+	n, err := s.wFile.Write(buf.Bytes())
+	s.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("error writing spool: %w", err)
+	}
+	err = s.wFile.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing spool: %w", err)
+	}
+	s.depth += len(entries)
+	if st, err := s.wFile.Stat(); err == nil && st.Size() >= s.cfg.SegmentSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	for s.size > s.cfg.MaxSize && len(s.segments) > 1 {
+		s.l.Warnf("spool over size limit of %d bytes, dropping oldest segment", s.cfg.MaxSize)
+		s.dropHead()
+	}
+	return nil
+}
+
+// dropHead removes the oldest segment regardless of whether it was read
+func (s *Spool) dropHead() {
+	seg := s.segments[0]
+	s.depth -= s.countEntries(seg)
+	if st, err := os.Stat(s.segmentPath(seg)); err == nil {
+		s.size -= st.Size()
+	}
+	os.Remove(s.segmentPath(seg))
+	s.segments = s.segments[1:]
+	s.rSeg = s.segments[0]
+	s.rOffset = 0
+	s.savePosition()
+}
+
+// Peek returns up to n oldest entries without removing them; call Commit() once they are handled.
+// Expired (older than MaxAge) and corrupted entries at the head are dropped.
+// Peek never returns entries spanning over dropped ones so Commit() count always matches.
+func (s *Spool) Peek(n int) (entries []Entry, err error) {
+	s.Lock()
+	defer s.Unlock()
+	minTS := time.Now().Add(-s.cfg.MaxAge)
+	expired := 0
+	defer func() {
+		if expired > 0 {
+			s.l.Infof("dropped %d spooled entries older than %s", expired, s.cfg.MaxAge)
+			s.savePosition()
+		}
+	}()
+	// local cursor; read position only moves when dropping entries at the head
+	segIdx := 0
+	offset := s.rOffset
+	for segIdx < len(s.segments) && len(entries) < n {
+		seg := s.segments[segIdx]
+		f, err := os.Open(s.segmentPath(seg))
+		if err != nil {
+			return entries, fmt.Errorf("error opening spool segment: %w", err)
+		}
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return entries, err
+		}
+		r := bufio.NewReader(f)
+		stop := false
+		for len(entries) < n {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				// no line or partial line at the end, writer did not finish it yet
+				break
+			}
+			offset += int64(len(line))
+			e, perr := parseLine(line)
+			if perr == nil && !e.TS.Before(minTS) {
+				entries = append(entries, e)
+				continue
+			}
+			if len(entries) > 0 {
+				stop = true
+				break
+			}
+			if perr != nil {
+				s.l.Warnf("skipping corrupted spool entry: %s", perr)
+			} else {
+				expired++
+			}
+			s.rOffset = offset
+			s.depth--
+		}
+		f.Close()
+		if stop || seg == s.wSeg {
+			break
+		}
+		if len(entries) < n {
+			if len(entries) == 0 {
+				s.removeReadSegment()
+			} else {
+				segIdx++
+			}
+			offset = 0
+		}
+	}
+	return entries, nil
+}
+
+// Commit marks n oldest entries (as returned by Peek) as handled
+func (s *Spool) Commit(n int) error {
+	s.Lock()
+	defer s.Unlock()
+	for n > 0 {
+		f, err := os.Open(s.segmentPath(s.rSeg))
+		if err != nil {
+			return err
+		}
+		f.Seek(s.rOffset, io.SeekStart)
+		r := bufio.NewReader(f)
+		for n > 0 {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			s.rOffset += int64(len(line))
+			s.depth--
+			n--
+		}
+		f.Close()
+		if n > 0 {
+			if s.rSeg == s.wSeg {
+				return fmt.Errorf("commit past the end of spool")
+			}
+			s.removeReadSegment()
+		}
+	}
+	if s.rSeg != s.wSeg {
+		if st, err := os.Stat(s.segmentPath(s.rSeg)); err == nil && st.Size() <= s.rOffset {
+			s.removeReadSegment()
+		}
+	}
+	return s.savePosition()
+}
+
+func (s *Spool) removeReadSegment() {
+	if st, err := os.Stat(s.segmentPath(s.rSeg)); err == nil {
+		s.size -= st.Size()
+	}
+	os.Remove(s.segmentPath(s.rSeg))
+	s.segments = s.segments[1:]
+	s.rSeg = s.segments[0]
+	s.rOffset = 0
+	s.savePosition()
+}
+
+// Depth returns number of entries still in spool
+func (s *Spool) Depth() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.depth
+}
+
+// Size returns size of spool on disk in bytes
+func (s *Spool) Size() int64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.size
+}
+
+// Oldest returns timestamp of the oldest entry in spool or zero time if it is empty
+func (s *Spool) Oldest() time.Time {
+	s.Lock()
+	defer s.Unlock()
+	// unlike Peek it doesn't drop expired or corrupted entries, it only reads
+	offset := s.rOffset
+	for _, seg := range s.segments {
+		f, err := os.Open(s.segmentPath(seg))
+		if err != nil {
+			return time.Time{}
+		}
+		_, err = f.Seek(offset, io.SeekStart)
+		if err != nil {
+			f.Close()
+			return time.Time{}
+		}
+		r := bufio.NewReader(f)
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			if e, err := parseLine(line); err == nil {
+				f.Close()
+				return e.TS
+			}
+		}
+		f.Close()
+		offset = 0
+	}
+	return time.Time{}
+}
+
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	err := s.savePosition()
+	if s.wFile != nil {
+		return s.wFile.Close()
+	}
+	return err
+}
+
+func parseLine(line []byte) (e Entry, err error) {
+	line = bytes.TrimSuffix(line, []byte{'\n'})
+	idx := bytes.IndexByte(line, ' ')
+	if idx < 1 {
+		return e, fmt.Errorf("no timestamp in entry")
+	}
+	ts, err := strconv.ParseInt(string(line[:idx]), 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("bad timestamp: %w", err)
+	}
+	e.TS = time.Unix(0, ts)
+	e.Data = line[idx+1:]
+	return e, nil
+}
@@ -0,0 +1,76 @@
+package spool
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"testing"
+	"time"
+)
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{
+		Dir:         dir,
+		SegmentSize: 100,
+		Logger:      zaptest.NewLogger(t).Sugar(),
+	}
+	s, err := New(cfg)
+	require.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		require.NoError(t, s.Append(Entry{TS: time.Now(), Data: []byte(fmt.Sprintf("entry-%02d", i))}))
+	}
+	assert.Equal(t, 20, s.Depth())
+	e, err := s.Peek(5)
+	require.NoError(t, err)
+	require.Len(t, e, 5)
+	assert.Equal(t, "entry-00", string(e[0].Data))
+	require.NoError(t, s.Commit(len(e)))
+	assert.Equal(t, 15, s.Depth())
+	require.NoError(t, s.Close())
+
+	s, err = New(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, 15, s.Depth())
+	all := []string{}
+	for {
+		e, err := s.Peek(4)
+		require.NoError(t, err)
+		if len(e) == 0 {
+			break
+		}
+		for _, v := range e {
+			all = append(all, string(v.Data))
+		}
+		require.NoError(t, s.Commit(len(e)))
+	}
+	require.Len(t, all, 15)
+	assert.Equal(t, "entry-05", all[0])
+	assert.Equal(t, "entry-19", all[14])
+	assert.Equal(t, 0, s.Depth())
+	assert.True(t, s.Oldest().IsZero())
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	s, err := New(Config{
+		Dir:    t.TempDir(),
+		MaxAge: time.Hour,
+		Logger: zaptest.NewLogger(t).Sugar(),
+	})
+	require.NoError(t, err)
+	old := time.Now().Add(-time.Hour * 2)
+	require.NoError(t, s.Append(
+		Entry{TS: old, Data: []byte("old")},
+		Entry{TS: time.Now(), Data: []byte("new")},
+	))
+	// only reads, expired entries are dropped by Peek
+	assert.Equal(t, old.UnixNano(), s.Oldest().UnixNano())
+	assert.Equal(t, 2, s.Depth())
+	e, err := s.Peek(10)
+	require.NoError(t, err)
+	require.Len(t, e, 1)
+	assert.Equal(t, "new", string(e[0].Data))
+	assert.Equal(t, 1, s.Depth())
+	assert.Error(t, s.Append(Entry{TS: time.Now(), Data: []byte("multi\nline")}))
+}
@@ -0,0 +1,111 @@
+// Package tasmota ingests Tasmota's native telemetry (tele/<topic>/SENSOR and STATE) for devices without HA discovery
+package tasmota
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/internal/telemetry"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+const (
+	lwtOnline  = "Online"
+	lwtOffline = "Offline"
+)
+
+// UptimeMetric is UptimeSec from STATE, sent without prefix
+const UptimeMetric = "tasmota_uptime_seconds"
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Prefix is %prefix% part of FullTopic for telemetry, "tele" by default
+	Prefix string             `yaml:"prefix"`
+	Logger *zap.SugaredLogger `yaml:"-"`
+}
+
+// Registry gets sensors, their states and uptime, and delivers Tasmota topics, implemented by queue.Queue
+type Registry interface {
+	telemetry.Registry
+	Subscribe(filter string, handler queue.MessageHandler) error
+}
+
+var telemetryMessages = mon.GlobalRegistry.MustRegister("esphome2prom_tasmota_messages", mon.NewCounter())
+var telemetryErrors = mon.GlobalRegistry.MustRegister("esphome2prom_tasmota_errors", mon.NewCounter())
+
+// Source turns telemetry of every Tasmota device under prefix into sensors
+type Source struct {
+	cfg Config
+	l   *zap.SugaredLogger
+	// devices by Tasmota topic
+	devices *telemetry.Devices
+}
+
+func New(cfg Config, reg Registry) (*Source, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if len(cfg.Prefix) == 0 {
+		cfg.Prefix = "tele"
+	}
+	if strings.ContainsAny(cfg.Prefix, "+#") {
+		return nil, fmt.Errorf("prefix [%s] can't contain + or #", cfg.Prefix)
+	}
+	s := &Source{
+		cfg:     cfg,
+		l:       cfg.Logger,
+		devices: telemetry.NewDevices("tasmota", "Tasmota", reg, cfg.Logger),
+	}
+	filter := cfg.Prefix + "/+/+"
+	err := reg.Subscribe(filter, s.onMessage)
+	if err != nil {
+		return nil, fmt.Errorf("error subscribing to %s: %w", filter, err)
+	}
+	s.l.Infof("reading Tasmota telemetry from %s", filter)
+	return s, nil
+}
+
+func (s *Source) onMessage(topic string, payload []byte) {
+	name, kind, ok := strings.Cut(strings.TrimPrefix(topic, s.cfg.Prefix+"/"), "/")
+	if !ok {
+		return
+	}
+	var readings []telemetry.Reading
+	var uptime *float64
+	var err error
+	switch kind {
+	case "LWT":
+		// sensors of device going offline are removed until it sends telemetry again
+		switch string(payload) {
+		case lwtOnline:
+			s.devices.SetOnline(name, true)
+		case lwtOffline:
+			s.devices.SetOnline(name, false)
+		}
+		return
+	case "SENSOR":
+		readings, err = sensorReadings(payload)
+	case "STATE":
+		readings, uptime, err = stateReadings(payload)
+	default:
+		return
+	}
+	telemetryMessages.Update(1)
+	if err != nil {
+		telemetryErrors.Update(1)
+		s.l.Warnf("[%s] %s", topic, err)
+		return
+	}
+	var metrics []queue.Metric
+	if uptime != nil {
+		metrics = append(metrics, queue.Metric{Name: UptimeMetric, Labels: map[string]string{"device": name}, Value: *uptime, TS: time.Now()})
+	}
+	s.devices.Update(name, readings, metrics)
+}
+
+// Close stops handling telemetry, devices' sensors stay registered
+func (s *Source) Close() {
+	s.devices.Close()
+}
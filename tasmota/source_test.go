@@ -0,0 +1,88 @@
+package tasmota
+
+import (
+	"github.com/XANi/esphome2prom/broker"
+	"github.com/XANi/esphome2prom/internal/sourcetest"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"testing"
+)
+
+const plugSensor = `{"Time":"2025-10-19T10:00:00","ENERGY":{"TotalStartTime":"2024-01-01T00:00:00","Total":12.345,"Yesterday":0.5,"Today":0.1,"Power":45,"Voltage":231,"Current":0.2},"AM2301":{"Temperature":71.6,"Humidity":40.1,"DewPoint":46.0},"TempUnit":"F"}`
+
+func TestSource(t *testing.T) {
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{Logger: zaptest.NewLogger(t).Sugar()}, reg)
+	require.NoError(t, err)
+	h := reg.Handler("tele/+/+")
+	require.NotNil(t, h)
+	h("tele/plug1/LWT", []byte("Online"))
+	h("tele/plug1/SENSOR", []byte(plugSensor))
+	h("tele/plug1/STATE", []byte(`{"Uptime":"0T01:00:00","UptimeSec":3600,"Wifi":{"AP":1,"RSSI":80,"Signal":-60}}`))
+	h("tele/plug1/RESULT", []byte(`{"POWER":"ON"}`))
+
+	sensors := reg.Sensors()
+	assert.Len(t, sensors, 9)
+	d := sensors["tasmota/plug1/sensor/ENERGY-Power/config"]
+	assert.Equal(t, queue.DeviceClassPower, d.DeviceClass)
+	assert.Equal(t, "ENERGY Power", d.Name)
+	assert.Equal(t, "plug1", d.Dev.Name)
+	d = sensors["tasmota/plug1/sensor/AM2301-Temperature/config"]
+	assert.Equal(t, "°F", d.Unit)
+	assert.Equal(t, "total_increasing", sensors["tasmota/plug1/sensor/ENERGY-Total/config"].StateClass)
+	assert.Equal(t, []string{"45"}, reg.States("tasmota/plug1/sensor/ENERGY-Power/state"))
+	assert.Equal(t, []string{"12.345"}, reg.States("tasmota/plug1/sensor/ENERGY-Total/state"))
+	assert.Equal(t, []string{"-60"}, reg.States("tasmota/plug1/sensor/Wifi-Signal/state"))
+	assert.Equal(t, []string{"80"}, reg.States("tasmota/plug1/sensor/Wifi-RSSI/state"))
+	assert.Equal(t, "%", sensors["tasmota/plug1/sensor/Wifi-RSSI/config"].Unit)
+	metrics := reg.Metrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, UptimeMetric, metrics[0].Name)
+	assert.Equal(t, 3600.0, metrics[0].Value)
+	assert.Equal(t, "plug1", metrics[0].Labels["device"])
+	online, err := mon.GlobalRegistry.GetMetric("esphome2prom_tasmota_online", map[string]string{"device": "plug1"})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, online.Value())
+
+	h("tele/plug1/LWT", []byte("Offline"))
+	assert.Empty(t, reg.Sensors())
+	assert.Equal(t, 0.0, online.Value())
+	h("tele/plug1/SENSOR", []byte(`{"ENERGY":{"Voltage":[230,231,229]}}`))
+	assert.Len(t, reg.Sensors(), 3)
+	assert.Equal(t, []string{"229"}, reg.States("tasmota/plug1/sensor/ENERGY-Voltage-3/state"))
+
+	h("tele/plug1/SENSOR", []byte(`{"ENERGY":`))
+	s.Close()
+	assert.Len(t, reg.Sensors(), 3)
+	h("tele/plug1/SENSOR", []byte(plugSensor))
+	assert.Len(t, reg.Sensors(), 3)
+}
+
+func TestSourcePrefix(t *testing.T) {
+	_, err := New(Config{Prefix: "tele/#"}, sourcetest.NewRegistry())
+	assert.Error(t, err)
+}
+
+func TestSourceQueue(t *testing.T) {
+	b, err := broker.New(broker.Config{Address: "127.0.0.1:0", Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	defer b.Close()
+	q, sink := sourcetest.NewQueue(t, b)
+	s, err := New(Config{Logger: zaptest.NewLogger(t).Sugar()}, q)
+	require.NoError(t, err)
+	defer s.Close()
+	require.NoError(t, b.Publish("tele/plug1/SENSOR", []byte(plugSensor), false, 0))
+	byName := map[string]queue.Metric{}
+	for _, m := range sink.WaitFor(t, 7) {
+		byName[m.Labels["sensor"]] = m
+	}
+	// same metric names and units as sensors coming from ESPHome
+	assert.Equal(t, "temperature", byName["AM2301 Temperature"].Name)
+	assert.InDelta(t, 22.0, byName["AM2301 Temperature"].Value, 0.001)
+	assert.Equal(t, "power", byName["ENERGY Power"].Name)
+	assert.Equal(t, 45.0, byName["ENERGY Power"].Value)
+	assert.Equal(t, "plug1", byName["ENERGY Power"].Labels["device"])
+}
@@ -0,0 +1,121 @@
+package tasmota
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/internal/telemetry"
+	"github.com/XANi/esphome2prom/queue"
+	"strconv"
+)
+
+// fields maps field of sensor object in SENSOR telemetry (AM2301.Temperature, ENERGY.Power, ...) to sensor type.
+// Temperature and pressure units come from TempUnit and PressureUnit
+var fields = map[string]telemetry.FieldType{
+	"Temperature":   {Class: queue.DeviceClassTemperature, StateClass: "measurement"},
+	"DewPoint":      {Class: queue.DeviceClassTemperature, StateClass: "measurement"},
+	"Humidity":      {Class: queue.DeviceClassHumidity, Unit: "%", StateClass: "measurement"},
+	"Pressure":      {Class: queue.DeviceClassPressure, StateClass: "measurement"},
+	"SeaPressure":   {Class: queue.DeviceClassPressure, StateClass: "measurement"},
+	"CarbonDioxide": {Class: queue.DeviceClassCO2, Unit: "ppm", StateClass: "measurement"},
+	"eCO2":          {Class: queue.DeviceClassCO2, Unit: "ppm", StateClass: "measurement"},
+	"PM1":           {Class: queue.DeviceClassParticulate1, Unit: "µg/m³", StateClass: "measurement"},
+	"PM2.5":         {Class: queue.DeviceClassParticulate25, Unit: "µg/m³", StateClass: "measurement"},
+	"PM10":          {Class: queue.DeviceClassParticulate10, Unit: "µg/m³", StateClass: "measurement"},
+	"Voltage":       {Class: queue.DeviceClassVoltage, Unit: "V", StateClass: "measurement"},
+	"Current":       {Class: queue.DeviceClassCurrent, Unit: "A", StateClass: "measurement"},
+	"Power":         {Class: queue.DeviceClassPower, Unit: "W", StateClass: "measurement"},
+	"Total":         {Class: queue.DeviceClassEnergy, Unit: "kWh", StateClass: "total_increasing"},
+}
+
+// sensorReadings returns known values from SENSOR message
+func sensorReadings(payload []byte) ([]telemetry.Reading, error) {
+	var msg map[string]json.RawMessage
+	err := json.Unmarshal(payload, &msg)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding SENSOR: %w", err)
+	}
+	var units struct {
+		TempUnit     string
+		PressureUnit string
+	}
+	json.Unmarshal(payload, &units)
+	if len(units.TempUnit) == 0 {
+		units.TempUnit = "C"
+	}
+	if len(units.PressureUnit) == 0 {
+		units.PressureUnit = "hPa"
+	}
+	var out []telemetry.Reading
+	for _, key := range telemetry.SortedKeys(msg) {
+		var obj map[string]json.RawMessage
+		// Time, units and anything else that isn't a sensor
+		if json.Unmarshal(msg[key], &obj) != nil {
+			continue
+		}
+		for _, field := range telemetry.SortedKeys(obj) {
+			typ, ok := fields[field]
+			if !ok {
+				continue
+			}
+			switch typ.Class {
+			case queue.DeviceClassTemperature:
+				typ.Unit = "°" + units.TempUnit
+			case queue.DeviceClassPressure:
+				typ.Unit = units.PressureUnit
+			}
+			out = append(out, values(key, field, typ, obj[field])...)
+		}
+	}
+	return out, nil
+}
+
+// stateReadings returns WiFi signal and quality from STATE message, and uptime in seconds if it has one
+func stateReadings(payload []byte) (readings []telemetry.Reading, uptime *float64, err error) {
+	var msg struct {
+		UptimeSec *float64
+		Wifi      struct {
+			// RSSI is link quality in %, not dBm
+			RSSI   *float64
+			Signal *float64
+		}
+	}
+	err = json.Unmarshal(payload, &msg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error decoding STATE: %w", err)
+	}
+	if msg.Wifi.Signal != nil {
+		readings = append(readings, telemetry.Reading{
+			Name:  "Wifi Signal",
+			ID:    "Wifi-Signal",
+			Type:  telemetry.FieldType{Class: queue.DeviceClassSignalStrength, Unit: "dBm", StateClass: "measurement"},
+			Value: *msg.Wifi.Signal,
+		})
+	}
+	if msg.Wifi.RSSI != nil {
+		readings = append(readings, telemetry.Reading{
+			Name:  "Wifi RSSI",
+			ID:    "Wifi-RSSI",
+			Type:  telemetry.FieldType{Class: queue.DeviceClassSignalStrength, Unit: "%", StateClass: "measurement"},
+			Value: *msg.Wifi.RSSI,
+		})
+	}
+	return readings, msg.UptimeSec, nil
+}
+
+// values returns number, or every element of array for multi-channel meters
+func values(key, field string, typ telemetry.FieldType, raw json.RawMessage) []telemetry.Reading {
+	var v float64
+	if json.Unmarshal(raw, &v) == nil {
+		return []telemetry.Reading{{Name: key + " " + field, ID: key + "-" + field, Type: typ, Value: v}}
+	}
+	var arr []float64
+	if json.Unmarshal(raw, &arr) != nil {
+		return nil
+	}
+	out := make([]telemetry.Reading, 0, len(arr))
+	for i, v := range arr {
+		n := strconv.Itoa(i + 1)
+		out = append(out, telemetry.Reading{Name: key + " " + field + " " + n, ID: key + "-" + field + "-" + n, Type: typ, Value: v})
+	}
+	return out
+}
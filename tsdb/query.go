@@ -0,0 +1,149 @@
+package tsdb
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MaxPoints is limit of points per series in range query, same as in Prometheus
+const MaxPoints = 11000
+
+type Point struct {
+	TS    time.Time
+	Value float64
+}
+
+// Range is values of one series in range query
+type Range struct {
+	Series Series
+	Points []Point
+}
+
+// Series returns series matching any of selectors, sorted
+func (db *TSDB) Series(selectors ...Selector) []Series {
+	db.Lock()
+	defer db.Unlock()
+	var out []Series
+	for _, s := range db.series {
+		for _, sel := range selectors {
+			if sel.Match(s.Name, s.Labels) {
+				out = append(out, *s)
+				break
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b Series) int {
+		return strings.Compare(seriesKey(a.Name, a.Labels), seriesKey(b.Name, b.Labels))
+	})
+	return out
+}
+
+// tier picks coarsest tier not coarser than step that still has start, finest one that has it otherwise
+func (db *TSDB) tier(start time.Time, step time.Duration, now time.Time) int {
+	best := -1
+	retention := db.cfg.Retention
+	for i := -1; i < len(db.cfg.Tiers); i++ {
+		var resolution time.Duration
+		if i >= 0 {
+			resolution, retention = db.cfg.Tiers[i].Resolution, db.cfg.Tiers[i].Retention
+		}
+		if now.Sub(start) > retention {
+			continue
+		}
+		if best < 0 || resolution <= step {
+			best = i + 1
+		}
+	}
+	if best < 0 {
+		// older than any retention, coarsest tier has the most of it
+		return len(db.cfg.Tiers)
+	}
+	return best
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// QueryRange returns series matching selector with values every step from start to end.
+// Value at each step is average of samples in (t-step, t], steps without samples are skipped
+func (db *TSDB) QueryRange(sel Selector, start, end time.Time, step time.Duration) ([]Range, error) {
+	return db.queryRange(sel, start, end, step, time.Now())
+}
+
+func (db *TSDB) queryRange(sel Selector, start, end time.Time, step time.Duration, now time.Time) ([]Range, error) {
+	if step <= 0 {
+		return nil, fmt.Errorf("step has to be positive")
+	}
+	if end.Before(start) {
+		return nil, fmt.Errorf("end is before start")
+	}
+	points := int(end.Sub(start)/step) + 1
+	if points > MaxPoints {
+		return nil, fmt.Errorf("%d points per series exceed limit of %d, increase step", points, MaxPoints)
+	}
+	series := db.Series(sel)
+	if len(series) == 0 {
+		return []Range{}, nil
+	}
+	ids := make([]uint64, 0, len(series))
+	for _, s := range series {
+		ids = append(ids, s.ID)
+	}
+	from := start.Add(-step + time.Millisecond)
+	tier := db.tier(start, step, now)
+	samples, err := db.store.Samples(tier, ids, from, end)
+	if err != nil {
+		return nil, err
+	}
+	// newest buckets are not downsampled yet, raw samples fill them in
+	if done := db.downsampled(tier); tier > 0 && !end.Before(done) {
+		raw, err := db.store.Samples(0, ids, latest(from, done), end)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, raw...)
+	}
+	type bucket struct {
+		sum   float64
+		count int
+	}
+	buckets := map[uint64][]bucket{}
+	for _, s := range samples {
+		b, ok := buckets[s.SeriesID]
+		if !ok {
+			b = make([]bucket, points)
+			buckets[s.SeriesID] = b
+		}
+		// index of first step at or after sample
+		idx := 0
+		if s.TS.After(start) {
+			idx = int((s.TS.Sub(start) + step - 1) / step)
+		}
+		if idx >= points {
+			continue
+		}
+		b[idx].sum += s.Value
+		b[idx].count++
+	}
+	out := make([]Range, 0, len(series))
+	for _, s := range series {
+		b, ok := buckets[s.ID]
+		if !ok {
+			continue
+		}
+		r := Range{Series: s}
+		for i, v := range b {
+			if v.count > 0 {
+				r.Points = append(r.Points, Point{TS: start.Add(step * time.Duration(i)), Value: v.sum / float64(v.count)})
+			}
+		}
+		out = append(out, r)
+	}
+	return out, nil
+}
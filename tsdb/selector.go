@@ -0,0 +1,142 @@
+package tsdb
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// NameLabel matches metric name, same as in Prometheus
+const NameLabel = "__name__"
+
+type Matcher struct {
+	Label string
+	Type  MatchType
+	Value string
+	re    *regexp.Regexp
+}
+
+func (m *Matcher) matches(v string) bool {
+	switch m.Type {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// Selector is Prometheus series selector, name{label="value",...}, without PromQL functions
+type Selector struct {
+	Matchers []Matcher
+}
+
+// Match checks series against all matchers, missing label is empty
+func (s *Selector) Match(name string, labels map[string]string) bool {
+	for _, m := range s.Matchers {
+		v := labels[m.Label]
+		if m.Label == NameLabel {
+			v = name
+		}
+		if !m.matches(v) {
+			return false
+		}
+	}
+	return true
+}
+
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// matchOps are in order they have to be tried in
+var matchOps = []MatchType{MatchRegexp, MatchNotRegexp, MatchNotEqual, MatchEqual}
+
+// ParseSelector parses metric{label="value"} with =, !=, =~ and !~ matchers
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	s = strings.TrimSpace(s)
+	name, rest := s, ""
+	if i := strings.IndexByte(s, '{'); i >= 0 {
+		if !strings.HasSuffix(s, "}") {
+			return sel, fmt.Errorf("selector [%s] has unclosed {", s)
+		}
+		name, rest = strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:len(s)-1])
+	}
+	if len(name) > 0 {
+		if !metricNameRe.MatchString(name) {
+			return sel, fmt.Errorf("invalid metric name [%s]", name)
+		}
+		sel.Matchers = append(sel.Matchers, Matcher{Label: NameLabel, Type: MatchEqual, Value: name})
+	}
+	for len(rest) > 0 {
+		j := strings.IndexFunc(rest, func(r rune) bool {
+			return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+		})
+		if j <= 0 {
+			return sel, fmt.Errorf("expected label name at [%s]", rest)
+		}
+		m := Matcher{Label: rest[:j]}
+		rest = strings.TrimSpace(rest[j:])
+		for _, op := range matchOps {
+			if strings.HasPrefix(rest, string(op)) {
+				m.Type = op
+				break
+			}
+		}
+		if len(m.Type) == 0 {
+			return sel, fmt.Errorf("expected =, !=, =~ or !~ after %s", m.Label)
+		}
+		rest = strings.TrimSpace(rest[len(m.Type):])
+		if !strings.HasPrefix(rest, `"`) {
+			return sel, fmt.Errorf("value of %s has to be double quoted", m.Label)
+		}
+		k := 1
+		for k < len(rest) && rest[k] != '"' {
+			if rest[k] == '\\' {
+				k++
+			}
+			k++
+		}
+		if k >= len(rest) {
+			return sel, fmt.Errorf("unterminated value of %s", m.Label)
+		}
+		var err error
+		m.Value, err = strconv.Unquote(rest[:k+1])
+		if err != nil {
+			return sel, fmt.Errorf("invalid value of %s: %w", m.Label, err)
+		}
+		if m.Type == MatchRegexp || m.Type == MatchNotRegexp {
+			m.re, err = regexp.Compile("^(?:" + m.Value + ")$")
+			if err != nil {
+				return sel, fmt.Errorf("invalid regexp of %s: %w", m.Label, err)
+			}
+		}
+		sel.Matchers = append(sel.Matchers, m)
+		rest = strings.TrimSpace(rest[k+1:])
+		if strings.HasPrefix(rest, ",") {
+			rest = strings.TrimSpace(rest[1:])
+		} else if len(rest) > 0 {
+			return sel, fmt.Errorf("expected , or } at [%s]", rest)
+		}
+	}
+	// same as Prometheus, {foo!="bar"} alone would select everything
+	for _, m := range sel.Matchers {
+		if !m.matches("") {
+			return sel, nil
+		}
+	}
+	return sel, fmt.Errorf("selector [%s] needs at least one matcher that doesn't match empty string", s)
+}
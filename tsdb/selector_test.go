@@ -0,0 +1,44 @@
+package tsdb
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{"device": "garage", "sensor": "t1"}
+	for sel, match := range map[string]bool{
+		`esphome_temperature`:                                     true,
+		`esphome_temperature{}`:                                   true,
+		`esphome_temperature{device="garage"}`:                    true,
+		`esphome_temperature{ device = "garage" , sensor!="t2" }`: true,
+		`{__name__=~"esphome_.*",device=~"gar.+"}`:                true,
+		`{device="garage",sensor!~"t\\d"}`:                        false,
+		`esphome_humidity{device="garage"}`:                       false,
+		`esphome_temperature{device="gar"}`:                       false,
+		`esphome_temperature{device=~"gar"}`:                      false,
+		`esphome_temperature{room=""}`:                            true,
+		`{device="with \"quote\""}`:                               false,
+	} {
+		s, err := ParseSelector(sel)
+		require.NoError(t, err, sel)
+		assert.Equal(t, match, s.Match("esphome_temperature", labels), sel)
+	}
+	for _, sel := range []string{
+		``,
+		`{}`,
+		`{device!="garage"}`,
+		`{device=~".*"}`,
+		`esphome-temperature`,
+		`esphome_temperature{device="garage"`,
+		`esphome_temperature{device=garage}`,
+		`esphome_temperature{device="garage}`,
+		`esphome_temperature{device~"garage"}`,
+		`esphome_temperature{device="garage" sensor="t1"}`,
+		`esphome_temperature{device=~"("}`,
+	} {
+		_, err := ParseSelector(sel)
+		assert.Error(t, err, sel)
+	}
+}
@@ -0,0 +1,272 @@
+// Package tsdb stores samples in db with downsampled tiers, so small sites can chart history without Prometheus
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type TierConfig struct {
+	// Resolution is bucket size samples are averaged into
+	Resolution time.Duration `yaml:"resolution"`
+	Retention  time.Duration `yaml:"retention"`
+}
+
+type Config struct {
+	Enabled bool `yaml:"enabled"`
+	// Retention of raw samples
+	Retention time.Duration `yaml:"retention"`
+	// Tiers of averages, each coarser than previous one and multiple of its resolution
+	Tiers []TierConfig `yaml:"tiers"`
+	// Interval of downsampling and removing expired samples
+	Interval time.Duration `yaml:"interval"`
+	// Filter selects metrics that are stored, all by default. Applied by queue like filter of any other sink
+	Filter queue.SinkFilter   `yaml:"filter"`
+	Logger *zap.SugaredLogger `yaml:"-"`
+}
+
+type Series struct {
+	ID     uint64
+	Name   string
+	Labels map[string]string
+}
+
+type Sample struct {
+	SeriesID uint64
+	TS       time.Time
+	Value    float64
+}
+
+// Store keeps series and samples, implemented by db.DB. Tier 0 is raw samples, tier N is Config.Tiers[N-1]
+type Store interface {
+	Series() ([]Series, error)
+	// AddSeries stores new series and sets its ID
+	AddSeries(s *Series) error
+	AddSamples(samples []Sample) error
+	// Downsample averages samples of tier-1 in [from, to) into buckets of resolution in tier and records tier is done until to
+	Downsample(tier int, resolution time.Duration, from, to time.Time) error
+	// Downsampled returns time each tier is downsampled until
+	Downsampled() (map[int]time.Time, error)
+	// DeleteSamples removes samples of tier older than before
+	DeleteSamples(tier int, before time.Time) error
+	// Samples returns samples of series in tier in [from, to], oldest first
+	Samples(tier int, series []uint64, from, to time.Time) ([]Sample, error)
+}
+
+var storedSamples = mon.GlobalRegistry.MustRegister("esphome2prom_tsdb_samples", mon.NewCounter())
+var storedSeries = mon.GlobalRegistry.MustRegister("esphome2prom_tsdb_series", mon.NewGauge())
+var storeErrors = mon.GlobalRegistry.MustRegister("esphome2prom_tsdb_errors", mon.NewCounter())
+
+// downsampleDelay leaves time for samples still in sink queues to reach the bucket before it is averaged
+const downsampleDelay = time.Minute
+
+// TSDB is sink storing samples, it downsamples and expires them in background
+type TSDB struct {
+	cfg   Config
+	store Store
+	l     *zap.SugaredLogger
+	// series by key
+	series map[string]*Series
+	// downsampled until, by tier
+	done    map[int]time.Time
+	stop    chan struct{}
+	stopped chan struct{}
+	sync.Mutex
+}
+
+func New(cfg Config, store Store) (*TSDB, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = time.Hour * 24 * 7
+	}
+	if cfg.Tiers == nil {
+		cfg.Tiers = []TierConfig{{Resolution: time.Minute * 5, Retention: time.Hour * 24 * 365}}
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	var prev time.Duration
+	for _, t := range cfg.Tiers {
+		if t.Resolution <= prev || t.Resolution%time.Millisecond != 0 || (prev > 0 && t.Resolution%prev != 0) {
+			return nil, fmt.Errorf("tier resolution %s has to be coarser than and multiple of previous one", t.Resolution)
+		}
+		if t.Retention < t.Resolution {
+			return nil, fmt.Errorf("tier %s retention %s is shorter than its resolution", t.Resolution, t.Retention)
+		}
+		prev = t.Resolution
+	}
+	series, err := store.Series()
+	if err != nil {
+		return nil, fmt.Errorf("error loading series: %w", err)
+	}
+	done, err := store.Downsampled()
+	if err != nil {
+		return nil, fmt.Errorf("error loading tiers: %w", err)
+	}
+	db := &TSDB{
+		cfg:     cfg,
+		store:   store,
+		l:       cfg.Logger,
+		series:  map[string]*Series{},
+		done:    done,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	for _, s := range series {
+		db.series[seriesKey(s.Name, s.Labels)] = &s
+	}
+	storedSeries.Update(float64(len(db.series)))
+	db.l.Infof("loaded %d series", len(db.series))
+	go db.run()
+	return db, nil
+}
+
+// seriesKey is name{k="v",...} with sorted labels
+func seriesKey(name string, labels map[string]string) string {
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i, k := range slices.Sorted(maps.Keys(labels)) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", k, labels[k])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Write stores samples, metrics whose series can't be added are skipped so they don't hold back the rest
+func (db *TSDB) Write(ctx context.Context, metrics []queue.Metric) error {
+	samples := make([]Sample, 0, len(metrics))
+	db.Lock()
+	for _, m := range metrics {
+		key := seriesKey(m.Name, m.Labels)
+		s, ok := db.series[key]
+		if !ok {
+			s = &Series{Name: m.Name, Labels: maps.Clone(m.Labels)}
+			err := db.store.AddSeries(s)
+			if err != nil {
+				storeErrors.Update(1)
+				db.l.Errorf("error adding series %s: %s", key, err)
+				continue
+			}
+			db.series[key] = s
+			storedSeries.Update(float64(len(db.series)))
+		}
+		ts := m.TS
+		if ts.IsZero() {
+			ts = time.Now()
+		}
+		samples = append(samples, Sample{SeriesID: s.ID, TS: ts, Value: m.Value})
+	}
+	db.Unlock()
+	if len(samples) == 0 {
+		return nil
+	}
+	err := db.store.AddSamples(samples)
+	if err != nil {
+		storeErrors.Update(1)
+		return err
+	}
+	storedSamples.Update(float64(len(samples)))
+	return nil
+}
+
+func (db *TSDB) run() {
+	defer close(db.stopped)
+	t := time.NewTicker(db.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			db.maintain(time.Now())
+		case <-db.stop:
+			return
+		}
+	}
+}
+
+func (db *TSDB) downsampled(tier int) time.Time {
+	db.Lock()
+	defer db.Unlock()
+	return db.done[tier]
+}
+
+// align rounds t down to multiple of resolution since epoch, same as buckets in store
+func align(t time.Time, resolution time.Duration) time.Time {
+	res := resolution.Milliseconds()
+	return time.UnixMilli(t.UnixMilli() / res * res)
+}
+
+// maintain downsamples finished buckets of every tier and removes expired samples.
+// Samples not downsampled into next tier yet are kept even if expired
+func (db *TSDB) maintain(now time.Time) {
+	until := now.Add(-downsampleDelay)
+	for i, t := range db.cfg.Tiers {
+		tier := i + 1
+		to := align(until, t.Resolution)
+		if tier > 1 {
+			// previous tier has to be finished first
+			prev := db.downsampled(tier - 1)
+			if prev.IsZero() {
+				break
+			}
+			to = align(prev, t.Resolution)
+		}
+		from := db.downsampled(tier)
+		if !to.After(from) {
+			continue
+		}
+		err := db.store.Downsample(tier, t.Resolution, from, to)
+		if err != nil {
+			storeErrors.Update(1)
+			db.l.Errorf("error downsampling tier %s: %s", t.Resolution, err)
+			break
+		}
+		db.Lock()
+		db.done[tier] = to
+		db.Unlock()
+	}
+	retention := db.cfg.Retention
+	for tier := 0; tier <= len(db.cfg.Tiers); tier++ {
+		if tier > 0 {
+			retention = db.cfg.Tiers[tier-1].Retention
+		}
+		before := now.Add(-retention)
+		if tier < len(db.cfg.Tiers) {
+			if done := db.downsampled(tier + 1); done.Before(before) {
+				before = done
+			}
+		}
+		if before.IsZero() {
+			continue
+		}
+		err := db.store.DeleteSamples(tier, before)
+		if err != nil {
+			storeErrors.Update(1)
+			db.l.Errorf("error removing expired samples of tier %d: %s", tier, err)
+		}
+	}
+}
+
+// Close stops background downsampling, samples are written synchronously so there is nothing to flush
+func (db *TSDB) Close() {
+	select {
+	case <-db.stop:
+		return
+	default:
+	}
+	close(db.stop)
+	<-db.stopped
+}
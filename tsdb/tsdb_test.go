@@ -0,0 +1,263 @@
+package tsdb
+
+import (
+	"context"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memSample struct {
+	value float64
+	count int
+}
+
+// memStore keeps samples by tier, series and unix ms
+type memStore struct {
+	// badSeries fails AddSeries of series with that name
+	badSeries string
+	// downsampleErr is returned by Downsample
+	downsampleErr error
+	series        []Series
+	samples       map[int]map[uint64]map[int64]memSample
+	done          map[int]time.Time
+	sync.Mutex
+}
+
+func newMemStore() *memStore {
+	return &memStore{samples: map[int]map[uint64]map[int64]memSample{}, done: map[int]time.Time{}}
+}
+
+func (m *memStore) Series() ([]Series, error) {
+	m.Lock()
+	defer m.Unlock()
+	return slices.Clone(m.series), nil
+}
+
+func (m *memStore) AddSeries(s *Series) error {
+	m.Lock()
+	defer m.Unlock()
+	if s.Name == m.badSeries {
+		return fmt.Errorf("bad series")
+	}
+	s.ID = uint64(len(m.series) + 1)
+	m.series = append(m.series, *s)
+	return nil
+}
+
+func (m *memStore) add(tier int, id uint64, ts int64, s memSample) {
+	if m.samples[tier] == nil {
+		m.samples[tier] = map[uint64]map[int64]memSample{}
+	}
+	if m.samples[tier][id] == nil {
+		m.samples[tier][id] = map[int64]memSample{}
+	}
+	m.samples[tier][id][ts] = s
+}
+
+func (m *memStore) AddSamples(samples []Sample) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, s := range samples {
+		m.add(0, s.SeriesID, s.TS.UnixMilli(), memSample{value: s.Value, count: 1})
+	}
+	return nil
+}
+
+func (m *memStore) Downsample(tier int, resolution time.Duration, from, to time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.downsampleErr != nil {
+		return m.downsampleErr
+	}
+	res := resolution.Milliseconds()
+	for id, samples := range m.samples[tier-1] {
+		buckets := map[int64]memSample{}
+		for ts, s := range samples {
+			if ts < from.UnixMilli() || ts >= to.UnixMilli() {
+				continue
+			}
+			b := buckets[ts/res*res]
+			b.value += s.value * float64(s.count)
+			b.count += s.count
+			buckets[ts/res*res] = b
+		}
+		for ts, b := range buckets {
+			m.add(tier, id, ts, memSample{value: b.value / float64(b.count), count: b.count})
+		}
+	}
+	m.done[tier] = to
+	return nil
+}
+
+func (m *memStore) Downsampled() (map[int]time.Time, error) {
+	m.Lock()
+	defer m.Unlock()
+	out := map[int]time.Time{}
+	for k, v := range m.done {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (m *memStore) DeleteSamples(tier int, before time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+	for _, samples := range m.samples[tier] {
+		for ts := range samples {
+			if ts < before.UnixMilli() {
+				delete(samples, ts)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *memStore) Samples(tier int, series []uint64, from, to time.Time) ([]Sample, error) {
+	m.Lock()
+	defer m.Unlock()
+	var out []Sample
+	for _, id := range series {
+		for ts, s := range m.samples[tier][id] {
+			if ts >= from.UnixMilli() && ts <= to.UnixMilli() {
+				out = append(out, Sample{SeriesID: id, TS: time.UnixMilli(ts), Value: s.value})
+			}
+		}
+	}
+	slices.SortFunc(out, func(a, b Sample) int { return a.TS.Compare(b.TS) })
+	return out, nil
+}
+
+func (m *memStore) count(tier int) int {
+	m.Lock()
+	defer m.Unlock()
+	n := 0
+	for _, samples := range m.samples[tier] {
+		n += len(samples)
+	}
+	return n
+}
+
+func TestTSDBInvalidTiers(t *testing.T) {
+	for _, tiers := range [][]TierConfig{
+		{{Resolution: 0, Retention: time.Hour}},
+		{{Resolution: time.Minute * 5, Retention: time.Hour}, {Resolution: time.Minute * 7, Retention: time.Hour * 2}},
+		{{Resolution: time.Minute * 5, Retention: time.Hour}, {Resolution: time.Minute, Retention: time.Hour * 2}},
+		{{Resolution: time.Hour, Retention: time.Minute}},
+	} {
+		_, err := New(Config{Tiers: tiers}, newMemStore())
+		assert.Error(t, err, tiers)
+	}
+}
+
+func TestTSDB(t *testing.T) {
+	store := newMemStore()
+	db, err := New(Config{
+		Logger:    zaptest.NewLogger(t).Sugar(),
+		Retention: time.Hour,
+		Tiers: []TierConfig{
+			{Resolution: time.Minute * 5, Retention: time.Hour * 24},
+			{Resolution: time.Hour, Retention: time.Hour * 24 * 30},
+		},
+	}, store)
+	require.NoError(t, err)
+	defer db.Close()
+
+	now := time.Now().Truncate(time.Hour)
+	var metrics []queue.Metric
+	// 3 hours of samples every minute, value is minute since start
+	for i := range 180 {
+		ts := now.Add(-time.Hour * 3).Add(time.Minute * time.Duration(i))
+		metrics = append(metrics,
+			queue.Metric{Name: "esphome_temperature", Labels: map[string]string{"device": "garage", "sensor": "t1"}, Value: float64(i), TS: ts},
+			queue.Metric{Name: "esphome_temperature", Labels: map[string]string{"device": "shed", "sensor": "t1"}, Value: 1, TS: ts},
+		)
+	}
+	require.NoError(t, db.Write(context.Background(), metrics))
+	assert.Len(t, db.Series(mustSelector(t, `{sensor="t1"}`)), 2)
+
+	db.maintain(now.Add(time.Minute * 2))
+	assert.Equal(t, 36*2, store.count(1))
+	assert.Equal(t, 3*2, store.count(2))
+	// raw older than an hour is gone
+	assert.Equal(t, 58*2, store.count(0))
+	// second run has nothing new to downsample
+	db.maintain(now.Add(time.Minute * 3))
+	assert.Equal(t, 36*2, store.count(1))
+
+	sel := mustSelector(t, `esphome_temperature{device="garage"}`)
+	// raw covers last hour
+	r, err := db.queryRange(sel, now.Add(-time.Minute*30), now, time.Minute, now)
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	assert.Equal(t, "garage", r[0].Series.Labels["device"])
+	require.Len(t, r[0].Points, 30)
+	assert.Equal(t, 150.0, r[0].Points[0].Value)
+
+	// 5 minute tier, step 10 minutes averages two buckets
+	r, err = db.queryRange(sel, now.Add(-time.Hour*2), now.Add(-time.Hour), time.Minute*10, now)
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	require.Len(t, r[0].Points, 7)
+	// (t-10m, t] has buckets starting at minutes 65 and 70
+	assert.Equal(t, 69.5, r[0].Points[1].Value)
+
+	// range older than 5 minute tier retention comes from hour tier
+	_, err = db.QueryRange(sel, now.Add(-time.Hour*24*8), now, time.Minute)
+	require.Error(t, err)
+	r, err = db.queryRange(sel, now.Add(-time.Hour*24*8), now, time.Hour, now)
+	require.NoError(t, err)
+	require.Len(t, r, 1)
+	assert.Len(t, r[0].Points, 3)
+	assert.Equal(t, 29.5, r[0].Points[0].Value)
+}
+
+func TestTSDBWriteSkipsBadSeries(t *testing.T) {
+	store := newMemStore()
+	store.badSeries = "bad"
+	db, err := New(Config{Logger: zaptest.NewLogger(t).Sugar()}, store)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, db.Write(context.Background(), []queue.Metric{
+		{Name: "bad", Value: 1},
+		{Name: "esphome_temperature", Value: 2},
+	}))
+	assert.Len(t, db.Series(mustSelector(t, `{__name__=~".+"}`)), 1)
+	assert.Equal(t, 1, store.count(0))
+}
+
+func TestTSDBKeepsSamplesNotDownsampled(t *testing.T) {
+	store := newMemStore()
+	store.downsampleErr = fmt.Errorf("disk full")
+	db, err := New(Config{
+		Logger:    zaptest.NewLogger(t).Sugar(),
+		Retention: time.Hour,
+		Tiers:     []TierConfig{{Resolution: time.Minute * 5, Retention: time.Hour * 24}},
+	}, store)
+	require.NoError(t, err)
+	defer db.Close()
+	now := time.Now().Truncate(time.Hour)
+	require.NoError(t, db.Write(context.Background(), []queue.Metric{
+		{Name: "esphome_temperature", Value: 1, TS: now.Add(-time.Hour * 2)},
+		{Name: "esphome_temperature", Value: 2, TS: now.Add(-time.Minute * 30)},
+	}))
+	db.maintain(now)
+	assert.Equal(t, 2, store.count(0))
+	// once downsampled, expired raw samples go
+	store.downsampleErr = nil
+	db.maintain(now)
+	assert.Equal(t, 1, store.count(0))
+	assert.Equal(t, 2, store.count(1))
+}
+
+func mustSelector(t *testing.T, s string) Selector {
+	sel, err := ParseSelector(s)
+	require.NoError(t, err)
+	return sel
+}
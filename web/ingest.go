@@ -0,0 +1,171 @@
+package web
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxIngestBody = 1 << 20
+
+var ingestAccepted = mon.GlobalRegistry.MustRegister("esphome2prom_ingest_accepted", mon.NewCounter())
+var ingestRejected = mon.GlobalRegistry.MustRegister("esphome2prom_ingest_rejected", mon.NewCounter())
+var ingestUnauthorized = mon.GlobalRegistry.MustRegister("esphome2prom_ingest_unauthorized", mon.NewCounter())
+
+// Ingester gets pushed sensors, implemented by queue.Queue
+type Ingester interface {
+	AddSensor(id string, d queue.ESPHomeDiscovery)
+	State(stateTopic string, payload []byte)
+	SensorDiscovery(device, sensor string) (queue.ESPHomeDiscovery, bool)
+}
+
+type IngestConfig struct {
+	// Tokens accepted as "Authorization: Bearer <token>", endpoint is disabled without any
+	Tokens []string `yaml:"tokens"`
+}
+
+// IngestSample is single pushed value, described the same way MQTT discovery describes a sensor
+type IngestSample struct {
+	Device      string            `json:"device"`
+	Sensor      string            `json:"sensor"`
+	DeviceClass queue.DeviceClass `json:"device_class"`
+	Unit        string            `json:"unit"`
+	StateClass  string            `json:"state_class"`
+	// Value is number or numeric string
+	Value json.RawMessage `json:"value"`
+}
+
+type ingestError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+type ingestHandler struct {
+	cfg IngestConfig
+	in  Ingester
+	// registered discovery by state topic, sensor is re-added when its class or unit changes
+	sensors map[string]queue.ESPHomeDiscovery
+	sync.Mutex
+}
+
+func newIngestHandler(cfg IngestConfig, in Ingester) *ingestHandler {
+	return &ingestHandler{
+		cfg:     cfg,
+		in:      in,
+		sensors: map[string]queue.ESPHomeDiscovery{},
+	}
+}
+
+func (h *ingestHandler) authorized(c *gin.Context) bool {
+	// not accepted in query string, it would end up in access log
+	token, bearer := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !bearer || len(token) == 0 {
+		return false
+	}
+	ok := 0
+	for _, t := range h.cfg.Tokens {
+		ok |= subtle.ConstantTimeCompare([]byte(t), []byte(token))
+	}
+	return ok == 1
+}
+
+// Ingest accepts single sample or JSON array of them
+func (h *ingestHandler) Ingest(c *gin.Context) {
+	if !h.authorized(c) {
+		ingestUnauthorized.Update(1)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxIngestBody))
+	if err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	var samples []IngestSample
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &samples)
+	} else {
+		samples = make([]IngestSample, 1)
+		err = json.Unmarshal(body, &samples[0])
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("invalid JSON: %s", err)})
+		return
+	}
+	var errs []ingestError
+	for i, s := range samples {
+		err := h.ingest(s)
+		if err != nil {
+			errs = append(errs, ingestError{Index: i, Error: err.Error()})
+		}
+	}
+	accepted := len(samples) - len(errs)
+	ingestAccepted.Update(float64(accepted))
+	ingestRejected.Update(float64(len(errs)))
+	if len(errs) > 0 {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"accepted": accepted, "errors": errs})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"accepted": accepted})
+}
+
+func (h *ingestHandler) ingest(s IngestSample) error {
+	if len(s.Device) == 0 || len(s.Sensor) == 0 || len(s.DeviceClass) == 0 {
+		return fmt.Errorf("device, sensor and device_class are required")
+	}
+	if strings.ContainsAny(s.Device+s.Sensor, "/+#") {
+		return fmt.Errorf("device and sensor can't contain /, + or #")
+	}
+	str := string(s.Value)
+	if len(s.Value) > 0 && s.Value[0] == '"' {
+		json.Unmarshal(s.Value, &str)
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return fmt.Errorf("value [%s] is not a number", s.Value)
+	}
+	prefix := "http/" + s.Device + "/sensor/" + s.Sensor
+	d := queue.ESPHomeDiscovery{
+		DeviceClass: s.DeviceClass,
+		Unit:        s.Unit,
+		StateClass:  s.StateClass,
+		Name:        s.Sensor,
+		StateTopic:  prefix + "/state",
+		UniqID:      s.Device + "-" + s.Sensor,
+		Dev:         &queue.ESPHomeDev{ID: s.Device, Name: s.Device},
+	}
+	// same device and sensor name from MQTT or other source would end up as the same series
+	if reg, ok := h.in.SensorDiscovery(s.Device, s.Sensor); ok && reg.StateTopic != d.StateTopic {
+		return fmt.Errorf("sensor %s of %s already comes from other source", s.Sensor, s.Device)
+	}
+	h.Lock()
+	old, ok := h.sensors[d.StateTopic]
+	if !ok || old.DeviceClass != d.DeviceClass || old.Unit != d.Unit || old.StateClass != d.StateClass {
+		h.in.AddSensor(prefix+"/config", d)
+		h.sensors[d.StateTopic] = d
+	}
+	h.Unlock()
+	// queue only keeps sensors it has type for
+	reg, ok := h.in.SensorDiscovery(s.Device, s.Sensor)
+	if !ok {
+		return fmt.Errorf("device class %s is not supported", s.DeviceClass)
+	}
+	if reg.StateTopic != d.StateTopic {
+		return fmt.Errorf("sensor %s of %s already comes from other source", s.Sensor, s.Device)
+	}
+	if reg.DeviceClass != s.DeviceClass {
+		return fmt.Errorf("device class %s is not supported", s.DeviceClass)
+	}
+	h.in.State(d.StateTopic, []byte(strconv.FormatFloat(v, 'f', -1, 64)))
+	return nil
+}
@@ -0,0 +1,145 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSink struct {
+	metrics []queue.Metric
+	sync.Mutex
+}
+
+func (s *testSink) Write(ctx context.Context, metrics []queue.Metric) error {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+	return nil
+}
+
+func (s *testSink) Close() {}
+
+func (s *testSink) byDevice() map[string]queue.Metric {
+	s.Lock()
+	defer s.Unlock()
+	m := map[string]queue.Metric{}
+	for _, metric := range s.metrics {
+		m[metric.Labels["device"]+"/"+metric.Labels["sensor"]] = metric
+	}
+	return m
+}
+
+func ingestBackend(t *testing.T) (*WebBackend, *queue.Queue, *testSink) {
+	sink := &testSink{}
+	q, err := queue.New(&queue.Config{
+		Logger: zaptest.NewLogger(t).Sugar(),
+		Sinks:  []queue.SinkConfig{{Name: "test", Custom: sink, MaxBatchDuration: time.Millisecond * 10}},
+	})
+	require.NoError(t, err)
+	t.Cleanup(q.Close)
+	backend, err := New(Config{
+		Logger:     zaptest.NewLogger(t).Sugar(),
+		ListenAddr: "0.0.0.0",
+		Ingest:     IngestConfig{Tokens: []string{"t0ken"}},
+		Ingester:   q,
+	}, webContent)
+	require.NoError(t, err)
+	return backend, q, sink
+}
+
+func ingest(backend *WebBackend, path, auth, body string) (int, map[string]any) {
+	r, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	if len(auth) > 0 {
+		r.Header.Set("Authorization", auth)
+	}
+	w := testServer(backend.r, r)
+	var resp map[string]any
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	return w.Code, resp
+}
+
+func TestIngest(t *testing.T) {
+	backend, _, sink := ingestBackend(t)
+	code, resp := ingest(backend, "/api/v1/ingest", "Bearer t0ken",
+		`{"device":"garage","sensor":"temp","device_class":"temperature","unit":"°F","value":212}`)
+	require.Equal(t, http.StatusOK, code, resp)
+	assert.Equal(t, 1.0, resp["accepted"])
+	code, resp = ingest(backend, "/api/v1/ingest", "Bearer t0ken", `[
+		{"device":"garage","sensor":"hum","device_class":"humidity","unit":"%","value":"55.5"},
+		{"device":"shed","sensor":"temp","device_class":"temperature","unit":"°C","value":-3}
+	]`)
+	require.Equal(t, http.StatusOK, code, resp)
+	assert.Equal(t, 2.0, resp["accepted"])
+	require.Eventually(t, func() bool {
+		return len(sink.byDevice()) == 3
+	}, time.Second*5, time.Millisecond*10)
+	m := sink.byDevice()
+	assert.InDelta(t, 100.0, m["garage/temp"].Value, 0.001)
+	assert.Equal(t, 55.5, m["garage/hum"].Value)
+	assert.Equal(t, -3.0, m["shed/temp"].Value)
+}
+
+func TestIngestRejected(t *testing.T) {
+	backend, q, _ := ingestBackend(t)
+	code, _ := ingest(backend, "/api/v1/ingest", "", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = ingest(backend, "/api/v1/ingest?token=t0ken", "", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = ingest(backend, "/api/v1/ingest", "Bearer wrong", `{}`)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = ingest(backend, "/api/v1/ingest", "Bearer t0ken", `{"device":`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, resp := ingest(backend, "/api/v1/ingest", "Bearer t0ken", `[
+		{"device":"garage","sensor":"temp","device_class":"temperature","unit":"°C","value":20},
+		{"device":"garage","sensor":"door","device_class":"door","value":1},
+		{"device":"garage","sensor":"temp2","device_class":"temperature","value":"warm"},
+		{"device":"garage/x","sensor":"temp","device_class":"temperature","value":1},
+		{"sensor":"temp","device_class":"temperature","value":1}
+	]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Equal(t, 1.0, resp["accepted"])
+	errs := resp["errors"].([]any)
+	require.Len(t, errs, 4)
+	assert.Equal(t, 1.0, errs[0].(map[string]any)["index"])
+	assert.Contains(t, errs[0].(map[string]any)["error"], "not supported")
+	assert.Contains(t, errs[1].(map[string]any)["error"], "not a number")
+	assert.Contains(t, errs[2].(map[string]any)["error"], "can't contain")
+	assert.Contains(t, errs[3].(map[string]any)["error"], "required")
+
+	q.AddSensor("esphome/garage/sensor/hum/config", queue.ESPHomeDiscovery{
+		DeviceClass: queue.DeviceClassHumidity,
+		Name:        "hum",
+		StateTopic:  "esphome/garage/sensor/hum/state",
+		Dev:         &queue.ESPHomeDev{Name: "garage"},
+	})
+	code, resp = ingest(backend, "/api/v1/ingest", "Bearer t0ken", `{"device":"garage","sensor":"hum","device_class":"humidity","value":50}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+	assert.Contains(t, resp["errors"].([]any)[0].(map[string]any)["error"], "other source")
+	d, ok := q.SensorDiscovery("garage", "hum")
+	require.True(t, ok)
+	assert.Equal(t, "esphome/garage/sensor/hum/state", d.StateTopic)
+}
+
+func TestIngestDisabledWithoutTokens(t *testing.T) {
+	q, err := queue.New(&queue.Config{Logger: zaptest.NewLogger(t).Sugar()})
+	require.NoError(t, err)
+	t.Cleanup(q.Close)
+	backend, err := New(Config{
+		Logger:     zaptest.NewLogger(t).Sugar(),
+		ListenAddr: "0.0.0.0",
+		Ingester:   q,
+	}, webContent)
+	require.NoError(t, err)
+	code, _ := ingest(backend, "/api/v1/ingest", "Bearer ", `{}`)
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,56 @@
+package web
+
+import (
+	"github.com/XANi/esphome2prom/inventory"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+)
+
+const defaultHistoryLimit = 100
+
+// Inventory lists devices and their history, implemented by inventory.Inventory
+type Inventory interface {
+	Devices() []inventory.Device
+	History(device string, limit int) ([]inventory.Event, error)
+}
+
+type inventoryHandler struct {
+	inv Inventory
+}
+
+// Devices returns all known devices
+func (h *inventoryHandler) Devices(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"devices": h.inv.Devices()})
+}
+
+// History returns device's newest events, ?limit= of them
+func (h *inventoryHandler) History(c *gin.Context) {
+	limit := defaultHistoryLimit
+	if l := c.Query("limit"); len(l) > 0 {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit has to be positive number"})
+			return
+		}
+	}
+	device := c.Param("device")
+	found := false
+	for _, d := range h.inv.Devices() {
+		if d.Name == device {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.JSON(http.StatusNotFound, gin.H{"error": "no device " + device})
+		return
+	}
+	events, err := h.inv.History(device, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"device": device, "events": events})
+}
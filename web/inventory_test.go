@@ -0,0 +1,59 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/XANi/esphome2prom/inventory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"net/http"
+	"testing"
+)
+
+type testInventory struct {
+	events []inventory.Event
+}
+
+func (i *testInventory) Devices() []inventory.Device {
+	return []inventory.Device{{Name: "garage", MAC: "aa:bb:cc:dd:ee:ff", Sensors: []string{"t1"}}}
+}
+
+func (i *testInventory) History(device string, limit int) ([]inventory.Event, error) {
+	return i.events[:min(limit, len(i.events))], nil
+}
+
+func TestInventoryAPI(t *testing.T) {
+	inv := &testInventory{events: []inventory.Event{
+		{Device: "garage", Kind: inventory.EventFirmware, Old: "2025.10.0", New: "2025.11.0"},
+		{Device: "garage", Kind: inventory.EventFirstSeen},
+	}}
+	backend, err := New(Config{
+		Logger:     zaptest.NewLogger(t).Sugar(),
+		ListenAddr: "0.0.0.0",
+		Inventory:  inv,
+	}, webContent)
+	require.NoError(t, err)
+	get := func(path string) (int, map[string]any) {
+		r, _ := http.NewRequest("GET", path, nil)
+		w := testServer(backend.r, r)
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+	code, resp := get("/api/v1/devices")
+	require.Equal(t, http.StatusOK, code)
+	devices := resp["devices"].([]any)
+	require.Len(t, devices, 1)
+	assert.Equal(t, "aa:bb:cc:dd:ee:ff", devices[0].(map[string]any)["mac"])
+
+	code, resp = get("/api/v1/devices/garage/history?limit=1")
+	require.Equal(t, http.StatusOK, code)
+	events := resp["events"].([]any)
+	require.Len(t, events, 1)
+	assert.Equal(t, "2025.11.0", events[0].(map[string]any)["new"])
+
+	code, _ = get("/api/v1/devices/garage/history?limit=x")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = get("/api/v1/devices/shed/history")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -24,6 +24,13 @@ type Config struct {
 	Logger       *zap.SugaredLogger `yaml:"-"`
 	AccessLogger *zap.SugaredLogger `yaml:"-"`
 	ListenAddr   string             `yaml:"listen_addr"`
+	// Ingest enables POST /api/v1/ingest, requires Ingester
+	Ingest   IngestConfig `yaml:"ingest"`
+	Ingester Ingester     `yaml:"-"`
+	// Inventory enables GET /api/v1/devices and /api/v1/devices/:device/history
+	Inventory Inventory `yaml:"-"`
+	// TSDB enables Prometheus-style /api/v1/series and /api/v1/query_range
+	TSDB SeriesStore `yaml:"-"`
 }
 
 func New(cfg Config, webFS fs.FS) (backend *WebBackend, err error) {
@@ -53,7 +60,7 @@ func New(cfg Config, webFS fs.FS) (backend *WebBackend, err error) {
 	r.Use(ginzap.GinzapWithConfig(w.al.Desugar(), &ginzap.Config{
 		TimeFormat: time.RFC3339,
 		UTC:        false,
-		SkipPaths:  []string{"/_status/health", "/_status/metrics"},
+		SkipPaths:  []string{"/_status/health", "/_status/metrics", "/metrics"},
 	}))
 	//r.Use(ginzap.RecoveryWithZap(w.al.Desugar(), true))
 	// basic logging to stdout
@@ -64,6 +71,7 @@ func New(cfg Config, webFS fs.FS) (backend *WebBackend, err error) {
 	r.GET("/_status/health", gin.WrapF(mon.HandleHealthcheck))
 	r.HEAD("/_status/health", gin.WrapF(mon.HandleHealthcheck))
 	r.GET("/_status/metrics", gin.WrapF(mon.HandleMetrics))
+	r.GET("/metrics", gin.WrapF(mon.HandlePrometheus))
 	defer mon.GlobalStatus.Update(mon.StatusOk, "ok")
 	// healthcheckHandler, haproxyStatus := mon.HandleHealthchecksHaproxy()
 	// r.GET("/_status/metrics", gin.WrapF(healthcheckHandler))
@@ -81,6 +89,25 @@ func New(cfg Config, webFS fs.FS) (backend *WebBackend, err error) {
 			"title": c.Request.RemoteAddr,
 		})
 	})
+	if cfg.Ingester != nil {
+		if len(cfg.Ingest.Tokens) > 0 {
+			r.POST("/api/v1/ingest", newIngestHandler(cfg.Ingest, cfg.Ingester).Ingest)
+		} else {
+			w.l.Debugf("no ingest tokens configured, /api/v1/ingest disabled")
+		}
+	}
+	if cfg.Inventory != nil {
+		h := &inventoryHandler{inv: cfg.Inventory}
+		r.GET("/api/v1/devices", h.Devices)
+		r.GET("/api/v1/devices/:device/history", h.History)
+	}
+	if cfg.TSDB != nil {
+		h := &seriesHandler{db: cfg.TSDB}
+		r.GET("/api/v1/series", h.Series)
+		r.POST("/api/v1/series", h.Series)
+		r.GET("/api/v1/query_range", h.QueryRange)
+		r.POST("/api/v1/query_range", h.QueryRange)
+	}
 	r.NoRoute(func(c *gin.Context) {
 		c.HTML(http.StatusNotFound, "404.tmpl", gin.H{
 			"notfound": c.Request.URL.Path,
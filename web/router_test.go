@@ -37,4 +37,7 @@ func TestWebBackend_Run(t *testing.T) {
 	t2 := testServer(backend.r, r2)
 	b, _ = ioutil.ReadAll(t2.Body)
 	assert.Contains(t, string(b), "background-color")
+	r3, _ := http.NewRequest("GET", "/metrics", nil)
+	t3 := testServer(backend.r, r3)
+	assert.Equal(t, http.StatusOK, t3.Code)
 }
@@ -0,0 +1,136 @@
+package web
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/tsdb"
+	"github.com/gin-gonic/gin"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// SeriesStore is local time-series storage, implemented by tsdb.TSDB
+type SeriesStore interface {
+	Series(selectors ...tsdb.Selector) []tsdb.Series
+	QueryRange(sel tsdb.Selector, start, end time.Time, step time.Duration) ([]tsdb.Range, error)
+}
+
+// seriesHandler serves subset of Prometheus HTTP API, so its clients (e.g. Grafana) can chart stored history
+type seriesHandler struct {
+	db SeriesStore
+}
+
+func apiError(c *gin.Context, code int, errorType string, err error) {
+	c.JSON(code, gin.H{"status": "error", "errorType": errorType, "error": err.Error()})
+}
+
+// parseTime takes unix time in seconds or RFC3339, same as Prometheus
+func parseTime(s string) (time.Time, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		sec, frac := math.Modf(f)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid time [%s], expected unix timestamp or RFC3339", s)
+	}
+	return t, nil
+}
+
+// parseStep takes seconds or Go duration
+func parseStep(s string) (time.Duration, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return d, fmt.Errorf("invalid step [%s], expected seconds or duration", s)
+	}
+	return d, nil
+}
+
+func seriesLabels(s tsdb.Series) map[string]string {
+	labels := make(map[string]string, len(s.Labels)+1)
+	for k, v := range s.Labels {
+		labels[k] = v
+	}
+	labels[tsdb.NameLabel] = s.Name
+	return labels
+}
+
+// Series returns labels of series matching any of match[] selectors
+func (h *seriesHandler) Series(c *gin.Context) {
+	c.Request.ParseForm()
+	matches := c.Request.Form["match[]"]
+	if len(matches) == 0 {
+		apiError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("no match[] parameter provided"))
+		return
+	}
+	selectors := make([]tsdb.Selector, 0, len(matches))
+	for _, m := range matches {
+		sel, err := tsdb.ParseSelector(m)
+		if err != nil {
+			apiError(c, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+		selectors = append(selectors, sel)
+	}
+	series := h.db.Series(selectors...)
+	data := make([]map[string]string, 0, len(series))
+	for _, s := range series {
+		data = append(data, seriesLabels(s))
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": data})
+}
+
+// QueryRange returns matrix of series matching query selector, PromQL functions are not supported
+func (h *seriesHandler) QueryRange(c *gin.Context) {
+	c.Request.ParseForm()
+	sel, err := tsdb.ParseSelector(c.Request.Form.Get("query"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	start, err := parseTime(c.Request.Form.Get("start"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	end, err := parseTime(c.Request.Form.Get("end"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	step, err := parseStep(c.Request.Form.Get("step"))
+	if err != nil {
+		apiError(c, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if step <= 0 {
+		apiError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("step has to be positive"))
+		return
+	}
+	if end.Before(start) {
+		apiError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("end is before start"))
+		return
+	}
+	if end.Sub(start)/step >= tsdb.MaxPoints {
+		apiError(c, http.StatusBadRequest, "bad_data", fmt.Errorf("exceeded maximum resolution of %d points per series, increase step", tsdb.MaxPoints))
+		return
+	}
+	ranges, err := h.db.QueryRange(sel, start, end, step)
+	if err != nil {
+		apiError(c, http.StatusInternalServerError, "internal", err)
+		return
+	}
+	result := make([]gin.H, 0, len(ranges))
+	for _, r := range ranges {
+		values := make([][2]any, 0, len(r.Points))
+		for _, p := range r.Points {
+			values = append(values, [2]any{float64(p.TS.UnixMilli()) / 1000, strconv.FormatFloat(p.Value, 'f', -1, 64)})
+		}
+		result = append(result, gin.H{"metric": seriesLabels(r.Series), "values": values})
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "success", "data": gin.H{"resultType": "matrix", "result": result}})
+}
@@ -0,0 +1,101 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/XANi/esphome2prom/tsdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testSeriesStore struct {
+	series []tsdb.Series
+	// last query
+	start, end time.Time
+	step       time.Duration
+}
+
+func (s *testSeriesStore) Series(selectors ...tsdb.Selector) []tsdb.Series {
+	var out []tsdb.Series
+	for _, series := range s.series {
+		for _, sel := range selectors {
+			if sel.Match(series.Name, series.Labels) {
+				out = append(out, series)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (s *testSeriesStore) QueryRange(sel tsdb.Selector, start, end time.Time, step time.Duration) ([]tsdb.Range, error) {
+	s.start, s.end, s.step = start, end, step
+	var out []tsdb.Range
+	for _, series := range s.Series(sel) {
+		out = append(out, tsdb.Range{Series: series, Points: []tsdb.Point{{TS: start, Value: 21.5}, {TS: start.Add(step), Value: 22}}})
+	}
+	return out, nil
+}
+
+func TestSeriesAPI(t *testing.T) {
+	store := &testSeriesStore{series: []tsdb.Series{
+		{ID: 1, Name: "esphome_temperature", Labels: map[string]string{"device": "garage"}},
+		{ID: 2, Name: "esphome_humidity", Labels: map[string]string{"device": "garage"}},
+	}}
+	backend, err := New(Config{
+		Logger:     zaptest.NewLogger(t).Sugar(),
+		ListenAddr: "0.0.0.0",
+		TSDB:       store,
+	}, webContent)
+	require.NoError(t, err)
+	call := func(method, path string, form url.Values) (int, map[string]any) {
+		r, _ := http.NewRequest(method, path, strings.NewReader(form.Encode()))
+		if method == "POST" {
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		w := testServer(backend.r, r)
+		var resp map[string]any
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return w.Code, resp
+	}
+
+	code, resp := call("GET", "/api/v1/series?match[]="+url.QueryEscape(`esphome_temperature`)+"&match[]="+url.QueryEscape(`{__name__="esphome_humidity"}`), nil)
+	require.Equal(t, http.StatusOK, code, resp)
+	data := resp["data"].([]any)
+	require.Len(t, data, 2)
+	assert.Equal(t, map[string]any{"__name__": "esphome_temperature", "device": "garage"}, data[0])
+	code, resp = call("GET", "/api/v1/series", nil)
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, "error", resp["status"])
+
+	code, resp = call("POST", "/api/v1/query_range", url.Values{
+		"query": {`esphome_temperature{device="garage"}`},
+		"start": {"1700000000"},
+		"end":   {"2023-11-14T23:13:20Z"},
+		"step":  {"60"},
+	})
+	require.Equal(t, http.StatusOK, code, resp)
+	assert.Equal(t, time.Minute, store.step)
+	assert.True(t, store.start.Equal(time.Unix(1700000000, 0)))
+	assert.True(t, store.end.Equal(time.Unix(1700003600, 0)))
+	result := resp["data"].(map[string]any)["result"].([]any)
+	require.Len(t, result, 1)
+	assert.Equal(t, []any{[]any{1700000000.0, "21.5"}, []any{1700000060.0, "22"}}, result[0].(map[string]any)["values"])
+
+	for _, q := range []string{
+		"query=esphome_temperature&start=1700000000&end=1700003600&step=0",
+		"query=esphome_temperature&start=1700003600&end=1700000000&step=60",
+		"query=esphome_temperature&start=0&end=1700000000&step=1",
+		"query=esphome_temperature&start=yesterday&end=1700000000&step=60",
+		"query=rate(esphome_temperature[5m])&start=1700000000&end=1700003600&step=60",
+	} {
+		code, resp = call("GET", "/api/v1/query_range?"+q, nil)
+		assert.Equal(t, http.StatusBadRequest, code, q)
+		assert.Equal(t, "bad_data", resp["errorType"], q)
+	}
+}
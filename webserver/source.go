@@ -0,0 +1,295 @@
+// Package webserver ingests sensors from ESPHome web_server component's /events Server-Sent Events stream,
+// for nodes that expose neither MQTT nor native API
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/efigence/go-mon"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NodeConfig struct {
+	// URL of node's web server, /events is appended
+	URL      string `yaml:"url"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Name is device name in metrics, defaults to title node sends in its first ping event
+	Name string `yaml:"name"`
+	// Sensors maps entity ID (sensor-temperature, or sensor/Temperature in newer ESPHome) to sensor.
+	// Stream has no device class so only listed entities are ingested
+	Sensors map[string]SensorConfig `yaml:"sensors"`
+}
+
+type SensorConfig struct {
+	DeviceClass queue.DeviceClass `yaml:"device_class"`
+	// Unit defaults to unit sent in state event
+	Unit string `yaml:"unit"`
+	// Name defaults to entity name from state event or object ID
+	Name       string `yaml:"name"`
+	StateClass string `yaml:"state_class"`
+}
+
+type Config struct {
+	Nodes []NodeConfig `yaml:"nodes"`
+	// reconnect delay of each node
+	queue.BackoffConfig `yaml:",inline"`
+	// Timeout for connecting and response headers
+	Timeout time.Duration `yaml:"timeout"`
+	// IdleTimeout drops stream that had no event for that long, node pings every 10s
+	IdleTimeout time.Duration      `yaml:"idle_timeout"`
+	Logger      *zap.SugaredLogger `yaml:"-"`
+}
+
+// Source keeps event stream open to every node
+type Source struct {
+	cfg    Config
+	reg    queue.SensorRegistry
+	l      *zap.SugaredLogger
+	client *http.Client
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func New(cfg Config, reg queue.SensorRegistry) (*Source, error) {
+	if cfg.Logger == nil {
+		cfg.Logger = zap.NewNop().Sugar()
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Second * 10
+	}
+	if cfg.IdleTimeout <= 0 {
+		cfg.IdleTimeout = time.Minute
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Source{
+		cfg: cfg,
+		reg: reg,
+		l:   cfg.Logger,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: cfg.Timeout}).DialContext,
+			ResponseHeaderTimeout: cfg.Timeout,
+		}},
+		cancel: cancel,
+	}
+	nodes := make([]*node, 0, len(cfg.Nodes))
+	for _, nc := range cfg.Nodes {
+		u, err := url.Parse(nc.URL)
+		if err != nil || len(u.Host) == 0 {
+			cancel()
+			return nil, fmt.Errorf("bad node url [%s]", nc.URL)
+		}
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/events"
+		nodes = append(nodes, &node{
+			cfg:     nc,
+			s:       s,
+			l:       s.l.Named(u.Host),
+			events:  u.String(),
+			host:    u.Hostname(),
+			sensors: map[string]string{},
+		})
+	}
+	for _, n := range nodes {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			n.run(ctx)
+		}()
+	}
+	return s, nil
+}
+
+// Close disconnects from all nodes, their sensors stay registered as nodes are not gone
+func (s *Source) Close() {
+	s.cancel()
+	s.wg.Wait()
+}
+
+type node struct {
+	cfg    NodeConfig
+	s      *Source
+	l      *zap.SugaredLogger
+	events string
+	host   string
+	// name is device name, from config or ping event
+	name string
+	// topic prefix by entity ID of sensors registered from this node
+	sensors map[string]string
+}
+
+func (n *node) run(ctx context.Context) {
+	connected := n.metric("esphome2prom_web_server_connected", mon.NewGauge())
+	connects := n.metric("esphome2prom_web_server_connects", mon.NewCounter())
+	failures := n.metric("esphome2prom_web_server_errors", mon.NewCounter())
+	backoff := queue.NewBackoff(n.s.cfg.BackoffConfig)
+	for {
+		wasUp := false
+		err := n.stream(ctx, func() {
+			wasUp = true
+			connected.Update(1)
+			connects.Update(1)
+		})
+		connected.Update(0)
+		if ctx.Err() != nil {
+			return
+		}
+		failures.Update(1)
+		if wasUp {
+			backoff.Reset()
+		}
+		n.l.Warnf("event stream failed: %s, reconnecting in %s", err, backoff.Delay())
+		if !backoff.Wait(ctx) {
+			return
+		}
+	}
+}
+
+func (n *node) metric(name string, m mon.Metric) mon.Metric {
+	m, err := mon.GlobalRegistry.RegisterOrGet(name, m, map[string]string{"node": n.events})
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// stream reads single connection's events until it breaks
+func (n *node) stream(ctx context.Context, up func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.events, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	if len(n.cfg.Username) > 0 {
+		req.SetBasicAuth(n.cfg.Username, n.cfg.Password)
+	}
+	resp, err := n.s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	up()
+	n.l.Infof("connected to %s", n.events)
+	// cancelling request is the only way to unblock body read
+	idle := time.AfterFunc(n.s.cfg.IdleTimeout, cancel)
+	defer idle.Stop()
+	err = readEvents(resp.Body, func(ev sseEvent) error {
+		idle.Reset(n.s.cfg.IdleTimeout)
+		switch ev.Event {
+		case "ping":
+			n.onPing(ev.Data)
+		case "state":
+			n.onState(ev.Data)
+		case "log":
+			n.l.Debugf("node log: %s", ev.Data)
+		}
+		return nil
+	})
+	// on Close run() doesn't look at the error
+	if ctx.Err() != nil {
+		return fmt.Errorf("no events for %s", n.s.cfg.IdleTimeout)
+	}
+	return err
+}
+
+type pingEvent struct {
+	Title string `json:"title"`
+}
+
+func (n *node) onPing(data string) {
+	if len(n.name) > 0 || len(data) == 0 {
+		return
+	}
+	var p pingEvent
+	if json.Unmarshal([]byte(data), &p) == nil {
+		n.name = p.Title
+	}
+}
+
+type stateEvent struct {
+	ID    string          `json:"id"`
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+	State string          `json:"state"`
+	Unit  string          `json:"uom"`
+}
+
+func (n *node) onState(data string) {
+	var ev stateEvent
+	err := json.Unmarshal([]byte(data), &ev)
+	if err != nil {
+		n.l.Debugf("could not decode state event %s: %s", data, err)
+		return
+	}
+	sc, ok := n.cfg.Sensors[ev.ID]
+	if !ok {
+		return
+	}
+	// NaN is sent as null
+	v, err := strconv.ParseFloat(string(ev.Value), 64)
+	if err != nil {
+		return
+	}
+	prefix, ok := n.sensors[ev.ID]
+	if !ok {
+		prefix = n.addSensor(ev, sc)
+	}
+	n.s.reg.State(prefix+"/state", []byte(strconv.FormatFloat(v, 'f', -1, 64)))
+}
+
+// addSensor registers entity on its first state, that's when its name and unit are known. Returns topic prefix
+func (n *node) addSensor(ev stateEvent, sc SensorConfig) string {
+	device := n.cfg.Name
+	if len(device) == 0 {
+		device = n.name
+	}
+	if len(device) == 0 {
+		device = n.host
+	}
+	objectID := strings.NewReplacer("/", "-", " ", "_").Replace(ev.ID)
+	name := sc.Name
+	if len(name) == 0 {
+		name = ev.Name
+	}
+	if len(name) == 0 {
+		name = strings.TrimPrefix(ev.ID, "sensor-")
+	}
+	unit := sc.Unit
+	if len(unit) == 0 {
+		unit = ev.Unit
+	}
+	if len(unit) == 0 {
+		// older web_server only has unit in formatted state
+		_, unit, _ = strings.Cut(ev.State, " ")
+	}
+	prefix := "web_server/" + device + "/sensor/" + objectID
+	d := queue.ESPHomeDiscovery{
+		DeviceClass: sc.DeviceClass,
+		Unit:        unit,
+		StateClass:  sc.StateClass,
+		Name:        name,
+		StateTopic:  prefix + "/state",
+		UniqID:      device + "-" + objectID,
+		Dev: &queue.ESPHomeDev{
+			ID:   device,
+			Name: device,
+		},
+	}
+	n.sensors[ev.ID] = prefix
+	n.s.reg.AddSensor(prefix+"/config", d)
+	return prefix
+}
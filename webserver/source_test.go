@@ -0,0 +1,150 @@
+package webserver
+
+import (
+	"fmt"
+	"github.com/XANi/esphome2prom/internal/sourcetest"
+	"github.com/XANi/esphome2prom/queue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeNode serves /events the way web_server does: ping first, then states. Connection is closed after events are sent
+// if drop is set
+type fakeNode struct {
+	events []string
+	drop   bool
+	conns  atomic.Int32
+}
+
+func (f *fakeNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/events" {
+		http.NotFound(w, r)
+		return
+	}
+	if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f.conns.Add(1)
+	w.Header().Set("Content-Type", "text/event-stream")
+	fmt.Fprint(w, "retry: 30000\nid: 1\nevent: ping\ndata: {\"title\":\"kitchen\",\"comment\":\"\",\"ota\":true,\"log\":true,\"lang\":\"en\"}\n\n")
+	for _, ev := range f.events {
+		fmt.Fprint(w, ev)
+	}
+	w.(http.Flusher).Flush()
+	if f.drop {
+		return
+	}
+	<-r.Context().Done()
+}
+
+func testSource(t *testing.T, reg queue.SensorRegistry, nodes ...NodeConfig) *Source {
+	s, err := New(Config{
+		Nodes:         nodes,
+		BackoffConfig: queue.BackoffConfig{MinBackoff: time.Millisecond * 10},
+		Logger:        zaptest.NewLogger(t).Sugar(),
+	}, reg)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s
+}
+
+var testSensors = map[string]SensorConfig{
+	"sensor-temperature": {DeviceClass: queue.DeviceClassTemperature, StateClass: "measurement"},
+	"sensor/Humidity":    {DeviceClass: queue.DeviceClassHumidity, Name: "hum"},
+}
+
+func TestSourceStates(t *testing.T) {
+	f := &fakeNode{events: []string{
+		// old format, unit only in state string
+		"event: state\ndata: {\"id\":\"sensor-temperature\",\"value\":21.5,\"state\":\"21.5 °C\"}\n\n",
+		"event: log\ndata: [D][sensor:093]: 'Humidity': Sending state 40.00000 %\n\n",
+		// newer format
+		"event: state\ndata: {\"id\":\"sensor/Humidity\",\"name\":\"Humidity\",\"value\":40,\"state\":\"40 %\",\"uom\":\"%\"}\n\n",
+		// not mapped
+		"event: state\ndata: {\"id\":\"sensor-uptime\",\"value\":100,\"state\":\"100 s\"}\n\n",
+		// NaN
+		"event: state\ndata: {\"id\":\"sensor-temperature\",\"value\":null,\"state\":\"NA\"}\n\n",
+		"event: state\ndata: {\"id\":\"sensor-temperature\",\"value\":22,\"state\":\"22.0 °C\"}\n\n",
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	reg := sourcetest.NewRegistry()
+	testSource(t, reg, NodeConfig{URL: srv.URL, Username: "admin", Password: "secret", Sensors: testSensors})
+	require.Eventually(t, func() bool {
+		return len(reg.States("web_server/kitchen/sensor/sensor-temperature/state")) == 2 &&
+			len(reg.States("web_server/kitchen/sensor/sensor-Humidity/state")) == 1
+	}, time.Second*5, time.Millisecond*10)
+	sensors := reg.Sensors()
+	assert.Equal(t, []string{"21.5", "22"}, reg.States("web_server/kitchen/sensor/sensor-temperature/state"))
+	assert.Equal(t, []string{"40"}, reg.States("web_server/kitchen/sensor/sensor-Humidity/state"))
+	assert.Len(t, reg.StateTopics(), 2)
+	temp := sensors["web_server/kitchen/sensor/sensor-temperature/config"]
+	assert.Equal(t, "temperature", temp.Name)
+	assert.Equal(t, "°C", temp.Unit)
+	assert.Equal(t, "measurement", temp.StateClass)
+	require.NotNil(t, temp.Dev)
+	assert.Equal(t, "kitchen", temp.Dev.Name)
+	hum := sensors["web_server/kitchen/sensor/sensor-Humidity/config"]
+	assert.Equal(t, "hum", hum.Name)
+	assert.Equal(t, "%", hum.Unit)
+}
+
+func TestSourceReconnect(t *testing.T) {
+	f := &fakeNode{drop: true, events: []string{
+		"event: state\ndata: {\"id\":\"sensor-temperature\",\"value\":21.5,\"state\":\"21.5 °C\"}\n\n",
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	reg := sourcetest.NewRegistry()
+	testSource(t, reg, NodeConfig{URL: srv.URL + "/", Name: "garage", Username: "admin", Password: "secret", Sensors: testSensors})
+	require.Eventually(t, func() bool {
+		return len(reg.States("web_server/garage/sensor/sensor-temperature/state")) >= 3
+	}, time.Second*5, time.Millisecond*10)
+	assert.GreaterOrEqual(t, f.conns.Load(), int32(3))
+}
+
+func TestSourceCloseKeepsSensors(t *testing.T) {
+	f := &fakeNode{events: []string{
+		"event: state\ndata: {\"id\":\"sensor-temperature\",\"value\":21.5,\"state\":\"21.5 °C\"}\n\n",
+	}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	reg := sourcetest.NewRegistry()
+	s, err := New(Config{Nodes: []NodeConfig{{URL: srv.URL, Username: "admin", Password: "secret", Sensors: testSensors}}}, reg)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(reg.States("web_server/kitchen/sensor/sensor-temperature/state")) == 1
+	}, time.Second*5, time.Millisecond*10)
+	s.Close()
+	assert.Len(t, reg.Sensors(), 1)
+}
+
+func TestSourceUnauthorized(t *testing.T) {
+	srv := httptest.NewServer(&fakeNode{})
+	t.Cleanup(srv.Close)
+	s := &Source{cfg: Config{IdleTimeout: time.Second}, client: http.DefaultClient}
+	n := &node{s: s, events: srv.URL + "/events", sensors: map[string]string{}}
+	err := n.stream(t.Context(), func() {})
+	assert.ErrorContains(t, err, "401")
+}
+
+func TestReadEvents(t *testing.T) {
+	var events []sseEvent
+	err := readEvents(strings.NewReader(": comment\nevent: state\ndata: a\ndata:b\nid: 5\n\ndata: plain\n\n"), func(ev sseEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	assert.ErrorContains(t, err, "unexpected EOF")
+	assert.Equal(t, []sseEvent{
+		{Event: "state", Data: "a\nb", ID: "5"},
+		{Event: "message", Data: "plain"},
+	}, events)
+}
@@ -0,0 +1,57 @@
+package webserver
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// sseEvent is single Server-Sent Event
+type sseEvent struct {
+	Event string
+	Data  string
+	ID    string
+}
+
+// readEvents calls f for every event in the stream until it ends or f returns error
+func readEvents(r io.Reader, f func(ev sseEvent) error) error {
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	var ev sseEvent
+	var data []string
+	for s.Scan() {
+		line := s.Text()
+		if len(line) == 0 {
+			if len(data) > 0 || len(ev.Event) > 0 {
+				ev.Data = strings.Join(data, "\n")
+				if len(ev.Event) == 0 {
+					ev.Event = "message"
+				}
+				if err := f(ev); err != nil {
+					return err
+				}
+			}
+			ev = sseEvent{}
+			data = data[:0]
+			continue
+		}
+		// comment
+		if line[0] == ':' {
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			ev.Event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			ev.ID = value
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}